@@ -0,0 +1,122 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+const (
+	activitySuccessResponse = `{
+		"status": "ok",
+		"events": [
+			{
+				"type": "login",
+				"outcome": "failure",
+				"failureReason": "Failed to verify assertion: cloned authenticator is detected",
+				"credentialID": "LFdoCFJTyB82ZzSJUHc-c72yraRc_1mPvGX8ToE8su39xX26Jcqd31LUkKOS36FIAWgWl6itMKqmDvruha6ywA",
+				"clientIP": "192.0.2.1",
+				"userAgent": "Mozilla/5.0",
+				"time": "01 Feb 09 01:00 UTC"
+			},
+			{
+				"type": "registration",
+				"outcome": "success",
+				"failureReason": "",
+				"credentialID": "LFdoCFJTyB82ZzSJUHc-c72yraRc_1mPvGX8ToE8su39xX26Jcqd31LUkKOS36FIAWgWl6itMKqmDvruha6ywA",
+				"clientIP": "192.0.2.1",
+				"userAgent": "Mozilla/5.0",
+				"time": "01 Jan 09 01:00 UTC"
+			}
+		]
+	}`
+
+	activityNoEventsResponse = `{
+		"status": "ok",
+		"events": []
+	}`
+
+	activityErrorResponse = `{
+		"status": "failed",
+		"errorMessage": "Failed to query activity: connection refused"
+	}`
+)
+
+var (
+	activityTests = handlerTest{
+		requestMethod:     "GET",
+		requestURL:        "/user/activity",
+		equalResponseBody: equalJSONResponse,
+		testcases: []handlerTestData{
+			{
+				name:                 "user is not logged in",
+				server:               getMockServerWithAuditLog(nil, nil),
+				initMockSessionStore: initSessionStore(getEmptySession, getEmptySession),
+				requestBody:          "",
+				wantStatusCode:       http.StatusUnauthorized,
+				wantResponseBody:     userErrorResponse,
+			},
+			{
+				name:                 "audit log error",
+				server:               getMockServerWithAuditLog(nil, errors.New("connection refused")),
+				initMockSessionStore: initSessionStore(getUserSession, getUserSession),
+				requestBody:          "",
+				wantStatusCode:       http.StatusInternalServerError,
+				wantResponseBody:     activityErrorResponse,
+			},
+			{
+				name:                 "no events",
+				server:               getMockServerWithAuditLog([]*auditEvent{}, nil),
+				initMockSessionStore: initSessionStore(getUserSession, getUserSession),
+				requestBody:          "",
+				wantStatusCode:       http.StatusOK,
+				wantResponseBody:     activityNoEventsResponse,
+			},
+			{
+				name:                 "user is logged in",
+				server:               getMockServerWithAuditLog(getMockAuditEvents(), nil),
+				initMockSessionStore: initSessionStore(getUserSession, getUserSession),
+				requestBody:          "",
+				wantStatusCode:       http.StatusOK,
+				wantResponseBody:     activitySuccessResponse,
+			},
+		},
+	}
+)
+
+func getMockServerWithAuditLog(events []*auditEvent, err error) *Server {
+	auditLog := &MockAuditLog{}
+	auditLog.On("getEvents", mock.Anything, mockExistingUser.UserID, maxActivityEvents).Return(events, err).Maybe()
+	s := getMockServer()
+	s.auditLog = auditLog
+	return s
+}
+
+func getMockAuditEvents() []*auditEvent {
+	return []*auditEvent{
+		{
+			UserID:        mockExistingUser.UserID,
+			CredentialID:  mockCredential.CredentialID,
+			Type:          auditEventLogin,
+			Outcome:       auditOutcomeFailure,
+			FailureReason: "Failed to verify assertion: cloned authenticator is detected",
+			ClientIP:      "192.0.2.1",
+			UserAgent:     "Mozilla/5.0",
+			CreatedAt:     time.Date(2009, time.February, 1, 1, 0, 0, 0, time.UTC),
+		},
+		{
+			UserID:       mockExistingUser.UserID,
+			CredentialID: mockCredential.CredentialID,
+			Type:         auditEventRegistration,
+			Outcome:      auditOutcomeSuccess,
+			ClientIP:     "192.0.2.1",
+			UserAgent:    "Mozilla/5.0",
+			CreatedAt:    time.Date(2009, time.January, 1, 1, 0, 0, 0, time.UTC),
+		},
+	}
+}
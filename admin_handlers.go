@@ -0,0 +1,342 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultAdminUsersLimit = 20
+	maxAdminUsersLimit     = 100
+)
+
+// loadAdmins saves registered user ID of each administrator username.  Administrator is identified by
+// both username and user ID, so a user registering a deleted or never registered administrator username
+// doesn't become administrator.
+func (s *Server) loadAdmins(ctx context.Context, usernames []string) error {
+	for _, username := range usernames {
+		u, err := s.dataStore.GetUser(ctx, username)
+		if err == ErrNoRecords {
+			s.admins[username] = nil
+			s.logger.Warn("administrator isn't registered", "username", username)
+			continue
+		} else if err != nil {
+			return errors.New("failed to query administrator " + username + ": " + err.Error())
+		}
+		s.admins[username] = u.UserID
+	}
+	return nil
+}
+
+// isAdmin returns true if user has administrator username and user ID.
+func (s *Server) isAdmin(u *User) bool {
+	s.adminsMu.RLock()
+	defer s.adminsMu.RUnlock()
+
+	userID := s.admins[u.UserName]
+	return userID != nil && bytes.Equal(userID, u.UserID)
+}
+
+// reservedAdminUsername returns true if username is an administrator username that can't be used to sign up.
+func (s *Server) reservedAdminUsername(username string) bool {
+	s.adminsMu.RLock()
+	defer s.adminsMu.RUnlock()
+
+	_, ok := s.admins[username]
+	return ok && !s.adminSignup
+}
+
+// registerAdmin saves user ID of administrator registered after server started.  It is only used
+// if administrator signup is allowed.
+func (s *Server) registerAdmin(u *User) {
+	s.adminsMu.Lock()
+	defer s.adminsMu.Unlock()
+
+	if userID, ok := s.admins[u.UserName]; ok && userID == nil && s.adminSignup {
+		s.admins[u.UserName] = u.UserID
+	}
+}
+
+// adminUserID returns user ID of administrator making request, saved in request context by adminOnly.
+func adminUserID(r *http.Request) []byte {
+	userID, _ := r.Context().Value(contextKeyAdminUserID).([]byte)
+	return userID
+}
+
+// userIDFromRequest returns user ID decoded from "userID" route variable.
+func userIDFromRequest(r *http.Request) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(mux.Vars(r)["userID"])
+}
+
+// formatAAGUID returns 16-byte AAGUID in UUID format used by metadata service, such as
+// "cb69481e-8ff7-4039-93ec-0a2729a154a8".
+func formatAAGUID(aaguid []byte) string {
+	h := hex.EncodeToString(aaguid)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// handleAdminUsers returns users matching "search" query parameter, paginated by "offset" and "limit" query parameters.
+func (s *Server) handleAdminUsers() http.HandlerFunc {
+	type userResponse struct {
+		UserID          string `json:"userID"`
+		Name            string `json:"name"`
+		DisplayName     string `json:"displayName"`
+		CredentialCount int    `json:"credentialCount"`
+	}
+	type response struct {
+		Status string         `json:"status"`
+		Users  []userResponse `json:"users"`
+		Total  int            `json:"total"` // number of users matching search
+		Offset int            `json:"offset"`
+		Limit  int            `json:"limit"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		offset, limit := 0, defaultAdminUsersLimit
+		if v := query.Get("offset"); v != "" {
+			var err error
+			if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+				writeFailedServerResponse(w, http.StatusBadRequest, "Offset \""+v+"\" is not a non-negative number")
+				return
+			}
+		}
+		if v := query.Get("limit"); v != "" {
+			var err error
+			if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > maxAdminUsersLimit {
+				writeFailedServerResponse(w, http.StatusBadRequest, "Limit \""+v+"\" is not a number between 1 and "+strconv.Itoa(maxAdminUsersLimit))
+				return
+			}
+		}
+
+		users, total, err := s.dataStore.GetUsers(r.Context(), query.Get("search"), offset, limit)
+		if err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to query users in database: "+err.Error())
+			return
+		}
+		resp := response{
+			Status: statusOK,
+			Users:  make([]userResponse, len(users)),
+			Total:  total,
+			Offset: offset,
+			Limit:  limit,
+		}
+		for i, u := range users {
+			resp.Users[i] = userResponse{
+				UserID:          base64.RawURLEncoding.EncodeToString(u.UserID),
+				Name:            u.UserName,
+				DisplayName:     u.DisplayName,
+				CredentialCount: len(u.CredentialIDs),
+			}
+		}
+		b, err := json.Marshal(resp)
+		if err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "failed to json marshal response body")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// handleAdminUser returns user in request path with user's credentials.
+func (s *Server) handleAdminUser() http.HandlerFunc {
+	type credentialResponse struct {
+		CredentialID string `json:"credentialID"`
+		Nickname     string `json:"nickname"`
+		Description  string `json:"description"`
+		AAGUID       string `json:"aaguid,omitempty"` // empty if authenticator doesn't provide AAGUID or AAGUID is zero
+		Counter      uint32 `json:"counter"`
+		RegisteredAt string `json:"registeredAt"`
+		LoggedInAt   string `json:"loggedInAt"`
+		Flagged      bool   `json:"flagged"`
+		Disabled     bool   `json:"disabled"`
+	}
+	type response struct {
+		Status      string               `json:"status"`
+		UserID      string               `json:"userID"`
+		Name        string               `json:"name"`
+		DisplayName string               `json:"displayName"`
+		Credentials []credentialResponse `json:"credentials"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r)
+		if err != nil {
+			writeFailedServerResponse(w, http.StatusBadRequest, "Failed to base64 decode user ID: "+err.Error())
+			return
+		}
+		u, err := s.dataStore.GetUserByID(r.Context(), userID)
+		if err == ErrNoRecords {
+			writeFailedServerResponse(w, http.StatusNotFound, "User not found")
+			return
+		} else if err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to query user in database: "+err.Error())
+			return
+		}
+		credentials, err := s.dataStore.GetCredentials(r.Context(), userID)
+		if err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to query credentials in database: "+err.Error())
+			return
+		}
+		resp := response{
+			Status:      statusOK,
+			UserID:      base64.RawURLEncoding.EncodeToString(u.UserID),
+			Name:        u.UserName,
+			DisplayName: u.DisplayName,
+			Credentials: make([]credentialResponse, len(credentials)),
+		}
+		for i, c := range credentials {
+			resp.Credentials[i] = credentialResponse{
+				CredentialID: base64.RawURLEncoding.EncodeToString(c.CredentialID),
+				Nickname:     c.Nickname,
+				Description:  c.Description,
+				Counter:      c.Counter,
+				RegisteredAt: c.RegisteredAt.Format("02 Jan 06 15:04 MST"),
+				LoggedInAt:   c.LoggedInAt.Format("02 Jan 06 15:04 MST"),
+				Flagged:      c.Flagged,
+				Disabled:     c.Disabled,
+			}
+			if len(c.AAGUID) == 16 && !bytes.Equal(c.AAGUID, make([]byte, 16)) {
+				resp.Credentials[i].AAGUID = formatAAGUID(c.AAGUID)
+			}
+		}
+		b, err := json.Marshal(resp)
+		if err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "failed to json marshal response body")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// handleAdminDeleteUser deletes user in request path with user's credentials.
+func (s *Server) handleAdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	aw := s.startAudit(w, r, auditEventAdminUserDelete)
+	defer aw.record()
+	w = aw
+	aw.event.ActorUserID = adminUserID(r)
+
+	userID, err := userIDFromRequest(r)
+	if err != nil {
+		writeFailedServerResponse(w, http.StatusBadRequest, "Failed to base64 decode user ID: "+err.Error())
+		return
+	}
+	aw.event.UserID = userID
+
+	if err = s.dataStore.DeleteUser(r.Context(), userID); err == ErrNoRecords {
+		writeFailedServerResponse(w, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to delete user: "+err.Error())
+		return
+	}
+
+	writeOKServerResponse(w)
+}
+
+// handleAdminRevokeSessions logs out user in request path from all sessions and revokes user's API tokens.
+func (s *Server) handleAdminRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	aw := s.startAudit(w, r, auditEventAdminSessionsRevoke)
+	defer aw.record()
+	w = aw
+	aw.event.ActorUserID = adminUserID(r)
+
+	userID, err := userIDFromRequest(r)
+	if err != nil {
+		writeFailedServerResponse(w, http.StatusBadRequest, "Failed to base64 decode user ID: "+err.Error())
+		return
+	}
+	aw.event.UserID = userID
+
+	if err = s.dataStore.RevokeSessions(r.Context(), userID, time.Now()); err == ErrNoRecords {
+		writeFailedServerResponse(w, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to revoke sessions: "+err.Error())
+		return
+	}
+
+	writeOKServerResponse(w)
+}
+
+// handleAdminDisableCredential disables credential in request path, so it can't be used to log in.
+func (s *Server) handleAdminDisableCredential(w http.ResponseWriter, r *http.Request) {
+	aw := s.startAudit(w, r, auditEventAdminCredentialDisable)
+	defer aw.record()
+	w = aw
+	aw.event.ActorUserID = adminUserID(r)
+
+	userID, credentialID, ok := adminCredentialFromRequest(w, r)
+	if !ok {
+		return
+	}
+	aw.event.UserID = userID
+	aw.event.CredentialID = credentialID
+
+	if err := s.dataStore.DisableCredential(r.Context(), userID, credentialID); err == ErrNoRecords {
+		writeFailedServerResponse(w, http.StatusNotFound, "Credential not found")
+		return
+	} else if err != nil {
+		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to disable credential: "+err.Error())
+		return
+	}
+
+	writeOKServerResponse(w)
+}
+
+// handleAdminDeleteCredential deletes credential in request path.  User's last credential can't be deleted,
+// user should be deleted instead.
+func (s *Server) handleAdminDeleteCredential(w http.ResponseWriter, r *http.Request) {
+	aw := s.startAudit(w, r, auditEventAdminCredentialDelete)
+	defer aw.record()
+	w = aw
+	aw.event.ActorUserID = adminUserID(r)
+
+	userID, credentialID, ok := adminCredentialFromRequest(w, r)
+	if !ok {
+		return
+	}
+	aw.event.UserID = userID
+	aw.event.CredentialID = credentialID
+
+	if err := s.dataStore.DeleteCredential(r.Context(), userID, credentialID); err == ErrNoRecords {
+		writeFailedServerResponse(w, http.StatusNotFound, "Credential not found")
+		return
+	} else if err == ErrLastRecord {
+		writeFailedServerResponse(w, http.StatusConflict, "Failed to delete credential: user must have at least one credential")
+		return
+	} else if err != nil {
+		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to delete credential: "+err.Error())
+		return
+	}
+
+	writeOKServerResponse(w)
+}
+
+// adminCredentialFromRequest returns user ID and credential ID in request path.  It writes failed response
+// and returns false if they can't be decoded.
+func adminCredentialFromRequest(w http.ResponseWriter, r *http.Request) (userID []byte, credentialID []byte, ok bool) {
+	userID, err := userIDFromRequest(r)
+	if err != nil {
+		writeFailedServerResponse(w, http.StatusBadRequest, "Failed to base64 decode user ID: "+err.Error())
+		return nil, nil, false
+	}
+	credentialID, err = credentialIDFromRequest(r)
+	if err != nil {
+		writeFailedServerResponse(w, http.StatusBadRequest, "Failed to base64 decode credential ID: "+err.Error())
+		return nil, nil, false
+	}
+	return userID, credentialID, true
+}
@@ -0,0 +1,486 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/webauthn"
+	"github.com/fxamacker/webauthn-demo/virtualauthenticator"
+)
+
+type adminUsersResponse struct {
+	serverResponse
+	Users []struct {
+		UserID          string `json:"userID"`
+		Name            string `json:"name"`
+		CredentialCount int    `json:"credentialCount"`
+	} `json:"users"`
+	Total int `json:"total"`
+}
+
+type adminUserResponse struct {
+	serverResponse
+	Name        string `json:"name"`
+	Credentials []struct {
+		CredentialID string `json:"credentialID"`
+		AAGUID       string `json:"aaguid"`
+		Counter      uint32 `json:"counter"`
+		RegisteredAt string `json:"registeredAt"`
+		Disabled     bool   `json:"disabled"`
+	} `json:"credentials"`
+}
+
+func newAdminServer(t *testing.T, admins []string, opts ...Option) (*Server, *httptest.Server) {
+	opts = append([]Option{
+		WithConfig(&Config{CounterPolicy: counterPolicyReject, AuditLog: auditLogMemory, Admins: admins, AdminSignup: true}),
+		WithWebAuthnConfig(getWebAuthnConfig()),
+		WithOrigin(e2eOrigin),
+		WithDataStore(newMemStore()),
+		WithSessionStore(getMemSessionStore()),
+	}, opts...)
+	s, err := NewServer(opts...)
+	if err != nil {
+		t.Fatalf("NewServer() returns error %q", err)
+	}
+	return s, httptest.NewTLSServer(s)
+}
+
+func TestAdminAPI(t *testing.T) {
+	const adminUsername = "admin@example.com"
+	s, ts := newAdminServer(t, []string{adminUsername})
+	defer s.Close()
+	defer ts.Close()
+
+	newAuthenticator := func(attestationFormat string) *virtualauthenticator.Authenticator {
+		a, err := virtualauthenticator.New(e2eOrigin, attestationFormat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	admin := newE2EClient(t, ts)
+	admin.register(newAuthenticator(virtualauthenticator.AttestationFormatNone), adminUsername, webauthn.ResidentKeyDiscouraged)
+
+	// John has two credentials, Jane has one.
+	john, jane := newE2EClient(t, ts), newE2EClient(t, ts)
+	johnKey1, johnKey2 := newAuthenticator(virtualauthenticator.AttestationFormatPacked), newAuthenticator(virtualauthenticator.AttestationFormatNone)
+	john.register(johnKey1, "john@example.com", webauthn.ResidentKeyDiscouraged)
+	john.register(johnKey2, "john@example.com", webauthn.ResidentKeyDiscouraged)
+	jane.register(newAuthenticator(virtualauthenticator.AttestationFormatNone), "jane@example.com", webauthn.ResidentKeyDiscouraged)
+
+	// Admin API requires administrator.
+	var resp serverResponse
+	if statusCode := john.do("GET", "/admin/users", nil, &resp); statusCode != http.StatusForbidden {
+		t.Errorf("GET /admin/users by non-admin returns status code %d, want %d", statusCode, http.StatusForbidden)
+	}
+	if statusCode := newE2EClient(t, ts).do("GET", "/admin/users", nil, &resp); statusCode != http.StatusUnauthorized {
+		t.Errorf("GET /admin/users without login returns status code %d, want %d", statusCode, http.StatusUnauthorized)
+	}
+
+	// List and search users.
+	testCases := []struct {
+		query     string
+		wantNames []string
+		wantTotal int
+	}{
+		{"", []string{"admin@example.com", "jane@example.com", "john@example.com"}, 3},
+		{"?search=@EXAMPLE", []string{"admin@example.com", "jane@example.com", "john@example.com"}, 3},
+		{"?search=Jane", []string{"jane@example.com"}, 1},
+		{"?offset=2&limit=1", []string{"john@example.com"}, 3},
+		{"?search=nobody", nil, 0},
+	}
+	var johnID string
+	for _, tc := range testCases {
+		var usersResp adminUsersResponse
+		if statusCode := admin.do("GET", "/admin/users"+tc.query, nil, &usersResp); statusCode != http.StatusOK {
+			t.Fatalf("GET /admin/users%s returns status code %d, error %q", tc.query, statusCode, usersResp.ErrorMessage)
+		}
+		var names []string
+		for _, u := range usersResp.Users {
+			names = append(names, u.Name)
+			if u.Name == "john@example.com" {
+				johnID = u.UserID
+				if u.CredentialCount != 2 {
+					t.Errorf("GET /admin/users%s returns %d credentials of %s, want 2", tc.query, u.CredentialCount, u.Name)
+				}
+			}
+		}
+		if len(names) != len(tc.wantNames) || usersResp.Total != tc.wantTotal {
+			t.Errorf("GET /admin/users%s returns users %v, total %d, want %v, total %d", tc.query, names, usersResp.Total, tc.wantNames, tc.wantTotal)
+			continue
+		}
+		for i := range names {
+			if names[i] != tc.wantNames[i] {
+				t.Errorf("GET /admin/users%s returns users %v, want %v", tc.query, names, tc.wantNames)
+				break
+			}
+		}
+	}
+	for _, query := range []string{"?offset=-1", "?limit=0", "?limit=101", "?limit=ten"} {
+		if statusCode := admin.do("GET", "/admin/users"+query, nil, &resp); statusCode != http.StatusBadRequest {
+			t.Errorf("GET /admin/users%s returns status code %d, want %d", query, statusCode, http.StatusBadRequest)
+		}
+	}
+
+	// Get user's credentials.
+	var userResp adminUserResponse
+	if statusCode := admin.do("GET", "/admin/users/"+johnID, nil, &userResp); statusCode != http.StatusOK {
+		t.Fatalf("GET /admin/users/%s returns status code %d, error %q", johnID, statusCode, userResp.ErrorMessage)
+	}
+	if userResp.Name != "john@example.com" || len(userResp.Credentials) != 2 {
+		t.Fatalf("GET /admin/users/%s returns user %s with %d credentials, want john@example.com with 2 credentials", johnID, userResp.Name, len(userResp.Credentials))
+	}
+	key1ID := base64.RawURLEncoding.EncodeToString(johnKey1.Credentials()[0].ID)
+	key2ID := base64.RawURLEncoding.EncodeToString(johnKey2.Credentials()[0].ID)
+	for _, c := range userResp.Credentials {
+		if c.RegisteredAt == "" || c.Disabled {
+			t.Errorf("GET /admin/users/%s returns credential %+v, want registered and enabled credential", johnID, c)
+		}
+		if c.CredentialID == key1ID && len(c.AAGUID) != 36 {
+			t.Errorf("GET /admin/users/%s returns packed credential with AAGUID %q, want UUID", johnID, c.AAGUID)
+		}
+	}
+	unknownUserID := base64.RawURLEncoding.EncodeToString([]byte("unknown user"))
+	if statusCode := admin.do("GET", "/admin/users/"+unknownUserID, nil, &resp); statusCode != http.StatusNotFound {
+		t.Errorf("GET /admin/users/%s returns status code %d, want %d", unknownUserID, statusCode, http.StatusNotFound)
+	}
+
+	// Disabled credential can't be used to log in.
+	if statusCode := admin.do("POST", "/admin/users/"+johnID+"/credentials/"+key1ID+"/disable", nil, &resp); statusCode != http.StatusOK {
+		t.Fatalf("POST /admin/users/%s/credentials/%s/disable returns status code %d, error %q", johnID, key1ID, statusCode, resp.ErrorMessage)
+	}
+	john.logout()
+	var options webauthn.PublicKeyCredentialRequestOptions
+	if statusCode := john.do("POST", "/assertion/options", map[string]string{"username": "john@example.com"}, &options); statusCode != http.StatusOK {
+		t.Fatalf("POST /assertion/options returns status code %d", statusCode)
+	}
+	result, err := johnKey1.Get(&options)
+	if err != nil {
+		t.Fatalf("Get() returns error %q", err)
+	}
+	if statusCode := john.do("POST", "/assertion/result", result, &resp); statusCode != http.StatusForbidden {
+		t.Errorf("POST /assertion/result with disabled credential returns status code %d, want %d", statusCode, http.StatusForbidden)
+	}
+
+	// Delete credential, but not user's last credential.
+	if statusCode := admin.do("DELETE", "/admin/users/"+johnID+"/credentials/"+key1ID, nil, &resp); statusCode != http.StatusOK {
+		t.Fatalf("DELETE /admin/users/%s/credentials/%s returns status code %d, error %q", johnID, key1ID, statusCode, resp.ErrorMessage)
+	}
+	if statusCode := admin.do("DELETE", "/admin/users/"+johnID+"/credentials/"+key1ID, nil, &resp); statusCode != http.StatusNotFound {
+		t.Errorf("DELETE deleted credential returns status code %d, want %d", statusCode, http.StatusNotFound)
+	}
+	if statusCode := admin.do("DELETE", "/admin/users/"+johnID+"/credentials/"+key2ID, nil, &resp); statusCode != http.StatusConflict {
+		t.Errorf("DELETE last credential returns status code %d, want %d", statusCode, http.StatusConflict)
+	}
+	john.login(johnKey2, "john@example.com")
+
+	// Delete user.
+	if statusCode := admin.do("DELETE", "/admin/users/"+johnID, nil, &resp); statusCode != http.StatusOK {
+		t.Fatalf("DELETE /admin/users/%s returns status code %d, error %q", johnID, statusCode, resp.ErrorMessage)
+	}
+	if statusCode := admin.do("GET", "/admin/users/"+johnID, nil, &resp); statusCode != http.StatusNotFound {
+		t.Errorf("GET deleted user returns status code %d, want %d", statusCode, http.StatusNotFound)
+	}
+	if statusCode := admin.do("DELETE", "/admin/users/"+johnID, nil, &resp); statusCode != http.StatusNotFound {
+		t.Errorf("DELETE deleted user returns status code %d, want %d", statusCode, http.StatusNotFound)
+	}
+
+	// Admin actions are audited with affected user and administrator.
+	adminUser, err := s.dataStore.GetUser(context.Background(), adminUsername)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deleteEvents int
+	for _, e := range s.auditLog.(*memAuditLog).events {
+		if e.Type == auditEventAdminUserDelete && base64.RawURLEncoding.EncodeToString(e.UserID) == johnID {
+			deleteEvents++
+			if !bytes.Equal(e.ActorUserID, adminUser.UserID) {
+				t.Errorf("%s event has actor %x, want administrator %x", e.Type, e.ActorUserID, adminUser.UserID)
+			}
+		}
+	}
+	if deleteEvents != 2 {
+		t.Errorf("audit log has %d %s events, want 2", deleteEvents, auditEventAdminUserDelete)
+	}
+}
+
+func TestAdminRevokeSessions(t *testing.T) {
+	const adminUsername = "admin@example.com"
+	s, ts := newAdminServer(t, []string{adminUsername}, WithStaticDir("static"))
+	defer s.Close()
+	defer ts.Close()
+
+	newAuthenticator := func() *virtualauthenticator.Authenticator {
+		a, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	admin := newE2EClient(t, ts)
+	admin.register(newAuthenticator(), adminUsername, webauthn.ResidentKeyDiscouraged)
+
+	// John is logged in from two browsers.
+	johnKey := newAuthenticator()
+	laptop, phone := newE2EClient(t, ts), newE2EClient(t, ts)
+	laptop.register(johnKey, "john@example.com", webauthn.ResidentKeyDiscouraged)
+	phone.login(johnKey, "john@example.com")
+	var usersResp adminUsersResponse
+	if statusCode := admin.do("GET", "/admin/users?search=john@", nil, &usersResp); statusCode != http.StatusOK || len(usersResp.Users) != 1 {
+		t.Fatalf("GET /admin/users?search=john@ returns status code %d, %d users, want 1 user", statusCode, len(usersResp.Users))
+	}
+	johnID := usersResp.Users[0].UserID
+
+	// Admin console is only served to administrators.
+	testCases := []struct {
+		name           string
+		client         *e2eClient
+		wantStatusCode int
+	}{
+		{"admin", admin, http.StatusOK},
+		{"non-admin", laptop, http.StatusForbidden},
+		{"anonymous", newE2EClient(t, ts), http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		if statusCode := tc.client.do("GET", "/admin.html", nil, nil); statusCode != tc.wantStatusCode {
+			t.Errorf("GET /admin.html by %s returns status code %d, want %d", tc.name, statusCode, tc.wantStatusCode)
+		}
+	}
+	if statusCode := laptop.do("GET", "/index.html", nil, nil); statusCode != http.StatusOK {
+		t.Errorf("GET /index.html by non-admin returns status code %d, want %d", statusCode, http.StatusOK)
+	}
+
+	// Revoking sessions logs out all of John's sessions, but John can log in again.
+	var resp serverResponse
+	if statusCode := laptop.do("DELETE", "/admin/users/"+johnID+"/sessions", nil, &resp); statusCode != http.StatusForbidden {
+		t.Errorf("DELETE /admin/users/%s/sessions by non-admin returns status code %d, want %d", johnID, statusCode, http.StatusForbidden)
+	}
+	if statusCode := admin.do("DELETE", "/admin/users/"+johnID+"/sessions", nil, &resp); statusCode != http.StatusOK {
+		t.Fatalf("DELETE /admin/users/%s/sessions returns status code %d, error %q", johnID, statusCode, resp.ErrorMessage)
+	}
+	for _, c := range []*e2eClient{laptop, phone} {
+		if statusCode := c.do("GET", "/user", nil, &resp); statusCode != http.StatusUnauthorized {
+			t.Errorf("GET /user after sessions are revoked returns status code %d, want %d", statusCode, http.StatusUnauthorized)
+		}
+	}
+	if statusCode := admin.do("GET", "/user", nil, &resp); statusCode != http.StatusOK {
+		t.Errorf("GET /user by admin after John's sessions are revoked returns status code %d, want %d", statusCode, http.StatusOK)
+	}
+	phone.login(johnKey, "john@example.com")
+	if name, statusCode := phone.userName(); statusCode != http.StatusOK || name != "john@example.com" {
+		t.Errorf("GET /user after login returns status code %d, user %q, want user %q", statusCode, name, "john@example.com")
+	}
+	if statusCode := laptop.do("GET", "/user", nil, &resp); statusCode != http.StatusUnauthorized {
+		t.Errorf("GET /user of revoked session after new login returns status code %d, want %d", statusCode, http.StatusUnauthorized)
+	}
+
+	unknownUserID := base64.RawURLEncoding.EncodeToString([]byte("unknown user"))
+	if statusCode := admin.do("DELETE", "/admin/users/"+unknownUserID+"/sessions", nil, &resp); statusCode != http.StatusNotFound {
+		t.Errorf("DELETE /admin/users/%s/sessions returns status code %d, want %d", unknownUserID, statusCode, http.StatusNotFound)
+	}
+}
+
+// revocationCountingStore counts GetSessionsRevokedAt queries.
+type revocationCountingStore struct {
+	DataStore
+	count int32
+}
+
+func (s *revocationCountingStore) GetSessionsRevokedAt(ctx context.Context, userID []byte, credentialID []byte) (time.Time, error) {
+	atomic.AddInt32(&s.count, 1)
+	return s.DataStore.GetSessionsRevokedAt(ctx, userID, credentialID)
+}
+
+func TestRevocationLookupCachedPerRequest(t *testing.T) {
+	const adminUsername = "admin@example.com"
+	store := &revocationCountingStore{DataStore: newMemStore()}
+	s, ts := newAdminServer(t, []string{adminUsername}, WithDataStore(store))
+	defer s.Close()
+	defer ts.Close()
+
+	a, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := newE2EClient(t, ts)
+	admin.register(a, adminUsername, webauthn.ResidentKeyDiscouraged)
+
+	// Session, login, and administrator middleware of a request share one revocation lookup.
+	for _, path := range []string{"/user", "/admin/users"} {
+		atomic.StoreInt32(&store.count, 0)
+		if statusCode := admin.do("GET", path, nil, nil); statusCode != http.StatusOK {
+			t.Fatalf("GET %s returns status code %d", path, statusCode)
+		}
+		if n := atomic.LoadInt32(&store.count); n != 1 {
+			t.Errorf("GET %s queries revoked sessions %d times, want 1", path, n)
+		}
+	}
+}
+
+func TestAdminIdentity(t *testing.T) {
+	const adminUsername = "admin@example.com"
+	const unregisteredAdminUsername = "root@example.com"
+	store := newMemStore()
+
+	newAuthenticator := func() *virtualauthenticator.Authenticator {
+		a, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	signUp := func(c *e2eClient, username string) (int, string) {
+		var resp serverResponse
+		statusCode := c.do("POST", "/attestation/options", attestationOptionsRequest(username, webauthn.ResidentKeyDiscouraged), &resp)
+		return statusCode, resp.ErrorMessage
+	}
+
+	// Administrator registers while administrator signup is allowed.
+	signupServer, signupTS := newAdminServer(t, []string{adminUsername}, WithDataStore(store))
+	defer signupServer.Close()
+	defer signupTS.Close()
+	adminKey := newAuthenticator()
+	newE2EClient(t, signupTS).register(adminKey, adminUsername, webauthn.ResidentKeyDiscouraged)
+
+	// Server started without administrator signup identifies administrator by registered user ID.
+	s, err := NewServer(
+		WithConfig(&Config{CounterPolicy: counterPolicyReject, AuditLog: auditLogMemory, Admins: []string{adminUsername, unregisteredAdminUsername}}),
+		WithWebAuthnConfig(getWebAuthnConfig()),
+		WithOrigin(e2eOrigin),
+		WithDataStore(store),
+		WithSessionStore(getMemSessionStore()),
+	)
+	if err != nil {
+		t.Fatalf("NewServer() returns error %q", err)
+	}
+	defer s.Close()
+	ts := httptest.NewTLSServer(s)
+	defer ts.Close()
+
+	admin := newE2EClient(t, ts)
+	admin.login(adminKey, adminUsername)
+	if statusCode := admin.do("GET", "/admin/users", nil, nil); statusCode != http.StatusOK {
+		t.Errorf("GET /admin/users by administrator returns status code %d, want %d", statusCode, http.StatusOK)
+	}
+
+	// Administrator usernames can't be used to sign up, whether they are registered or not.
+	attacker := newE2EClient(t, ts)
+	if statusCode, errorMessage := signUp(attacker, unregisteredAdminUsername); statusCode != http.StatusBadRequest || errorMessage != "Username is already registered" {
+		t.Errorf("signup with unregistered administrator username returns status code %d, error %q, want %d, %q", statusCode, errorMessage, http.StatusBadRequest, "Username is already registered")
+	}
+	u, err := store.GetUser(context.Background(), adminUsername)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.DeleteUser(context.Background(), u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if statusCode, errorMessage := signUp(attacker, adminUsername); statusCode != http.StatusBadRequest || errorMessage != "Username is already registered" {
+		t.Errorf("signup with deleted administrator username returns status code %d, error %q, want %d, %q", statusCode, errorMessage, http.StatusBadRequest, "Username is already registered")
+	}
+
+	// User registering deleted administrator username while administrator signup is allowed isn't administrator.
+	attacker = newE2EClient(t, signupTS)
+	attacker.register(newAuthenticator(), adminUsername, webauthn.ResidentKeyDiscouraged)
+	if statusCode := attacker.do("GET", "/admin/users", nil, nil); statusCode != http.StatusForbidden {
+		t.Errorf("GET /admin/users by user with deleted administrator username returns status code %d, want %d", statusCode, http.StatusForbidden)
+	}
+}
+
+func TestAdminDisableCredentialEndsSessions(t *testing.T) {
+	const adminUsername = "admin@example.com"
+	const username = "johndoe@example.com"
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, ts := newAdminServer(t, []string{adminUsername}, WithConfig(&Config{
+		CounterPolicy: counterPolicyReject,
+		AuditLog:      auditLogMemory,
+		Admins:        []string{adminUsername},
+		AdminSignup:   true,
+		APITokens:     &apiTokenConfig{SigningKeyFile: writeSigningKeyFile(t, t.TempDir(), signingKey)},
+	}))
+	defer s.Close()
+	defer ts.Close()
+
+	newAuthenticator := func() *virtualauthenticator.Authenticator {
+		a, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	admin := newE2EClient(t, ts)
+	admin.register(newAuthenticator(), adminUsername, webauthn.ResidentKeyDiscouraged)
+
+	// User is logged in with a browser session and has API tokens issued with the same credential.
+	lostKey := newAuthenticator()
+	user := newE2EClient(t, ts)
+	user.register(lostKey, username, webauthn.ResidentKeyDiscouraged)
+	apiClient := newE2EClient(t, ts)
+	var options webauthn.PublicKeyCredentialRequestOptions
+	if statusCode := apiClient.do("POST", "/assertion/options", map[string]string{"username": username}, &options); statusCode != http.StatusOK {
+		t.Fatalf("POST /assertion/options returns status code %d", statusCode)
+	}
+	result, err := lostKey.Get(&options)
+	if err != nil {
+		t.Fatalf("Get() returns error %q", err)
+	}
+	var tokens apiTokenResponse
+	if statusCode := apiClient.do("POST", "/assertion/result?token=true", result, &tokens); statusCode != http.StatusOK {
+		t.Fatalf("POST /assertion/result?token=true returns status code %d", statusCode)
+	}
+	getUserWithAccessToken := func() int {
+		req, err := http.NewRequest("GET", ts.URL+"/user", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("GET /user returns error %q", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if _, statusCode := user.userName(); statusCode != http.StatusOK {
+		t.Fatalf("GET /user before credential is disabled returns status code %d", statusCode)
+	}
+	if statusCode := getUserWithAccessToken(); statusCode != http.StatusOK {
+		t.Fatalf("GET /user with access token before credential is disabled returns status code %d", statusCode)
+	}
+
+	// Administrator disables lost key.
+	u, err := s.dataStore.GetUser(context.Background(), username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/admin/users/" + base64.RawURLEncoding.EncodeToString(u.UserID) + "/credentials/" + base64.RawURLEncoding.EncodeToString(lostKey.Credentials()[0].ID) + "/disable"
+	if statusCode := admin.do("POST", path, nil, nil); statusCode != http.StatusOK {
+		t.Fatalf("POST %s returns status code %d", path, statusCode)
+	}
+
+	// Session, access token, and refresh token issued with disabled credential are rejected.
+	if _, statusCode := user.userName(); statusCode != http.StatusUnauthorized {
+		t.Errorf("GET /user after credential is disabled returns status code %d, want %d", statusCode, http.StatusUnauthorized)
+	}
+	if statusCode := getUserWithAccessToken(); statusCode != http.StatusUnauthorized {
+		t.Errorf("GET /user with access token after credential is disabled returns status code %d, want %d", statusCode, http.StatusUnauthorized)
+	}
+	var resp serverResponse
+	if statusCode := apiClient.do("POST", "/token/refresh", map[string]string{"refreshToken": tokens.RefreshToken}, &resp); statusCode != http.StatusUnauthorized || resp.ErrorMessage != "Invalid refresh token" {
+		t.Errorf("POST /token/refresh after credential is disabled returns status code %d, error %q, want %d, %q", statusCode, resp.ErrorMessage, http.StatusUnauthorized, "Invalid refresh token")
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	defaultAccessTokenTTL  = 60 * 5            // access tokens expire after 5 minutes
+	defaultRefreshTokenTTL = 60 * 60 * 24 * 30 // refresh tokens expire after 30 days
+
+	contextKeyBearerToken contextKey = "BearerToken" // context key for *apiAccessTokenClaims of authenticated request
+)
+
+// apiTokenConfig has settings of access tokens and refresh tokens issued to API clients after login.
+type apiTokenConfig struct {
+	SigningKeyFile  string // PEM file with ES256 or EdDSA private keys.  The first key signs tokens, others verify tokens signed before rotation.
+	AccessTokenTTL  int    // Access token lifetime in seconds.
+	RefreshTokenTTL int    // Refresh token lifetime in seconds.
+}
+
+func (c *apiTokenConfig) valid() error {
+	if c.SigningKeyFile == "" {
+		return errors.New("API token signing key file is empty")
+	}
+	if c.AccessTokenTTL < 0 || c.RefreshTokenTTL < 0 {
+		return errors.New("API token TTL is negative")
+	}
+	return nil
+}
+
+// apiTokenIssuer issues signed JWT access tokens and opaque refresh tokens to API clients.
+type apiTokenIssuer struct {
+	issuer          string
+	audience        string
+	keys            *signingKeySet
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+}
+
+func newAPITokenIssuer(c *apiTokenConfig, origin string) (*apiTokenIssuer, error) {
+	if err := c.valid(); err != nil {
+		return nil, err
+	}
+	keys, err := loadSigningKeySet(c.SigningKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys.keys {
+		if k.alg != "ES256" && k.alg != "EdDSA" {
+			return nil, errors.New("API token signing key has alg " + k.alg + ", want ES256 or EdDSA")
+		}
+	}
+	ti := &apiTokenIssuer{
+		issuer: strings.TrimRight(origin, "/"),
+		// Audience differs from OpenID Connect access tokens, so one can't be used as the other.
+		audience:        strings.TrimRight(origin, "/") + "/api",
+		keys:            keys,
+		accessTokenTTL:  time.Duration(c.AccessTokenTTL) * time.Second,
+		refreshTokenTTL: time.Duration(c.RefreshTokenTTL) * time.Second,
+	}
+	if ti.accessTokenTTL == 0 {
+		ti.accessTokenTTL = defaultAccessTokenTTL * time.Second
+	}
+	if ti.refreshTokenTTL == 0 {
+		ti.refreshTokenTTL = defaultRefreshTokenTTL * time.Second
+	}
+	return ti, nil
+}
+
+// apiAccessTokenClaims are claims in API access token.
+type apiAccessTokenClaims struct {
+	Issuer       string   `json:"iss"`
+	Subject      string   `json:"sub"` // base64url encoded user ID
+	Audience     string   `json:"aud"`
+	ExpiresAt    int64    `json:"exp"`
+	IssuedAt     int64    `json:"iat"`
+	CredentialID string   `json:"cid"` // base64url encoded ID of credential used to log in
+	AMR          []string `json:"amr"`
+	JTI          string   `json:"jti"`
+}
+
+// apiTokenResponse is response of login and refresh requests with tokens.
+type apiTokenResponse struct {
+	Status       string `json:"status"`
+	AccessToken  string `json:"accessToken"`
+	TokenType    string `json:"tokenType"`
+	ExpiresIn    int64  `json:"expiresIn"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+func newRandomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func refreshTokenHash(token string) []byte {
+	h := sha256.Sum256([]byte(token))
+	return h[:]
+}
+
+// issue returns access token and new refresh token stored in data store.
+func (ti *apiTokenIssuer) issue(ctx context.Context, dataStore DataStore, userID []byte, credentialID []byte, userVerified bool) (*apiTokenResponse, error) {
+	now := time.Now()
+	jti, err := newRandomToken()
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := signJWS(ti.keys.current(), oidcAccessTokenType, apiAccessTokenClaims{
+		Issuer:       ti.issuer,
+		Subject:      base64.RawURLEncoding.EncodeToString(userID),
+		Audience:     ti.audience,
+		ExpiresAt:    now.Add(ti.accessTokenTTL).Unix(),
+		IssuedAt:     now.Unix(),
+		CredentialID: base64.RawURLEncoding.EncodeToString(credentialID),
+		AMR:          authenticationMethods(userVerified),
+		JTI:          jti,
+	})
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := newRandomToken()
+	if err != nil {
+		return nil, err
+	}
+	err = dataStore.AddRefreshToken(ctx, &RefreshToken{
+		TokenHash:    refreshTokenHash(refreshToken),
+		UserID:       userID,
+		CredentialID: credentialID,
+		UserVerified: userVerified,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(ti.refreshTokenTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &apiTokenResponse{
+		Status:       statusOK,
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(ti.accessTokenTTL / time.Second),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// verifyAccessToken returns claims of access token issued by ti.
+func (ti *apiTokenIssuer) verifyAccessToken(token string) (*apiAccessTokenClaims, error) {
+	t, err := ti.keys.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if t.header.Typ != oidcAccessTokenType {
+		return nil, errors.New("token type is not " + oidcAccessTokenType)
+	}
+	var claims apiAccessTokenClaims
+	if err := json.Unmarshal(t.payload, &claims); err != nil {
+		return nil, errors.New("failed to json decode token claims: " + err.Error())
+	}
+	if claims.Issuer != ti.issuer || claims.Audience != ti.audience {
+		return nil, errors.New("token isn't issued for this server")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errors.New("token is expired")
+	}
+	return &claims, nil
+}
+
+func writeAPITokenResponse(w http.ResponseWriter, resp *apiTokenResponse) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeFailedServerResponse(w, http.StatusInternalServerError, "failed to json marshal response body")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(b)
+}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// handleTokenRefresh exchanges refresh token for a new access token and a new refresh token.
+// Refresh token can be used only once.
+func (s *Server) handleTokenRefresh(w http.ResponseWriter, r *http.Request) {
+	var req refreshTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFailedServerResponse(w, http.StatusBadRequest, "Failed to parse request: "+err.Error())
+		return
+	}
+	tokenHash := refreshTokenHash(req.RefreshToken)
+	t, err := s.dataStore.GetRefreshToken(r.Context(), tokenHash)
+	if err == ErrNoRecords {
+		writeFailedServerResponse(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	} else if err != nil {
+		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to find refresh token: "+err.Error())
+		return
+	}
+	// Delete refresh token first, so concurrent requests with the same token can't both succeed.
+	if err = s.dataStore.DeleteRefreshToken(r.Context(), tokenHash); err == ErrNoRecords {
+		writeFailedServerResponse(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	} else if err != nil {
+		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to delete refresh token: "+err.Error())
+		return
+	}
+	if time.Now().After(t.ExpiresAt) {
+		writeFailedServerResponse(w, http.StatusUnauthorized, "Refresh token is expired")
+		return
+	}
+
+	// Refresh token can't outlive credential used to log in.
+	c, err := s.dataStore.GetCredential(r.Context(), t.UserID, t.CredentialID)
+	if err == ErrNoRecords {
+		writeFailedServerResponse(w, http.StatusUnauthorized, "Credential is deleted")
+		return
+	} else if err != nil {
+		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to find credential: "+err.Error())
+		return
+	}
+	if c.Disabled {
+		writeFailedServerResponse(w, http.StatusUnauthorized, "Credential is disabled")
+		return
+	}
+
+	resp, err := s.apiTokens.issue(r.Context(), s.dataStore, t.UserID, t.CredentialID, t.UserVerified)
+	if err != nil {
+		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to issue tokens: "+err.Error())
+		return
+	}
+	writeAPITokenResponse(w, resp)
+}
+
+// handleTokenRevoke deletes refresh token.  Unknown refresh token isn't an error, as in RFC 7009.
+func (s *Server) handleTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	var req refreshTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFailedServerResponse(w, http.StatusBadRequest, "Failed to parse request: "+err.Error())
+		return
+	}
+	if err := s.dataStore.DeleteRefreshToken(r.Context(), refreshTokenHash(req.RefreshToken)); err != nil && err != ErrNoRecords {
+		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to delete refresh token: "+err.Error())
+		return
+	}
+	writeOKServerResponse(w)
+}
+
+// loggedInUserOrBearerToken returns a handler that authenticates request with Bearer access token if
+// request has one, or with login session like loggedInUserOnly otherwise.  User authenticated by access
+// token is stored in request context as a login session that isn't saved.
+func (s *Server) loggedInUserOrBearerToken(next http.HandlerFunc) http.HandlerFunc {
+	sessionNext := s.loggedInUserOnly(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if s.apiTokens == nil || len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+			sessionNext(w, r)
+			return
+		}
+		unauthorized := func(errMsg string) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeFailedServerResponse(w, http.StatusUnauthorized, errMsg)
+		}
+		claims, err := s.apiTokens.verifyAccessToken(auth[7:])
+		if err != nil {
+			unauthorized("Invalid access token: " + err.Error())
+			return
+		}
+		userID, err := base64.RawURLEncoding.DecodeString(claims.Subject)
+		if err != nil {
+			unauthorized("Invalid access token: token has invalid subject")
+			return
+		}
+		credentialID, err := base64.RawURLEncoding.DecodeString(claims.CredentialID)
+		if err != nil {
+			unauthorized("Invalid access token: token has invalid credential ID")
+			return
+		}
+		u, err := s.dataStore.GetUserByID(r.Context(), userID)
+		if err == ErrNoRecords {
+			unauthorized("Invalid access token: user doesn't exist")
+			return
+		} else if err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to find user: "+err.Error())
+			return
+		}
+		// Access token is revoked if it is issued at or before revocation, !iat.After(revokedAt).  iat has
+		// seconds precision, so token issued in the same second as revocation is revoked.
+		iat := time.Unix(claims.IssuedAt, 0)
+		if revoked, err := s.sessionsRevoked(r.Context(), u.UserID, credentialID, iat); err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to check revoked sessions: "+err.Error())
+			return
+		} else if revoked {
+			unauthorized("Invalid access token: user's sessions are revoked")
+			return
+		}
+		setRequestLogUserID(r.Context(), u.UserID)
+
+		userVerified := false
+		for _, method := range claims.AMR {
+			if method == "mfa" {
+				userVerified = true
+			}
+		}
+		session := sessions.NewSession(s.sessionStore, sessionNameLoginSession)
+		session.Values[sessionMapKeyUserSession] = &userSession{
+			User:                 u,
+			LoggedInCredentialID: credentialID,
+			UserVerified:         userVerified,
+		}
+		ctx := context.WithValue(r.Context(), contextKeyLoginSession, session)
+		ctx = context.WithValue(ctx, contextKeyBearerToken, claims)
+		next(w, r.WithContext(ctx))
+	}
+}
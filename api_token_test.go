@@ -0,0 +1,285 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/webauthn"
+	"github.com/fxamacker/webauthn-demo/virtualauthenticator"
+)
+
+func TestAPITokens(t *testing.T) {
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		CounterPolicy: counterPolicyReject,
+		AuditLog:      auditLogMemory,
+		APITokens:     &apiTokenConfig{SigningKeyFile: writeSigningKeyFile(t, t.TempDir(), signingKey)},
+	}
+	s, err := NewServer(
+		WithConfig(c),
+		WithWebAuthnConfig(getWebAuthnConfig()),
+		WithOrigin(e2eOrigin),
+		WithDataStore(newMemStore()),
+		WithSessionStore(getMemSessionStore()),
+	)
+	if err != nil {
+		t.Fatalf("NewServer() returns error %q", err)
+	}
+	defer s.Close()
+	ts := httptest.NewTLSServer(s)
+	defer ts.Close()
+
+	a, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username := "johndoe@example.com"
+	browser := newE2EClient(t, ts)
+	browser.register(a, username, webauthn.ResidentKeyDiscouraged)
+
+	// API client logs in with tokens and sends requests without cookies.
+	apiClient := newE2EClient(t, ts)
+	var options webauthn.PublicKeyCredentialRequestOptions
+	if statusCode := apiClient.do("POST", "/assertion/options", map[string]string{"username": username}, &options); statusCode != http.StatusOK {
+		t.Fatalf("POST /assertion/options returns status code %d", statusCode)
+	}
+	result, err := a.Get(&options)
+	if err != nil {
+		t.Fatalf("Get() returns error %q", err)
+	}
+	var tokens apiTokenResponse
+	if statusCode := apiClient.do("POST", "/assertion/result?token=true", result, &tokens); statusCode != http.StatusOK {
+		t.Fatalf("POST /assertion/result?token=true returns status code %d", statusCode)
+	}
+	if tokens.Status != statusOK || tokens.TokenType != "Bearer" || tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("POST /assertion/result?token=true returns %+v, want tokens", tokens)
+	}
+
+	bearer := func(method string, path string, accessToken string, v interface{}) int {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s %s returns error %q", method, path, err)
+		}
+		defer resp.Body.Close()
+		if len(resp.Header["Set-Cookie"]) > 0 {
+			t.Errorf("%s %s with access token sets cookie %v", method, path, resp.Header["Set-Cookie"])
+		}
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("%s %s returns invalid JSON: %s", method, path, err)
+			}
+		}
+		return resp.StatusCode
+	}
+	post := func(path string, body interface{}, v interface{}) int {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := ts.Client().Post(ts.URL+path, "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("POST %s returns error %q", path, err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("POST %s returns invalid JSON: %s", path, err)
+		}
+		return resp.StatusCode
+	}
+
+	var user struct {
+		Name string `json:"name"`
+	}
+	if statusCode := bearer("GET", "/user", tokens.AccessToken, &user); statusCode != http.StatusOK || user.Name != username {
+		t.Errorf("GET /user with access token returns status code %d, name %q, want %d, %q", statusCode, user.Name, http.StatusOK, username)
+	}
+	if statusCode := bearer("GET", "/credentials", tokens.AccessToken, nil); statusCode != http.StatusOK {
+		t.Errorf("GET /credentials with access token returns status code %d, want %d", statusCode, http.StatusOK)
+	}
+	if statusCode := bearer("GET", "/user", tokens.AccessToken[:len(tokens.AccessToken)-2], nil); statusCode != http.StatusUnauthorized {
+		t.Errorf("GET /user with tampered access token returns status code %d, want %d", statusCode, http.StatusUnauthorized)
+	}
+
+	// Refresh token is rotated, and used refresh token is rejected.
+	var refreshed apiTokenResponse
+	if statusCode := post("/token/refresh", refreshTokenRequest{tokens.RefreshToken}, &refreshed); statusCode != http.StatusOK || refreshed.RefreshToken == "" || refreshed.RefreshToken == tokens.RefreshToken {
+		t.Fatalf("POST /token/refresh returns status code %d, %+v, want new tokens", statusCode, refreshed)
+	}
+	if statusCode := bearer("GET", "/user", refreshed.AccessToken, nil); statusCode != http.StatusOK {
+		t.Errorf("GET /user with refreshed access token returns status code %d, want %d", statusCode, http.StatusOK)
+	}
+	var resp serverResponse
+	if statusCode := post("/token/refresh", refreshTokenRequest{tokens.RefreshToken}, &resp); statusCode != http.StatusUnauthorized {
+		t.Errorf("POST /token/refresh with used refresh token returns status code %d, want %d", statusCode, http.StatusUnauthorized)
+	}
+
+	// Revoked refresh token is rejected.
+	if statusCode := post("/token/revoke", refreshTokenRequest{refreshed.RefreshToken}, &resp); statusCode != http.StatusOK || resp.Status != statusOK {
+		t.Errorf("POST /token/revoke returns status code %d, %+v, want %d", statusCode, resp, http.StatusOK)
+	}
+	if statusCode := post("/token/refresh", refreshTokenRequest{refreshed.RefreshToken}, &resp); statusCode != http.StatusUnauthorized {
+		t.Errorf("POST /token/refresh with revoked refresh token returns status code %d, want %d", statusCode, http.StatusUnauthorized)
+	}
+
+	// Browser login without token query parameter doesn't return tokens.
+	browser.logout()
+	browser.login(a, username)
+	if name, statusCode := browser.userName(); statusCode != http.StatusOK || name != username {
+		t.Errorf("GET /user after browser login returns status code %d, name %q, want %d, %q", statusCode, name, http.StatusOK, username)
+	}
+}
+
+func TestAPITokenRevokedInSameSecond(t *testing.T) {
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		CounterPolicy: counterPolicyReject,
+		AuditLog:      auditLogMemory,
+		APITokens:     &apiTokenConfig{SigningKeyFile: writeSigningKeyFile(t, t.TempDir(), signingKey)},
+	}
+	s, err := NewServer(
+		WithConfig(c),
+		WithWebAuthnConfig(getWebAuthnConfig()),
+		WithOrigin(e2eOrigin),
+		WithDataStore(newMemStore()),
+		WithSessionStore(getMemSessionStore()),
+	)
+	if err != nil {
+		t.Fatalf("NewServer() returns error %q", err)
+	}
+	defer s.Close()
+	ts := httptest.NewTLSServer(s)
+	defer ts.Close()
+
+	a, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const username = "johndoe@example.com"
+	apiClient := newE2EClient(t, ts)
+	apiClient.register(a, username, webauthn.ResidentKeyDiscouraged)
+	var options webauthn.PublicKeyCredentialRequestOptions
+	if statusCode := apiClient.do("POST", "/assertion/options", map[string]string{"username": username}, &options); statusCode != http.StatusOK {
+		t.Fatalf("POST /assertion/options returns status code %d", statusCode)
+	}
+	result, err := a.Get(&options)
+	if err != nil {
+		t.Fatalf("Get() returns error %q", err)
+	}
+	var tokens apiTokenResponse
+	if statusCode := apiClient.do("POST", "/assertion/result?token=true", result, &tokens); statusCode != http.StatusOK {
+		t.Fatalf("POST /assertion/result?token=true returns status code %d", statusCode)
+	}
+
+	// Decode iat of access token.
+	parts := strings.Split(tokens.AccessToken, ".")
+	if len(parts) != 3 {
+		t.Fatalf("access token %q isn't a JWT", tokens.AccessToken)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims apiAccessTokenClaims
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	iat := time.Unix(claims.IssuedAt, 0)
+	u, err := s.dataStore.GetUser(context.Background(), username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getUser := func() int {
+		req, err := http.NewRequest("GET", ts.URL+"/user", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("GET /user returns error %q", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Access token is revoked if it is issued at or before revocation, including revocation later
+	// in the same second as iat.
+	testCases := []struct {
+		name           string
+		revokedAt      time.Time
+		wantStatusCode int
+	}{
+		{"revoked before iat", iat.Add(-time.Nanosecond), http.StatusOK},
+		{"revoked at iat", iat, http.StatusUnauthorized},
+		{"revoked in the same second after iat", iat.Add(500 * time.Millisecond), http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		if err := s.dataStore.RevokeSessions(context.Background(), u.UserID, tc.revokedAt); err != nil {
+			t.Fatal(err)
+		}
+		if statusCode := getUser(); statusCode != tc.wantStatusCode {
+			t.Errorf("GET /user with access token %s returns status code %d, want %d", tc.name, statusCode, tc.wantStatusCode)
+		}
+	}
+}
+
+func TestAPITokenConfigError(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name         string
+		config       *apiTokenConfig
+		wantErrorMsg string
+	}{
+		{
+			name:         "no signing key file",
+			config:       &apiTokenConfig{},
+			wantErrorMsg: "API token signing key file is empty",
+		},
+		{
+			name:         "negative TTL",
+			config:       &apiTokenConfig{SigningKeyFile: "keys.pem", AccessTokenTTL: -1},
+			wantErrorMsg: "API token TTL is negative",
+		},
+		{
+			name:         "RSA signing key",
+			config:       &apiTokenConfig{SigningKeyFile: writeSigningKeyFile(t, dir, rsaKey)},
+			wantErrorMsg: "API token signing key has alg RS256, want ES256 or EdDSA",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newAPITokenIssuer(tc.config, e2eOrigin); err == nil || !strings.HasPrefix(err.Error(), tc.wantErrorMsg) {
+				t.Errorf("newAPITokenIssuer() returns error %v, want error %q", err, tc.wantErrorMsg)
+			}
+		})
+	}
+}
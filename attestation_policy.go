@@ -0,0 +1,132 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/fxamacker/webauthn"
+)
+
+// attestationPolicyConfig has attestation policy settings from config file.
+type attestationPolicyConfig struct {
+	AttestationTypes []string // Acceptable attestation types: "None", "Self", "Basic", and "AttCA".  All types are acceptable if empty.
+	TrustAnchorDir   string   // Folder of PEM encoded root certificates.  If set, Basic and AttCA attestations must chain to one of them.
+}
+
+var attestationTypesByName = map[string]webauthn.AttestationType{
+	webauthn.AttestationTypeNone.String():  webauthn.AttestationTypeNone,
+	webauthn.AttestationTypeSelf.String():  webauthn.AttestationTypeSelf,
+	webauthn.AttestationTypeBasic.String(): webauthn.AttestationTypeBasic,
+	webauthn.AttestationTypeCA.String():    webauthn.AttestationTypeCA,
+}
+
+func (c *attestationPolicyConfig) valid() error {
+	for _, name := range c.AttestationTypes {
+		if _, ok := attestationTypesByName[name]; !ok {
+			return errors.New("attestation policy has unsupported attestation type \"" + name + "\"")
+		}
+	}
+	return nil
+}
+
+// attestationPolicy verifies attestation type and trust path returned by webauthn.VerifyAttestation.
+// A nil *attestationPolicy accepts all attestations.
+type attestationPolicy struct {
+	attTypes map[webauthn.AttestationType]bool // acceptable attestation types, nil if all types are acceptable
+	roots    *x509.CertPool                    // trust anchors, nil if trust path isn't checked
+}
+
+func newAttestationPolicy(c *attestationPolicyConfig) (*attestationPolicy, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if err := c.valid(); err != nil {
+		return nil, err
+	}
+	p := &attestationPolicy{}
+	if len(c.AttestationTypes) > 0 {
+		p.attTypes = make(map[webauthn.AttestationType]bool)
+		for _, name := range c.AttestationTypes {
+			p.attTypes[attestationTypesByName[name]] = true
+		}
+	}
+	if c.TrustAnchorDir != "" {
+		roots, err := loadCertPool(c.TrustAnchorDir)
+		if err != nil {
+			return nil, err
+		}
+		p.roots = roots
+	}
+	return p, nil
+}
+
+// loadCertPool returns a cert pool with all certificates found in *.pem files in dir.
+func loadCertPool(dir string) (*x509.CertPool, error) {
+	fileNames, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	count := 0
+	for _, fileName := range fileNames {
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			return nil, errors.New("failed to read trust anchor file: " + err.Error())
+		}
+		for {
+			var block *pem.Block
+			if block, data = pem.Decode(data); block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, errors.New("failed to parse trust anchor in " + fileName + ": " + err.Error())
+			}
+			pool.AddCert(cert)
+			count++
+		}
+	}
+	if count == 0 {
+		return nil, errors.New("no trust anchors found in " + dir)
+	}
+	return pool, nil
+}
+
+// verify returns an error if attestation type isn't acceptable or trust path doesn't chain to a trust anchor.
+// Trust path is only checked for Basic and AttCA attestations because None and Self attestations don't have one.
+func (p *attestationPolicy) verify(attType webauthn.AttestationType, trustPath interface{}) error {
+	if p == nil {
+		return nil
+	}
+	if p.attTypes != nil && !p.attTypes[attType] {
+		return errors.New("attestation type " + attType.String() + " is not acceptable")
+	}
+	if p.roots == nil || (attType != webauthn.AttestationTypeBasic && attType != webauthn.AttestationTypeCA) {
+		return nil
+	}
+	certs, ok := trustPath.([]*x509.Certificate)
+	if !ok || len(certs) == 0 {
+		return errors.New("attestation doesn't have trust path")
+	}
+	verifyOptions := x509.VerifyOptions{
+		Roots:         p.roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, c := range certs[1:] {
+		verifyOptions.Intermediates.AddCert(c)
+	}
+	if _, err := certs[0].Verify(verifyOptions); err != nil {
+		return errors.New("attestation trust path doesn't chain to a trust anchor: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/fxamacker/webauthn"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/mock"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Attestations from fxamacker/webauthn attestation statement format tests.  TPM attestation has the same authenticator data,
+// certInfo, and pubArea, but certInfo is re-signed by a test AIK certificate issued by testdata/tpm_attestation_roots
+// because the original AIK certificate doesn't chain to a root in x5c or the system cert pool.  Test AIK certificate
+// also has anyExtendedKeyUsage because fxamacker/webauthn verifies TPM certificate chain with default key usage.
+const (
+	fidoU2FAttestationRequest = `{
+		"rawId": "Bo-VjHOkJZy8DjnCJnIc0Oxt9QAz5upMdSJxNbd-GyAo6MNIvPBb9YsUlE0ZJaaWXtWH5FQyPS6bT_e698IirQ==",
+		"id":    "Bo-VjHOkJZy8DjnCJnIc0Oxt9QAz5upMdSJxNbd-GyAo6MNIvPBb9YsUlE0ZJaaWXtWH5FQyPS6bT_e698IirQ==",
+		"response": {
+			"attestationObject": "o2NmbXRoZmlkby11MmZnYXR0U3RtdKJjc2lnWEgwRgIhAO-683ISJhKdmUPmVbQuYZsp8lkD7YJcInHS3QOfbrioAiEAzgMJ499cBczBw826r1m55Jmd9mT4d1iEXYS8FbIn8MpjeDVjgVkCSDCCAkQwggEuoAMCAQICBFVivqAwCwYJKoZIhvcNAQELMC4xLDAqBgNVBAMTI1l1YmljbyBVMkYgUm9vdCBDQSBTZXJpYWwgNDU3MjAwNjMxMCAXDTE0MDgwMTAwMDAwMFoYDzIwNTAwOTA0MDAwMDAwWjAqMSgwJgYDVQQDDB9ZdWJpY28gVTJGIEVFIFNlcmlhbCAxNDMyNTM0Njg4MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAESzMfdz2BRLmZXL5FhVF-F1g6pHYjaVy-haxILIAZ8sm5RnrgRbDmbxMbLqMkPJH9pgLjGPP8XY0qerrnK9FDCaM7MDkwIgYJKwYBBAGCxAoCBBUxLjMuNi4xLjQuMS40MTQ4Mi4xLjUwEwYLKwYBBAGC5RwCAQEEBAMCBSAwCwYJKoZIhvcNAQELA4IBAQCsFtmzbrazqbdtdZSzT1n09z7byf3rKTXra0Ucq_QdJdPnFhTXRyYEynKleOMj7bdgBGhfBefRub4F226UQPrFz8kypsr66FKZdy7bAnggIDzUFB0-629qLOmeOVeAMmOrq41uxICn3whK0sunt9bXfJTD68CxZvlgV8r1_jpjHqJqQzdio2--z0z0RQliX9WvEEmqfIvHaJpmWemvXejw1ywoglF0xQ4Gq39qB5CDe22zKr_cvKg1y7sJDvHw2Z4Iab_p5WdkxCMObAV3KbAQ3g7F-czkyRwoJiGOqAgau5aRUewWclryqNled5W8qiJ6m5RDIMQnYZyq-FTZgpjXaGF1dGhEYXRhWMRJlg3liA6MaHQ0Fw9kdmBbj-SuuaKGMseZXPO6gx2XY0EAAAAAAAAAAAAAAAAAAAAAAAAAAABABo-VjHOkJZy8DjnCJnIc0Oxt9QAz5upMdSJxNbd-GyAo6MNIvPBb9YsUlE0ZJaaWXtWH5FQyPS6bT_e698IiraUBAgMmIAEhWCA1c9AIeH5sN6x1Q-2qR7v255tkeGbWs0ECCDw35kJGBCJYIBjTUxruadjFFMnWlR5rPJr23sBJT9qexY9PCc9o8hmT",
+			"clientDataJSON":    "eyJjaGFsbGVuZ2UiOiJWdTh1RHFua3dPamQ4M0tMajZTY24yQmdGTkxGYkdSN0txX1hKSndRbm5hdHp0VVI3WElCTDdLOHVNUENJYVFtS3cxTUNWUTVhYXpOSkZrN05ha2dxQSIsImNsaWVudEV4dGVuc2lvbnMiOnt9LCJoYXNoQWxnb3JpdGhtIjoiU0hBLTI1NiIsIm9yaWdpbiI6Imh0dHBzOi8vbG9jYWxob3N0Ojg0NDMiLCJ0eXBlIjoid2ViYXV0aG4uY3JlYXRlIn0"
+		},
+		"type": "public-key"
+	}`
+
+	packedBasicAttestationRequest = `{
+		"rawId": "sL39APyTmisrjh11vghaqNfuruLQmCfR0c1ryKtaQ81jkEhNa5u9xLTnkibvXC9YpzBLFwWEZ3k9CR_sxzm_pWYbBOtKxeZu9z2GT8b6QW4iQvRlyumCT3oENx_8401r",
+		"id":    "sL39APyTmisrjh11vghaqNfuruLQmCfR0c1ryKtaQ81jkEhNa5u9xLTnkibvXC9YpzBLFwWEZ3k9CR_sxzm_pWYbBOtKxeZu9z2GT8b6QW4iQvRlyumCT3oENx_8401r",
+		"response": {
+			"attestationObject": "o2NmbXRmcGFja2VkZ2F0dFN0bXSjY2FsZyZjc2lnWEgwRgIhAIsK0Wr9tmud-waIYoQw20UWi7DL_gDx_PNG3PB57eHLAiEAtRyd-4JI2pCVX-dDz4mbHc_AkvC3d_4qnBBa3n2I_hVjeDVjg1kCRTCCAkEwggHooAMCAQICEBWfe8LNiRjxKGuTSPqfM-IwCgYIKoZIzj0EAwIwSTELMAkGA1UEBhMCQ04xHTAbBgNVBAoMFEZlaXRpYW4gVGVjaG5vbG9naWVzMRswGQYDVQQDDBJGZWl0aWFuIEZJRE8yIENBLTEwIBcNMTgwNDExMDAwMDAwWhgPMjAzMzA0MTAyMzU5NTlaMG8xCzAJBgNVBAYTAkNOMR0wGwYDVQQKDBRGZWl0aWFuIFRlY2hub2xvZ2llczEiMCAGA1UECwwZQXV0aGVudGljYXRvciBBdHRlc3RhdGlvbjEdMBsGA1UEAwwURlQgQmlvUGFzcyBGSURPMiBVU0IwWTATBgcqhkjOPQIBBggqhkjOPQMBBwNCAASABnVcWfvJSbAVqNIKkliXvoMKsu_oLPiP7aCQlmPlSMcfEScFM7QkRnidTP7hAUOKlOmDPeIALC8qHddvTdtdo4GJMIGGMB0GA1UdDgQWBBR6VIJCgGLYiuevhJglxK-RqTSY8jAfBgNVHSMEGDAWgBRNO9jEZxUbuxPo84TYME-daRXAgzAMBgNVHRMBAf8EAjAAMBMGCysGAQQBguUcAgEBBAQDAgUgMCEGCysGAQQBguUcAQEEBBIEEEI4MkVENzNDOEZCNEU1QTIwCgYIKoZIzj0EAwIDRwAwRAIgJEtFo76I3LfgJaLGoxLP-4btvCdKIsEFLjFIUfDosIcCIDQav04cJPILGnPVPazCqfkVtBuyOmsBbx_v-ODn-JDAWQH_MIIB-zCCAaCgAwIBAgIQFZ97ws2JGPEoa5NI-p8z4TAKBggqhkjOPQQDAjBLMQswCQYDVQQGEwJDTjEdMBsGA1UECgwURmVpdGlhbiBUZWNobm9sb2dpZXMxHTAbBgNVBAMMFEZlaXRpYW4gRklETyBSb290IENBMCAXDTE4MDQxMDAwMDAwMFoYDzIwMzgwNDA5MjM1OTU5WjBJMQswCQYDVQQGEwJDTjEdMBsGA1UECgwURmVpdGlhbiBUZWNobm9sb2dpZXMxGzAZBgNVBAMMEkZlaXRpYW4gRklETzIgQ0EtMTBZMBMGByqGSM49AgEGCCqGSM49AwEHA0IABI5-YAnswRZlzKD6w-lv5Qg7lW1XJRHrWzL01mc5V91n2LYXNR3_S7mA5gupuTO5mjQw8xfqIRMHVr1qB3TedY-jZjBkMB0GA1UdDgQWBBRNO9jEZxUbuxPo84TYME-daRXAgzAfBgNVHSMEGDAWgBTRoZhNgX_DuWv2B2e9UBL-kEXxVDASBgNVHRMBAf8ECDAGAQH_AgEAMA4GA1UdDwEB_wQEAwIBBjAKBggqhkjOPQQDAgNJADBGAiEA-3-j0kBHoRFQwnhWbSHMkBaY7KF_TztINFN5ymDkwmUCIQDrCkPBiMHXvYg-kSRgVsKwuVtYonRvC588qRwpLStZ7FkB3DCCAdgwggF-oAMCAQICEBWfe8LNiRjxKGuTSPqfM9YwCgYIKoZIzj0EAwIwSzELMAkGA1UEBhMCQ04xHTAbBgNVBAoMFEZlaXRpYW4gVGVjaG5vbG9naWVzMR0wGwYDVQQDDBRGZWl0aWFuIEZJRE8gUm9vdCBDQTAgFw0xODA0MDEwMDAwMDBaGA8yMDQ4MDMzMTIzNTk1OVowSzELMAkGA1UEBhMCQ04xHTAbBgNVBAoMFEZlaXRpYW4gVGVjaG5vbG9naWVzMR0wGwYDVQQDDBRGZWl0aWFuIEZJRE8gUm9vdCBDQTBZMBMGByqGSM49AgEGCCqGSM49AwEHA0IABJ3wCm47zF9RMtW-pPlkEHTVTLfSYBlsidz7zOAUiuV6k36PvtKAI_-LZ8MiC9BxQUfUrfpLY6klw344lwLq7POjQjBAMB0GA1UdDgQWBBTRoZhNgX_DuWv2B2e9UBL-kEXxVDAPBgNVHRMBAf8EBTADAQH_MA4GA1UdDwEB_wQEAwIBBjAKBggqhkjOPQQDAgNIADBFAiEAt7E9ZQYxnhfsSk6c1dSmFNnJGoU3eJiycs2DoWh7-IoCIA9iWJH8h-UOAaaPK66DtCLe6GIxdpIMv3kmd1PRpWqsaGF1dGhEYXRhWOSVaQiPHs7jIylUA129ENfK45EwWidRtVm7j9fLsim91EEAAAABQjgyRUQ3M0M4RkI0RTVBMgBgsL39APyTmisrjh11vghaqNfuruLQmCfR0c1ryKtaQ81jkEhNa5u9xLTnkibvXC9YpzBLFwWEZ3k9CR_sxzm_pWYbBOtKxeZu9z2GT8b6QW4iQvRlyumCT3oENx_8401rpQECAyYgASFYIFkdweEE6mWiIAYPDoKz3881Aoa4sn8zkTm0aPKKYBvdIlggtlG32lxrang8M0tojYJ36CL1VMv2pZSzqR_NfvG88bA",
+			"clientDataJSON":    "eyJjaGFsbGVuZ2UiOiJ1Vlg4OElnUmEwU1NyTUlSVF9xN2NSY2RmZ2ZSQnhDZ25fcGtwVUFuWEpLMnpPYjMwN3dkMU9MWFEwQXVOYU10QlIzYW1rNkhZenAtX1Z4SlRQcHdHdyIsIm9yaWdpbiI6Imh0dHBzOi8vd2ViYXV0aG4ub3JnIiwidG9rZW5CaW5kaW5nIjp7InN0YXR1cyI6Im5vdC1zdXBwb3J0ZWQifSwidHlwZSI6IndlYmF1dGhuLmNyZWF0ZSJ9"
+		},
+		"type": "public-key"
+	}`
+
+	packedSelfAttestationRequest = `{
+		"id":    "H6X2BnnjgOzu_Oj87vpRnwMJeJYVzwM3wtY1lhAfQ14",
+		"rawId": "H6X2BnnjgOzu_Oj87vpRnwMJeJYVzwM3wtY1lhAfQ14",
+		"response": {
+			"attestationObject": "o2NmbXRmcGFja2VkZ2F0dFN0bXSiY2FsZzn__mNzaWdZAQCPypMLXWqtCZ1sc5QdjhH-pAzm8-adpfbemd5zsym2krscwV0EeOdTrdUOdy3hWj5HuK9dIX_OpNro2jKrHfUj_0Kp-u87iqJ3MPzs-D9zXOqkbWqcY94Zh52wrPwhGfJ8BiQp5T4Q97E042hYQRDKmtv7N-BT6dywiuFHxfm1sDbUZ_yyEIN3jgttJzjp_wvk_RJmb78bLPTlym83Y0Ws73K6FFeiqFNqLA_8a4V0I088hs_IEPlj8PWxW0wnIUhI9IcRf0GEmUwTBpbNDGpIFGOudnl_C3YuXuzK3R6pv2r7m9-9cIIeeYXD9BhSMBQ0A8oxBbVF7j-0xXDNrXHZaGF1dGhEYXRhWQFnSZYN5YgOjGh0NBcPZHZgW4_krrmihjLHmVzzuoMdl2NBAAAAOKjVmSRjt0nqud40p1PeHgEAIB-l9gZ544Ds7vzo_O76UZ8DCXiWFc8DN8LWNZYQH0NepAEDAzn__iBZAQDAIqzybPPmgeL5OR6JKq9bWDiENJlN_LePQEnf1_sgOm4FJ9kBTbOTtWplfoMXg40A7meMppiRqP72A3tmILwZ5xKIyY7V8Y2t8X1ilYJol2nCKOpAEqGLTRJjF64GQxen0uFpi1tA6l6N-ZboPxjky4aidBdUP22YZuEPCO8-9ZTha8qwvTgZwMHhZ40TUPEJGGWOnHNlYmqnfFfk0P-UOZokI0rqtqqQGMwzV2RrH2kjKTZGfyskAQnrqf9PoJkye4KUjWkWnZzhkZbrDoLyTEX2oWvTTflnR5tAVMQch4UGgEHSZ00G5SFoc19nGx_UJcqezx5cLZsny-qQYDRjIUMBAAE",
+			"clientDataJSON":    "eyJvcmlnaW4iOiJodHRwOi8vbG9jYWxob3N0OjMwMDAiLCJjaGFsbGVuZ2UiOiJBWGtYV1hQUDNnTHg4T0xscGtKM2FSUmhGV250blNFTmdnbmpEcEJxbDFuZ0tvbDd4V3dldlVZdnJwQkRQM0xFdmRyMkVPU3RPRnBHR3huTXZYay1WdyIsInR5cGUiOiJ3ZWJhdXRobi5jcmVhdGUifQ"
+		},
+		"type": "public-key"
+	}`
+
+	tpmAttestationRequest = `{
+		"rawId": "hWzdFiPbOMQ5KNBsMhs-Zeh8F0iTHrH63YKkrxJFgjQ",
+		"id":    "hWzdFiPbOMQ5KNBsMhs-Zeh8F0iTHrH63YKkrxJFgjQ",
+		"response": {
+			"attestationObject": "o2NmbXRjdHBtZ2F0dFN0bXSmY2FsZzn__mNzaWdZAQBbStZplkxX6PI8NGBy7BFJpOHCFR9EbaYGwcNryNb53FLMF5gvjJy3zrVSNkTZLApAnqQ70C4np3Hn_caYpqsyi_kKHa4nlvOj49X8jBlUR_PcIgNGMEy4aY-xTQYQfF0shA4Dc-P2J64pR8wr5xXa9wZDqH3x4JC1dAKXBM8xYox6jk_QqMIG1l9HDcbwPrWNNzRqrPVlpTZpPfM43grPh2C3pUgzV_YOtdsC763xwzBRYtI6A0uRp88FHMDcWoDFa7eh4UtFhFca-2fzEXDCw1LsZJKvTiOMpEyMl0r2QrJUQvDXm9fV5dV39QsYBZ2SCMZP44zj1s-GKlgK5InoY3ZlcmMyLjBjeDVjglkDZzCCA2MwggJLoAMCAQICAQIwDQYJKoZIhvcNAQELBQAwQTEWMBQGA1UEChMNV2ViQXV0aG4gRGVtbzEnMCUGA1UEAxMeV2ViQXV0aG4gRGVtbyBUZXN0IFRQTSBSb290IENBMB4XDTE5MTAwMTAwMDAwMFoXDTQ5MTAwMTAwMDAwMFowADCCASIwDQYJKoZIhvcNAQEBBQADggEPADCCAQoCggEBAMO1_NCIz7ivWbt7305o7X_4APfplUeo-y-iN_MRkgSPzE96jGAae3rsOLVnX3yYbsmWyuHuzktWJdWNR8TMdhcCQcRD_4yWcH-Yok-DCaBWYB3ibXwqUDR-ZmIkMZRkXh0-DeFncTWNvwYWt84X-XvMLVo7WQ1SLZKVMAY5Mz7evxgjCMfum88n-ov6wpo5rzaEOAVr-xFGWy2h7JOI3O27yoEy1r46smNr_u-yeQIzZWaXNqttepoFqaxEmqBcpVCJ2QupcUj5dUtjlDTt4jQn0Mzy70Mf0dBC4E9p2r9ftB2CGDLMFIpiKIiwpd9iWzCpgRvssh9um_2M8UD8R8kCAwEAAaOBpjCBozAWBgNVHSUEDzANBgRVHSUABgVngQUIAzAfBgNVHSMEGDAWgBSBVSrxEQ_6dRtNubrHu7qT4OnrRDAOBgNVHQ8BAf8EBAMCB4AwDAYDVR0TAQH_BAIwADBKBgNVHREBAf8EQDA-pDwwOjE4MA4GBWeBBQIDDAVpZDoxMzAQBgVngQUCAgwHTlBDVDZ4eDAUBgVngQUCAQwLaWQ6NEU1NDQzMDAwDQYJKoZIhvcNAQELBQADggEBAGQ2JqXWuiV7FJf0rIHbaiaSW8UCLNlBDw22hF1FJfM8NLbCJi0glvRtxnNo5vPB_A7qREJ3Isx6Qk64JILo9gKgftRry1hcYMZvBEWNag5swPkBnhJxo5tMKybGXDfqmTCt9__27w2YQWdAHASitW-HL-XuJXZtsnVukgerjQldnZFRxB8S0S3i5TBRcBpGJSAKjzFahimsHcQx3Qco_aJqeWrncngphfMjOj8-mnB3g0hAxNu80oH984GAvLjPbFWivhHqAVa6GA7S9rJ21LL8D4CHahu5wIstyxoShgCmQdED22Lfevndjps2-KxOdWFC2M8PELnNToiHLud9a09ZA0MwggM_MIICJ6ADAgECAgEBMA0GCSqGSIb3DQEBCwUAMEExFjAUBgNVBAoTDVdlYkF1dGhuIERlbW8xJzAlBgNVBAMTHldlYkF1dGhuIERlbW8gVGVzdCBUUE0gUm9vdCBDQTAeFw0xOTEwMDEwMDAwMDBaFw00OTEwMDEwMDAwMDBaMEExFjAUBgNVBAoTDVdlYkF1dGhuIERlbW8xJzAlBgNVBAMTHldlYkF1dGhuIERlbW8gVGVzdCBUUE0gUm9vdCBDQTCCASIwDQYJKoZIhvcNAQEBBQADggEPADCCAQoCggEBALespItFQxTSR35mWeLDc-V6K81Hg5NLD9dnkWJvo9zHoxawmHXAOuUuR24PNU8og5IoDsB_orodIimm-mDvtgyVZqmQXkh_D-msydOLxKl4wrACMNZiTBIKitVAO9h8RIDv_8T3Qb6HuX1ee_8bIbb2oStGYoxFV2dUWFrbj9zNhxQUb7spQuTtTV2NEupGmYEpqooBEunsxjFqBG-rC8rzSJ9Tl6ktFDghEM2NdyhkzV6gU5ACMp9VuhHmip_TsJKFO5yLDaH24u4OcM4K0S_oEXARBzNN75_5g4d8Q0EjXGCHgK9CJXRr6aSrPrJ7X-ipKzd5YokXfaiEJMlrCbECAwEAAaNCMEAwDgYDVR0PAQH_BAQDAgEGMA8GA1UdEwEB_wQFMAMBAf8wHQYDVR0OBBYEFIFVKvERD_p1G025use7upPg6etEMA0GCSqGSIb3DQEBCwUAA4IBAQCJaE1Ed7VJHjEBHI5xJkoufLEVOj3H6zYIqGoPjcraTSBUA2Mb2x1UjFUAChvj4KNQl3PtrX7dmacx-xuDGbJa_bnVa9HzI9lDFrmEoFs0aNuZcLwm2xjKPeUL1_FCZ4vTZKu1oaU8QLp2ItVIBEpcvCYs14Tp2ZD2blXkQELjEN8YDu7fCcyvEDLuqtivujGJ-G7gv7KSTAccOCb7WAaaUndi_BcBCpRz0r4YpNQdZfeJO1Srll7QHHkUcXvhNS98oKTnHl6ZbVwlCs8Egk-4jrItSHWP9TZtplsAA0Q_IxIpi_0YMfhUJvqnFK5hd7GMkNXrgGNMqx5rK-CR3y-xZ3B1YkFyZWFZATYAAQALAAYEcgAgnf_L82w4OuaZ-5ho3G3LidcVOIS-KAOSLBJBWL-tIq4AEAAQCAAAAAAAAQDF2m9Nk1e94gL1xVjNCjFW0lTy4K2atXkx-YJrdH3hrE8p1gcIdNzleRDhmERJnY5CRwM5sXDQIrUBq4jpwvTtMC5HGccN6-iEJAPtm9_CJzCmGhtw9hbF8bcAys94RhN9xLLUaajhWqtPrYZXCEAi0o9E2QdTIxJrcAfJgZOf33JMr0--R1BAQxpOoGRDC8ss-tfQW9ufZLWw4JUuz4Z5Jz1sbfqBYB8UUDMWoT0HgsMaPmvd7T17xGvB-pvvDf-Dt96vFGtYLEZEgho8Yu26pr5CK_BOQ-2vX9N4MIYVPXNhogMGGmKYqybhM3yhye0GdBpZBUd5iOcgME6uGJ1_aGNlcnRJbmZvWKH_VENHgBcAIgALvFn039mmpC3DuGav8t8NGYJrvwFLZ6sK1uuxdjBrgAcAFKyfPwVpxmL7CRSR8e7jGMbww9-bAAAAAbFaSMdoQPnj2POfBQGp4MSlP7vEEwAiAAtxIa6_prmv0HAy9C8JJeDsZ0CN1Zmle_oPgMfxVgEITwAiAAsBUjR5D8ABmM2-uFQQwrarjDG7AgU6ccgMXRCWOF_jtGhhdXRoRGF0YVkBZ5VpCI8ezuMjKVQDXb0Q18rjkTBaJ1G1WbuP18uyKb3URQAAAAAImHBYytxLgbbhMN5Q3L6WACCFbN0WI9s4xDko0GwyGz5l6HwXSJMesfrdgqSvEkWCNKQBAwM5AQAgWQEAxdpvTZNXveIC9cVYzQoxVtJU8uCtmrV5MfmCa3R94axPKdYHCHTc5XkQ4ZhESZ2OQkcDObFw0CK1AauI6cL07TAuRxnHDevohCQD7ZvfwicwphobcPYWxfG3AMrPeEYTfcSy1Gmo4VqrT62GVwhAItKPRNkHUyMSa3AHyYGTn99yTK9PvkdQQEMaTqBkQwvLLPrX0Fvbn2S1sOCVLs-GeSc9bG36gWAfFFAzFqE9B4LDGj5r3e09e8Rrwfqb7w3_g7ferxRrWCxGRIIaPGLtuqa-QivwTkPtr1_TeDCGFT1zYaIDBhpimKsm4TN8ocntBnQaWQVHeYjnIDBOrhidfyFDAQAB",
+			"clientDataJSON":    "ew0KCSJ0eXBlIiA6ICJ3ZWJhdXRobi5jcmVhdGUiLA0KCSJjaGFsbGVuZ2UiIDogIndrNkxxRVhBTUFacHFjVFlsWTJ5b3I1RGppeUlfYjFneTluRE90Q0IxeUdZbm1fNFdHNFVrMjRGQXI3QXhUT0ZmUU1laWdrUnhPVExaTnJMeEN2Vl9RIiwNCgkib3JpZ2luIiA6ICJodHRwczovL3dlYmF1dGhuLm9yZyIsDQoJInRva2VuQmluZGluZyIgOiANCgl7DQoJCSJzdGF0dXMiIDogInN1cHBvcnRlZCINCgl9DQp9"
+		},
+		"type": "public-key"
+	}`
+
+	attestationPolicyErrorResponseAttestationType = `{
+		"status": "failed",
+		"errorMessage": "Attestation is rejected by policy: attestation type Self is not acceptable"
+	}`
+
+	attestationPolicyErrorResponseUntrustedRoot = `{
+		"status": "failed",
+		"errorMessage": "Attestation is rejected by policy: attestation trust path doesn't chain to a trust anchor: x509: certificate signed by unknown authority"
+	}`
+
+	attestationPolicyErrorResponseAttCAType = `{
+		"status": "failed",
+		"errorMessage": "Attestation is rejected by policy: attestation type AttCA is not acceptable"
+	}`
+)
+
+// attestationFixture has data needed to create a session for an attestation fixture.
+type attestationFixture struct {
+	origin       string
+	rpID         string
+	challenge    string
+	alg          int
+	rawID        string
+	userVerified bool // authenticator data has UV flag set
+}
+
+var (
+	fidoU2FAttestation = attestationFixture{
+		origin:    "https://localhost:8443",
+		rpID:      "localhost",
+		challenge: "Vu8uDqnkwOjd83KLj6Scn2BgFNLFbGR7Kq_XJJwQnnatztUR7XIBL7K8uMPCIaQmKw1MCVQ5aazNJFk7NakgqA",
+		alg:       webauthn.COSEAlgES256,
+		rawID:     "Bo-VjHOkJZy8DjnCJnIc0Oxt9QAz5upMdSJxNbd-GyAo6MNIvPBb9YsUlE0ZJaaWXtWH5FQyPS6bT_e698IirQ",
+	}
+
+	packedBasicAttestation = attestationFixture{
+		origin:    "https://webauthn.org",
+		rpID:      "webauthn.org",
+		challenge: "uVX88IgRa0SSrMIRT_q7cRcdfgfRBxCgn_pkpUAnXJK2zOb307wd1OLXQ0AuNaMtBR3amk6HYzp-_VxJTPpwGw",
+		alg:       webauthn.COSEAlgES256,
+		rawID:     "sL39APyTmisrjh11vghaqNfuruLQmCfR0c1ryKtaQ81jkEhNa5u9xLTnkibvXC9YpzBLFwWEZ3k9CR_sxzm_pWYbBOtKxeZu9z2GT8b6QW4iQvRlyumCT3oENx_8401r",
+	}
+
+	packedSelfAttestation = attestationFixture{
+		origin:    "http://localhost:3000",
+		rpID:      "localhost",
+		challenge: "AXkXWXPP3gLx8OLlpkJ3aRRhFWntnSENggnjDpBql1ngKol7xWwevUYvrpBDP3LEvdr2EOStOFpGGxnMvXk-Vw",
+		alg:       webauthn.COSEAlgRS1,
+		rawID:     "H6X2BnnjgOzu_Oj87vpRnwMJeJYVzwM3wtY1lhAfQ14",
+	}
+
+	tpmAttestation = attestationFixture{
+		origin:       "https://webauthn.org",
+		rpID:         "webauthn.org",
+		challenge:    "wk6LqEXAMAZpqcTYlY2yor5DjiyI_b1gy9nDOtCB1yGYnm_4WG4Uk24FAr7AxTOFfQMeigkRxOTLZNrLxCvV_Q",
+		alg:          webauthn.COSEAlgRS256,
+		rawID:        "hWzdFiPbOMQ5KNBsMhs-Zeh8F0iTHrH63YKkrxJFgjQ",
+		userVerified: true,
+	}
+
+	trustedRootsPolicy = &attestationPolicyConfig{
+		AttestationTypes: []string{"Basic", "AttCA"},
+		TrustAnchorDir:   "testdata/attestation_roots",
+	}
+
+	tpmTrustedRootsPolicy = &attestationPolicyConfig{
+		AttestationTypes: []string{"Basic", "AttCA"},
+		TrustAnchorDir:   "testdata/tpm_attestation_roots",
+	}
+
+	attestationPolicyTests = handlerTest{
+		requestMethod:     "POST",
+		requestURL:        "/attestation/result",
+		equalResponseBody: equalServerResponse,
+		testcases: []handlerTestData{
+			{
+				name:                 "fido-u2f attestation without policy",
+				server:               getMockServerWithAttestationPolicy(fidoU2FAttestation.origin, nil),
+				initMockDataStore:    initDataStoreAddAnyUserCredential,
+				initMockSessionStore: initSessionStore(getAttestationFixtureSession(fidoU2FAttestation), getAttestationFixtureUserSession(fidoU2FAttestation)),
+				requestBody:          fidoU2FAttestationRequest,
+				wantStatusCode:       http.StatusOK,
+				wantResponseBody:     attestationResultSuccessResponse,
+			},
+			{
+				name:                 "fido-u2f attestation without trusted root",
+				server:               getMockServerWithAttestationPolicy(fidoU2FAttestation.origin, trustedRootsPolicy),
+				initMockDataStore:    initDataStoreAddUserCredentialNotCalled,
+				initMockSessionStore: initSessionStore(getAttestationFixtureSession(fidoU2FAttestation), getEmptySession),
+				requestBody:          fidoU2FAttestationRequest,
+				wantStatusCode:       http.StatusBadRequest,
+				wantResponseBody:     attestationPolicyErrorResponseUntrustedRoot,
+			},
+			{
+				name:                 "packed basic attestation with trusted root",
+				server:               getMockServerWithAttestationPolicy(packedBasicAttestation.origin, trustedRootsPolicy),
+				initMockDataStore:    initDataStoreAddAnyUserCredential,
+				initMockSessionStore: initSessionStore(getAttestationFixtureSession(packedBasicAttestation), getAttestationFixtureUserSession(packedBasicAttestation)),
+				requestBody:          packedBasicAttestationRequest,
+				wantStatusCode:       http.StatusOK,
+				wantResponseBody:     attestationResultSuccessResponse,
+			},
+			{
+				name:                 "packed self attestation is acceptable",
+				server:               getMockServerWithAttestationPolicy(packedSelfAttestation.origin, &attestationPolicyConfig{AttestationTypes: []string{"Self"}}),
+				initMockDataStore:    initDataStoreAddAnyUserCredential,
+				initMockSessionStore: initSessionStore(getAttestationFixtureSession(packedSelfAttestation), getAttestationFixtureUserSession(packedSelfAttestation)),
+				requestBody:          packedSelfAttestationRequest,
+				wantStatusCode:       http.StatusOK,
+				wantResponseBody:     attestationResultSuccessResponse,
+			},
+			{
+				name:                 "packed self attestation isn't acceptable",
+				server:               getMockServerWithAttestationPolicy(packedSelfAttestation.origin, trustedRootsPolicy),
+				initMockDataStore:    initDataStoreAddUserCredentialNotCalled,
+				initMockSessionStore: initSessionStore(getAttestationFixtureSession(packedSelfAttestation), getEmptySession),
+				requestBody:          packedSelfAttestationRequest,
+				wantStatusCode:       http.StatusBadRequest,
+				wantResponseBody:     attestationPolicyErrorResponseAttestationType,
+			},
+			{
+				name:                 "tpm attestation with trusted root",
+				server:               getMockServerWithAttestationPolicy(tpmAttestation.origin, tpmTrustedRootsPolicy),
+				initMockDataStore:    initDataStoreAddAnyUserCredential,
+				initMockSessionStore: initSessionStore(getAttestationFixtureSession(tpmAttestation), getAttestationFixtureUserSession(tpmAttestation)),
+				requestBody:          tpmAttestationRequest,
+				wantStatusCode:       http.StatusOK,
+				wantResponseBody:     attestationResultSuccessResponse,
+			},
+			{
+				name:                 "tpm attestation without trusted root",
+				server:               getMockServerWithAttestationPolicy(tpmAttestation.origin, trustedRootsPolicy),
+				initMockDataStore:    initDataStoreAddUserCredentialNotCalled,
+				initMockSessionStore: initSessionStore(getAttestationFixtureSession(tpmAttestation), getEmptySession),
+				requestBody:          tpmAttestationRequest,
+				wantStatusCode:       http.StatusBadRequest,
+				wantResponseBody:     attestationPolicyErrorResponseUntrustedRoot,
+			},
+			{
+				name:                 "tpm attestation type isn't acceptable",
+				server:               getMockServerWithAttestationPolicy(tpmAttestation.origin, &attestationPolicyConfig{AttestationTypes: []string{"Basic"}, TrustAnchorDir: "testdata/tpm_attestation_roots"}),
+				initMockDataStore:    initDataStoreAddUserCredentialNotCalled,
+				initMockSessionStore: initSessionStore(getAttestationFixtureSession(tpmAttestation), getEmptySession),
+				requestBody:          tpmAttestationRequest,
+				wantStatusCode:       http.StatusBadRequest,
+				wantResponseBody:     attestationPolicyErrorResponseAttCAType,
+			},
+		},
+	}
+)
+
+func getMockServerWithAttestationPolicy(origin string, c *attestationPolicyConfig) *Server {
+	policy, err := newAttestationPolicy(c)
+	if err != nil {
+		panic(err)
+	}
+	return &Server{
+		webAuthnConfig:    getWebAuthnConfig(),
+		attestationPolicy: policy,
+		dataStore:         newMockDataStore(),
+		sessionStore:      &MockSessionStore{},
+		challengeStore:    &MockChallengeStore{},
+		tracer:            noop.Tracer{},
+		router:            mux.NewRouter(),
+		rpOrigin:          origin,
+	}
+}
+
+func getAttestationFixtureSession(f attestationFixture) getSessionFunc {
+	return func(store sessions.Store) *sessions.Session {
+		session := sessions.NewSession(store, sessionNameLoginSession)
+		mockNewUserCopy := *mockNewUser
+		session.Values[sessionMapKeyUserSession] = &userSession{User: &mockNewUserCopy}
+		session.Values[sessionMapKeyWebAuthnCreationOptions] = &webauthn.PublicKeyCredentialCreationOptions{
+			RP: webauthn.PublicKeyCredentialRpEntity{
+				Name: "WebAuthn local server",
+				ID:   f.rpID,
+			},
+			User: webauthn.PublicKeyCredentialUserEntity{
+				Name:        mockNewUserCopy.UserName,
+				ID:          mockNewUserCopy.UserID,
+				DisplayName: mockNewUserCopy.DisplayName,
+			},
+			Challenge: base64RawURLDecodeString(f.challenge),
+			PubKeyCredParams: []webauthn.PublicKeyCredentialParameters{
+				{Type: webauthn.PublicKeyCredentialTypePublicKey, Alg: f.alg},
+			},
+			Timeout: uint64(10000),
+			AuthenticatorSelection: webauthn.AuthenticatorSelectionCriteria{
+				AuthenticatorAttachment: webauthn.AuthenticatorCrossPlatform,
+				ResidentKey:             webauthn.ResidentKeyPreferred,
+				UserVerification:        webauthn.UserVerificationPreferred,
+			},
+			Attestation: webauthn.AttestationDirect,
+		}
+		return session
+	}
+}
+
+func getAttestationFixtureUserSession(f attestationFixture) getSessionFunc {
+	return func(store sessions.Store) *sessions.Session {
+		session := sessions.NewSession(store, sessionNameLoginSession)
+		mockNewUserCopy := *mockNewUser
+		rawID := base64RawURLDecodeString(strings.TrimRight(f.rawID, "="))
+		mockNewUserCopy.CredentialIDs = [][]byte{rawID}
+		session.Values[sessionMapKeyUserSession] = &userSession{
+			User:                 &mockNewUserCopy,
+			LoggedInCredentialID: rawID,
+			UserVerified:         f.userVerified,
+		}
+		return session
+	}
+}
+
+func initDataStoreAddAnyUserCredential(mockDataStore *MockDataStore) {
+	mockDataStore.On("AddUserCredential", mock.Anything, mockNewUser, mock.Anything).Return(nil).Once()
+	mockDataStore.On("ReplaceRecoveryCodes", mock.Anything, mockNewUser.UserID, mock.Anything).Return(nil).Once()
+}
@@ -0,0 +1,285 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Supported AUDIT_LOG values.
+const (
+	auditLogDatabase = "database"
+	auditLogFile     = "file"
+	auditLogMemory   = "memory"
+)
+
+// Audit event types.
+const (
+	auditEventRegistrationOptions = "registration_options"
+	auditEventRegistration        = "registration"
+	auditEventLoginOptions        = "login_options"
+	auditEventLogin               = "login"
+	auditEventLogout              = "logout"
+	auditEventCredentialRename    = "credential_rename"
+	auditEventCredentialDelete    = "credential_delete"
+	auditEventRecoveryLogin       = "recovery_login"
+	auditEventRecoveryCodesRegen  = "recovery_codes_regenerate"
+
+	auditEventAdminCredentialDisable = "admin_credential_disable"
+	auditEventAdminCredentialDelete  = "admin_credential_delete"
+	auditEventAdminUserDelete        = "admin_user_delete"
+	auditEventAdminSessionsRevoke    = "admin_sessions_revoke"
+	auditEventAdminUnlock            = "admin_unlock"
+)
+
+// Audit event outcomes.
+const (
+	auditOutcomeSuccess = "success"
+	auditOutcomeFailure = "failure"
+)
+
+// auditEvent records a registration, login, logout, or credential change attempt.
+type auditEvent struct {
+	UserID        []byte    `json:"userID,omitempty"`       // nil if user is unknown
+	CredentialID  []byte    `json:"credentialID,omitempty"` // nil if credential is unknown
+	ActorUserID   []byte    `json:"actorUserID,omitempty"`  // administrator making the change, nil if event isn't an admin action
+	Type          string    `json:"type"`
+	Outcome       string    `json:"outcome"`
+	FailureReason string    `json:"failureReason,omitempty"`
+	ClientIP      string    `json:"clientIP"`
+	UserAgent     string    `json:"userAgent"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// auditLog records audit events and queries them by user.
+type auditLog interface {
+	record(ctx context.Context, e *auditEvent) error
+	// getEvents returns user's most recent events, newest first.
+	getEvents(ctx context.Context, userID []byte, limit int) ([]*auditEvent, error)
+}
+
+// newAuditLog returns auditLog selected by config.  Database audit log keeps events in the same database as DataStore.
+func newAuditLog(c *Config, dataStore DataStore) (auditLog, error) {
+	switch c.AuditLog {
+	case auditLogDatabase:
+		db, ok := dataStore.(*dbStore)
+		if !ok {
+			return nil, errors.New("database audit log requires " + dbDriverPostgres + " or " + dbDriverSQLite + " data store")
+		}
+		return &sqlAuditLog{db: db.DB}, nil
+	case auditLogFile:
+		return newFileAuditLog(c.AuditLogFile)
+	case auditLogMemory:
+		return newMemAuditLog(), nil
+	}
+	return nil, errors.New("unsupported audit log \"" + c.AuditLog + "\"")
+}
+
+// auditWriter hijacks ResponseWriter to record an audit event with response outcome when handler returns.
+// Failure reason is set by writeFailedServerResponse.
+type auditWriter struct {
+	http.ResponseWriter
+	server *Server
+	r      *http.Request
+	event  *auditEvent
+	status int
+}
+
+// startAudit returns auditWriter for request.  Handler must call record when it returns.
+func (s *Server) startAudit(w http.ResponseWriter, r *http.Request, eventType string) *auditWriter {
+	return &auditWriter{
+		ResponseWriter: w,
+		server:         s,
+		r:              r,
+		event: &auditEvent{
+			Type:      eventType,
+			ClientIP:  clientIP(r),
+			UserAgent: r.UserAgent(),
+		},
+	}
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// record records audit event with user and credential set by handler.
+func (w *auditWriter) record() {
+	setRequestLogUserID(w.r.Context(), w.event.UserID)
+	if w.server.auditLog == nil {
+		return
+	}
+	e := w.event
+	e.Outcome = auditOutcomeSuccess
+	if w.status >= http.StatusBadRequest {
+		e.Outcome = auditOutcomeFailure
+	}
+	e.CreatedAt = time.Now()
+	// Event is recorded even if client disconnected and canceled request context, because failed attempts
+	// are often from clients that don't wait for response.
+	if err := w.server.auditLog.record(context.WithoutCancel(w.r.Context()), e); err != nil {
+		w.server.logger.ErrorContext(w.r.Context(), "Failed to record audit event", "type", e.Type, "error", err)
+	}
+}
+
+// sqlAuditLog is an auditLog using audit_events table in PostgreSQL or SQLite.
+type sqlAuditLog struct {
+	db *sql.DB
+}
+
+func (l *sqlAuditLog) record(ctx context.Context, e *auditEvent) error {
+	query := "INSERT INTO audit_events (user_id, credential_id, actor_user_id, event_type, outcome, failure_reason, client_ip, user_agent, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+	_, err := l.db.ExecContext(ctx, query, e.UserID, e.CredentialID, e.ActorUserID, e.Type, e.Outcome, e.FailureReason, e.ClientIP, e.UserAgent, e.CreatedAt.UTC())
+	return err
+}
+
+func (l *sqlAuditLog) getEvents(ctx context.Context, userID []byte, limit int) ([]*auditEvent, error) {
+	query := "SELECT credential_id, actor_user_id, event_type, outcome, failure_reason, client_ip, user_agent, created_at FROM audit_events WHERE user_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2"
+	rows, err := l.db.QueryContext(ctx, query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*auditEvent
+	for rows.Next() {
+		e := &auditEvent{UserID: userID}
+		if err := rows.Scan(&e.CredentialID, &e.ActorUserID, &e.Type, &e.Outcome, &e.FailureReason, &e.ClientIP, &e.UserAgent, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// fileAuditLog is an auditLog appending JSON encoded events to a file, one event per line.
+type fileAuditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func newFileAuditLog(path string) (*fileAuditLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.New("failed to open audit log file: " + err.Error())
+	}
+	return &fileAuditLog{path: path, file: f}, nil
+}
+
+func (l *fileAuditLog) record(ctx context.Context, e *auditEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err = l.file.Write(append(b, '\n'))
+	return err
+}
+
+// getEvents reads the whole file, so it is only suitable for small audit logs.
+func (l *fileAuditLog) getEvents(ctx context.Context, userID []byte, limit int) ([]*auditEvent, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []*auditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, errors.New("failed to decode audit event: " + err.Error())
+		}
+		if bytes.Equal(e.UserID, userID) {
+			events = append(events, &e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return newestAuditEvents(events, limit), nil
+}
+
+func (l *fileAuditLog) close() error {
+	return l.file.Close()
+}
+
+// maxMemAuditEvents is the number of most recent events kept by memAuditLog.  Events of unauthenticated
+// requests, such as login options, are recorded too, so memory audit log must be bounded.
+const maxMemAuditEvents = 10000
+
+// memAuditLog is a concurrency-safe in-memory auditLog keeping the most recent maxEvents events.
+type memAuditLog struct {
+	mu        sync.RWMutex
+	events    []*auditEvent // ring buffer in recorded order starting at next once it is full
+	next      int           // index of the oldest event once events is full
+	maxEvents int
+}
+
+func newMemAuditLog() *memAuditLog {
+	return &memAuditLog{maxEvents: maxMemAuditEvents}
+}
+
+// record appends event, replacing the oldest event if log is full.
+func (l *memAuditLog) record(ctx context.Context, e *auditEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e2 := *e
+	if len(l.events) < l.maxEvents {
+		l.events = append(l.events, &e2)
+		return nil
+	}
+	l.events[l.next] = &e2
+	l.next = (l.next + 1) % l.maxEvents
+	return nil
+}
+
+func (l *memAuditLog) getEvents(ctx context.Context, userID []byte, limit int) ([]*auditEvent, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var events []*auditEvent
+	for i := range l.events {
+		e := l.events[(l.next+i)%len(l.events)]
+		if bytes.Equal(e.UserID, userID) {
+			e2 := *e
+			events = append(events, &e2)
+		}
+	}
+	return newestAuditEvents(events, limit), nil
+}
+
+// newestAuditEvents returns at most limit events from events in recorded order, newest first.
+func newestAuditEvents(events []*auditEvent, limit int) []*auditEvent {
+	var newest []*auditEvent
+	for i := len(events) - 1; i >= 0 && len(newest) < limit; i-- {
+		newest = append(newest, events[i])
+	}
+	return newest
+}
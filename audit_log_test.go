@@ -0,0 +1,256 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAuditLog(t *testing.T) {
+	sqliteStore, err := newSQLiteStore(filepath.Join(t.TempDir(), "webauthn.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqliteStore.Close()
+
+	testCases := []struct {
+		name      string
+		config    *Config
+		dataStore DataStore
+	}{
+		{"memory", &Config{AuditLog: auditLogMemory}, nil},
+		{"file", &Config{AuditLog: auditLogFile, AuditLogFile: filepath.Join(t.TempDir(), "audit.log")}, nil},
+		{"database", &Config{AuditLog: auditLogDatabase}, sqliteStore},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			l, err := newAuditLog(tc.config, tc.dataStore)
+			if err != nil {
+				t.Fatalf("newAuditLog() returns error %q", err)
+			}
+			if fileAuditLog, ok := l.(*fileAuditLog); ok {
+				defer fileAuditLog.close()
+			}
+
+			createdAt := time.Date(2009, time.January, 1, 1, 0, 0, 0, time.UTC)
+			events := []*auditEvent{
+				{UserID: user1.UserID, CredentialID: credential1.CredentialID, Type: auditEventRegistration, Outcome: auditOutcomeSuccess, ClientIP: "192.0.2.1", UserAgent: "Mozilla/5.0", CreatedAt: createdAt},
+				{UserID: user2.UserID, CredentialID: credential2.CredentialID, Type: auditEventRegistration, Outcome: auditOutcomeSuccess, ClientIP: "192.0.2.2", UserAgent: "Mozilla/5.0", CreatedAt: createdAt.Add(time.Minute)},
+				{UserID: user1.UserID, CredentialID: credential1.CredentialID, Type: auditEventLogin, Outcome: auditOutcomeFailure, FailureReason: "Challenge expired", ClientIP: "192.0.2.1", UserAgent: "Mozilla/5.0", CreatedAt: createdAt.Add(2 * time.Minute)},
+				{UserID: user1.UserID, Type: auditEventLogout, Outcome: auditOutcomeSuccess, ClientIP: "192.0.2.1", UserAgent: "Mozilla/5.0", CreatedAt: createdAt.Add(3 * time.Minute)},
+				{Type: auditEventLoginOptions, Outcome: auditOutcomeFailure, FailureReason: "Missing username", ClientIP: "192.0.2.3", CreatedAt: createdAt.Add(4 * time.Minute)},
+				{UserID: user1.UserID, CredentialID: credential1.CredentialID, ActorUserID: user2.UserID, Type: auditEventAdminCredentialDisable, Outcome: auditOutcomeSuccess, ClientIP: "192.0.2.2", UserAgent: "Mozilla/5.0", CreatedAt: createdAt.Add(5 * time.Minute)},
+			}
+			for _, e := range events {
+				if err := l.record(ctx, e); err != nil {
+					t.Fatalf("record(%+v) returns error %q", e, err)
+				}
+			}
+
+			gotEvents, err := l.getEvents(ctx, user1.UserID, 2)
+			if err != nil {
+				t.Fatalf("getEvents() returns error %q", err)
+			}
+			wantEvents := []*auditEvent{events[5], events[3]}
+			if len(gotEvents) != len(wantEvents) {
+				t.Fatalf("getEvents() returns %d events, want %d", len(gotEvents), len(wantEvents))
+			}
+			for i, e := range gotEvents {
+				e.CreatedAt = e.CreatedAt.UTC()
+				if !reflect.DeepEqual(e, wantEvents[i]) {
+					t.Errorf("getEvents() returns event %+v, want %+v", e, wantEvents[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAuditLogError(t *testing.T) {
+	wantErrorMsg := "database audit log requires postgres or sqlite data store"
+	if _, err := newAuditLog(&Config{AuditLog: auditLogDatabase}, newMemStore()); err == nil || err.Error() != wantErrorMsg {
+		t.Errorf("newAuditLog() returns error %v, want %q", err, wantErrorMsg)
+	}
+}
+
+func TestHandlerAuditEvents(t *testing.T) {
+	testCases := []struct {
+		name              string
+		requestMethod     string
+		requestURL        string
+		requestBody       string
+		getSession        getSessionFunc
+		saveSession       getSessionFunc
+		wantEvent         *auditEvent
+		initMockDataStore initMockDataStoreFunc
+	}{
+		{
+			name:          "logout",
+			requestMethod: "GET",
+			requestURL:    "/logout",
+			getSession:    getUserSession,
+			saveSession:   getEmptySession,
+			wantEvent: &auditEvent{
+				UserID:       mockExistingUser.UserID,
+				CredentialID: mockCredential.CredentialID,
+				Type:         auditEventLogout,
+				Outcome:      auditOutcomeSuccess,
+				ClientIP:     "192.0.2.1",
+				UserAgent:    "Mozilla/5.0",
+			},
+		},
+		{
+			name:          "login options without username",
+			requestMethod: "POST",
+			requestURL:    "/assertion/options",
+			requestBody:   assertionOptionsRequestMissingUserName,
+			getSession:    getEmptySession,
+			saveSession:   getEmptySession,
+			wantEvent: &auditEvent{
+				Type:          auditEventLoginOptions,
+				Outcome:       auditOutcomeFailure,
+				FailureReason: "Missing username",
+				ClientIP:      "192.0.2.1",
+				UserAgent:     "Mozilla/5.0",
+			},
+		},
+		{
+			name:              "login with wrong challenge",
+			requestMethod:     "POST",
+			requestURL:        "/assertion/result",
+			requestBody:       assertionResultRequest,
+			getSession:        getAssertionOptionsExistingUserWrongChallengeSession,
+			saveSession:       getAssertionOptionsExistingUserWrongChallengeSession,
+			initMockDataStore: initDataStoreGetAndUpdateCredential,
+			wantEvent: &auditEvent{
+				UserID:        mockExistingUser.UserID,
+				CredentialID:  mockCredential.CredentialID,
+				Type:          auditEventLogin,
+				Outcome:       auditOutcomeFailure,
+				FailureReason: "Failed to verify assertion: webauthn/assertion: failed to verify client data challenge: client data challenge does not match expected challenge",
+				ClientIP:      "192.0.2.1",
+				UserAgent:     "Mozilla/5.0",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			auditLog := newMemAuditLog()
+			s := getMockServer()
+			s.auditLog = auditLog
+			if tc.initMockDataStore != nil {
+				tc.initMockDataStore(s.dataStore.(*MockDataStore))
+			}
+			initSessionStore(tc.getSession, tc.saveSession)(s.sessionStore.(*MockSessionStore))
+			initChallengeStore(s.challengeStore.(*MockChallengeStore))
+			s.router = mux.NewRouter()
+			s.routes()
+
+			r := httptest.NewRequest(tc.requestMethod, tc.requestURL, strings.NewReader(tc.requestBody))
+			r.Header.Set("User-Agent", "Mozilla/5.0")
+			s.router.ServeHTTP(httptest.NewRecorder(), r)
+
+			if len(auditLog.events) != 1 {
+				t.Fatalf("%s records %d audit events, want 1", tc.requestURL, len(auditLog.events))
+			}
+			e := auditLog.events[0]
+			if e.CreatedAt.IsZero() {
+				t.Errorf("%s records audit event without timestamp", tc.requestURL)
+			}
+			e.CreatedAt = time.Time{}
+			if !reflect.DeepEqual(e, tc.wantEvent) {
+				t.Errorf("%s records audit event %+v, want %+v", tc.requestURL, e, tc.wantEvent)
+			}
+		})
+	}
+}
+
+func TestAuditWriterStatus(t *testing.T) {
+	s := &Server{auditLog: newMemAuditLog()}
+	r := httptest.NewRequest("GET", "/", nil)
+
+	aw := s.startAudit(httptest.NewRecorder(), r, auditEventLogin)
+	writeOKServerResponse(aw)
+	aw.record()
+
+	aw = s.startAudit(httptest.NewRecorder(), r, auditEventLogin)
+	writeFailedServerResponse(aw, http.StatusBadRequest, "Missing username")
+	aw.record()
+
+	events := s.auditLog.(*memAuditLog).events
+	if events[0].Outcome != auditOutcomeSuccess || events[0].FailureReason != "" {
+		t.Errorf("OK response records audit event %+v, want success outcome", events[0])
+	}
+	if events[1].Outcome != auditOutcomeFailure || events[1].FailureReason != "Missing username" {
+		t.Errorf("failed response records audit event %+v, want failure outcome with reason", events[1])
+	}
+}
+
+func TestMemAuditLogLimit(t *testing.T) {
+	ctx := context.Background()
+	l := newMemAuditLog()
+	l.maxEvents = 3
+
+	createdAt := time.Date(2009, time.January, 1, 1, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		e := &auditEvent{UserID: user1.UserID, Type: auditEventLogin, Outcome: auditOutcomeSuccess, CreatedAt: createdAt.Add(time.Duration(i) * time.Minute)}
+		if err := l.record(ctx, e); err != nil {
+			t.Fatalf("record(%+v) returns error %q", e, err)
+		}
+	}
+	if len(l.events) != l.maxEvents {
+		t.Errorf("memAuditLog keeps %d events, want %d", len(l.events), l.maxEvents)
+	}
+
+	// The oldest events are replaced, and the rest are returned newest first.
+	events, err := l.getEvents(ctx, user1.UserID, 10)
+	if err != nil {
+		t.Fatalf("getEvents() returns error %q", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("getEvents() returns %d events, want 3", len(events))
+	}
+	for i, e := range events {
+		if want := createdAt.Add(time.Duration(4-i) * time.Minute); !e.CreatedAt.Equal(want) {
+			t.Errorf("getEvents() returns event %d created at %v, want %v", i, e.CreatedAt, want)
+		}
+	}
+}
+
+func TestAuditWriterCanceledRequest(t *testing.T) {
+	sqliteStore, err := newSQLiteStore(filepath.Join(t.TempDir(), "webauthn.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqliteStore.Close()
+	s := &Server{auditLog: &sqlAuditLog{db: sqliteStore.DB}, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	// Client disconnects before handler returns.
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("POST", "/assertion/result", nil).WithContext(ctx)
+	aw := s.startAudit(httptest.NewRecorder(), r, auditEventLogin)
+	aw.event.UserID = user1.UserID
+	cancel()
+	writeFailedServerResponse(aw, http.StatusBadRequest, "Failed to verify assertion")
+	aw.record()
+
+	events, err := s.auditLog.getEvents(context.Background(), user1.UserID, 1)
+	if err != nil {
+		t.Fatalf("getEvents() returns error %q", err)
+	}
+	if len(events) != 1 || events[0].Outcome != auditOutcomeFailure {
+		t.Errorf("canceled request records audit events %+v, want failed login event", events)
+	}
+}
@@ -1,18 +1,20 @@
 // Copyright (c) 2019 Faye Amacker. All rights reserved.
 // Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
 
-package main
+package webauthndemo
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/fxamacker/webauthn"
 	"github.com/gorilla/sessions"
 )
 
-func (s *server) handleAssertionOptions() http.HandlerFunc {
+func (s *Server) handleAssertionOptions() http.HandlerFunc {
 	type request struct {
 		Username         string                               `json:"username"`
 		UserVerification webauthn.UserVerificationRequirement `json:"userVerification"`
@@ -22,6 +24,10 @@ func (s *server) handleAssertionOptions() http.HandlerFunc {
 		*webauthn.PublicKeyCredentialRequestOptions
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
+		aw := s.startAudit(w, r, auditEventLoginOptions)
+		defer aw.record()
+		w = aw
+
 		session, ok := r.Context().Value(contextKeyLoginSession).(*sessions.Session)
 		if !ok {
 			panic("Failed to get session data from context")
@@ -33,36 +39,63 @@ func (s *server) handleAssertionOptions() http.HandlerFunc {
 			writeFailedServerResponse(w, http.StatusBadRequest, "Failed to json decode request body: "+err.Error())
 			return
 		}
-		if optionsRequest.Username == "" {
+		if optionsRequest.Username == "" && !s.usernamelessLogin {
 			writeFailedServerResponse(w, http.StatusBadRequest, "Missing username")
 			return
 		}
+		if optionsRequest.Username != "" && !s.allowUsername(w, r, optionsRequest.Username) {
+			return
+		}
 		if optionsRequest.UserVerification == "" {
 			optionsRequest.UserVerification = webauthn.UserVerificationPreferred
 		}
 
-		// Get user from datastore.
-		u, err := s.dataStore.getUser(r.Context(), optionsRequest.Username)
-		if err != nil && err != errNoRecords {
-			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to query user in database: "+err.Error())
-			return
-		}
-		if u == nil || u.UserID == nil {
-			writeFailedServerResponse(w, http.StatusBadRequest, optionsRequest.Username+" is not registered")
-			return
+		// Get user from datastore.  User is unknown for usernameless login until assertion is verified.
+		var u *User
+		if optionsRequest.Username != "" {
+			var err error
+			u, err = s.dataStore.GetUser(r.Context(), optionsRequest.Username)
+			if err != nil && err != ErrNoRecords {
+				writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to query user in database: "+err.Error())
+				return
+			}
+			if (u == nil || u.UserID == nil) && s.fakeUsers != nil {
+				// Unknown user gets the same response as registered user, and assertion verification fails later.
+				u = s.fakeUsers.get(optionsRequest.Username)
+			} else if u == nil || u.UserID == nil {
+				writeFailedServerResponse(w, http.StatusBadRequest, optionsRequest.Username+" is not registered")
+				return
+			} else {
+				aw.event.UserID = u.UserID
+			}
 		}
 
 		// Generate PublicKeyCredentialRequestOptions from WebAuthn config and user input.
-		requestOptions, err := webauthn.NewAssertionOptions(s.webAuthnConfig, &webauthn.User{ID: u.UserID, Name: u.UserName, DisplayName: u.DisplayName, CredentialIDs: u.CredentialIDs})
+		// Usernameless login options don't have allowCredentials, so authenticator can choose a discoverable credential.
+		webAuthnUser := &webauthn.User{}
+		if u != nil {
+			webAuthnUser = &webauthn.User{ID: u.UserID, Name: u.UserName, DisplayName: u.DisplayName, CredentialIDs: u.CredentialIDs}
+		}
+		requestOptions, err := webauthn.NewAssertionOptions(s.webAuthnConfig, webAuthnUser)
 		if err != nil {
 			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to generate PublicKeyCredentialRequestOptions: "+err.Error())
 			return
 		}
 		requestOptions.UserVerification = optionsRequest.UserVerification
 
+		// Register challenge so that it can only be used once before it expires.
+		if err = s.challengeStore.add(r.Context(), requestOptions.Challenge, challengeTTL(requestOptions.Timeout)); err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to save challenge: "+err.Error())
+			return
+		}
+
 		// Save requestOptions and user info in session to verify credential later.
 		session.Values[sessionMapKeyWebAuthnRequestOptions] = requestOptions
-		session.Values[sessionMapKeyUserSession] = &userSession{User: u}
+		if u != nil {
+			session.Values[sessionMapKeyUserSession] = &userSession{User: u}
+		} else {
+			delete(session.Values, sessionMapKeyUserSession)
+		}
 
 		// Write response.
 		getOptionsResponse := response{
@@ -79,7 +112,11 @@ func (s *server) handleAssertionOptions() http.HandlerFunc {
 	}
 }
 
-func (s *server) handleAssertionResult(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleAssertionResult(w http.ResponseWriter, r *http.Request) {
+	aw := s.startAudit(w, r, auditEventLogin)
+	defer aw.record()
+	w = aw
+
 	// Get saved requestOptions and user info.
 	session, ok := r.Context().Value(contextKeyLoginSession).(*sessions.Session)
 	if !ok {
@@ -92,25 +129,96 @@ func (s *server) handleAssertionResult(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	uSession, ok := session.Values[sessionMapKeyUserSession].(*userSession)
-	if !ok {
+	if !ok && (!s.usernamelessLogin || len(savedRequestOptions.AllowCredentials) > 0) {
 		delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
 		writeFailedServerResponse(w, http.StatusUnauthorized, "Session doesn't have user data")
 		return
 	}
+	if uSession != nil {
+		aw.event.UserID = uSession.User.UserID
+		if !s.checkLockout(w, r, uSession.User.UserName) {
+			delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
+			return
+		}
+	}
 
 	// Parse credential.
-	credentialAssertion, err := webauthn.ParseAssertion(r.Body)
+	credentialAssertion, err := s.parseAssertion(r.Context(), r.Body)
 	if err != nil {
 		delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
 		writeFailedServerResponse(w, http.StatusBadRequest, "Failed to parse assertion: "+err.Error())
 		return
 	}
-
-	// Get credential from datastore by received credential ID.
-	c, err := s.dataStore.getCredential(r.Context(), uSession.User.UserID, credentialAssertion.RawID)
-	if err != nil {
+	aw.event.CredentialID = credentialAssertion.RawID
+	if err = s.challengeStore.consume(r.Context(), savedRequestOptions.Challenge); err == errChallengeExpired {
+		delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
+		writeFailedServerResponse(w, http.StatusBadRequest, "Challenge expired")
+		return
+	} else if err == errChallengeUsed {
+		delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
+		writeFailedServerResponse(w, http.StatusBadRequest, "Challenge already used")
+		return
+	} else if err != nil {
+		delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
+		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to consume challenge: "+err.Error())
+		return
+	}
+	var c *Credential
+	if uSession == nil {
+		// Usernameless login: find credential by received credential ID and user by credential owner.
+		if len(credentialAssertion.UserHandle) == 0 {
+			delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
+			writeFailedServerResponse(w, http.StatusBadRequest, "Assertion doesn't have user handle")
+			return
+		}
+		c, err = s.dataStore.GetCredentialByID(r.Context(), credentialAssertion.RawID)
+		if err == ErrNoRecords {
+			delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
+			s.writeAssertionFailure(w, http.StatusBadRequest, "Credential is not registered")
+			return
+		} else if err != nil {
+			delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to find credential: "+err.Error())
+			return
+		}
+		if !bytes.Equal(credentialAssertion.UserHandle, c.UserID) {
+			delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
+			s.writeAssertionFailure(w, http.StatusBadRequest, "User handle doesn't match credential owner")
+			return
+		}
+		aw.event.UserID = c.UserID
+		u, err := s.dataStore.GetUserByID(r.Context(), c.UserID)
+		if err != nil {
+			delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to find user: "+err.Error())
+			return
+		}
+		uSession = &userSession{User: u}
+		if !s.checkLockout(w, r, u.UserName) {
+			delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
+			return
+		}
+	} else {
+		// Get credential from datastore by received credential ID.
+		c, err = s.dataStore.GetCredential(r.Context(), uSession.User.UserID, credentialAssertion.RawID)
+		if err == ErrNoRecords {
+			// Fake user's credential in allowCredentials is counted like a registered credential,
+			// so lockout doesn't reveal whether username is registered.
+			if s.fakeUsers != nil && allowedCredential(savedRequestOptions.AllowCredentials, credentialAssertion.RawID) {
+				s.countLogin(r, uSession.User.UserName, false)
+			}
+			delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
+			s.writeAssertionFailure(w, http.StatusBadRequest, "Credential is not registered")
+			return
+		} else if err != nil {
+			delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to find credential: "+err.Error())
+			return
+		}
+	}
+	if c.Disabled {
 		delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
-		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to find credential: "+err.Error())
+		s.writeAssertionFailure(w, http.StatusForbidden, "Credential is disabled")
 		return
 	}
 	credKey, _, err := webauthn.ParseCredential(c.CoseKey)
@@ -120,7 +228,7 @@ func (s *server) handleAssertionResult(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify credential.
+	// Verify credential.  Signature counter is verified separately to apply counter policy.
 	var userCredentialIDs [][]byte
 	for _, desc := range savedRequestOptions.AllowCredentials {
 		userCredentialIDs = append(userCredentialIDs, desc.ID)
@@ -132,27 +240,81 @@ func (s *server) handleAssertionResult(w http.ResponseWriter, r *http.Request) {
 		UserVerification:  savedRequestOptions.UserVerification,
 		UserID:            uSession.User.UserID,
 		UserCredentialIDs: userCredentialIDs,
-		PrevCounter:       c.Counter,
 		Credential:        credKey,
 	}
-	if err = webauthn.VerifyAssertion(credentialAssertion, expected); err != nil {
+	if err = s.verifyAssertion(r.Context(), credentialAssertion, expected); err != nil {
+		s.countLogin(r, uSession.User.UserName, false)
 		delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
-		writeFailedServerResponse(w, http.StatusBadRequest, "Failed to verify assertion: "+err.Error())
+		s.writeAssertionFailure(w, http.StatusBadRequest, "Failed to verify assertion: "+err.Error())
 		return
 	}
 
-	// Update authenticator counter in datastore.
-	c.Counter = credentialAssertion.AuthnData.Counter
-	if err = s.dataStore.updateCredential(r.Context(), c); err != nil {
+	// Apply counter policy if signature counter doesn't increase, which indicates a possible cloned authenticator.
+	prevCounter := c.Counter
+	counter := credentialAssertion.AuthnData.Counter
+	if counterRegressed(prevCounter, counter) {
+		e := &CloneEvent{
+			UserID:       c.UserID,
+			CredentialID: c.CredentialID,
+			PrevCounter:  prevCounter,
+			Counter:      counter,
+			Action:       s.counterPolicy,
+			DetectedAt:   time.Now(),
+		}
+		if err = s.dataStore.AddCloneEvent(r.Context(), e); err != nil {
+			delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to record clone event: "+err.Error())
+			return
+		}
+		switch s.counterPolicy {
+		case counterPolicyFlag:
+			// Keep the highest counter so that regression from a clone is detected again.
+			c.Flagged = true
+			counter = prevCounter
+		case counterPolicyDisable:
+			delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
+			if err = s.dataStore.DisableCredential(r.Context(), c.UserID, c.CredentialID); err != nil {
+				writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to disable credential: "+err.Error())
+				return
+			}
+			writeFailedServerResponse(w, http.StatusForbidden, "Credential is disabled because cloned authenticator is detected")
+			return
+		default:
+			delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
+			writeFailedServerResponse(w, http.StatusBadRequest, "Failed to verify assertion: cloned authenticator is detected")
+			return
+		}
+	}
+
+	// Update authenticator counter in datastore.  Update fails if counter is changed by a concurrent login.
+	c.Counter = counter
+	if err = s.dataStore.UpdateCredential(r.Context(), c, prevCounter); err == ErrCounterChanged {
+		delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
+		writeFailedServerResponse(w, http.StatusConflict, "Failed to update credential: signature counter is changed by another login")
+		return
+	} else if err != nil {
 		delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
 		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to update credential: "+err.Error())
 		return
 	}
+	s.countLogin(r, uSession.User.UserName, true)
 
 	// Delete requestOptions and update user info in session.
 	delete(session.Values, sessionMapKeyWebAuthnRequestOptions)
 	uSession.LoggedInCredentialID = credentialAssertion.RawID
+	uSession.LoggedInAt = time.Now()
+	uSession.UserVerified = credentialAssertion.AuthnData.UserVerified
+	session.Values[sessionMapKeyUserSession] = uSession
 
-	// Write response.
+	// Write response with API tokens if client requests them.
+	if s.apiTokens != nil && r.URL.Query().Get("token") == "true" {
+		resp, err := s.apiTokens.issue(r.Context(), s.dataStore, uSession.User.UserID, uSession.LoggedInCredentialID, uSession.UserVerified)
+		if err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to issue tokens: "+err.Error())
+			return
+		}
+		writeAPITokenResponse(w, resp)
+		return
+	}
 	writeOKServerResponse(w)
 }
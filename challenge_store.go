@@ -0,0 +1,154 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// challengeStore registers issued WebAuthn challenges and consumes each challenge at most once,
+// so a challenge can't be replayed even if session data is replayed.
+type challengeStore interface {
+	// add registers challenge that expires after ttl.
+	add(ctx context.Context, challenge []byte, ttl time.Duration) error
+	// consume marks challenge as used.  It returns errChallengeExpired if challenge expired or
+	// wasn't issued, and errChallengeUsed if challenge was consumed before.
+	consume(ctx context.Context, challenge []byte) error
+}
+
+var (
+	errChallengeExpired = errors.New("webauthn/challenge: challenge expired")
+	errChallengeUsed    = errors.New("webauthn/challenge: challenge already used")
+)
+
+const defaultChallengeTTL = 5 * time.Minute
+
+// challengeTTL returns challenge time-to-live derived from WebAuthn timeout in milliseconds.
+func challengeTTL(timeout uint64) time.Duration {
+	if timeout == 0 {
+		return defaultChallengeTTL
+	}
+	return time.Duration(timeout) * time.Millisecond
+}
+
+// memChallengeStore is a concurrency-safe in-memory challengeStore.  Used challenges are
+// kept until they expire to detect reuse.
+type memChallengeStore struct {
+	mu         sync.Mutex
+	challenges map[string]memChallenge
+	lastSweep  time.Time
+}
+
+type memChallenge struct {
+	expiresAt time.Time
+	used      bool
+}
+
+const memChallengeSweepInterval = time.Minute
+
+func newMemChallengeStore() *memChallengeStore {
+	return &memChallengeStore{challenges: make(map[string]memChallenge)}
+}
+
+func (m *memChallengeStore) add(ctx context.Context, challenge []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.lastSweep) >= memChallengeSweepInterval {
+		for k, c := range m.challenges {
+			if !now.Before(c.expiresAt) {
+				delete(m.challenges, k)
+			}
+		}
+		m.lastSweep = now
+	}
+	m.challenges[string(challenge)] = memChallenge{expiresAt: now.Add(ttl)}
+	return nil
+}
+
+func (m *memChallengeStore) consume(ctx context.Context, challenge []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.challenges[string(challenge)]
+	if !ok {
+		return errChallengeExpired
+	}
+	if c.used {
+		return errChallengeUsed
+	}
+	if !time.Now().Before(c.expiresAt) {
+		delete(m.challenges, string(challenge))
+		return errChallengeExpired
+	}
+	c.used = true
+	m.challenges[string(challenge)] = c
+	return nil
+}
+
+// redisChallengeStore is a challengeStore using Redis keys that expire with challenges.
+// It is used with Redis session store so that challenges are shared by all server instances.
+type redisChallengeStore struct {
+	pool *redis.Pool
+}
+
+const (
+	redisChallengeKeyPrefix = "challenge_"
+	redisChallengeIssued    = "issued"
+	redisChallengeUsed      = "used"
+)
+
+// redisConsumeChallengeScript atomically marks issued challenge as used and keeps its expiration.
+// It returns 0 if challenge doesn't exist, 1 if challenge is used, and 2 if challenge is consumed.
+var redisConsumeChallengeScript = redis.NewScript(1, `
+local v = redis.call("GET", KEYS[1])
+if not v then
+	return 0
+end
+if v == ARGV[1] then
+	return 1
+end
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl <= 0 then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ttl)
+return 2
+`)
+
+func redisChallengeKey(challenge []byte) string {
+	return redisChallengeKeyPrefix + base64.RawURLEncoding.EncodeToString(challenge)
+}
+
+func (s *redisChallengeStore) add(ctx context.Context, challenge []byte, ttl time.Duration) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", redisChallengeKey(challenge), redisChallengeIssued, "PX", int64(ttl/time.Millisecond))
+	return err
+}
+
+func (s *redisChallengeStore) consume(ctx context.Context, challenge []byte) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	result, err := redis.Int(redisConsumeChallengeScript.Do(conn, redisChallengeKey(challenge), redisChallengeUsed))
+	if err != nil {
+		return err
+	}
+	switch result {
+	case 0:
+		return errChallengeExpired
+	case 1:
+		return errChallengeUsed
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestChallengeTTL(t *testing.T) {
+	testCases := []struct {
+		timeout uint64
+		wantTTL time.Duration
+	}{
+		{0, defaultChallengeTTL},
+		{10000, 10 * time.Second},
+		{60000, time.Minute},
+	}
+	for _, tc := range testCases {
+		if ttl := challengeTTL(tc.timeout); ttl != tc.wantTTL {
+			t.Errorf("challengeTTL(%d) returns %s, want %s", tc.timeout, ttl, tc.wantTTL)
+		}
+	}
+}
+
+func TestMemChallengeStore(t *testing.T) {
+	ctx := context.Background()
+	store := newMemChallengeStore()
+	challenge := []byte("challenge")
+
+	if err := store.add(ctx, challenge, time.Minute); err != nil {
+		t.Fatalf("add() returns error %q", err)
+	}
+	if err := store.consume(ctx, challenge); err != nil {
+		t.Errorf("consume() returns error %q", err)
+	}
+	if err := store.consume(ctx, challenge); err != errChallengeUsed {
+		t.Errorf("consume() used challenge returns error %v, want %q", err, errChallengeUsed)
+	}
+	if err := store.consume(ctx, []byte("unknown challenge")); err != errChallengeExpired {
+		t.Errorf("consume() unknown challenge returns error %v, want %q", err, errChallengeExpired)
+	}
+}
+
+func TestMemChallengeStoreExpiredChallenge(t *testing.T) {
+	ctx := context.Background()
+	store := newMemChallengeStore()
+	challenge := []byte("challenge")
+
+	if err := store.add(ctx, challenge, -time.Second); err != nil {
+		t.Fatalf("add() returns error %q", err)
+	}
+	if err := store.consume(ctx, challenge); err != errChallengeExpired {
+		t.Errorf("consume() expired challenge returns error %v, want %q", err, errChallengeExpired)
+	}
+}
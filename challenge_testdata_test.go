@@ -0,0 +1,102 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/stretchr/testify/mock"
+)
+
+const (
+	challengeErrorResponseExpired = `{
+		"status": "failed",
+		"errorMessage": "Challenge expired"
+	}`
+
+	challengeErrorResponseUsed = `{
+		"status": "failed",
+		"errorMessage": "Challenge already used"
+	}`
+
+	challengeErrorResponseStoreFailure = `{
+		"status": "failed",
+		"errorMessage": "Failed to consume challenge: challenge store is unavailable"
+	}`
+)
+
+var (
+	challengeAttestationResultTests = handlerTest{
+		requestMethod:     "POST",
+		requestURL:        "/attestation/result",
+		equalResponseBody: equalServerResponse,
+		testcases: []handlerTestData{
+			{
+				name:                   "challenge expired",
+				server:                 getMockServer(),
+				initMockDataStore:      initDataStoreAddUserCredentialNotCalled,
+				initMockSessionStore:   initSessionStore(getAttestationOptionsNewUserSession1, getUserSession),
+				initMockChallengeStore: initChallengeStoreConsume(errChallengeExpired),
+				requestBody:            attestationResultRequest,
+				wantStatusCode:         http.StatusBadRequest,
+				wantResponseBody:       challengeErrorResponseExpired,
+			},
+			{
+				name:                   "challenge already used",
+				server:                 getMockServer(),
+				initMockDataStore:      initDataStoreAddUserCredentialNotCalled,
+				initMockSessionStore:   initSessionStore(getAttestationOptionsNewUserSession1, getUserSession),
+				initMockChallengeStore: initChallengeStoreConsume(errChallengeUsed),
+				requestBody:            attestationResultRequest,
+				wantStatusCode:         http.StatusBadRequest,
+				wantResponseBody:       challengeErrorResponseUsed,
+			},
+			{
+				name:                   "challenge store failure",
+				server:                 getMockServer(),
+				initMockDataStore:      initDataStoreAddUserCredentialNotCalled,
+				initMockSessionStore:   initSessionStore(getAttestationOptionsNewUserSession1, getUserSession),
+				initMockChallengeStore: initChallengeStoreConsume(errors.New("challenge store is unavailable")),
+				requestBody:            attestationResultRequest,
+				wantStatusCode:         http.StatusInternalServerError,
+				wantResponseBody:       challengeErrorResponseStoreFailure,
+			},
+		},
+	}
+
+	challengeAssertionResultTests = handlerTest{
+		requestMethod:     "POST",
+		requestURL:        "/assertion/result",
+		equalResponseBody: equalServerResponse,
+		testcases: []handlerTestData{
+			{
+				name:                   "challenge expired",
+				server:                 getMockServer(),
+				initMockDataStore:      initDataStoreGetAndUpdateCredentialNotCalled,
+				initMockSessionStore:   initSessionStore(getAssertionOptionsExistingUserSession, getUserSession),
+				initMockChallengeStore: initChallengeStoreConsume(errChallengeExpired),
+				requestBody:            assertionResultRequest,
+				wantStatusCode:         http.StatusBadRequest,
+				wantResponseBody:       challengeErrorResponseExpired,
+			},
+			{
+				name:                   "challenge already used",
+				server:                 getMockServer(),
+				initMockDataStore:      initDataStoreGetAndUpdateCredentialNotCalled,
+				initMockSessionStore:   initSessionStore(getAssertionOptionsExistingUserSession, getUserSession),
+				initMockChallengeStore: initChallengeStoreConsume(errChallengeUsed),
+				requestBody:            assertionResultRequest,
+				wantStatusCode:         http.StatusBadRequest,
+				wantResponseBody:       challengeErrorResponseUsed,
+			},
+		},
+	}
+)
+
+func initChallengeStoreConsume(err error) initMockChallengeStoreFunc {
+	return func(mockChallengeStore *MockChallengeStore) {
+		mockChallengeStore.On("consume", mock.Anything, mock.Anything).Return(err).Once()
+	}
+}
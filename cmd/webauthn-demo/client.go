@@ -0,0 +1,314 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/webauthn"
+	"github.com/fxamacker/webauthn-demo/virtualauthenticator"
+)
+
+const clientUsage = `Usage: webauthn-demo client <command> [flags]
+
+Commands:
+  register  register a new credential with software authenticator and log in
+  login     log in with a credential saved in keys file
+  whoami    print logged in user
+  logout    log out
+
+Flags:
+`
+
+// runClient runs client command with args.  It speaks the same JSON protocol as the demo web
+// pages, keeps credentials in keys file, and keeps session cookies in cookies file between runs.
+func runClient(args []string, stdout io.Writer, stderr io.Writer) error {
+	var serverURL, origin, keysFilePath, cookiesFilePath, attestationFormat string
+	var username, displayName, residentKey, userVerification string
+	var insecure bool
+
+	flags := flag.NewFlagSet("client", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&serverURL, "url", "https://localhost:8443", "server URL")
+	flags.StringVar(&origin, "origin", "", "origin in client data (default: server URL)")
+	flags.StringVar(&keysFilePath, "keys", "webauthn-keys.json", "keys file path")
+	flags.StringVar(&cookiesFilePath, "cookies", "webauthn-cookies.json", "cookies file path")
+	flags.StringVar(&attestationFormat, "attestation", virtualauthenticator.AttestationFormatNone, "attestation format of new keys file: none, packed, or fido-u2f")
+	flags.StringVar(&username, "username", "", "username, empty for usernameless login")
+	flags.StringVar(&displayName, "displayname", "", "display name (default: username)")
+	flags.StringVar(&residentKey, "residentkey", string(webauthn.ResidentKeyPreferred), "resident key requirement: discouraged, preferred, or required")
+	flags.StringVar(&userVerification, "userverification", string(webauthn.UserVerificationPreferred), "user verification requirement: discouraged, preferred, or required")
+	flags.BoolVar(&insecure, "insecure", false, "skip server certificate verification")
+	flags.Usage = func() {
+		fmt.Fprint(stderr, clientUsage)
+		flags.PrintDefaults()
+	}
+
+	if len(args) == 0 {
+		flags.Usage()
+		return errors.New("missing client command")
+	}
+	command := args[0]
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if origin == "" {
+		origin = serverURL
+	}
+	if displayName == "" {
+		displayName = username
+	}
+
+	jar, err := loadCookieJar(cookiesFilePath)
+	if err != nil {
+		return err
+	}
+	authenticator, err := virtualauthenticator.LoadFile(keysFilePath, origin, attestationFormat)
+	if err != nil {
+		return err
+	}
+	c := &client{
+		serverURL:     serverURL,
+		authenticator: authenticator,
+		httpClient: &http.Client{
+			Jar:       jar,
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure}},
+		},
+	}
+
+	switch command {
+	case "register":
+		if username == "" {
+			return errors.New("missing username")
+		}
+		var recoveryCodes []string
+		recoveryCodes, err = c.register(username, displayName, webauthn.ResidentKeyRequirement(residentKey), webauthn.UserVerificationRequirement(userVerification))
+		if err == nil {
+			err = authenticator.SaveFile(keysFilePath)
+		}
+		if err == nil && len(recoveryCodes) > 0 {
+			fmt.Fprintln(stdout, "Recovery codes (shown only once):")
+			for _, code := range recoveryCodes {
+				fmt.Fprintln(stdout, "  "+code)
+			}
+		}
+		if err == nil {
+			err = c.whoami(stdout)
+		}
+	case "login":
+		err = c.login(username, webauthn.UserVerificationRequirement(userVerification))
+		if err == nil {
+			err = authenticator.SaveFile(keysFilePath) // save signature counter
+		}
+		if err == nil {
+			err = c.whoami(stdout)
+		}
+	case "whoami":
+		err = c.whoami(stdout)
+	case "logout":
+		err = c.do("GET", "/logout", nil, nil)
+	default:
+		flags.Usage()
+		return errors.New("unknown client command \"" + command + "\"")
+	}
+	if saveErr := jar.save(); err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// client is a WebAuthn client with software authenticator.
+type client struct {
+	serverURL     string
+	httpClient    *http.Client
+	authenticator *virtualauthenticator.Authenticator
+}
+
+// register returns recovery codes if this is user's first registration.
+func (c *client) register(username string, displayName string, residentKey webauthn.ResidentKeyRequirement, userVerification webauthn.UserVerificationRequirement) ([]string, error) {
+	optionsRequest := map[string]interface{}{
+		"username":    username,
+		"displayName": displayName,
+		"authenticatorSelection": map[string]interface{}{
+			"authenticatorAttachment": webauthn.AuthenticatorCrossPlatform,
+			"requireResidentKey":      residentKey == webauthn.ResidentKeyRequired,
+			"residentKey":             residentKey,
+			"userVerification":        userVerification,
+		},
+		"attestation": webauthn.AttestationDirect,
+	}
+	var options webauthn.PublicKeyCredentialCreationOptions
+	if err := c.do("POST", "/attestation/options", optionsRequest, &options); err != nil {
+		return nil, err
+	}
+	result, err := c.authenticator.Create(&options)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	if err := c.do("POST", "/attestation/result", result, &resp); err != nil {
+		return nil, err
+	}
+	return resp.RecoveryCodes, nil
+}
+
+func (c *client) login(username string, userVerification webauthn.UserVerificationRequirement) error {
+	optionsRequest := map[string]interface{}{
+		"username":         username,
+		"userVerification": userVerification,
+	}
+	var options webauthn.PublicKeyCredentialRequestOptions
+	if err := c.do("POST", "/assertion/options", optionsRequest, &options); err != nil {
+		return err
+	}
+	result, err := c.authenticator.Get(&options)
+	if err != nil {
+		return err
+	}
+	return c.do("POST", "/assertion/result", result, nil)
+}
+
+func (c *client) whoami(stdout io.Writer) error {
+	var user json.RawMessage
+	if err := c.do("GET", "/user", nil, &user); err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, user, "", "  "); err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+	_, err := out.WriteTo(stdout)
+	return err
+}
+
+// do sends request with JSON encoded body and decodes JSON response into v.  It returns
+// server error message if response status is "failed".
+func (c *client) do(method string, path string, body interface{}, v interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, c.serverURL+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "application/json" {
+		return errors.New(path + " response header has unexpected Content-Type: " + resp.Header.Get("Content-Type"))
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var serverResp struct {
+		Status       string `json:"status"`
+		ErrorMessage string `json:"errorMessage"`
+	}
+	if err := json.Unmarshal(data, &serverResp); err != nil {
+		return errors.New("failed to decode " + path + " response: " + err.Error())
+	}
+	if serverResp.Status != "ok" {
+		return errors.New(serverResp.ErrorMessage)
+	}
+	if v != nil {
+		if err := json.Unmarshal(data, v); err != nil {
+			return errors.New("failed to decode " + path + " response: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// cookieJar is an http.CookieJar saved to file, so session is kept between client runs.
+type cookieJar struct {
+	mu      sync.Mutex
+	path    string
+	cookies map[string][]*http.Cookie // key is host
+}
+
+func loadCookieJar(path string) (*cookieJar, error) {
+	jar := &cookieJar{path: path, cookies: make(map[string][]*http.Cookie)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return jar, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &jar.cookies); err != nil {
+		return nil, errors.New("failed to decode cookies file: " + err.Error())
+	}
+	return jar, nil
+}
+
+// SetCookies implements http.CookieJar.  Cookies are replaced by name, and removed if expired.
+func (jar *cookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	jar.mu.Lock()
+	defer jar.mu.Unlock()
+
+	now := time.Now()
+	for _, cookie := range cookies {
+		if cookie.MaxAge > 0 {
+			cookie.Expires = now.Add(time.Duration(cookie.MaxAge) * time.Second)
+		}
+		var kept []*http.Cookie
+		for _, c := range jar.cookies[u.Host] {
+			if c.Name != cookie.Name {
+				kept = append(kept, c)
+			}
+		}
+		if cookie.MaxAge >= 0 && (cookie.Expires.IsZero() || cookie.Expires.After(now)) {
+			kept = append(kept, cookie)
+		}
+		jar.cookies[u.Host] = kept
+	}
+}
+
+// Cookies implements http.CookieJar.
+func (jar *cookieJar) Cookies(u *url.URL) []*http.Cookie {
+	jar.mu.Lock()
+	defer jar.mu.Unlock()
+
+	now := time.Now()
+	var cookies []*http.Cookie
+	for _, c := range jar.cookies[u.Host] {
+		if c.Expires.IsZero() || c.Expires.After(now) {
+			cookies = append(cookies, &http.Cookie{Name: c.Name, Value: c.Value})
+		}
+	}
+	return cookies
+}
+
+func (jar *cookieJar) save() error {
+	jar.mu.Lock()
+	defer jar.mu.Unlock()
+
+	data, err := json.Marshal(jar.cookies)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(jar.path, data, 0600)
+}
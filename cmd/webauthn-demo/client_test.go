@@ -0,0 +1,100 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/webauthn"
+	webauthndemo "github.com/fxamacker/webauthn-demo"
+)
+
+const testOrigin = "https://localhost:8443"
+
+func newTestServer(t *testing.T) *httptest.Server {
+	c := &webauthndemo.Config{
+		WebAuthn: &webauthn.Config{
+			RPID:                    "localhost",
+			RPName:                  "WebAuthn local server",
+			Timeout:                 uint64(10000),
+			ChallengeLength:         32,
+			AuthenticatorAttachment: webauthn.AuthenticatorCrossPlatform,
+			ResidentKey:             webauthn.ResidentKeyPreferred,
+			UserVerification:        webauthn.UserVerificationPreferred,
+			Attestation:             webauthn.AttestationDirect,
+			CredentialAlgs:          []int{webauthn.COSEAlgES256},
+		},
+		Origin:            testOrigin,
+		UsernamelessLogin: true,
+		CounterPolicy:     "reject",
+		SessionKey:        []byte("session_key"),
+		SessionStore:      "memory",
+		SessionMaxAge:     60,
+		DBDriver:          "memory",
+		AuditLog:          "memory",
+	}
+	s, err := webauthndemo.NewServer(webauthndemo.WithConfig(c))
+	if err != nil {
+		t.Fatalf("NewServer() returns error %q", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return httptest.NewTLSServer(s)
+}
+
+func TestClient(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	dir := t.TempDir()
+	commonArgs := []string{
+		"-url", ts.URL,
+		"-origin", testOrigin,
+		"-insecure",
+		"-keys", filepath.Join(dir, "keys.json"),
+		"-cookies", filepath.Join(dir, "cookies.json"),
+		"-attestation", "packed",
+	}
+	runCommand := func(command string, args ...string) (string, error) {
+		var stdout, stderr bytes.Buffer
+		err := runClient(append(append([]string{command}, commonArgs...), args...), &stdout, &stderr)
+		return stdout.String(), err
+	}
+
+	testCases := []struct {
+		command      string
+		args         []string
+		wantOutput   string
+		wantErrorMsg string
+	}{
+		{command: "whoami", wantErrorMsg: "User is not logged in"},
+		{command: "register", args: []string{"-username", "johndoe@example.com"}, wantOutput: `"name": "johndoe@example.com"`},
+		{command: "whoami", wantOutput: `"name": "johndoe@example.com"`},
+		{command: "logout"},
+		{command: "whoami", wantErrorMsg: "User is not logged in"},
+		{command: "login", args: []string{"-username", "johndoe@example.com"}, wantOutput: `"name": "johndoe@example.com"`},
+		{command: "logout"},
+		{command: "login", wantOutput: `"name": "johndoe@example.com"`}, // usernameless login
+		{command: "login", args: []string{"-username", "janedoe@example.com"}, wantErrorMsg: "janedoe@example.com is not registered"},
+		{command: "unregister", wantErrorMsg: "unknown client command \"unregister\""},
+	}
+	for _, tc := range testCases {
+		output, err := runCommand(tc.command, tc.args...)
+		if tc.wantErrorMsg != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErrorMsg) {
+				t.Errorf("client %s %v returns error %v, want error containing %q", tc.command, tc.args, err, tc.wantErrorMsg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("client %s %v returns error %q", tc.command, tc.args, err)
+		}
+		if !strings.Contains(output, tc.wantOutput) {
+			t.Errorf("client %s %v prints %q, want output containing %q", tc.command, tc.args, output, tc.wantOutput)
+		}
+	}
+}
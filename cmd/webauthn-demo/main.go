@@ -7,39 +7,39 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	_ "github.com/fxamacker/webauthn/androidkeystore"
-	_ "github.com/fxamacker/webauthn/androidsafetynet"
-	_ "github.com/fxamacker/webauthn/fidou2f"
-	_ "github.com/fxamacker/webauthn/packed"
-	_ "github.com/fxamacker/webauthn/tpm"
-
-	_ "github.com/lib/pq"
-)
-
-type contextKey string
-
-const (
-	sessionNameLoginSession              string = "LoginSession"            // session store name for login session
-	sessionMapKeyUserSession             string = "UserSession"             // session map key for *userSession
-	sessionMapKeyWebAuthnCreationOptions string = "WebAuthnCreationOptions" // session map key for *webauthn.PublicKeyCredentialCreationOptions
-	sessionMapKeyWebAuthnRequestOptions  string = "WebAuthnRequestOptions"  // session map key for *webauthn.PublicKeyCredentialRequestOptions
-
-	contextKeyLoginSession contextKey = contextKey(sessionNameLoginSession) // context key for login session
+	webauthndemo "github.com/fxamacker/webauthn-demo"
 )
 
 func main() {
-	var serverAddr, configFilePath, certFilePath, keyFilePath string
+	if len(os.Args) > 1 && os.Args[1] == "client" {
+		if err := runClient(os.Args[2:], os.Stdout, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:], os.Stdout, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var serverAddr, configFilePath, certFilePath, keyFilePath, staticDir, logLevel string
 	flag.StringVar(&serverAddr, "addr", "", "web server address")
 	flag.StringVar(&configFilePath, "config", "", "config file path")
 	flag.StringVar(&certFilePath, "cert", "", "cert file path")
 	flag.StringVar(&keyFilePath, "key", "", "key file path")
+	flag.StringVar(&staticDir, "static", "./static", "static web pages directory")
+	flag.StringVar(&logLevel, "loglevel", "info", "log level: debug, info, warn, or error")
 
 	flag.Parse()
 
@@ -55,6 +55,14 @@ func main() {
 		return
 	}
 
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		fmt.Println("Invalid log level: " + err.Error())
+		flag.Usage()
+		return
+	}
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
 	if _, err := os.Stat(certFilePath); os.IsNotExist(err) {
 		fmt.Println("Cert file " + certFilePath + " doesn't exist.")
 		flag.Usage()
@@ -67,31 +75,29 @@ func main() {
 		return
 	}
 
-	c, err := newConfig(configFile)
+	c, err := webauthndemo.NewConfig(configFile)
 	if err != nil {
 		panic(err)
 	}
 
-	s, err := newServer(c)
+	s, err := webauthndemo.NewServer(webauthndemo.WithConfig(c), webauthndemo.WithStaticDir(staticDir), webauthndemo.WithLogger(logger))
 	if err != nil {
 		panic(err)
 	}
-	defer s.close()
-
-	s.routes()
+	defer s.Close()
 
 	server := &http.Server{
 		Addr:         serverAddr,
 		WriteTimeout: time.Second * 15,
 		ReadTimeout:  time.Second * 15,
 		IdleTimeout:  time.Second * 60,
-		Handler:      s.router,
+		Handler:      s,
 	}
 
 	go func() {
 		if err := server.ListenAndServeTLS(certFilePath, keyFilePath); err != http.ErrServerClosed {
 			// Error starting or closing listener
-			log.Printf("HTTP server ListenAndServeTLS: %v\n", err)
+			logger.Error("HTTP server ListenAndServeTLS", "error", err)
 		}
 	}()
 
@@ -104,6 +110,6 @@ func main() {
 
 	if err := server.Shutdown(ctx); err != nil {
 		// Error from closing listeners, or context timeout
-		log.Printf("HTTP server Shutdown: %v\n", err)
+		logger.Error("HTTP server Shutdown", "error", err)
 	}
 }
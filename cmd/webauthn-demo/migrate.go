@@ -0,0 +1,107 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	webauthndemo "github.com/fxamacker/webauthn-demo"
+)
+
+const migrateUsage = `Usage: webauthn-demo migrate <command> [flags]
+
+Commands:
+  up      apply pending schema migrations
+  down    revert the latest applied schema migration
+  status  print applied and pending schema migrations
+
+Flags:
+`
+
+// runMigrate runs migrate command with args.  Database is selected by DB_DRIVER and
+// DB_CONNSTRING environment variables like server, unless they are overridden by flags.
+func runMigrate(args []string, stdout io.Writer, stderr io.Writer) error {
+	var driver, connString string
+
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&driver, "driver", envOrDefault("DB_DRIVER", "postgres"), "database driver: postgres, sqlite, or memory")
+	flags.StringVar(&connString, "connstring", os.Getenv("DB_CONNSTRING"), "database connection string (default for sqlite: webauthn.db)")
+	flags.Usage = func() {
+		fmt.Fprint(stderr, migrateUsage)
+		flags.PrintDefaults()
+	}
+
+	if len(args) == 0 {
+		flags.Usage()
+		return errors.New("missing migrate command")
+	}
+	command := args[0]
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if connString == "" && driver == "sqlite" {
+		connString = "webauthn.db"
+	}
+
+	m, err := webauthndemo.NewMigrator(driver, connString)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	ctx := context.Background()
+	switch command {
+	case "up":
+		applied, err := m.Up(ctx)
+		for _, s := range applied {
+			fmt.Fprintf(stdout, "Applied %04d_%s\n", s.Version, s.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Fprintln(stdout, "No pending migrations")
+		}
+	case "down":
+		reverted, err := m.Down(ctx)
+		if err != nil {
+			return err
+		}
+		if reverted == nil {
+			fmt.Fprintln(stdout, "No applied migrations")
+			return nil
+		}
+		fmt.Fprintf(stdout, "Reverted %04d_%s\n", reverted.Version, reverted.Name)
+	case "status":
+		status, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			appliedAt := "pending"
+			if !s.AppliedAt.IsZero() {
+				appliedAt = "applied at " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(stdout, "%04d_%s  %s\n", s.Version, s.Name, appliedAt)
+		}
+	default:
+		flags.Usage()
+		return errors.New("unknown migrate command \"" + command + "\"")
+	}
+	return nil
+}
+
+func envOrDefault(key string, defaultValue string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return defaultValue
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	dbFilePath := filepath.Join(t.TempDir(), "webauthn.db")
+	run := func(command string) string {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		if err := runMigrate([]string{command, "-driver", "sqlite", "-connstring", dbFilePath}, &stdout, &stderr); err != nil {
+			t.Fatalf("migrate %s returns error %q, stderr %q", command, err, stderr.String())
+		}
+		return stdout.String()
+	}
+
+	testCases := []struct {
+		command string
+		want    string
+	}{
+		{"status", "0001_create_tables  pending\n"},
+		{"up", "Applied 0001_create_tables\nApplied 0002_add_credentials_aaguid\n"},
+		{"up", "No pending migrations\n"},
+		{"status", "0001_create_tables  applied at "},
+		{"down", "Reverted 0014_add_audit_events_actor_user_id\n"},
+		{"down", "Reverted 0013_add_credentials_id_unique\n"},
+	}
+	for _, tc := range testCases {
+		if out := run(tc.command); !strings.HasPrefix(out, tc.want) {
+			t.Errorf("migrate %s prints %q, want %q", tc.command, out, tc.want)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	if err := runMigrate([]string{"sideways", "-driver", "memory"}, &stdout, &stderr); err == nil || err.Error() != `unknown migrate command "sideways"` {
+		t.Errorf("migrate sideways returns error %v, want unknown migrate command", err)
+	}
+}
+
+// TestMigrateBaselineDatabase migrates database created by db/createtables.sql of the first
+// release, which is saved in testdata.
+func TestMigrateBaselineDatabase(t *testing.T) {
+	dbFilePath := filepath.Join(t.TempDir(), "webauthn.db")
+	schema, err := os.ReadFile("testdata/createtables.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite", dbFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec(string(schema)); err != nil {
+		t.Fatalf("failed to create baseline schema: %s", err)
+	}
+	if _, err = db.Exec("INSERT INTO users (id, username, display_name) VALUES (X'0102', 'johndoe@example.com', 'John Doe')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec("INSERT INTO credentials (id, user_id, counter, cose_key) VALUES (X'0304', X'0102', 7, X'0506')"); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if err := runMigrate([]string{"up", "-driver", "sqlite", "-connstring", dbFilePath}, &stdout, &stderr); err != nil {
+		t.Fatalf("migrate up returns error %q, stdout %q, stderr %q", err, stdout.String(), stderr.String())
+	}
+	if out := stdout.String(); !strings.HasPrefix(out, "Applied 0001_create_tables\n") || !strings.HasSuffix(out, "Applied 0014_add_audit_events_actor_user_id\n") {
+		t.Errorf("migrate up prints %q, want all migrations applied", out)
+	}
+
+	// Existing user and credential are kept, and added columns have default values.
+	var counter int
+	var description, nickname string
+	var flagged, disabled bool
+	if err := db.QueryRow("SELECT counter, description, nickname, flagged, disabled FROM credentials WHERE id = X'0304'").Scan(&counter, &description, &nickname, &flagged, &disabled); err != nil {
+		t.Fatalf("failed to query migrated credential: %s", err)
+	}
+	if counter != 7 || description != "" || nickname != "" || flagged || disabled {
+		t.Errorf("migrated credential has counter %d, description %q, nickname %q, flagged %t, disabled %t", counter, description, nickname, flagged, disabled)
+	}
+	var sessionsRevokedAt sql.NullTime
+	if err := db.QueryRow("SELECT sessions_revoked_at FROM users WHERE id = X'0102'").Scan(&sessionsRevokedAt); err != nil || sessionsRevokedAt.Valid {
+		t.Errorf("migrated user has sessions_revoked_at %v, %v, want NULL", sessionsRevokedAt, err)
+	}
+	for _, table := range []string{"sessions", "clone_events", "audit_events", "refresh_tokens", "recovery_codes"} {
+		if _, err := db.Exec("SELECT count(*) FROM " + table); err != nil {
+			t.Errorf("migrate up doesn't create %s table: %s", table, err)
+		}
+	}
+}
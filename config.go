@@ -1,7 +1,7 @@
 // Copyright (c) 2019 Faye Amacker. All rights reserved.
 // Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
 
-package main
+package webauthndemo
 
 import (
 	"encoding/base64"
@@ -9,24 +9,49 @@ import (
 	"errors"
 	"io"
 	"os"
+	"strconv"
 
 	"github.com/fxamacker/webauthn"
 )
 
-// config has configuration data from config file and environment variables.
-type config struct {
-	WebAuthn     *webauthn.Config
-	Origin       string
-	SessionKey   []byte
-	DBConnString string
-	RedisNetwork string
-	RedisAddr    string
-	RedisPwd     string
+const defaultSessionMaxAge = 60 * 5 // expires after 5 minutes
+
+// Config has configuration data from config file and environment variables.
+type Config struct {
+	WebAuthn          *webauthn.Config
+	Origin            string
+	AttestationPolicy *attestationPolicyConfig
+	MetadataService   *metadataServiceConfig
+	OIDC              *oidcConfig        // OpenID Connect provider, disabled if nil.
+	ForwardAuth       *forwardAuthConfig // Forward authentication for reverse proxies.
+	APITokens         *apiTokenConfig    // Access tokens and refresh tokens for API clients, disabled if nil.
+	RateLimit         *rateLimitConfig   // Rate limits of WebAuthn ceremonies and lockout after failed logins, disabled if nil.
+	TrustedProxies    []string           // IP addresses or CIDRs of reverse proxies whose X-Forwarded-For header sets client IP.
+	Admins            []string           // Usernames of administrators.
+	AdminSignup       bool               // Allow usernames in Admins to sign up, so administrators can register.
+	Metrics           bool               // Serve Prometheus metrics at /metrics.
+	Tracing           *tracingConfig     // OpenTelemetry tracing, disabled if nil.
+	UsernamelessLogin bool               // Allow login with discoverable credentials without username.
+	FakeLoginOptions  bool               // Return fake login options for unknown usernames to prevent username enumeration.
+	CounterPolicy     string             // Action if signature counter doesn't increase: "reject" (default), "flag", or "disable".
+	SessionKey        []byte
+	SessionStore      string
+	SessionMaxAge     int // Session max age in seconds.
+	DBDriver          string
+	DBConnString      string
+	DBAutoMigrate     bool // Apply pending schema migrations when server starts.
+	AuditLog          string
+	AuditLogFile      string // JSON-lines file used by file audit log.
+	RedisNetwork      string
+	RedisAddr         string
+	RedisPwd          string
 }
 
-func newConfig(configFile io.Reader) (*config, error) {
+// NewConfig returns Config decoded from config file, with session, data store, audit log, and
+// Redis settings read from environment variables.
+func NewConfig(configFile io.Reader) (*Config, error) {
 	var err error
-	c := &config{}
+	c := &Config{}
 	if err := json.NewDecoder(configFile).Decode(c); err != nil {
 		return nil, errors.New("failed to decode config file: " + err.Error())
 	}
@@ -36,6 +61,50 @@ func newConfig(configFile io.Reader) (*config, error) {
 	if c.Origin == "" {
 		return nil, errors.New("origin is empty")
 	}
+	if c.AttestationPolicy != nil {
+		if err := c.AttestationPolicy.valid(); err != nil {
+			return nil, err
+		}
+	}
+	if c.MetadataService != nil {
+		if err := c.MetadataService.valid(); err != nil {
+			return nil, err
+		}
+	}
+	if c.OIDC != nil {
+		if err := c.OIDC.valid(); err != nil {
+			return nil, err
+		}
+	}
+	if c.ForwardAuth != nil {
+		if err := c.ForwardAuth.valid(); err != nil {
+			return nil, err
+		}
+	}
+	if c.APITokens != nil {
+		if err := c.APITokens.valid(); err != nil {
+			return nil, err
+		}
+	}
+	if c.RateLimit != nil {
+		if err := c.RateLimit.valid(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		return nil, err
+	}
+	if c.Tracing != nil {
+		if err := c.Tracing.valid(); err != nil {
+			return nil, err
+		}
+	}
+	if c.CounterPolicy == "" {
+		c.CounterPolicy = counterPolicyReject
+	}
+	if !validCounterPolicy(c.CounterPolicy) {
+		return nil, errors.New("counter policy \"" + c.CounterPolicy + "\" is not supported")
+	}
 	c.SessionKey, err = base64.RawStdEncoding.DecodeString(os.Getenv("SESSION_KEY"))
 	if err != nil {
 		return nil, errors.New("failed to base64 decode session key: " + err.Error())
@@ -43,9 +112,67 @@ func newConfig(configFile io.Reader) (*config, error) {
 	if len(c.SessionKey) == 0 {
 		return nil, errors.New("SESSION_KEY is empty")
 	}
+	c.SessionStore = os.Getenv("SESSION_STORE")
+	if c.SessionStore == "" {
+		c.SessionStore = sessionStoreRedis
+	}
+	switch c.SessionStore {
+	case sessionStoreRedis, sessionStoreMemory, sessionStoreCookie, sessionStoreDatabase:
+	default:
+		return nil, errors.New("SESSION_STORE \"" + c.SessionStore + "\" is not supported")
+	}
+	c.SessionMaxAge = defaultSessionMaxAge
+	if maxAge := os.Getenv("SESSION_MAX_AGE"); maxAge != "" {
+		if c.SessionMaxAge, err = strconv.Atoi(maxAge); err != nil || c.SessionMaxAge <= 0 {
+			return nil, errors.New("SESSION_MAX_AGE \"" + maxAge + "\" is not a positive number of seconds")
+		}
+	}
+	c.DBDriver = os.Getenv("DB_DRIVER")
+	if c.DBDriver == "" {
+		c.DBDriver = dbDriverPostgres
+	}
 	c.DBConnString = os.Getenv("DB_CONNSTRING")
-	if c.DBConnString == "" {
-		return nil, errors.New("DB_CONNSTRING is empty")
+	switch c.DBDriver {
+	case dbDriverPostgres:
+		if c.DBConnString == "" {
+			return nil, errors.New("DB_CONNSTRING is empty")
+		}
+	case dbDriverSQLite:
+		if c.DBConnString == "" {
+			c.DBConnString = "webauthn.db"
+		}
+	case dbDriverMemory:
+		if c.SessionStore == sessionStoreDatabase {
+			return nil, errors.New("SESSION_STORE \"" + sessionStoreDatabase + "\" requires DB_DRIVER \"" + dbDriverPostgres + "\" or \"" + dbDriverSQLite + "\"")
+		}
+	default:
+		return nil, errors.New("DB_DRIVER \"" + c.DBDriver + "\" is not supported")
+	}
+	if autoMigrate := os.Getenv("DB_AUTO_MIGRATE"); autoMigrate != "" {
+		if c.DBAutoMigrate, err = strconv.ParseBool(autoMigrate); err != nil {
+			return nil, errors.New("DB_AUTO_MIGRATE \"" + autoMigrate + "\" is not a boolean")
+		}
+	}
+	c.AuditLog = os.Getenv("AUDIT_LOG")
+	if c.AuditLog == "" {
+		c.AuditLog = auditLogDatabase
+		if c.DBDriver == dbDriverMemory {
+			c.AuditLog = auditLogMemory
+		}
+	}
+	switch c.AuditLog {
+	case auditLogDatabase:
+		if c.DBDriver == dbDriverMemory {
+			return nil, errors.New("AUDIT_LOG \"" + auditLogDatabase + "\" requires DB_DRIVER \"" + dbDriverPostgres + "\" or \"" + dbDriverSQLite + "\"")
+		}
+	case auditLogFile:
+		c.AuditLogFile = os.Getenv("AUDIT_LOG_FILE")
+		if c.AuditLogFile == "" {
+			c.AuditLogFile = "audit.log"
+		}
+	case auditLogMemory:
+	default:
+		return nil, errors.New("AUDIT_LOG \"" + c.AuditLog + "\" is not supported")
 	}
 	c.RedisNetwork = os.Getenv("REDIS_NETWORK")
 	if c.RedisNetwork == "" {
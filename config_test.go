@@ -1,7 +1,7 @@
 // Copyright (c) 2019 Faye Amacker. All rights reserved.
 // Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
 
-package main
+package webauthndemo
 
 import (
 	"encoding/base64"
@@ -17,7 +17,7 @@ type configTest struct {
 	name              string
 	configFileContent string
 	configEnv         map[string]string
-	wantConfig        config
+	wantConfig        Config
 }
 
 type configErrorTest struct {
@@ -43,6 +43,132 @@ const (
 		},
 		"Origin": "https://localhost:8443"
 	}`
+	attestationPolicyConfigFileContent = `{
+		"WebAuthn": {
+			"RPID": "localhost",
+			"RPName": "WebAuthn local host",
+			"RPIcon": "",
+			"Timeout": 30000,
+			"ChallengeLength": 32,
+			"AuthenticatorAttachment": "cross-platform",
+			"ResidentKey": "preferred",
+			"UserVerification": "preferred",
+			"Attestation": "direct",
+			"CredentialAlgs": [ -7, -37, -257 ]
+		},
+		"Origin": "https://localhost:8443",
+		"AttestationPolicy": {
+			"AttestationTypes": [ "Basic", "AttCA" ],
+			"TrustAnchorDir": "/opt/webauthn/roots"
+		}
+	}`
+	invalidAttestationPolicyConfigFileContent = `{
+		"WebAuthn": {
+			"RPID": "localhost",
+			"RPName": "WebAuthn local host",
+			"RPIcon": "",
+			"Timeout": 30000,
+			"ChallengeLength": 32,
+			"AuthenticatorAttachment": "cross-platform",
+			"ResidentKey": "preferred",
+			"UserVerification": "preferred",
+			"Attestation": "direct",
+			"CredentialAlgs": [ -7, -37, -257 ]
+		},
+		"Origin": "https://localhost:8443",
+		"AttestationPolicy": {
+			"AttestationTypes": [ "ECDAA" ]
+		}
+	}`
+	invalidMetadataServiceConfigFileContent = `{
+		"WebAuthn": {
+			"RPID": "localhost",
+			"RPName": "WebAuthn local host",
+			"RPIcon": "",
+			"Timeout": 30000,
+			"ChallengeLength": 32,
+			"AuthenticatorAttachment": "cross-platform",
+			"ResidentKey": "preferred",
+			"UserVerification": "preferred",
+			"Attestation": "direct",
+			"CredentialAlgs": [ -7, -37, -257 ]
+		},
+		"Origin": "https://localhost:8443",
+		"MetadataService": {
+			"BLOBFile": "",
+			"RootCertFile": "/opt/webauthn/mds/root.pem"
+		}
+	}`
+	counterPolicyConfigFileContent = `{
+		"WebAuthn": {
+			"RPID": "localhost",
+			"RPName": "WebAuthn local host",
+			"RPIcon": "",
+			"Timeout": 30000,
+			"ChallengeLength": 32,
+			"AuthenticatorAttachment": "cross-platform",
+			"ResidentKey": "preferred",
+			"UserVerification": "preferred",
+			"Attestation": "direct",
+			"CredentialAlgs": [ -7, -37, -257 ]
+		},
+		"Origin": "https://localhost:8443",
+		"CounterPolicy": "disable"
+	}`
+	invalidCounterPolicyConfigFileContent = `{
+		"WebAuthn": {
+			"RPID": "localhost",
+			"RPName": "WebAuthn local host",
+			"RPIcon": "",
+			"Timeout": 30000,
+			"ChallengeLength": 32,
+			"AuthenticatorAttachment": "cross-platform",
+			"ResidentKey": "preferred",
+			"UserVerification": "preferred",
+			"Attestation": "direct",
+			"CredentialAlgs": [ -7, -37, -257 ]
+		},
+		"Origin": "https://localhost:8443",
+		"CounterPolicy": "ignore"
+	}`
+	invalidOIDCConfigFileContent = `{
+		"WebAuthn": {
+			"RPID": "localhost",
+			"RPName": "WebAuthn local host",
+			"RPIcon": "",
+			"Timeout": 30000,
+			"ChallengeLength": 32,
+			"AuthenticatorAttachment": "cross-platform",
+			"ResidentKey": "preferred",
+			"UserVerification": "preferred",
+			"Attestation": "direct",
+			"CredentialAlgs": [ -7, -37, -257 ]
+		},
+		"Origin": "https://localhost:8443",
+		"OIDC": {
+			"Clients": [
+				{ "ClientID": "wiki", "RedirectURIs": [ "/callback" ] }
+			]
+		}
+	}`
+	invalidRateLimitConfigFileContent = `{
+		"WebAuthn": {
+			"RPID": "localhost",
+			"RPName": "WebAuthn local host",
+			"RPIcon": "",
+			"Timeout": 30000,
+			"ChallengeLength": 32,
+			"AuthenticatorAttachment": "cross-platform",
+			"ResidentKey": "preferred",
+			"UserVerification": "preferred",
+			"Attestation": "direct",
+			"CredentialAlgs": [ -7, -37, -257 ]
+		},
+		"Origin": "https://localhost:8443",
+		"RateLimit": {
+			"IPRequestsPerMinute": -60
+		}
+	}`
 	invalidWebAuthnConfigFileContent = `{
 		"WebAuthn": {
 			"RPID": "",
@@ -100,14 +226,19 @@ var (
 				"REDIS_ADDR":    "redis15.localnet.org:6390",
 				"REDIS_PWD":     "redis_password",
 			},
-			wantConfig: config{
-				WebAuthn:     webAuthnConfig,
-				Origin:       "https://localhost:8443",
-				SessionKey:   []byte("secure_session_key"),
-				DBConnString: "user=testuser password=testpassword host=localhost dbname=testdb",
-				RedisNetwork: "tcp",
-				RedisAddr:    "redis15.localnet.org:6390",
-				RedisPwd:     "redis_password",
+			wantConfig: Config{
+				WebAuthn:      webAuthnConfig,
+				Origin:        "https://localhost:8443",
+				CounterPolicy: "reject",
+				SessionKey:    []byte("secure_session_key"),
+				SessionStore:  "redis",
+				SessionMaxAge: 300,
+				DBDriver:      "postgres",
+				DBConnString:  "user=testuser password=testpassword host=localhost dbname=testdb",
+				AuditLog:      "database",
+				RedisNetwork:  "tcp",
+				RedisAddr:     "redis15.localnet.org:6390",
+				RedisPwd:      "redis_password",
 			},
 		},
 		{
@@ -117,14 +248,186 @@ var (
 				"SESSION_KEY":   base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
 				"DB_CONNSTRING": "user=testuser password=testpassword host=localhost dbname=testdb",
 			},
-			wantConfig: config{
-				WebAuthn:     webAuthnConfig,
-				Origin:       "https://localhost:8443",
-				SessionKey:   []byte("secure_session_key"),
-				DBConnString: "user=testuser password=testpassword host=localhost dbname=testdb",
-				RedisNetwork: "tcp",
-				RedisAddr:    "localhost:6379",
-				RedisPwd:     "",
+			wantConfig: Config{
+				WebAuthn:      webAuthnConfig,
+				Origin:        "https://localhost:8443",
+				CounterPolicy: "reject",
+				SessionKey:    []byte("secure_session_key"),
+				SessionStore:  "redis",
+				SessionMaxAge: 300,
+				DBDriver:      "postgres",
+				DBConnString:  "user=testuser password=testpassword host=localhost dbname=testdb",
+				AuditLog:      "database",
+				RedisNetwork:  "tcp",
+				RedisAddr:     "localhost:6379",
+				RedisPwd:      "",
+			},
+		},
+		{
+			name:              "attestation policy",
+			configFileContent: attestationPolicyConfigFileContent,
+			configEnv: map[string]string{
+				"SESSION_KEY":   base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
+				"DB_CONNSTRING": "user=testuser password=testpassword host=localhost dbname=testdb",
+			},
+			wantConfig: Config{
+				WebAuthn: webAuthnConfig,
+				Origin:   "https://localhost:8443",
+				AttestationPolicy: &attestationPolicyConfig{
+					AttestationTypes: []string{"Basic", "AttCA"},
+					TrustAnchorDir:   "/opt/webauthn/roots",
+				},
+				CounterPolicy: "reject",
+				SessionKey:    []byte("secure_session_key"),
+				SessionStore:  "redis",
+				SessionMaxAge: 300,
+				DBDriver:      "postgres",
+				DBConnString:  "user=testuser password=testpassword host=localhost dbname=testdb",
+				AuditLog:      "database",
+				RedisNetwork:  "tcp",
+				RedisAddr:     "localhost:6379",
+				RedisPwd:      "",
+			},
+		},
+		{
+			name:              "counter policy",
+			configFileContent: counterPolicyConfigFileContent,
+			configEnv: map[string]string{
+				"SESSION_KEY":   base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
+				"DB_CONNSTRING": "user=testuser password=testpassword host=localhost dbname=testdb",
+			},
+			wantConfig: Config{
+				WebAuthn:      webAuthnConfig,
+				Origin:        "https://localhost:8443",
+				CounterPolicy: "disable",
+				SessionKey:    []byte("secure_session_key"),
+				SessionStore:  "redis",
+				SessionMaxAge: 300,
+				DBDriver:      "postgres",
+				DBConnString:  "user=testuser password=testpassword host=localhost dbname=testdb",
+				AuditLog:      "database",
+				RedisNetwork:  "tcp",
+				RedisAddr:     "localhost:6379",
+				RedisPwd:      "",
+			},
+		},
+		{
+			name:              "sqlite database",
+			configFileContent: configFileContent,
+			configEnv: map[string]string{
+				"SESSION_KEY":   base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
+				"DB_DRIVER":     "sqlite",
+				"DB_CONNSTRING": "",
+			},
+			wantConfig: Config{
+				WebAuthn:      webAuthnConfig,
+				Origin:        "https://localhost:8443",
+				CounterPolicy: "reject",
+				SessionKey:    []byte("secure_session_key"),
+				SessionStore:  "redis",
+				SessionMaxAge: 300,
+				DBDriver:      "sqlite",
+				DBConnString:  "webauthn.db",
+				AuditLog:      "database",
+				RedisNetwork:  "tcp",
+				RedisAddr:     "localhost:6379",
+				RedisPwd:      "",
+			},
+		},
+		{
+			name:              "in-memory database",
+			configFileContent: configFileContent,
+			configEnv: map[string]string{
+				"SESSION_KEY":   base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
+				"DB_DRIVER":     "memory",
+				"DB_CONNSTRING": "",
+			},
+			wantConfig: Config{
+				WebAuthn:      webAuthnConfig,
+				Origin:        "https://localhost:8443",
+				CounterPolicy: "reject",
+				SessionKey:    []byte("secure_session_key"),
+				SessionStore:  "redis",
+				SessionMaxAge: 300,
+				DBDriver:      "memory",
+				AuditLog:      "memory",
+				RedisNetwork:  "tcp",
+				RedisAddr:     "localhost:6379",
+				RedisPwd:      "",
+			},
+		},
+		{
+			name:              "auto migrate",
+			configFileContent: configFileContent,
+			configEnv: map[string]string{
+				"SESSION_KEY":     base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
+				"DB_DRIVER":       "sqlite",
+				"DB_CONNSTRING":   "",
+				"DB_AUTO_MIGRATE": "true",
+			},
+			wantConfig: Config{
+				WebAuthn:      webAuthnConfig,
+				Origin:        "https://localhost:8443",
+				CounterPolicy: "reject",
+				SessionKey:    []byte("secure_session_key"),
+				SessionStore:  "redis",
+				SessionMaxAge: 300,
+				DBDriver:      "sqlite",
+				DBConnString:  "webauthn.db",
+				DBAutoMigrate: true,
+				AuditLog:      "database",
+				RedisNetwork:  "tcp",
+				RedisAddr:     "localhost:6379",
+				RedisPwd:      "",
+			},
+		},
+		{
+			name:              "memory session store",
+			configFileContent: configFileContent,
+			configEnv: map[string]string{
+				"SESSION_KEY":     base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
+				"SESSION_STORE":   "memory",
+				"SESSION_MAX_AGE": "900",
+				"DB_DRIVER":       "memory",
+				"DB_CONNSTRING":   "",
+			},
+			wantConfig: Config{
+				WebAuthn:      webAuthnConfig,
+				Origin:        "https://localhost:8443",
+				CounterPolicy: "reject",
+				SessionKey:    []byte("secure_session_key"),
+				SessionStore:  "memory",
+				SessionMaxAge: 900,
+				DBDriver:      "memory",
+				AuditLog:      "memory",
+				RedisNetwork:  "tcp",
+				RedisAddr:     "localhost:6379",
+				RedisPwd:      "",
+			},
+		},
+		{
+			name:              "file audit log",
+			configFileContent: configFileContent,
+			configEnv: map[string]string{
+				"SESSION_KEY":    base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
+				"DB_DRIVER":      "memory",
+				"DB_CONNSTRING":  "",
+				"AUDIT_LOG":      "file",
+				"AUDIT_LOG_FILE": "/var/log/webauthn/audit.log",
+			},
+			wantConfig: Config{
+				WebAuthn:      webAuthnConfig,
+				Origin:        "https://localhost:8443",
+				CounterPolicy: "reject",
+				SessionKey:    []byte("secure_session_key"),
+				SessionStore:  "redis",
+				SessionMaxAge: 300,
+				DBDriver:      "memory",
+				AuditLog:      "file",
+				AuditLogFile:  "/var/log/webauthn/audit.log",
+				RedisNetwork:  "tcp",
+				RedisAddr:     "localhost:6379",
+				RedisPwd:      "",
 			},
 		},
 	}
@@ -157,6 +460,51 @@ var (
 			},
 			wantErrorMsg: "origin is empty",
 		},
+		{
+			name:              "invalid attestation policy",
+			configFileContent: invalidAttestationPolicyConfigFileContent,
+			configEnv: map[string]string{
+				"SESSION_KEY":   base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
+				"DB_CONNSTRING": "user=testuser password=testpassword host=localhost dbname=testdb",
+			},
+			wantErrorMsg: "attestation policy has unsupported attestation type \"ECDAA\"",
+		},
+		{
+			name:              "invalid metadata service",
+			configFileContent: invalidMetadataServiceConfigFileContent,
+			configEnv: map[string]string{
+				"SESSION_KEY":   base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
+				"DB_CONNSTRING": "user=testuser password=testpassword host=localhost dbname=testdb",
+			},
+			wantErrorMsg: "metadata service BLOB file is empty",
+		},
+		{
+			name:              "invalid counter policy",
+			configFileContent: invalidCounterPolicyConfigFileContent,
+			configEnv: map[string]string{
+				"SESSION_KEY":   base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
+				"DB_CONNSTRING": "user=testuser password=testpassword host=localhost dbname=testdb",
+			},
+			wantErrorMsg: "counter policy \"ignore\" is not supported",
+		},
+		{
+			name:              "invalid OIDC config",
+			configFileContent: invalidOIDCConfigFileContent,
+			configEnv: map[string]string{
+				"SESSION_KEY":   base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
+				"DB_CONNSTRING": "user=testuser password=testpassword host=localhost dbname=testdb",
+			},
+			wantErrorMsg: "OIDC client \"wiki\" has invalid redirect URI \"/callback\"",
+		},
+		{
+			name:              "invalid rate limit config",
+			configFileContent: invalidRateLimitConfigFileContent,
+			configEnv: map[string]string{
+				"SESSION_KEY":   base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
+				"DB_CONNSTRING": "user=testuser password=testpassword host=localhost dbname=testdb",
+			},
+			wantErrorMsg: "rate limit is negative",
+		},
 		{
 			name:              "empty session key",
 			configFileContent: configFileContent,
@@ -175,6 +523,77 @@ var (
 			},
 			wantErrorMsg: "DB_CONNSTRING is empty",
 		},
+		{
+			name:              "unsupported session store",
+			configFileContent: configFileContent,
+			configEnv: map[string]string{
+				"SESSION_KEY":   base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
+				"SESSION_STORE": "memcached",
+				"DB_CONNSTRING": "user=testuser password=testpassword host=localhost dbname=testdb",
+			},
+			wantErrorMsg: "SESSION_STORE \"memcached\" is not supported",
+		},
+		{
+			name:              "invalid session max age",
+			configFileContent: configFileContent,
+			configEnv: map[string]string{
+				"SESSION_KEY":     base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
+				"SESSION_MAX_AGE": "-1",
+				"DB_CONNSTRING":   "user=testuser password=testpassword host=localhost dbname=testdb",
+			},
+			wantErrorMsg: "SESSION_MAX_AGE \"-1\" is not a positive number of seconds",
+		},
+		{
+			name:              "invalid auto migrate",
+			configFileContent: configFileContent,
+			configEnv: map[string]string{
+				"SESSION_KEY":     base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
+				"DB_CONNSTRING":   "user=testuser password=testpassword host=localhost dbname=testdb",
+				"DB_AUTO_MIGRATE": "sometimes",
+			},
+			wantErrorMsg: "DB_AUTO_MIGRATE \"sometimes\" is not a boolean",
+		},
+		{
+			name:              "database session store without database",
+			configFileContent: configFileContent,
+			configEnv: map[string]string{
+				"SESSION_KEY":   base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
+				"SESSION_STORE": "database",
+				"DB_DRIVER":     "memory",
+			},
+			wantErrorMsg: "SESSION_STORE \"database\" requires DB_DRIVER \"postgres\" or \"sqlite\"",
+		},
+		{
+			name:              "unsupported db driver",
+			configFileContent: configFileContent,
+			configEnv: map[string]string{
+				"SESSION_KEY":   base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
+				"DB_DRIVER":     "mysql",
+				"DB_CONNSTRING": "user=testuser password=testpassword host=localhost dbname=testdb",
+			},
+			wantErrorMsg: "DB_DRIVER \"mysql\" is not supported",
+		},
+		{
+			name:              "unsupported audit log",
+			configFileContent: configFileContent,
+			configEnv: map[string]string{
+				"SESSION_KEY":   base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
+				"DB_CONNSTRING": "user=testuser password=testpassword host=localhost dbname=testdb",
+				"AUDIT_LOG":     "syslog",
+			},
+			wantErrorMsg: "AUDIT_LOG \"syslog\" is not supported",
+		},
+		{
+			name:              "database audit log without database",
+			configFileContent: configFileContent,
+			configEnv: map[string]string{
+				"SESSION_KEY":   base64.RawStdEncoding.EncodeToString([]byte("secure_session_key")),
+				"DB_DRIVER":     "memory",
+				"DB_CONNSTRING": "",
+				"AUDIT_LOG":     "database",
+			},
+			wantErrorMsg: "AUDIT_LOG \"database\" requires DB_DRIVER \"postgres\" or \"sqlite\"",
+		},
 	}
 )
 
@@ -194,12 +613,12 @@ func TestNewConfig(t *testing.T) {
 					defer os.Unsetenv(k)
 				}
 			}
-			c, err := newConfig(strings.NewReader(tc.configFileContent))
+			c, err := NewConfig(strings.NewReader(tc.configFileContent))
 			if err != nil {
-				t.Errorf("newConfig returns error %s", err)
+				t.Errorf("NewConfig returns error %s", err)
 			}
 			if !reflect.DeepEqual(*c, tc.wantConfig) {
-				t.Errorf("newConfig returns %+v, want %+v", *c, tc.wantConfig)
+				t.Errorf("NewConfig returns %+v, want %+v", *c, tc.wantConfig)
 			}
 		})
 	}
@@ -221,10 +640,10 @@ func TestNewConfigError(t *testing.T) {
 					defer os.Unsetenv(k)
 				}
 			}
-			if _, err := newConfig(strings.NewReader(tc.configFileContent)); err == nil {
-				t.Errorf("newConfig returns no error, want error containing substring %q", tc.wantErrorMsg)
+			if _, err := NewConfig(strings.NewReader(tc.configFileContent)); err == nil {
+				t.Errorf("NewConfig returns no error, want error containing substring %q", tc.wantErrorMsg)
 			} else if !strings.Contains(err.Error(), tc.wantErrorMsg) {
-				t.Errorf("newConfig returns error %q, want error containing substring %q", err, tc.wantErrorMsg)
+				t.Errorf("NewConfig returns error %q, want error containing substring %q", err, tc.wantErrorMsg)
 			}
 		})
 	}
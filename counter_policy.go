@@ -0,0 +1,26 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+// Supported CounterPolicy values in config file.  Counter policy is applied when signature counter
+// in assertion doesn't increase, which indicates that authenticator may be cloned.
+const (
+	counterPolicyReject  = "reject"  // reject login (default)
+	counterPolicyFlag    = "flag"    // allow login and flag credential
+	counterPolicyDisable = "disable" // reject login and disable credential
+)
+
+func validCounterPolicy(policy string) bool {
+	switch policy {
+	case counterPolicyReject, counterPolicyFlag, counterPolicyDisable:
+		return true
+	}
+	return false
+}
+
+// counterRegressed returns true if signature counter didn't increase since previous login.
+// Authenticators that don't support signature counter always return 0.
+func counterRegressed(prevCounter uint32, counter uint32) bool {
+	return (counter != 0 || prevCounter != 0) && counter <= prevCounter
+}
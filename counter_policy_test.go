@@ -0,0 +1,26 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import "testing"
+
+func TestCounterRegressed(t *testing.T) {
+	testCases := []struct {
+		prevCounter uint32
+		counter     uint32
+		want        bool
+	}{
+		{0, 0, false}, // authenticator doesn't support signature counter
+		{0, 1, false},
+		{1, 2, false},
+		{2, 2, true},
+		{2, 1, true},
+		{2, 0, true},
+	}
+	for _, tc := range testCases {
+		if got := counterRegressed(tc.prevCounter, tc.counter); got != tc.want {
+			t.Errorf("counterRegressed(%d, %d) returns %t, want %t", tc.prevCounter, tc.counter, got, tc.want)
+		}
+	}
+}
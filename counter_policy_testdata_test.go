@@ -0,0 +1,141 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"net/http"
+
+	"github.com/stretchr/testify/mock"
+)
+
+const (
+	// Assertion fixture has signature counter 0, so stored counter 5 is a counter regression.
+	mockRegressedCounter = uint32(5)
+
+	counterPolicyErrorResponseRejected = `{
+		"status": "failed",
+		"errorMessage": "Failed to verify assertion: cloned authenticator is detected"
+	}`
+
+	counterPolicyErrorResponseDisabled = `{
+		"status": "failed",
+		"errorMessage": "Credential is disabled because cloned authenticator is detected"
+	}`
+
+	counterPolicyErrorResponseCredentialDisabled = `{
+		"status": "failed",
+		"errorMessage": "Credential is disabled"
+	}`
+
+	counterPolicyErrorResponseCounterChanged = `{
+		"status": "failed",
+		"errorMessage": "Failed to update credential: signature counter is changed by another login"
+	}`
+)
+
+var (
+	counterPolicyTests = handlerTest{
+		requestMethod:     "POST",
+		requestURL:        "/assertion/result",
+		equalResponseBody: equalServerResponse,
+		testcases: []handlerTestData{
+			{
+				name:                 "counter regression with reject policy",
+				server:               getMockServerWithCounterPolicy(counterPolicyReject),
+				initMockDataStore:    initDataStoreCounterRegressionRejected,
+				initMockSessionStore: initSessionStore(getAssertionOptionsExistingUserSession, getUserSession),
+				requestBody:          assertionResultRequest,
+				wantStatusCode:       http.StatusBadRequest,
+				wantResponseBody:     counterPolicyErrorResponseRejected,
+			},
+			{
+				name:                 "counter regression with flag policy",
+				server:               getMockServerWithCounterPolicy(counterPolicyFlag),
+				initMockDataStore:    initDataStoreCounterRegressionFlagged,
+				initMockSessionStore: initSessionStore(getAssertionOptionsExistingUserSession, getUserSession),
+				requestBody:          assertionResultRequest,
+				wantStatusCode:       http.StatusOK,
+				wantResponseBody:     assertionResultSuccessResponse,
+			},
+			{
+				name:                 "counter regression with disable policy",
+				server:               getMockServerWithCounterPolicy(counterPolicyDisable),
+				initMockDataStore:    initDataStoreCounterRegressionDisabled,
+				initMockSessionStore: initSessionStore(getAssertionOptionsExistingUserSession, getUserSession),
+				requestBody:          assertionResultRequest,
+				wantStatusCode:       http.StatusForbidden,
+				wantResponseBody:     counterPolicyErrorResponseDisabled,
+			},
+			{
+				name:                 "disabled credential",
+				server:               getMockServerWithCounterPolicy(counterPolicyDisable),
+				initMockDataStore:    initDataStoreGetDisabledCredential,
+				initMockSessionStore: initSessionStore(getAssertionOptionsExistingUserSession, getUserSession),
+				requestBody:          assertionResultRequest,
+				wantStatusCode:       http.StatusForbidden,
+				wantResponseBody:     counterPolicyErrorResponseCredentialDisabled,
+			},
+			{
+				name:                 "counter changed by concurrent login",
+				server:               getMockServer(),
+				initMockDataStore:    initDataStoreUpdateCredentialCounterChanged,
+				initMockSessionStore: initSessionStore(getAssertionOptionsExistingUserSession, getUserSession),
+				requestBody:          assertionResultRequest,
+				wantStatusCode:       http.StatusConflict,
+				wantResponseBody:     counterPolicyErrorResponseCounterChanged,
+			},
+		},
+	}
+)
+
+func getMockServerWithCounterPolicy(policy string) *Server {
+	s := getMockServer()
+	s.counterPolicy = policy
+	return s
+}
+
+func getRegressedCounterCredential() *Credential {
+	c := *mockCredential // make a copy of credentialMock
+	c.Counter = mockRegressedCounter
+	return &c
+}
+
+func mockCloneEvent(action string) interface{} {
+	return mock.MatchedBy(func(e *CloneEvent) bool {
+		return e.PrevCounter == mockRegressedCounter && e.Counter == 0 && e.Action == action
+	})
+}
+
+func initDataStoreCounterRegressionRejected(mockDataStore *MockDataStore) {
+	mockDataStore.On("GetCredential", mock.Anything, mockCredential.UserID, mockCredential.CredentialID).Return(getRegressedCounterCredential(), nil).Once()
+	mockDataStore.On("AddCloneEvent", mock.Anything, mockCloneEvent(counterPolicyReject)).Return(nil).Once()
+	mockDataStore.On("UpdateCredential", mock.Anything, mock.Anything, mock.Anything).Times(0)
+}
+
+func initDataStoreCounterRegressionFlagged(mockDataStore *MockDataStore) {
+	c2 := getRegressedCounterCredential()
+	c2.Flagged = true
+	mockDataStore.On("GetCredential", mock.Anything, mockCredential.UserID, mockCredential.CredentialID).Return(getRegressedCounterCredential(), nil).Once()
+	mockDataStore.On("AddCloneEvent", mock.Anything, mockCloneEvent(counterPolicyFlag)).Return(nil).Once()
+	mockDataStore.On("UpdateCredential", mock.Anything, c2, mockRegressedCounter).Return(nil).Once()
+}
+
+func initDataStoreCounterRegressionDisabled(mockDataStore *MockDataStore) {
+	mockDataStore.On("GetCredential", mock.Anything, mockCredential.UserID, mockCredential.CredentialID).Return(getRegressedCounterCredential(), nil).Once()
+	mockDataStore.On("AddCloneEvent", mock.Anything, mockCloneEvent(counterPolicyDisable)).Return(nil).Once()
+	mockDataStore.On("DisableCredential", mock.Anything, mockCredential.UserID, mockCredential.CredentialID).Return(nil).Once()
+	mockDataStore.On("UpdateCredential", mock.Anything, mock.Anything, mock.Anything).Times(0)
+}
+
+func initDataStoreGetDisabledCredential(mockDataStore *MockDataStore) {
+	c := *mockCredential // make a copy of credentialMock
+	c.Disabled = true
+	mockDataStore.On("GetCredential", mock.Anything, mockCredential.UserID, mockCredential.CredentialID).Return(&c, nil).Once()
+	mockDataStore.On("UpdateCredential", mock.Anything, mock.Anything, mock.Anything).Times(0)
+}
+
+func initDataStoreUpdateCredentialCounterChanged(mockDataStore *MockDataStore) {
+	mockDataStore.On("GetCredential", mock.Anything, mockCredential.UserID, mockCredential.CredentialID).Return(mockCredential, nil).Once()
+	mockDataStore.On("UpdateCredential", mock.Anything, mock.Anything, uint32(0)).Return(ErrCounterChanged).Once()
+}
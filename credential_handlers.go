@@ -0,0 +1,186 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+const maxCredentialNicknameLength = 64
+
+// credentialIDFromRequest returns credential ID decoded from "id" route variable.
+func credentialIDFromRequest(r *http.Request) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(mux.Vars(r)["id"])
+}
+
+func (s *Server) handleCredentials() http.HandlerFunc {
+	type credentialResponse struct {
+		CredentialID string `json:"credentialID"`
+		Nickname     string `json:"nickname"`
+		Description  string `json:"description"`
+		RegisteredAt string `json:"registeredAt"`
+		LoggedInAt   string `json:"loggedInAt"`
+		Current      bool   `json:"current"`  // true if credential is used by current session
+		Flagged      bool   `json:"flagged"`  // true if possible cloned authenticator is detected
+		Disabled     bool   `json:"disabled"` // true if credential can't be used to log in
+	}
+	type response struct {
+		Status      string               `json:"status"`
+		Credentials []credentialResponse `json:"credentials"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := r.Context().Value(contextKeyLoginSession).(*sessions.Session)
+		if !ok {
+			panic("Failed to get session data from context")
+		}
+		uSession, ok := session.Values[sessionMapKeyUserSession].(*userSession)
+		if !ok {
+			writeFailedServerResponse(w, http.StatusUnauthorized, "Session doesn't have user credential")
+			return
+		}
+
+		credentials, err := s.dataStore.GetCredentials(r.Context(), uSession.User.UserID)
+		if err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to query credentials in database: "+err.Error())
+			return
+		}
+		resp := response{
+			Status:      statusOK,
+			Credentials: make([]credentialResponse, len(credentials)),
+		}
+		for i, c := range credentials {
+			resp.Credentials[i] = credentialResponse{
+				CredentialID: base64.RawURLEncoding.EncodeToString(c.CredentialID),
+				Nickname:     c.Nickname,
+				Description:  c.Description,
+				RegisteredAt: c.RegisteredAt.Format("02 Jan 06 15:04 MST"),
+				LoggedInAt:   c.LoggedInAt.Format("02 Jan 06 15:04 MST"),
+				Current:      bytes.Equal(c.CredentialID, uSession.LoggedInCredentialID),
+				Flagged:      c.Flagged,
+				Disabled:     c.Disabled,
+			}
+		}
+		b, err := json.Marshal(resp)
+		if err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "failed to json marshal response body")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+func (s *Server) handleRenameCredential() http.HandlerFunc {
+	type request struct {
+		Nickname string `json:"nickname"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		aw := s.startAudit(w, r, auditEventCredentialRename)
+		defer aw.record()
+		w = aw
+
+		session, ok := r.Context().Value(contextKeyLoginSession).(*sessions.Session)
+		if !ok {
+			panic("Failed to get session data from context")
+		}
+		uSession, ok := session.Values[sessionMapKeyUserSession].(*userSession)
+		if !ok {
+			writeFailedServerResponse(w, http.StatusUnauthorized, "Session doesn't have user credential")
+			return
+		}
+		aw.event.UserID = uSession.User.UserID
+
+		// Parse and verify request.
+		credentialID, err := credentialIDFromRequest(r)
+		if err != nil {
+			writeFailedServerResponse(w, http.StatusBadRequest, "Failed to base64 decode credential ID: "+err.Error())
+			return
+		}
+		aw.event.CredentialID = credentialID
+		var renameRequest request
+		if err := json.NewDecoder(r.Body).Decode(&renameRequest); err != nil {
+			writeFailedServerResponse(w, http.StatusBadRequest, "Failed to json decode request body: "+err.Error())
+			return
+		}
+		nickname := strings.TrimSpace(renameRequest.Nickname)
+		if utf8.RuneCountInString(nickname) > maxCredentialNicknameLength {
+			writeFailedServerResponse(w, http.StatusBadRequest, "Nickname is longer than "+strconv.Itoa(maxCredentialNicknameLength)+" characters")
+			return
+		}
+
+		// Update credential nickname in datastore.
+		err = s.dataStore.RenameCredential(r.Context(), uSession.User.UserID, credentialID, nickname)
+		if err == ErrNoRecords {
+			writeFailedServerResponse(w, http.StatusNotFound, "Credential not found")
+			return
+		} else if err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to update credential: "+err.Error())
+			return
+		}
+
+		writeOKServerResponse(w)
+	}
+}
+
+func (s *Server) handleDeleteCredential(w http.ResponseWriter, r *http.Request) {
+	aw := s.startAudit(w, r, auditEventCredentialDelete)
+	defer aw.record()
+	w = aw
+
+	session, ok := r.Context().Value(contextKeyLoginSession).(*sessions.Session)
+	if !ok {
+		panic("Failed to get session data from context")
+	}
+	uSession, ok := session.Values[sessionMapKeyUserSession].(*userSession)
+	if !ok {
+		writeFailedServerResponse(w, http.StatusUnauthorized, "Session doesn't have user credential")
+		return
+	}
+
+	credentialID, err := credentialIDFromRequest(r)
+	if err != nil {
+		writeFailedServerResponse(w, http.StatusBadRequest, "Failed to base64 decode credential ID: "+err.Error())
+		return
+	}
+	aw.event.UserID = uSession.User.UserID
+	aw.event.CredentialID = credentialID
+
+	// Delete credential from datastore.
+	err = s.dataStore.DeleteCredential(r.Context(), uSession.User.UserID, credentialID)
+	if err == ErrNoRecords {
+		writeFailedServerResponse(w, http.StatusNotFound, "Credential not found")
+		return
+	} else if err == ErrLastRecord {
+		writeFailedServerResponse(w, http.StatusConflict, "Failed to delete credential: user must have at least one credential")
+		return
+	} else if err != nil {
+		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to delete credential: "+err.Error())
+		return
+	}
+
+	if bytes.Equal(credentialID, uSession.LoggedInCredentialID) {
+		// Deleted credential was used to log in, end current session.
+		delete(session.Values, sessionMapKeyUserSession)
+	} else {
+		// Remove deleted credential from user in session.
+		credentialIDs := make([][]byte, 0, len(uSession.User.CredentialIDs))
+		for _, id := range uSession.User.CredentialIDs {
+			if !bytes.Equal(id, credentialID) {
+				credentialIDs = append(credentialIDs, id)
+			}
+		}
+		uSession.User.CredentialIDs = credentialIDs
+	}
+
+	writeOKServerResponse(w)
+}
@@ -0,0 +1,289 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/mock"
+)
+
+var (
+	mockCredentialID      = "LFdoCFJTyB82ZzSJUHc-c72yraRc_1mPvGX8ToE8su39xX26Jcqd31LUkKOS36FIAWgWl6itMKqmDvruha6ywA"
+	mockOtherCredentialID = "b3RoZXJfY3JlZGVudGlhbF9pZA"
+
+	credentialsSuccessResponse = `{
+		"status": "ok",
+		"credentials": [
+			{
+				"credentialID": "LFdoCFJTyB82ZzSJUHc-c72yraRc_1mPvGX8ToE8su39xX26Jcqd31LUkKOS36FIAWgWl6itMKqmDvruha6ywA",
+				"nickname": "My security key",
+				"description": "Feitian BioPass FIDO2 Authenticator",
+				"registeredAt": "01 Jan 09 01:00 UTC",
+				"loggedInAt": "01 Feb 09 01:00 UTC",
+				"current": true,
+				"flagged": false,
+				"disabled": false
+			},
+			{
+				"credentialID": "b3RoZXJfY3JlZGVudGlhbF9pZA",
+				"nickname": "",
+				"description": "",
+				"registeredAt": "01 Mar 09 01:00 UTC",
+				"loggedInAt": "01 Mar 09 01:00 UTC",
+				"current": false,
+				"flagged": true,
+				"disabled": false
+			}
+		]
+	}`
+
+	credentialsDBErrorResponse = `{
+		"status": "failed",
+		"errorMessage": "Failed to query credentials in database: connection refused"
+	}`
+
+	credentialOKResponse = `{
+		"status": "ok",
+		"errorMessage": ""
+	}`
+
+	credentialNotFoundResponse = `{
+		"status": "failed",
+		"errorMessage": "Credential not found"
+	}`
+
+	renameCredentialBadRequestBodyResponse = `{
+		"status": "failed",
+		"errorMessage": "Failed to json decode request body: unexpected EOF"
+	}`
+
+	renameCredentialTooLongResponse = `{
+		"status": "failed",
+		"errorMessage": "Nickname is longer than 64 characters"
+	}`
+
+	deleteLastCredentialResponse = `{
+		"status": "failed",
+		"errorMessage": "Failed to delete credential: user must have at least one credential"
+	}`
+
+	credentialsTests = handlerTest{
+		requestMethod:     "GET",
+		requestURL:        "/credentials",
+		equalResponseBody: equalJSONResponse,
+		testcases: []handlerTestData{
+			{
+				name:                 "user is not logged in",
+				server:               getMockServer(),
+				initMockDataStore:    initDataStoreGetCredentialsNotCalled,
+				initMockSessionStore: initSessionStore(getEmptySession, getEmptySession),
+				requestBody:          "",
+				wantStatusCode:       http.StatusUnauthorized,
+				wantResponseBody:     userErrorResponse,
+			},
+			{
+				name:                 "database error",
+				server:               getMockServer(),
+				initMockDataStore:    initDataStoreGetCredentialsError,
+				initMockSessionStore: initSessionStore(getUserSession, getUserSession),
+				requestBody:          "",
+				wantStatusCode:       http.StatusInternalServerError,
+				wantResponseBody:     credentialsDBErrorResponse,
+			},
+			{
+				name:                 "user is logged in",
+				server:               getMockServer(),
+				initMockDataStore:    initDataStoreGetCredentials,
+				initMockSessionStore: initSessionStore(getUserSession, getUserSession),
+				requestBody:          "",
+				wantStatusCode:       http.StatusOK,
+				wantResponseBody:     credentialsSuccessResponse,
+			},
+		},
+	}
+
+	renameCredentialTests = handlerTest{
+		requestMethod:     "PATCH",
+		requestURL:        "/credentials/" + mockCredentialID,
+		equalResponseBody: equalServerResponse,
+		testcases: []handlerTestData{
+			{
+				name:                 "user is not logged in",
+				server:               getMockServer(),
+				initMockDataStore:    initDataStoreRenameCredentialNotCalled,
+				initMockSessionStore: initSessionStore(getEmptySession, getEmptySession),
+				requestBody:          `{"nickname": "My security key"}`,
+				wantStatusCode:       http.StatusUnauthorized,
+				wantResponseBody:     userErrorResponse,
+			},
+			{
+				name:                 "malformed request body",
+				server:               getMockServer(),
+				initMockDataStore:    initDataStoreRenameCredentialNotCalled,
+				initMockSessionStore: initSessionStore(getUserSession, getUserSession),
+				requestBody:          `{"nickname": "My security key"`,
+				wantStatusCode:       http.StatusBadRequest,
+				wantResponseBody:     renameCredentialBadRequestBodyResponse,
+			},
+			{
+				name:                 "nickname is too long",
+				server:               getMockServer(),
+				initMockDataStore:    initDataStoreRenameCredentialNotCalled,
+				initMockSessionStore: initSessionStore(getUserSession, getUserSession),
+				requestBody:          `{"nickname": "` + strings.Repeat("k", maxCredentialNicknameLength+1) + `"}`,
+				wantStatusCode:       http.StatusBadRequest,
+				wantResponseBody:     renameCredentialTooLongResponse,
+			},
+			{
+				name:                 "credential not found",
+				server:               getMockServer(),
+				initMockDataStore:    initDataStoreRenameCredential(ErrNoRecords),
+				initMockSessionStore: initSessionStore(getUserSession, getUserSession),
+				requestBody:          `{"nickname": " My security key "}`,
+				wantStatusCode:       http.StatusNotFound,
+				wantResponseBody:     credentialNotFoundResponse,
+			},
+			{
+				name:                 "credential is renamed",
+				server:               getMockServer(),
+				initMockDataStore:    initDataStoreRenameCredential(nil),
+				initMockSessionStore: initSessionStore(getUserSession, getUserSession),
+				requestBody:          `{"nickname": " My security key "}`,
+				wantStatusCode:       http.StatusOK,
+				wantResponseBody:     credentialOKResponse,
+			},
+		},
+	}
+
+	deleteCredentialTests = handlerTest{
+		requestMethod:     "DELETE",
+		requestURL:        "/credentials/" + mockCredentialID,
+		equalResponseBody: equalServerResponse,
+		testcases: []handlerTestData{
+			{
+				name:                 "user is not logged in",
+				server:               getMockServer(),
+				initMockDataStore:    initDataStoreDeleteCredentialNotCalled,
+				initMockSessionStore: initSessionStore(getEmptySession, getEmptySession),
+				requestBody:          "",
+				wantStatusCode:       http.StatusUnauthorized,
+				wantResponseBody:     userErrorResponse,
+			},
+			{
+				name:                 "last credential",
+				server:               getMockServer(),
+				initMockDataStore:    initDataStoreDeleteCredential(mockCredentialID, ErrLastRecord),
+				initMockSessionStore: initSessionStore(getUserSession, getUserSession),
+				requestBody:          "",
+				wantStatusCode:       http.StatusConflict,
+				wantResponseBody:     deleteLastCredentialResponse,
+			},
+			{
+				name:                 "credential not found",
+				server:               getMockServer(),
+				initMockDataStore:    initDataStoreDeleteCredential(mockCredentialID, ErrNoRecords),
+				initMockSessionStore: initSessionStore(getUserSession, getUserSession),
+				requestBody:          "",
+				wantStatusCode:       http.StatusNotFound,
+				wantResponseBody:     credentialNotFoundResponse,
+			},
+			{
+				name:                 "credential used by current session",
+				server:               getMockServer(),
+				initMockDataStore:    initDataStoreDeleteCredential(mockCredentialID, nil),
+				initMockSessionStore: initSessionStore(getUserSession, getEmptySession),
+				requestBody:          "",
+				wantStatusCode:       http.StatusOK,
+				wantResponseBody:     credentialOKResponse,
+			},
+		},
+	}
+
+	deleteOtherCredentialTests = handlerTest{
+		requestMethod:     "DELETE",
+		requestURL:        "/credentials/" + mockOtherCredentialID,
+		equalResponseBody: equalServerResponse,
+		testcases: []handlerTestData{
+			{
+				name:                 "credential not used by current session",
+				server:               getMockServer(),
+				initMockDataStore:    initDataStoreDeleteCredential(mockOtherCredentialID, nil),
+				initMockSessionStore: initSessionStore(getUserSessionWithTwoCredentials, getUserSession),
+				requestBody:          "",
+				wantStatusCode:       http.StatusOK,
+				wantResponseBody:     credentialOKResponse,
+			},
+		},
+	}
+)
+
+func getUserSessionWithTwoCredentials(store sessions.Store) *sessions.Session {
+	session := getUserSession(store)
+	u := session.Values[sessionMapKeyUserSession].(*userSession).User
+	u.CredentialIDs = append(u.CredentialIDs, base64RawURLDecodeString(mockOtherCredentialID))
+	return session
+}
+
+func initDataStoreGetCredentials(mockDataStore *MockDataStore) {
+	c1 := *mockCredential
+	c1.Nickname = "My security key"
+	c1.Description = "Feitian BioPass FIDO2 Authenticator"
+	c1.RegisteredAt = time.Date(2009, time.January, 1, 1, 0, 0, 0, time.UTC)
+	c1.LoggedInAt = time.Date(2009, time.February, 1, 1, 0, 0, 0, time.UTC)
+	c2 := Credential{
+		CredentialID: base64RawURLDecodeString(mockOtherCredentialID),
+		UserID:       mockCredential.UserID,
+		RegisteredAt: time.Date(2009, time.March, 1, 1, 0, 0, 0, time.UTC),
+		LoggedInAt:   time.Date(2009, time.March, 1, 1, 0, 0, 0, time.UTC),
+		Flagged:      true,
+	}
+	mockDataStore.On("GetCredentials", mock.Anything, mockExistingUser.UserID).Return([]*Credential{&c1, &c2}, nil).Once()
+}
+
+func initDataStoreGetCredentialsError(mockDataStore *MockDataStore) {
+	mockDataStore.On("GetCredentials", mock.Anything, mockExistingUser.UserID).Return(nil, errors.New("connection refused")).Once()
+}
+
+func initDataStoreGetCredentialsNotCalled(mockDataStore *MockDataStore) {
+	mockDataStore.On("GetCredentials", mock.Anything, mock.Anything).Times(0)
+}
+
+func initDataStoreRenameCredential(err error) initMockDataStoreFunc {
+	return func(mockDataStore *MockDataStore) {
+		mockDataStore.On("RenameCredential", mock.Anything, mockExistingUser.UserID, mockCredential.CredentialID, "My security key").Return(err).Once()
+	}
+}
+
+func initDataStoreRenameCredentialNotCalled(mockDataStore *MockDataStore) {
+	mockDataStore.On("RenameCredential", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Times(0)
+}
+
+func initDataStoreDeleteCredential(credentialID string, err error) initMockDataStoreFunc {
+	return func(mockDataStore *MockDataStore) {
+		mockDataStore.On("DeleteCredential", mock.Anything, mockExistingUser.UserID, base64RawURLDecodeString(credentialID)).Return(err).Once()
+	}
+}
+
+func initDataStoreDeleteCredentialNotCalled(mockDataStore *MockDataStore) {
+	mockDataStore.On("DeleteCredential", mock.Anything, mock.Anything, mock.Anything).Times(0)
+}
+
+// equalJSONResponse compares response bodies as generic JSON values.
+func equalJSONResponse(got []byte, want []byte) (bool, error) {
+	var gotResponse, wantResponse interface{}
+	if err := json.Unmarshal(want, &wantResponse); err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(got, &gotResponse); err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(gotResponse, wantResponse), nil
+}
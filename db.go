@@ -1,35 +1,164 @@
 // Copyright (c) 2019 Faye Amacker. All rights reserved.
 // Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
 
-package main
+package webauthndemo
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"errors"
+	"log/slog"
+	"strings"
 	"time"
 )
 
-// dataStore interface is implemented by dbStore to query/insert/update user and credential data.
-type dataStore interface {
-	getUser(ctx context.Context, username string) (*user, error)
-	getCredential(ctx context.Context, userID []byte, credentialID []byte) (*credential, error)
-	getCredentialTimestamp(ctx context.Context, userID []byte, credentialID []byte) (registeredAt time.Time, loggedInAt time.Time, err error)
-	addUserCredential(ctx context.Context, u *user, c *credential) error
-	updateCredential(ctx context.Context, c *credential) error
+// DataStore is implemented by dbStore and memStore to query/insert/update user and credential data.
+// Applications can implement DataStore to keep users and credentials in their own database.
+type DataStore interface {
+	GetUser(ctx context.Context, username string) (*User, error)
+	GetUserByID(ctx context.Context, userID []byte) (*User, error)
+	GetUsers(ctx context.Context, search string, offset int, limit int) (users []*User, total int, err error)
+	GetCredential(ctx context.Context, userID []byte, credentialID []byte) (*Credential, error)
+	GetCredentialByID(ctx context.Context, credentialID []byte) (*Credential, error)
+	GetCredentials(ctx context.Context, userID []byte) ([]*Credential, error)
+	GetCredentialTimestamp(ctx context.Context, userID []byte, credentialID []byte) (registeredAt time.Time, loggedInAt time.Time, err error)
+	AddUserCredential(ctx context.Context, u *User, c *Credential) error
+	UpdateCredential(ctx context.Context, c *Credential, prevCounter uint32) error
+	DisableCredential(ctx context.Context, userID []byte, credentialID []byte) error
+	RenameCredential(ctx context.Context, userID []byte, credentialID []byte, nickname string) error
+	DeleteCredential(ctx context.Context, userID []byte, credentialID []byte) error
+	DeleteUser(ctx context.Context, userID []byte) error
+	RevokeSessions(ctx context.Context, userID []byte, revokedAt time.Time) error
+	GetSessionsRevokedAt(ctx context.Context, userID []byte, credentialID []byte) (time.Time, error)
+	AddCloneEvent(ctx context.Context, e *CloneEvent) error
+	GetCloneEvents(ctx context.Context, userID []byte) ([]*CloneEvent, error)
+	AddRefreshToken(ctx context.Context, t *RefreshToken) error
+	GetRefreshToken(ctx context.Context, tokenHash []byte) (*RefreshToken, error)
+	DeleteRefreshToken(ctx context.Context, tokenHash []byte) error
+	ReplaceRecoveryCodes(ctx context.Context, userID []byte, codes []*RecoveryCode) error
+	GetRecoveryCodes(ctx context.Context, userID []byte) ([]*RecoveryCode, error)
+	DeleteRecoveryCode(ctx context.Context, userID []byte, codeHash []byte) error
 }
 
+// dbStore is a DataStore backed by PostgreSQL or SQLite.
 type dbStore struct {
 	*sql.DB
+	driver string       // dbDriverPostgres or dbDriverSQLite
+	logger *slog.Logger // logs SQL queries if not nil
 }
 
+// logQuery logs query at debug level, or at error level if query failed.
+func (db *dbStore) logQuery(ctx context.Context, query string, start time.Time, err error) {
+	if db.logger == nil {
+		return
+	}
+	if err != nil && err != sql.ErrNoRows {
+		db.logger.ErrorContext(ctx, "SQL query failed", "query", query, "latency", time.Since(start), "error", err)
+		return
+	}
+	db.logger.DebugContext(ctx, "SQL query", "query", query, "latency", time.Since(start))
+}
+
+// ExecContext executes query and logs it.
+func (db *dbStore) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	res, err := db.DB.ExecContext(ctx, query, args...)
+	db.logQuery(ctx, query, start, err)
+	return res, err
+}
+
+// QueryContext executes query that returns rows and logs it.
+func (db *dbStore) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := db.DB.QueryContext(ctx, query, args...)
+	db.logQuery(ctx, query, start, err)
+	return rows, err
+}
+
+// QueryRowContext executes query that returns at most one row and logs it.
+func (db *dbStore) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := db.DB.QueryRowContext(ctx, query, args...)
+	db.logQuery(ctx, query, start, row.Err())
+	return row
+}
+
+// Supported DB_DRIVER values.
+const (
+	dbDriverPostgres = "postgres"
+	dbDriverSQLite   = "sqlite"
+	dbDriverMemory   = "memory"
+)
+
+// newDataStore returns DataStore for driver.  connString is ignored by memory driver.
+func newDataStore(driver string, connString string) (DataStore, error) {
+	switch driver {
+	case dbDriverPostgres:
+		db, err := openPostgres(connString)
+		if err != nil {
+			return nil, err
+		}
+		return &dbStore{DB: db, driver: driver}, nil
+	case dbDriverSQLite:
+		return newSQLiteStore(connString)
+	case dbDriverMemory:
+		return newMemStore(), nil
+	}
+	return nil, errors.New("unsupported database driver \"" + driver + "\"")
+}
+
+// openPostgres opens PostgreSQL database and verifies connection.
+func openPostgres(connString string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", connString)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// migrate applies pending schema migrations.
+func (db *dbStore) migrate(ctx context.Context) ([]MigrationStatus, error) {
+	m, err := newMigrator(db.DB, db.driver)
+	if err != nil {
+		return nil, err
+	}
+	return m.Up(ctx)
+}
+
+// pendingMigrations returns schema migrations that aren't applied.
+func (db *dbStore) pendingMigrations(ctx context.Context) ([]MigrationStatus, error) {
+	m, err := newMigrator(db.DB, db.driver)
+	if err != nil {
+		return nil, err
+	}
+	status, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []MigrationStatus
+	for _, s := range status {
+		if s.AppliedAt.IsZero() {
+			pending = append(pending, s)
+		}
+	}
+	return pending, nil
+}
+
+// Errors returned by DataStore.
 var (
-	errNoRecords    = errors.New("webauthn/datastore: no records")
-	errRecordExists = errors.New("webauthn/datastore: record exists")
+	ErrNoRecords      = errors.New("webauthn/datastore: no records")
+	ErrRecordExists   = errors.New("webauthn/datastore: record exists")
+	ErrLastRecord     = errors.New("webauthn/datastore: last record")
+	ErrCounterChanged = errors.New("webauthn/datastore: counter changed")
 )
 
-// getUser queries user by username.  If user doesn't exist, returns errNoRecords.
-func (db *dbStore) getUser(ctx context.Context, username string) (*user, error) {
+// GetUser queries user by username.  If user doesn't exist, returns ErrNoRecords.
+func (db *dbStore) GetUser(ctx context.Context, username string) (*User, error) {
 	query := "SELECT users.id, display_name, credentials.id FROM users, credentials WHERE users.id = credentials.user_id AND username = $1"
 	rows, err := db.QueryContext(ctx, query, username)
 	if err != nil {
@@ -37,7 +166,7 @@ func (db *dbStore) getUser(ctx context.Context, username string) (*user, error)
 	}
 	defer rows.Close()
 
-	u := &user{
+	u := &User{
 		UserName: username,
 	}
 	for rows.Next() {
@@ -51,33 +180,143 @@ func (db *dbStore) getUser(ctx context.Context, username string) (*user, error)
 		return nil, err
 	}
 	if u.UserID == nil {
-		return nil, errNoRecords
+		return nil, ErrNoRecords
+	}
+	return u, nil
+}
+
+// GetUserByID queries user by user id.  If user doesn't exist, returns ErrNoRecords.
+func (db *dbStore) GetUserByID(ctx context.Context, userID []byte) (*User, error) {
+	query := "SELECT username, display_name, credentials.id FROM users, credentials WHERE users.id = credentials.user_id AND users.id = $1"
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	u := &User{
+		UserID: userID,
+	}
+	for rows.Next() {
+		var credentialID []byte
+		if err := rows.Scan(&u.UserName, &u.DisplayName, &credentialID); err != nil {
+			return nil, err
+		}
+		u.CredentialIDs = append(u.CredentialIDs, credentialID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if u.CredentialIDs == nil {
+		return nil, ErrNoRecords
 	}
 	return u, nil
 }
 
-// getCredential queries credential by user id and credential id.  If credential doesn't exist, returns errNoRecords.
-func (db *dbStore) getCredential(ctx context.Context, userID []byte, credentialID []byte) (*credential, error) {
-	c := &credential{
+// likePattern returns LIKE pattern matching strings containing s, with LIKE wildcards in s escaped by backslash.
+func likePattern(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+	return "%" + s + "%"
+}
+
+// GetUsers queries users whose username or display name contains search, case-insensitively, ordered by
+// username.  It returns at most limit users after skipping offset users, and total number of matched users.
+func (db *dbStore) GetUsers(ctx context.Context, search string, offset int, limit int) (users []*User, total int, err error) {
+	where := "WHERE LOWER(username) LIKE $1 ESCAPE '\\' OR LOWER(display_name) LIKE $1 ESCAPE '\\'"
+	pattern := likePattern(strings.ToLower(search))
+	row := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users "+where, pattern)
+	if err = row.Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := "SELECT u.id, u.username, u.display_name, credentials.id FROM (SELECT id, username, display_name FROM users " + where + " ORDER BY username LIMIT $2 OFFSET $3) u LEFT JOIN credentials ON u.id = credentials.user_id ORDER BY u.username, credentials.registered_at, credentials.id"
+	rows, err := db.QueryContext(ctx, query, pattern, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u User
+		var credentialID []byte
+		if err := rows.Scan(&u.UserID, &u.UserName, &u.DisplayName, &credentialID); err != nil {
+			return nil, 0, err
+		}
+		if len(users) == 0 || !bytes.Equal(users[len(users)-1].UserID, u.UserID) {
+			users = append(users, &u)
+		}
+		if credentialID != nil {
+			last := users[len(users)-1]
+			last.CredentialIDs = append(last.CredentialIDs, credentialID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+// GetCredential queries credential by user id and credential id.  If credential doesn't exist, returns ErrNoRecords.
+func (db *dbStore) GetCredential(ctx context.Context, userID []byte, credentialID []byte) (*Credential, error) {
+	c := &Credential{
 		CredentialID: credentialID,
 		UserID:       userID,
 	}
-	query := "SELECT counter, cose_key FROM credentials WHERE user_id = $1 AND id = $2"
+	query := "SELECT counter, cose_key, aaguid, description, flagged, disabled FROM credentials WHERE user_id = $1 AND id = $2"
 	row := db.QueryRowContext(ctx, query, userID, credentialID)
-	if err := row.Scan(&c.Counter, &c.CoseKey); err == sql.ErrNoRows {
-		return nil, errNoRecords
+	if err := row.Scan(&c.Counter, &c.CoseKey, &c.AAGUID, &c.Description, &c.Flagged, &c.Disabled); err == sql.ErrNoRows {
+		return nil, ErrNoRecords
 	} else if err != nil {
 		return nil, err
 	}
 	return c, nil
 }
 
-// getCredentialTimestamp queries credential's registered and last logged in timestamp by user id and credential id.  If credential doesn't exist, returns errNoRecords.
-func (db *dbStore) getCredentialTimestamp(ctx context.Context, userID []byte, credentialID []byte) (registeredAt time.Time, loggedInAt time.Time, err error) {
+// GetCredentialByID queries credential by credential id only.  It is used by usernameless login to find
+// credential owner.  If credential doesn't exist, returns ErrNoRecords.
+func (db *dbStore) GetCredentialByID(ctx context.Context, credentialID []byte) (*Credential, error) {
+	c := &Credential{
+		CredentialID: credentialID,
+	}
+	query := "SELECT user_id, counter, cose_key, aaguid, description, flagged, disabled FROM credentials WHERE id = $1"
+	row := db.QueryRowContext(ctx, query, credentialID)
+	if err := row.Scan(&c.UserID, &c.Counter, &c.CoseKey, &c.AAGUID, &c.Description, &c.Flagged, &c.Disabled); err == sql.ErrNoRows {
+		return nil, ErrNoRecords
+	} else if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCredentials queries all credentials of a user by user id, ordered by registration time.
+func (db *dbStore) GetCredentials(ctx context.Context, userID []byte) ([]*Credential, error) {
+	query := "SELECT id, counter, cose_key, aaguid, description, nickname, registered_at, loggedin_at, flagged, disabled FROM credentials WHERE user_id = $1 ORDER BY registered_at, id"
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credentials []*Credential
+	for rows.Next() {
+		c := &Credential{UserID: userID}
+		if err := rows.Scan(&c.CredentialID, &c.Counter, &c.CoseKey, &c.AAGUID, &c.Description, &c.Nickname, &c.RegisteredAt, &c.LoggedInAt, &c.Flagged, &c.Disabled); err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+// GetCredentialTimestamp queries credential's registered and last logged in timestamp by user id and credential id.  If credential doesn't exist, returns ErrNoRecords.
+func (db *dbStore) GetCredentialTimestamp(ctx context.Context, userID []byte, credentialID []byte) (registeredAt time.Time, loggedInAt time.Time, err error) {
 	query := "SELECT registered_at, loggedin_at FROM credentials WHERE user_id = $1 AND id = $2"
 	row := db.QueryRowContext(ctx, query, userID, credentialID)
 	if err = row.Scan(&registeredAt, &loggedInAt); err == sql.ErrNoRows {
-		err = errNoRecords
+		err = ErrNoRecords
 		return
 	} else if err != nil {
 		return
@@ -85,10 +324,11 @@ func (db *dbStore) getCredentialTimestamp(ctx context.Context, userID []byte, cr
 	return
 }
 
-// addUserCredential inserts user and credential.  If user exists, it skips user.  If both user and credential exist, it returns errRecordExists.
-func (db *dbStore) addUserCredential(ctx context.Context, u *user, c *credential) error {
-	userQuery := "INSERT INTO users (id, username, display_name) VALUES ($1, $2, $3) ON CONFLICT ON CONSTRAINT users_pkey DO NOTHING"
-	credentialQuery := "INSERT INTO credentials (id, user_id, counter, cose_key, registered_at, loggedin_at) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT ON CONSTRAINT credentials_pkey DO NOTHING"
+// AddUserCredential inserts user and credential.  If user exists, it skips user.  If credential id exists, it returns
+// ErrRecordExists without inserting user, because credential id must be unique to find credential owner in usernameless login.
+func (db *dbStore) AddUserCredential(ctx context.Context, u *User, c *Credential) error {
+	userQuery := "INSERT INTO users (id, username, display_name) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING"
+	credentialQuery := "INSERT INTO credentials (id, user_id, counter, cose_key, aaguid, description, registered_at, loggedin_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT DO NOTHING"
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
@@ -99,31 +339,310 @@ func (db *dbStore) addUserCredential(ctx context.Context, u *user, c *credential
 		return err
 	}
 	now := time.Now()
-	res, err := tx.Exec(credentialQuery, c.CredentialID, c.UserID, c.Counter, c.CoseKey, now, now)
+	res, err := tx.Exec(credentialQuery, c.CredentialID, c.UserID, c.Counter, c.CoseKey, c.AAGUID, c.Description, now, now)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if rowsAffected, err := res.RowsAffected(); err == nil && rowsAffected == 0 {
+		tx.Rollback()
+		return ErrRecordExists
+	}
+	return tx.Commit()
+}
+
+// UpdateCredential updates credential counter, flagged state, and last logged in timestamp by credential id and user id
+// after successful login.  Counter is updated only if stored counter is still prevCounter, so concurrent logins can't
+// both succeed with the same counter.  If credential doesn't exist, it returns ErrNoRecords.  If stored counter isn't
+// prevCounter, it returns ErrCounterChanged.
+func (db *dbStore) UpdateCredential(ctx context.Context, c *Credential, prevCounter uint32) error {
+	query := "UPDATE credentials SET counter = $1, flagged = $2, loggedin_at = $3 WHERE user_id = $4 AND id = $5 AND counter = $6"
+	res, err := db.ExecContext(ctx, query, c.Counter, c.Flagged, time.Now(), c.UserID, c.CredentialID, prevCounter)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil || rowsAffected > 0 {
+		return err
+	}
+	// Credential isn't updated, find out why.
+	var count int
+	row := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM credentials WHERE user_id = $1 AND id = $2", c.UserID, c.CredentialID)
+	if err := row.Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNoRecords
+	}
+	return ErrCounterChanged
+}
+
+// DisableCredential disables credential by user id and credential id, and deletes refresh tokens issued with it.
+// Sessions logged in with disabled credential are ended by GetSessionsRevokedAt.  If credential doesn't exist,
+// it returns ErrNoRecords.
+func (db *dbStore) DisableCredential(ctx context.Context, userID []byte, credentialID []byte) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("UPDATE credentials SET disabled = $1 WHERE user_id = $2 AND id = $3", true, userID, credentialID)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
-	if err = tx.Commit(); err != nil {
+	if rowsAffected, err := res.RowsAffected(); err == nil && rowsAffected == 0 {
+		tx.Rollback()
+		return ErrNoRecords
+	}
+	if _, err = tx.Exec("DELETE FROM refresh_tokens WHERE user_id = $1 AND credential_id = $2", userID, credentialID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RenameCredential sets credential nickname by user id and credential id.  If credential doesn't exist, it returns ErrNoRecords.
+func (db *dbStore) RenameCredential(ctx context.Context, userID []byte, credentialID []byte, nickname string) error {
+	query := "UPDATE credentials SET nickname = $1 WHERE user_id = $2 AND id = $3"
+	res, err := db.ExecContext(ctx, query, nickname, userID, credentialID)
+	if err != nil {
 		return err
 	}
 	rowsAffected, err := res.RowsAffected()
 	if err == nil && rowsAffected == 0 {
-		return errRecordExists
+		return ErrNoRecords
 	}
 	return nil
 }
 
-// updateCredential updates credential by credential id and user id.  If credential doesn't exist, it returns errNoRecords.
-func (db *dbStore) updateCredential(ctx context.Context, c *credential) error {
-	query := "UPDATE credentials SET counter = $1, loggedin_at = $2 WHERE user_id = $3 and id = $4"
-	res, err := db.ExecContext(ctx, query, c.Counter, time.Now(), c.UserID, c.CredentialID)
+// DeleteCredential deletes credential by user id and credential id.  If credential doesn't exist, it returns ErrNoRecords.
+// If credential is user's last credential, it returns ErrLastRecord because user wouldn't be able to log in without it.
+func (db *dbStore) DeleteCredential(ctx context.Context, userID []byte, credentialID []byte) error {
+	// Lock user's credentials until credential is deleted, so concurrent deletes can't remove user's last credential.
+	// SQLite doesn't support FOR UPDATE, but its only connection serializes transactions.
+	selectQuery := "SELECT id FROM credentials WHERE user_id = $1"
+	if db.driver == dbDriverPostgres {
+		selectQuery += " FOR UPDATE"
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query(selectQuery, userID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	count, found := 0, false
+	for rows.Next() {
+		var id []byte
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		count++
+		found = found || bytes.Equal(id, credentialID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if !found {
+		tx.Rollback()
+		return ErrNoRecords
+	}
+	if count == 1 {
+		tx.Rollback()
+		return ErrLastRecord
+	}
+	if _, err = tx.Exec("DELETE FROM credentials WHERE user_id = $1 AND id = $2", userID, credentialID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteUser deletes user and user's credentials, refresh tokens, and recovery codes by user id.  If user doesn't exist,
+// it returns ErrNoRecords.
+func (db *dbStore) DeleteUser(ctx context.Context, userID []byte) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM users WHERE id = $1", userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err == nil && rowsAffected == 0 {
+		return ErrNoRecords
+	}
+	return nil
+}
+
+// RevokeSessions ends user's login sessions started before revokedAt and deletes user's refresh tokens.
+// If user doesn't exist, returns ErrNoRecords.
+func (db *dbStore) RevokeSessions(ctx context.Context, userID []byte, revokedAt time.Time) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("UPDATE users SET sessions_revoked_at = $1 WHERE id = $2", revokedAt, userID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if rowsAffected, err := res.RowsAffected(); err == nil && rowsAffected == 0 {
+		tx.Rollback()
+		return ErrNoRecords
+	}
+	if _, err = tx.Exec("DELETE FROM refresh_tokens WHERE user_id = $1", userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetSessionsRevokedAt queries time user's sessions were last revoked.  It returns zero time if user's sessions
+// were never revoked.  If user doesn't exist, or credentialID isn't empty and user's credential doesn't exist
+// or is disabled, returns ErrNoRecords.
+func (db *dbStore) GetSessionsRevokedAt(ctx context.Context, userID []byte, credentialID []byte) (time.Time, error) {
+	var revokedAt sql.NullTime
+	var row *sql.Row
+	if len(credentialID) == 0 {
+		row = db.QueryRowContext(ctx, "SELECT sessions_revoked_at FROM users WHERE id = $1", userID)
+	} else {
+		query := "SELECT sessions_revoked_at FROM users WHERE id = $1 AND EXISTS (SELECT 1 FROM credentials WHERE user_id = $1 AND id = $2 AND NOT disabled)"
+		row = db.QueryRowContext(ctx, query, userID, credentialID)
+	}
+	if err := row.Scan(&revokedAt); err == sql.ErrNoRows {
+		return time.Time{}, ErrNoRecords
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return revokedAt.Time, nil
+}
+
+// AddCloneEvent inserts clone event.
+func (db *dbStore) AddCloneEvent(ctx context.Context, e *CloneEvent) error {
+	query := "INSERT INTO clone_events (user_id, credential_id, prev_counter, counter, action, detected_at) VALUES ($1, $2, $3, $4, $5, $6)"
+	_, err := db.ExecContext(ctx, query, e.UserID, e.CredentialID, e.PrevCounter, e.Counter, e.Action, e.DetectedAt)
+	return err
+}
+
+// GetCloneEvents queries all clone events of a user by user id, ordered by detection time.
+func (db *dbStore) GetCloneEvents(ctx context.Context, userID []byte) ([]*CloneEvent, error) {
+	query := "SELECT credential_id, prev_counter, counter, action, detected_at FROM clone_events WHERE user_id = $1 ORDER BY detected_at, id"
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*CloneEvent
+	for rows.Next() {
+		e := &CloneEvent{UserID: userID}
+		if err := rows.Scan(&e.CredentialID, &e.PrevCounter, &e.Counter, &e.Action, &e.DetectedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// AddRefreshToken inserts refresh token.
+func (db *dbStore) AddRefreshToken(ctx context.Context, t *RefreshToken) error {
+	query := "INSERT INTO refresh_tokens (token_hash, user_id, credential_id, user_verified, created_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6)"
+	_, err := db.ExecContext(ctx, query, t.TokenHash, t.UserID, t.CredentialID, t.UserVerified, t.CreatedAt, t.ExpiresAt)
+	return err
+}
+
+// GetRefreshToken queries refresh token by token hash.  If refresh token doesn't exist, returns ErrNoRecords.
+func (db *dbStore) GetRefreshToken(ctx context.Context, tokenHash []byte) (*RefreshToken, error) {
+	t := &RefreshToken{
+		TokenHash: tokenHash,
+	}
+	query := "SELECT user_id, credential_id, user_verified, created_at, expires_at FROM refresh_tokens WHERE token_hash = $1"
+	row := db.QueryRowContext(ctx, query, tokenHash)
+	if err := row.Scan(&t.UserID, &t.CredentialID, &t.UserVerified, &t.CreatedAt, &t.ExpiresAt); err == sql.ErrNoRows {
+		return nil, ErrNoRecords
+	} else if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// DeleteRefreshToken deletes refresh token by token hash.  If refresh token doesn't exist, it returns ErrNoRecords,
+// so only one of concurrent requests using the same refresh token succeeds.
+func (db *dbStore) DeleteRefreshToken(ctx context.Context, tokenHash []byte) error {
+	query := "DELETE FROM refresh_tokens WHERE token_hash = $1"
+	res, err := db.ExecContext(ctx, query, tokenHash)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err == nil && rowsAffected == 0 {
+		return ErrNoRecords
+	}
+	return nil
+}
+
+// ReplaceRecoveryCodes deletes user's recovery codes and inserts codes.
+func (db *dbStore) ReplaceRecoveryCodes(ctx context.Context, userID []byte, codes []*RecoveryCode) error {
+	deleteQuery := "DELETE FROM recovery_codes WHERE user_id = $1"
+	insertQuery := "INSERT INTO recovery_codes (user_id, code_hash, salt, created_at) VALUES ($1, $2, $3, $4)"
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(deleteQuery, userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, c := range codes {
+		if _, err = tx.Exec(insertQuery, userID, c.CodeHash, c.Salt, c.CreatedAt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetRecoveryCodes queries all unused recovery codes of a user by user id.
+func (db *dbStore) GetRecoveryCodes(ctx context.Context, userID []byte) ([]*RecoveryCode, error) {
+	query := "SELECT code_hash, salt, created_at FROM recovery_codes WHERE user_id = $1"
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var codes []*RecoveryCode
+	for rows.Next() {
+		c := &RecoveryCode{UserID: userID}
+		if err := rows.Scan(&c.CodeHash, &c.Salt, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		codes = append(codes, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DeleteRecoveryCode deletes a used recovery code.  If recovery code doesn't exist, it returns ErrNoRecords,
+// so only one of concurrent requests using the same recovery code succeeds.
+func (db *dbStore) DeleteRecoveryCode(ctx context.Context, userID []byte, codeHash []byte) error {
+	query := "DELETE FROM recovery_codes WHERE user_id = $1 AND code_hash = $2"
+	res, err := db.ExecContext(ctx, query, userID, codeHash)
 	if err != nil {
 		return err
 	}
 	rowsAffected, err := res.RowsAffected()
 	if err == nil && rowsAffected == 0 {
-		return errNoRecords
+		return ErrNoRecords
 	}
 	return nil
 }
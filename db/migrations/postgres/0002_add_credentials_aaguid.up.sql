@@ -0,0 +1 @@
+ALTER TABLE credentials ADD COLUMN IF NOT EXISTS aaguid BYTEA;
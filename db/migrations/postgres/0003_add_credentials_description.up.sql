@@ -0,0 +1 @@
+ALTER TABLE credentials ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE credentials ADD COLUMN IF NOT EXISTS nickname TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS clone_events (
+    id SERIAL PRIMARY KEY,
+    user_id BYTEA NOT NULL,
+    credential_id BYTEA NOT NULL,
+    prev_counter INT NOT NULL,
+    counter INT NOT NULL,
+    action TEXT NOT NULL,
+    detected_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS audit_events (
+    id SERIAL PRIMARY KEY,
+    user_id BYTEA,
+    credential_id BYTEA,
+    event_type TEXT NOT NULL,
+    outcome TEXT NOT NULL,
+    failure_reason TEXT NOT NULL DEFAULT '',
+    client_ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_user_id_created_at ON audit_events (user_id, created_at);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    user_id BYTEA NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    code_hash BYTEA NOT NULL,
+    salt BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (user_id, code_hash)
+);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS users (
+    id BLOB PRIMARY KEY,
+    username TEXT UNIQUE NOT NULL,
+    display_name TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS credentials (
+    id BLOB NOT NULL,
+    user_id BLOB NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    counter INTEGER NOT NULL,
+    cose_key BLOB NOT NULL,
+    registered_at TIMESTAMP,
+    loggedin_at TIMESTAMP,
+    PRIMARY KEY(id, user_id)
+);
@@ -0,0 +1 @@
+ALTER TABLE credentials ADD COLUMN aaguid BLOB;
@@ -0,0 +1 @@
+ALTER TABLE credentials ADD COLUMN description TEXT NOT NULL DEFAULT '';
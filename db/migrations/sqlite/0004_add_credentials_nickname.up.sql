@@ -0,0 +1 @@
+ALTER TABLE credentials ADD COLUMN nickname TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS sessions (
+    id TEXT PRIMARY KEY,
+    data BLOB NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE credentials ADD COLUMN flagged BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS clone_events;
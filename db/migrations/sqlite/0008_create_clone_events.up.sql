@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS clone_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id BLOB NOT NULL,
+    credential_id BLOB NOT NULL,
+    prev_counter INTEGER NOT NULL,
+    counter INTEGER NOT NULL,
+    action TEXT NOT NULL,
+    detected_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    user_id BLOB NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    code_hash BLOB NOT NULL,
+    salt BLOB NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, code_hash)
+);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS credentials_id_key;
@@ -0,0 +1 @@
+CREATE UNIQUE INDEX IF NOT EXISTS credentials_id_key ON credentials (id);
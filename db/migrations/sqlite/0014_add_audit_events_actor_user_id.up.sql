@@ -0,0 +1 @@
+ALTER TABLE audit_events ADD COLUMN actor_user_id BLOB;
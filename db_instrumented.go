@@ -0,0 +1,206 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentedDataStore is a DataStore that records call latency and spans of wrapped DataStore.
+type instrumentedDataStore struct {
+	DataStore
+	duration *prometheus.HistogramVec // nil if metrics are disabled
+	tracer   trace.Tracer
+}
+
+// start starts span of DataStore method call.  Returned function ends span and records latency
+// with outcome of call.
+func (s *instrumentedDataStore) start(ctx context.Context, method string, credentialID []byte) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := s.tracer.Start(ctx, "DataStore."+method, trace.WithSpanKind(trace.SpanKindClient))
+	if credentialID != nil {
+		span.SetAttributes(attrCredentialIDHash.String(credentialIDHash(credentialID)))
+	}
+	return ctx, func(err error) {
+		if s.duration != nil {
+			s.duration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+		}
+		switch err {
+		case nil:
+			span.SetAttributes(attrOutcome.String(auditOutcomeSuccess))
+		case ErrNoRecords:
+			span.SetAttributes(attrOutcome.String("no_records"))
+		default:
+			span.SetAttributes(attrOutcome.String(auditOutcomeFailure))
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+func (s *instrumentedDataStore) GetUser(ctx context.Context, username string) (*User, error) {
+	ctx, end := s.start(ctx, "GetUser", nil)
+	u, err := s.DataStore.GetUser(ctx, username)
+	end(err)
+	return u, err
+}
+
+func (s *instrumentedDataStore) GetUserByID(ctx context.Context, userID []byte) (*User, error) {
+	ctx, end := s.start(ctx, "GetUserByID", nil)
+	u, err := s.DataStore.GetUserByID(ctx, userID)
+	end(err)
+	return u, err
+}
+
+func (s *instrumentedDataStore) GetUsers(ctx context.Context, search string, offset int, limit int) ([]*User, int, error) {
+	ctx, end := s.start(ctx, "GetUsers", nil)
+	users, total, err := s.DataStore.GetUsers(ctx, search, offset, limit)
+	end(err)
+	return users, total, err
+}
+
+func (s *instrumentedDataStore) GetCredential(ctx context.Context, userID []byte, credentialID []byte) (*Credential, error) {
+	ctx, end := s.start(ctx, "GetCredential", credentialID)
+	c, err := s.DataStore.GetCredential(ctx, userID, credentialID)
+	end(err)
+	return c, err
+}
+
+func (s *instrumentedDataStore) GetCredentialByID(ctx context.Context, credentialID []byte) (*Credential, error) {
+	ctx, end := s.start(ctx, "GetCredentialByID", credentialID)
+	c, err := s.DataStore.GetCredentialByID(ctx, credentialID)
+	end(err)
+	return c, err
+}
+
+func (s *instrumentedDataStore) GetCredentials(ctx context.Context, userID []byte) ([]*Credential, error) {
+	ctx, end := s.start(ctx, "GetCredentials", nil)
+	cs, err := s.DataStore.GetCredentials(ctx, userID)
+	end(err)
+	return cs, err
+}
+
+func (s *instrumentedDataStore) GetCredentialTimestamp(ctx context.Context, userID []byte, credentialID []byte) (time.Time, time.Time, error) {
+	ctx, end := s.start(ctx, "GetCredentialTimestamp", credentialID)
+	registeredAt, loggedInAt, err := s.DataStore.GetCredentialTimestamp(ctx, userID, credentialID)
+	end(err)
+	return registeredAt, loggedInAt, err
+}
+
+func (s *instrumentedDataStore) AddUserCredential(ctx context.Context, u *User, c *Credential) error {
+	ctx, end := s.start(ctx, "AddUserCredential", c.CredentialID)
+	err := s.DataStore.AddUserCredential(ctx, u, c)
+	end(err)
+	return err
+}
+
+func (s *instrumentedDataStore) UpdateCredential(ctx context.Context, c *Credential, prevCounter uint32) error {
+	ctx, end := s.start(ctx, "UpdateCredential", c.CredentialID)
+	err := s.DataStore.UpdateCredential(ctx, c, prevCounter)
+	end(err)
+	return err
+}
+
+func (s *instrumentedDataStore) DisableCredential(ctx context.Context, userID []byte, credentialID []byte) error {
+	ctx, end := s.start(ctx, "DisableCredential", credentialID)
+	err := s.DataStore.DisableCredential(ctx, userID, credentialID)
+	end(err)
+	return err
+}
+
+func (s *instrumentedDataStore) RenameCredential(ctx context.Context, userID []byte, credentialID []byte, nickname string) error {
+	ctx, end := s.start(ctx, "RenameCredential", credentialID)
+	err := s.DataStore.RenameCredential(ctx, userID, credentialID, nickname)
+	end(err)
+	return err
+}
+
+func (s *instrumentedDataStore) DeleteCredential(ctx context.Context, userID []byte, credentialID []byte) error {
+	ctx, end := s.start(ctx, "DeleteCredential", credentialID)
+	err := s.DataStore.DeleteCredential(ctx, userID, credentialID)
+	end(err)
+	return err
+}
+
+func (s *instrumentedDataStore) DeleteUser(ctx context.Context, userID []byte) error {
+	ctx, end := s.start(ctx, "DeleteUser", nil)
+	err := s.DataStore.DeleteUser(ctx, userID)
+	end(err)
+	return err
+}
+
+func (s *instrumentedDataStore) RevokeSessions(ctx context.Context, userID []byte, revokedAt time.Time) error {
+	ctx, end := s.start(ctx, "RevokeSessions", nil)
+	err := s.DataStore.RevokeSessions(ctx, userID, revokedAt)
+	end(err)
+	return err
+}
+
+func (s *instrumentedDataStore) GetSessionsRevokedAt(ctx context.Context, userID []byte, credentialID []byte) (time.Time, error) {
+	ctx, end := s.start(ctx, "GetSessionsRevokedAt", nil)
+	revokedAt, err := s.DataStore.GetSessionsRevokedAt(ctx, userID, credentialID)
+	end(err)
+	return revokedAt, err
+}
+
+func (s *instrumentedDataStore) AddCloneEvent(ctx context.Context, e *CloneEvent) error {
+	ctx, end := s.start(ctx, "AddCloneEvent", nil)
+	err := s.DataStore.AddCloneEvent(ctx, e)
+	end(err)
+	return err
+}
+
+func (s *instrumentedDataStore) GetCloneEvents(ctx context.Context, userID []byte) ([]*CloneEvent, error) {
+	ctx, end := s.start(ctx, "GetCloneEvents", nil)
+	events, err := s.DataStore.GetCloneEvents(ctx, userID)
+	end(err)
+	return events, err
+}
+
+func (s *instrumentedDataStore) AddRefreshToken(ctx context.Context, t *RefreshToken) error {
+	ctx, end := s.start(ctx, "AddRefreshToken", nil)
+	err := s.DataStore.AddRefreshToken(ctx, t)
+	end(err)
+	return err
+}
+
+func (s *instrumentedDataStore) GetRefreshToken(ctx context.Context, tokenHash []byte) (*RefreshToken, error) {
+	ctx, end := s.start(ctx, "GetRefreshToken", nil)
+	t, err := s.DataStore.GetRefreshToken(ctx, tokenHash)
+	end(err)
+	return t, err
+}
+
+func (s *instrumentedDataStore) DeleteRefreshToken(ctx context.Context, tokenHash []byte) error {
+	ctx, end := s.start(ctx, "DeleteRefreshToken", nil)
+	err := s.DataStore.DeleteRefreshToken(ctx, tokenHash)
+	end(err)
+	return err
+}
+
+func (s *instrumentedDataStore) ReplaceRecoveryCodes(ctx context.Context, userID []byte, codes []*RecoveryCode) error {
+	ctx, end := s.start(ctx, "ReplaceRecoveryCodes", nil)
+	err := s.DataStore.ReplaceRecoveryCodes(ctx, userID, codes)
+	end(err)
+	return err
+}
+
+func (s *instrumentedDataStore) GetRecoveryCodes(ctx context.Context, userID []byte) ([]*RecoveryCode, error) {
+	ctx, end := s.start(ctx, "GetRecoveryCodes", nil)
+	codes, err := s.DataStore.GetRecoveryCodes(ctx, userID)
+	end(err)
+	return codes, err
+}
+
+func (s *instrumentedDataStore) DeleteRecoveryCode(ctx context.Context, userID []byte, codeHash []byte) error {
+	ctx, end := s.start(ctx, "DeleteRecoveryCode", nil)
+	err := s.DataStore.DeleteRecoveryCode(ctx, userID, codeHash)
+	end(err)
+	return err
+}
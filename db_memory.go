@@ -0,0 +1,424 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memStore is a concurrency-safe in-memory DataStore.  Data is lost when server stops, so
+// it is only suitable for development and tests.
+type memStore struct {
+	mu          sync.RWMutex
+	users       map[string]*User         // key is user ID, user.CredentialIDs isn't used
+	credentials map[string][]*Credential // key is user ID, credentials are in registration order
+	cloneEvents []*CloneEvent
+	tokens      map[string]*RefreshToken   // key is token hash
+	codes       map[string][]*RecoveryCode // key is user ID
+	revokedAt   map[string]time.Time       // key is user ID
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		users:       make(map[string]*User),
+		credentials: make(map[string][]*Credential),
+		tokens:      make(map[string]*RefreshToken),
+		codes:       make(map[string][]*RecoveryCode),
+		revokedAt:   make(map[string]time.Time),
+	}
+}
+
+// copyUser returns a copy of user u with user's credential IDs.  Caller must hold read lock.
+func (m *memStore) copyUser(u *User) *User {
+	u2 := &User{
+		UserID:      u.UserID,
+		UserName:    u.UserName,
+		DisplayName: u.DisplayName,
+	}
+	for _, c := range m.credentials[string(u.UserID)] {
+		u2.CredentialIDs = append(u2.CredentialIDs, c.CredentialID)
+	}
+	return u2
+}
+
+// findCredential returns index of credential in user's credentials, or -1 if it doesn't exist.  Caller must hold read lock.
+func (m *memStore) findCredential(userID []byte, credentialID []byte) int {
+	for i, c := range m.credentials[string(userID)] {
+		if bytes.Equal(c.CredentialID, credentialID) {
+			return i
+		}
+	}
+	return -1
+}
+
+// GetUser queries user by username.  If user doesn't exist, returns ErrNoRecords.
+func (m *memStore) GetUser(ctx context.Context, username string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for id, u := range m.users {
+		if u.UserName == username && len(m.credentials[id]) > 0 {
+			return m.copyUser(u), nil
+		}
+	}
+	return nil, ErrNoRecords
+}
+
+// GetUserByID queries user by user id.  If user doesn't exist, returns ErrNoRecords.
+func (m *memStore) GetUserByID(ctx context.Context, userID []byte) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[string(userID)]
+	if !ok || len(m.credentials[string(userID)]) == 0 {
+		return nil, ErrNoRecords
+	}
+	return m.copyUser(u), nil
+}
+
+// GetUsers queries users whose username or display name contains search, case-insensitively, ordered by
+// username.  It returns at most limit users after skipping offset users, and total number of matched users.
+func (m *memStore) GetUsers(ctx context.Context, search string, offset int, limit int) (users []*User, total int, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	search = strings.ToLower(search)
+	var matched []*User
+	for id, u := range m.users {
+		if len(m.credentials[id]) == 0 {
+			continue
+		}
+		if strings.Contains(strings.ToLower(u.UserName), search) || strings.Contains(strings.ToLower(u.DisplayName), search) {
+			matched = append(matched, u)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].UserName < matched[j].UserName })
+	for i := offset; i < len(matched) && i < offset+limit; i++ {
+		users = append(users, m.copyUser(matched[i]))
+	}
+	return users, len(matched), nil
+}
+
+// credentialRecord returns a copy of stored credential with the same fields as dbStore.GetCredential.  Caller must hold read lock.
+func (m *memStore) credentialRecord(userID []byte, i int) *Credential {
+	c := *m.credentials[string(userID)][i]
+	c.Nickname, c.RegisteredAt, c.LoggedInAt = "", time.Time{}, time.Time{}
+	return &c
+}
+
+// GetCredential queries credential by user id and credential id.  If credential doesn't exist, returns ErrNoRecords.
+func (m *memStore) GetCredential(ctx context.Context, userID []byte, credentialID []byte) (*Credential, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i := m.findCredential(userID, credentialID)
+	if i < 0 {
+		return nil, ErrNoRecords
+	}
+	return m.credentialRecord(userID, i), nil
+}
+
+// GetCredentialByID queries credential by credential id only.  If credential doesn't exist, returns ErrNoRecords.
+func (m *memStore) GetCredentialByID(ctx context.Context, credentialID []byte) (*Credential, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for userID := range m.credentials {
+		if i := m.findCredential([]byte(userID), credentialID); i >= 0 {
+			return m.credentialRecord([]byte(userID), i), nil
+		}
+	}
+	return nil, ErrNoRecords
+}
+
+// GetCredentials queries all credentials of a user by user id, ordered by registration time.
+func (m *memStore) GetCredentials(ctx context.Context, userID []byte) ([]*Credential, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var credentials []*Credential
+	for _, c := range m.credentials[string(userID)] {
+		c2 := *c
+		credentials = append(credentials, &c2)
+	}
+	return credentials, nil
+}
+
+// GetCredentialTimestamp queries credential's registered and last logged in timestamp by user id and credential id.  If credential doesn't exist, returns ErrNoRecords.
+func (m *memStore) GetCredentialTimestamp(ctx context.Context, userID []byte, credentialID []byte) (registeredAt time.Time, loggedInAt time.Time, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i := m.findCredential(userID, credentialID)
+	if i < 0 {
+		err = ErrNoRecords
+		return
+	}
+	c := m.credentials[string(userID)][i]
+	return c.RegisteredAt, c.LoggedInAt, nil
+}
+
+// AddUserCredential inserts user and credential.  If user exists, it skips user.  If credential id exists, it returns
+// ErrRecordExists without inserting user.
+func (m *memStore) AddUserCredential(ctx context.Context, u *User, c *Credential) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for userID := range m.credentials {
+		if m.findCredential([]byte(userID), c.CredentialID) >= 0 {
+			return ErrRecordExists
+		}
+	}
+	if _, ok := m.users[string(u.UserID)]; !ok {
+		for _, existingUser := range m.users {
+			if existingUser.UserName == u.UserName {
+				return errors.New("webauthn/datastore: username " + u.UserName + " exists")
+			}
+		}
+		m.users[string(u.UserID)] = &User{UserID: u.UserID, UserName: u.UserName, DisplayName: u.DisplayName}
+	}
+	now := time.Now()
+	c2 := *c
+	c2.Nickname, c2.RegisteredAt, c2.LoggedInAt = "", now, now
+	m.credentials[string(c.UserID)] = append(m.credentials[string(c.UserID)], &c2)
+	return nil
+}
+
+// UpdateCredential updates credential counter, flagged state, and last logged in timestamp by credential id and user id
+// if stored counter is prevCounter.  If credential doesn't exist, it returns ErrNoRecords.  If stored counter isn't
+// prevCounter, it returns ErrCounterChanged.
+func (m *memStore) UpdateCredential(ctx context.Context, c *Credential, prevCounter uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findCredential(c.UserID, c.CredentialID)
+	if i < 0 {
+		return ErrNoRecords
+	}
+	storedCredential := m.credentials[string(c.UserID)][i]
+	if storedCredential.Counter != prevCounter {
+		return ErrCounterChanged
+	}
+	storedCredential.Counter = c.Counter
+	storedCredential.Flagged = c.Flagged
+	storedCredential.LoggedInAt = time.Now()
+	return nil
+}
+
+// DisableCredential disables credential by user id and credential id, and deletes refresh tokens issued with it.
+// If credential doesn't exist, it returns ErrNoRecords.
+func (m *memStore) DisableCredential(ctx context.Context, userID []byte, credentialID []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findCredential(userID, credentialID)
+	if i < 0 {
+		return ErrNoRecords
+	}
+	m.credentials[string(userID)][i].Disabled = true
+	m.deleteRefreshTokens(userID, credentialID)
+	return nil
+}
+
+// RenameCredential sets credential nickname by user id and credential id.  If credential doesn't exist, it returns ErrNoRecords.
+func (m *memStore) RenameCredential(ctx context.Context, userID []byte, credentialID []byte, nickname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findCredential(userID, credentialID)
+	if i < 0 {
+		return ErrNoRecords
+	}
+	m.credentials[string(userID)][i].Nickname = nickname
+	return nil
+}
+
+// DeleteCredential deletes credential by user id and credential id.  If credential doesn't exist, it returns ErrNoRecords.
+// If credential is user's last credential, it returns ErrLastRecord.
+func (m *memStore) DeleteCredential(ctx context.Context, userID []byte, credentialID []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findCredential(userID, credentialID)
+	if i < 0 {
+		return ErrNoRecords
+	}
+	credentials := m.credentials[string(userID)]
+	if len(credentials) == 1 {
+		return ErrLastRecord
+	}
+	m.credentials[string(userID)] = append(credentials[:i:i], credentials[i+1:]...)
+	return nil
+}
+
+// DeleteUser deletes user and user's credentials, refresh tokens, and recovery codes by user id.  If user doesn't exist,
+// it returns ErrNoRecords.
+func (m *memStore) DeleteUser(ctx context.Context, userID []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[string(userID)]; !ok {
+		return ErrNoRecords
+	}
+	delete(m.users, string(userID))
+	delete(m.credentials, string(userID))
+	delete(m.codes, string(userID))
+	delete(m.revokedAt, string(userID))
+	m.deleteRefreshTokens(userID, nil)
+	return nil
+}
+
+// deleteRefreshTokens deletes user's refresh tokens, or only refresh tokens issued with credentialID if it
+// isn't empty.  Caller must hold write lock.
+func (m *memStore) deleteRefreshTokens(userID []byte, credentialID []byte) {
+	for tokenHash, t := range m.tokens {
+		if bytes.Equal(t.UserID, userID) && (len(credentialID) == 0 || bytes.Equal(t.CredentialID, credentialID)) {
+			delete(m.tokens, tokenHash)
+		}
+	}
+}
+
+// RevokeSessions ends user's login sessions started before revokedAt and deletes user's refresh tokens.
+// If user doesn't exist, returns ErrNoRecords.
+func (m *memStore) RevokeSessions(ctx context.Context, userID []byte, revokedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[string(userID)]; !ok {
+		return ErrNoRecords
+	}
+	m.revokedAt[string(userID)] = revokedAt
+	m.deleteRefreshTokens(userID, nil)
+	return nil
+}
+
+// GetSessionsRevokedAt queries time user's sessions were last revoked.  It returns zero time if user's sessions
+// were never revoked.  If user doesn't exist, or credentialID isn't empty and user's credential doesn't exist
+// or is disabled, returns ErrNoRecords.
+func (m *memStore) GetSessionsRevokedAt(ctx context.Context, userID []byte, credentialID []byte) (time.Time, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.users[string(userID)]; !ok {
+		return time.Time{}, ErrNoRecords
+	}
+	if len(credentialID) > 0 {
+		if i := m.findCredential(userID, credentialID); i < 0 || m.credentials[string(userID)][i].Disabled {
+			return time.Time{}, ErrNoRecords
+		}
+	}
+	return m.revokedAt[string(userID)], nil
+}
+
+// AddCloneEvent inserts clone event.
+func (m *memStore) AddCloneEvent(ctx context.Context, e *CloneEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e2 := *e
+	m.cloneEvents = append(m.cloneEvents, &e2)
+	return nil
+}
+
+// GetCloneEvents queries all clone events of a user by user id, ordered by detection time.
+func (m *memStore) GetCloneEvents(ctx context.Context, userID []byte) ([]*CloneEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var events []*CloneEvent
+	for _, e := range m.cloneEvents {
+		if bytes.Equal(e.UserID, userID) {
+			e2 := *e
+			events = append(events, &e2)
+		}
+	}
+	return events, nil
+}
+
+// AddRefreshToken inserts refresh token.
+func (m *memStore) AddRefreshToken(ctx context.Context, t *RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tokens[string(t.TokenHash)]; ok {
+		return ErrRecordExists
+	}
+	t2 := *t
+	m.tokens[string(t.TokenHash)] = &t2
+	return nil
+}
+
+// GetRefreshToken queries refresh token by token hash.  If refresh token doesn't exist, returns ErrNoRecords.
+func (m *memStore) GetRefreshToken(ctx context.Context, tokenHash []byte) (*RefreshToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	t, ok := m.tokens[string(tokenHash)]
+	if !ok {
+		return nil, ErrNoRecords
+	}
+	t2 := *t
+	return &t2, nil
+}
+
+// DeleteRefreshToken deletes refresh token by token hash.  If refresh token doesn't exist, it returns ErrNoRecords.
+func (m *memStore) DeleteRefreshToken(ctx context.Context, tokenHash []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tokens[string(tokenHash)]; !ok {
+		return ErrNoRecords
+	}
+	delete(m.tokens, string(tokenHash))
+	return nil
+}
+
+// ReplaceRecoveryCodes deletes user's recovery codes and inserts codes.
+func (m *memStore) ReplaceRecoveryCodes(ctx context.Context, userID []byte, codes []*RecoveryCode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	codes2 := make([]*RecoveryCode, len(codes))
+	for i, c := range codes {
+		c2 := *c
+		c2.UserID = userID
+		codes2[i] = &c2
+	}
+	m.codes[string(userID)] = codes2
+	return nil
+}
+
+// GetRecoveryCodes queries all unused recovery codes of a user by user id.
+func (m *memStore) GetRecoveryCodes(ctx context.Context, userID []byte) ([]*RecoveryCode, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var codes []*RecoveryCode
+	for _, c := range m.codes[string(userID)] {
+		c2 := *c
+		codes = append(codes, &c2)
+	}
+	return codes, nil
+}
+
+// DeleteRecoveryCode deletes a used recovery code.  If recovery code doesn't exist, it returns ErrNoRecords.
+func (m *memStore) DeleteRecoveryCode(ctx context.Context, userID []byte, codeHash []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	codes := m.codes[string(userID)]
+	for i, c := range codes {
+		if bytes.Equal(c.CodeHash, codeHash) {
+			m.codes[string(userID)] = append(codes[:i:i], codes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNoRecords
+}
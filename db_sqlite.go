@@ -0,0 +1,46 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// newSQLiteStore opens SQLite database file and applies pending schema migrations, so tables
+// are created if they don't exist.  dbStore queries are shared by PostgreSQL and SQLite, so they
+// must use portable SQL.
+func newSQLiteStore(dataSourceName string) (*dbStore, error) {
+	db, err := openSQLite(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	s := &dbStore{DB: db, driver: dbDriverSQLite}
+	if _, err = s.migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// openSQLite opens SQLite database file with foreign keys enabled.
+func openSQLite(dataSourceName string) (*sql.DB, error) {
+	if !strings.Contains(dataSourceName, "_pragma=foreign_keys") {
+		if strings.Contains(dataSourceName, "?") {
+			dataSourceName += "&_pragma=foreign_keys(1)"
+		} else {
+			dataSourceName += "?_pragma=foreign_keys(1)"
+		}
+	}
+	db, err := sql.Open("sqlite", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows only one writer at a time.
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
@@ -1,27 +1,31 @@
 // Copyright (c) 2019 Faye Amacker. All rights reserved.
 // Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
 
-package main
+package webauthndemo
 
 import (
 	"bytes"
 	"context"
-	"database/sql"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/suite"
 )
 
+// DBTestSuite tests DataStore implementations.  Each implementation runs the same tests.
 type DBTestSuite struct {
 	suite.Suite
-	dbStore
+	driver     string
+	connString string
+	store      DataStore
 }
 
-type credentialsByID []credential
+type credentialsByID []Credential
 
 func (c credentialsByID) Len() int { return len(c) }
 
@@ -31,7 +35,7 @@ func (c credentialsByID) Less(i, j int) bool {
 	return bytes.Compare(c[i].CredentialID, c[j].CredentialID) <= 0
 }
 
-type usersByID []user
+type usersByID []User
 
 func (u usersByID) Len() int { return len(u) }
 
@@ -42,11 +46,11 @@ func (u usersByID) Less(i, j int) bool {
 }
 
 var (
-	userNotExist = user{
+	userNotExist = User{
 		UserName: "user_not_exist",
 	}
 	// User with one credential
-	user1 = user{
+	user1 = User{
 		UserID:      []byte{117, 115, 101, 104, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
 		UserName:    "User1",
 		DisplayName: "User1 display name",
@@ -55,7 +59,7 @@ var (
 		},
 	}
 	// User with two credentials
-	user2 = user{
+	user2 = User{
 		UserID:      []byte{117, 115, 101, 104, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2},
 		UserName:    "User2",
 		DisplayName: "User2 display name",
@@ -64,95 +68,135 @@ var (
 			{99, 114, 101, 100, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3},
 		},
 	}
-	credentialNotExist = credential{
+	credentialNotExist = Credential{
 		CredentialID: []byte{99, 114, 101, 100, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
 		UserID:       []byte{117, 115, 101, 104, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
 	}
-	credential1 = credential{
+	credential1 = Credential{
 		CredentialID: []byte{99, 114, 101, 100, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
 		UserID:       []byte{117, 115, 101, 104, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
 		Counter:      1,
 		CoseKey:      []byte{1, 2, 3},
 	}
-	credential2 = credential{
+	credential2 = Credential{
 		CredentialID: []byte{99, 114, 101, 100, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2},
 		UserID:       []byte{117, 115, 101, 104, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2},
 		Counter:      2,
 		CoseKey:      []byte{1, 2, 3},
 	}
-	credential3 = credential{
+	credential3 = Credential{
 		CredentialID: []byte{99, 114, 101, 100, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3},
 		UserID:       []byte{117, 115, 101, 104, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2},
 		Counter:      3,
 		CoseKey:      []byte{1, 2, 3},
 	}
-	users       = []user{user1, user2}
-	credentials = []credential{credential1, credential2, credential3}
+	users       = []User{user1, user2}
+	credentials = []Credential{credential1, credential2, credential3}
 )
 
 func (suite *DBTestSuite) SetupSuite() {
-	connString := os.Getenv("DB_CONNSTRING")
-	if connString == "" {
-		panic("Missing env variable DB_CONNSTRING")
-	}
-	db, err := sql.Open("postgres", connString)
+	store, err := newDataStore(suite.driver, suite.connString)
 	if err != nil {
 		panic(err)
 	}
-	if err = db.Ping(); err != nil {
-		panic(err)
-	}
-	suite.dbStore.DB = db
+	suite.store = store
 }
 
 func (suite *DBTestSuite) TearDownSuite() {
-	suite.dbStore.Close()
+	if db, ok := suite.store.(*dbStore); ok {
+		db.Close()
+	}
 }
 
 func (suite *DBTestSuite) SetupTest() {
-	_, err := suite.dbStore.Exec("DELETE FROM credentials")
-	if err != nil {
-		panic(err)
-	}
-	_, err = suite.dbStore.Exec("DELETE FROM users")
-	if err != nil {
-		panic(err)
+	switch store := suite.store.(type) {
+	case *dbStore:
+		_, err := store.Exec("DELETE FROM clone_events")
+		if err != nil {
+			panic(err)
+		}
+		_, err = store.Exec("DELETE FROM refresh_tokens")
+		if err != nil {
+			panic(err)
+		}
+		_, err = store.Exec("DELETE FROM recovery_codes")
+		if err != nil {
+			panic(err)
+		}
+		_, err = store.Exec("DELETE FROM credentials")
+		if err != nil {
+			panic(err)
+		}
+		_, err = store.Exec("DELETE FROM users")
+		if err != nil {
+			panic(err)
+		}
+	case *memStore:
+		suite.store = newMemStore()
 	}
 }
 
 func (suite *DBTestSuite) seedUserCredentialTables(ctx context.Context) {
-	insertUserStmt, err := suite.dbStore.PrepareContext(ctx, "INSERT INTO users (id, username, display_name) VALUES ($1, $2, $3)")
-	if err != nil {
-		panic(err)
-	}
-	insertCredentialStmt, err := suite.dbStore.PrepareContext(ctx, "INSERT INTO credentials (id, user_id, counter, cose_key, registered_at, loggedin_at) VALUES ($1, $2, $3, $4, $5, $6)")
-	if err != nil {
-		panic(err)
-	}
-	for _, u := range users {
-		_, err := insertUserStmt.ExecContext(ctx, u.UserID, u.UserName, u.DisplayName)
+	switch store := suite.store.(type) {
+	case *dbStore:
+		insertUserStmt, err := store.PrepareContext(ctx, "INSERT INTO users (id, username, display_name) VALUES ($1, $2, $3)")
 		if err != nil {
 			panic(err)
 		}
-	}
-	for _, c := range credentials {
-		_, err := insertCredentialStmt.ExecContext(ctx, c.CredentialID, c.UserID, c.Counter, c.CoseKey, time.Now(), time.Now())
+		insertCredentialStmt, err := store.PrepareContext(ctx, "INSERT INTO credentials (id, user_id, counter, cose_key, registered_at, loggedin_at) VALUES ($1, $2, $3, $4, $5, $6)")
 		if err != nil {
 			panic(err)
 		}
+		for _, u := range users {
+			_, err := insertUserStmt.ExecContext(ctx, u.UserID, u.UserName, u.DisplayName)
+			if err != nil {
+				panic(err)
+			}
+		}
+		for _, c := range credentials {
+			_, err := insertCredentialStmt.ExecContext(ctx, c.CredentialID, c.UserID, c.Counter, c.CoseKey, time.Now(), time.Now())
+			if err != nil {
+				panic(err)
+			}
+		}
+	case *memStore:
+		for _, u := range users {
+			store.users[string(u.UserID)] = &User{UserID: u.UserID, UserName: u.UserName, DisplayName: u.DisplayName}
+		}
+		for _, c := range credentials {
+			c2 := c
+			c2.RegisteredAt, c2.LoggedInAt = time.Now(), time.Now()
+			store.credentials[string(c.UserID)] = append(store.credentials[string(c.UserID)], &c2)
+		}
 	}
 }
 
-func (suite *DBTestSuite) queryUserCredentialTables(ctx context.Context) ([]user, []credential) {
-	var users []user
-	rows, err := suite.dbStore.Query("SELECT id, username, display_name FROM users")
+func (suite *DBTestSuite) queryUserCredentialTables(ctx context.Context) ([]User, []Credential) {
+	if store, ok := suite.store.(*memStore); ok {
+		var users []User
+		var credentials []Credential
+		for id, u := range store.users {
+			u2 := User{UserID: u.UserID, UserName: u.UserName, DisplayName: u.DisplayName}
+			for _, c := range store.credentials[id] {
+				credentials = append(credentials, Credential{CredentialID: c.CredentialID, UserID: c.UserID, Counter: c.Counter, CoseKey: c.CoseKey})
+				u2.CredentialIDs = append(u2.CredentialIDs, c.CredentialID)
+			}
+			users = append(users, u2)
+		}
+		return users, credentials
+	}
+
+	store := suite.store.(*dbStore)
+
+	var users []User
+	rows, err := store.Query("SELECT id, username, display_name FROM users")
 	if err != nil {
 		panic(err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var u user
+		var u User
 		if err := rows.Scan(&u.UserID, &u.UserName, &u.DisplayName); err != nil {
 			panic(err)
 		}
@@ -162,15 +206,15 @@ func (suite *DBTestSuite) queryUserCredentialTables(ctx context.Context) ([]user
 		panic(err)
 	}
 
-	var credentials []credential
-	rows, err = suite.dbStore.Query("SELECT id, user_id, counter, cose_key FROM credentials")
+	var credentials []Credential
+	rows, err = store.Query("SELECT id, user_id, counter, cose_key FROM credentials")
 	if err != nil {
 		panic(err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var c credential
+		var c Credential
 		if err := rows.Scan(&c.CredentialID, &c.UserID, &c.Counter, &c.CoseKey); err != nil {
 			panic(err)
 		}
@@ -192,21 +236,21 @@ func (suite *DBTestSuite) TestGetUser() {
 
 	suite.seedUserCredentialTables(ctx)
 
-	user, err := suite.dbStore.getUser(ctx, userNotExist.UserName)
-	if err == nil || err != errNoRecords {
-		suite.T().Errorf("(*dbstore).getUser(%s) returns error %q, want error %q", userNotExist.UserName, err, errNoRecords)
+	user, err := suite.store.GetUser(ctx, userNotExist.UserName)
+	if err == nil || err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).GetUser(%s) returns error %q, want error %q", userNotExist.UserName, err, ErrNoRecords)
 	}
 	if user != nil {
-		suite.T().Errorf("(*dbstore).getUser(%s) returns user %+v, want nil", userNotExist.UserName, user)
+		suite.T().Errorf("(*dbstore).GetUser(%s) returns user %+v, want nil", userNotExist.UserName, user)
 	}
 
 	for _, expectedUser := range users {
-		user, err := suite.dbStore.getUser(ctx, expectedUser.UserName)
+		user, err := suite.store.GetUser(ctx, expectedUser.UserName)
 		if err != nil {
-			suite.T().Errorf("(*dbstore).getUser(%s) returns error %q", expectedUser.UserName, err)
+			suite.T().Errorf("(*dbstore).GetUser(%s) returns error %q", expectedUser.UserName, err)
 		}
 		if !reflect.DeepEqual(*user, expectedUser) {
-			suite.T().Errorf("(*dbstore).getUser(%s) returns user %+v, want %+v", expectedUser.UserName, user, expectedUser)
+			suite.T().Errorf("(*dbstore).GetUser(%s) returns user %+v, want %+v", expectedUser.UserName, user, expectedUser)
 		}
 	}
 }
@@ -216,21 +260,21 @@ func (suite *DBTestSuite) TestGetCredential() {
 
 	suite.seedUserCredentialTables(ctx)
 
-	c, err := suite.dbStore.getCredential(ctx, credentialNotExist.UserID, credentialNotExist.CredentialID)
-	if err == nil || err != errNoRecords {
-		suite.T().Errorf("(*dbstore).getCredential(%v, %v) returns error %q, want error %q", credentialNotExist.UserID, credentialNotExist.CredentialID, err, errNoRecords)
+	c, err := suite.store.GetCredential(ctx, credentialNotExist.UserID, credentialNotExist.CredentialID)
+	if err == nil || err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).GetCredential(%v, %v) returns error %q, want error %q", credentialNotExist.UserID, credentialNotExist.CredentialID, err, ErrNoRecords)
 	}
 	if c != nil {
-		suite.T().Errorf("(*dbstore).getCredential(%v, %v) returns credential %+v, want nil", credentialNotExist.UserID, credentialNotExist.CredentialID, c)
+		suite.T().Errorf("(*dbstore).GetCredential(%v, %v) returns credential %+v, want nil", credentialNotExist.UserID, credentialNotExist.CredentialID, c)
 	}
 
 	for _, expectedCredential := range credentials {
-		c, err := suite.dbStore.getCredential(ctx, expectedCredential.UserID, expectedCredential.CredentialID)
+		c, err := suite.store.GetCredential(ctx, expectedCredential.UserID, expectedCredential.CredentialID)
 		if err != nil {
-			suite.T().Errorf("(*dbstore).getCredential(%v, %v) returns error %q", expectedCredential.UserID, expectedCredential.CredentialID, err)
+			suite.T().Errorf("(*dbstore).GetCredential(%v, %v) returns error %q", expectedCredential.UserID, expectedCredential.CredentialID, err)
 		}
 		if !reflect.DeepEqual(*c, expectedCredential) {
-			suite.T().Errorf("(*dbstore).getCredential(%v, %v) returns credential %+v, want %+v", expectedCredential.UserID, expectedCredential.CredentialID, c, expectedCredential)
+			suite.T().Errorf("(*dbstore).GetCredential(%v, %v) returns credential %+v, want %+v", expectedCredential.UserID, expectedCredential.CredentialID, c, expectedCredential)
 		}
 	}
 }
@@ -239,24 +283,32 @@ func (suite *DBTestSuite) TestAddUserCredential() {
 	ctx := context.Background()
 
 	// User does not exist, add user record and credential record
-	if err := suite.dbStore.addUserCredential(ctx, &user2, &credential2); err != nil {
+	if err := suite.store.AddUserCredential(ctx, &user2, &credential2); err != nil {
 		suite.T().Errorf("(*dbstore).addUserAndCredential(%+v, %+v) returns error %q", user2, credential2, err)
 		return
 	}
 	// User exists, add credential record
-	if err := suite.dbStore.addUserCredential(ctx, &user2, &credential3); err != nil {
+	if err := suite.store.AddUserCredential(ctx, &user2, &credential3); err != nil {
 		suite.T().Errorf("(*dbstore).addUserAndCredential(%+v, %+v) returns error %q", user2, credential3, err)
 		return
 	}
 	// User and credential exist, return error
-	if err := suite.dbStore.addUserCredential(ctx, &user2, &credential3); err == nil || err != errRecordExists {
-		suite.T().Errorf("(*dbstore).addUserAndCredential(%+v, %+v) returns error %q, want error %q", user2, credential3, err, errRecordExists)
+	if err := suite.store.AddUserCredential(ctx, &user2, &credential3); err == nil || err != ErrRecordExists {
+		suite.T().Errorf("(*dbstore).addUserAndCredential(%+v, %+v) returns error %q, want error %q", user2, credential3, err, ErrRecordExists)
+		return
+	}
+	// Credential id exists for another user, return error without adding user
+	otherUser := User{UserID: []byte("other user id"), UserName: "OtherUser", DisplayName: "Other user display name"}
+	otherCredential := credential3
+	otherCredential.UserID = otherUser.UserID
+	if err := suite.store.AddUserCredential(ctx, &otherUser, &otherCredential); err == nil || err != ErrRecordExists {
+		suite.T().Errorf("(*dbstore).addUserAndCredential(%+v, %+v) returns error %q, want error %q", otherUser, otherCredential, err, ErrRecordExists)
 		return
 	}
 
 	usersFromDB, credentialsFromDB := suite.queryUserCredentialTables(ctx)
 
-	c := []credential{credential2, credential3}
+	c := []Credential{credential2, credential3}
 
 	sort.Sort(credentialsByID(credentialsFromDB))
 	sort.Sort(credentialsByID(c))
@@ -280,18 +332,18 @@ func (suite *DBTestSuite) TestUpdateCredential() {
 
 	suite.seedUserCredentialTables(ctx)
 
-	err := suite.dbStore.updateCredential(ctx, &credentialNotExist)
-	if err == nil || err != errNoRecords {
-		suite.T().Errorf("(*dbstore).updateCredential(%v, %v) returns error %q, want error %q", credentialNotExist.UserID, credentialNotExist.CredentialID, err, errNoRecords)
+	err := suite.store.UpdateCredential(ctx, &credentialNotExist, 0)
+	if err == nil || err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).UpdateCredential(%v, %v) returns error %q, want error %q", credentialNotExist.UserID, credentialNotExist.CredentialID, err, ErrNoRecords)
 	}
 
-	newCredentials := make([]credential, len(credentials))
+	newCredentials := make([]Credential, len(credentials))
 	copy(newCredentials, credentials)
 	for i := 0; i < len(newCredentials); i++ {
 		newCredentials[i].Counter++
-		err := suite.dbStore.updateCredential(ctx, &newCredentials[i])
+		err := suite.store.UpdateCredential(ctx, &newCredentials[i], credentials[i].Counter)
 		if err != nil {
-			suite.T().Errorf("(*dbstore).updateCredential(%v) returns error %q", credentials[i], err)
+			suite.T().Errorf("(*dbstore).UpdateCredential(%v) returns error %q", credentials[i], err)
 		}
 	}
 
@@ -305,6 +357,534 @@ func (suite *DBTestSuite) TestUpdateCredential() {
 	}
 }
 
+func (suite *DBTestSuite) TestUpdateCredentialCounterChanged() {
+	ctx := context.Background()
+
+	suite.seedUserCredentialTables(ctx)
+
+	// Two logins read the same counter, only the first one can update it.
+	c := credential1
+	c.Counter = credential1.Counter + 1
+	if err := suite.store.UpdateCredential(ctx, &c, credential1.Counter); err != nil {
+		suite.T().Errorf("(*dbstore).UpdateCredential(%v) returns error %q", c, err)
+	}
+	c.Counter = credential1.Counter + 1
+	err := suite.store.UpdateCredential(ctx, &c, credential1.Counter)
+	if err == nil || err != ErrCounterChanged {
+		suite.T().Errorf("(*dbstore).UpdateCredential(%v) returns error %q, want error %q", c, err, ErrCounterChanged)
+	}
+
+	// Flag credential.
+	c.Counter = credential1.Counter + 2
+	c.Flagged = true
+	if err := suite.store.UpdateCredential(ctx, &c, credential1.Counter+1); err != nil {
+		suite.T().Errorf("(*dbstore).UpdateCredential(%v) returns error %q", c, err)
+	}
+	credentialFromDB, err := suite.store.GetCredential(ctx, c.UserID, c.CredentialID)
+	if err != nil {
+		suite.T().Fatalf("(*dbstore).GetCredential(%v, %v) returns error %q", c.UserID, c.CredentialID, err)
+	}
+	if credentialFromDB.Counter != c.Counter || !credentialFromDB.Flagged {
+		suite.T().Errorf("Got credential %+v, want counter %d and flagged", credentialFromDB, c.Counter)
+	}
+}
+
+func (suite *DBTestSuite) TestDisableCredential() {
+	ctx := context.Background()
+
+	suite.seedUserCredentialTables(ctx)
+
+	err := suite.store.DisableCredential(ctx, credentialNotExist.UserID, credentialNotExist.CredentialID)
+	if err == nil || err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).DisableCredential(%v, %v) returns error %q, want error %q", credentialNotExist.UserID, credentialNotExist.CredentialID, err, ErrNoRecords)
+	}
+
+	createdAt := time.Date(2009, time.January, 1, 1, 0, 0, 0, time.UTC)
+	tokens := []*RefreshToken{
+		{
+			TokenHash:    []byte{116, 111, 107, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3},
+			UserID:       credential2.UserID,
+			CredentialID: credential2.CredentialID,
+			CreatedAt:    createdAt,
+			ExpiresAt:    createdAt.Add(time.Hour),
+		},
+		{
+			TokenHash:    []byte{116, 111, 107, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4},
+			UserID:       credential3.UserID,
+			CredentialID: credential3.CredentialID,
+			CreatedAt:    createdAt,
+			ExpiresAt:    createdAt.Add(time.Hour),
+		},
+	}
+	for _, token := range tokens {
+		if err := suite.store.AddRefreshToken(ctx, token); err != nil {
+			suite.T().Fatalf("(*dbstore).AddRefreshToken(%+v) returns error %q", token, err)
+		}
+	}
+
+	if err := suite.store.DisableCredential(ctx, credential2.UserID, credential2.CredentialID); err != nil {
+		suite.T().Errorf("(*dbstore).DisableCredential(%v, %v) returns error %q", credential2.UserID, credential2.CredentialID, err)
+	}
+
+	// Sessions and refresh tokens of disabled credential are revoked, other credential's aren't.
+	if _, err := suite.store.GetSessionsRevokedAt(ctx, credential2.UserID, credential2.CredentialID); err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).GetSessionsRevokedAt(%v, %v) of disabled credential returns error %q, want error %q", credential2.UserID, credential2.CredentialID, err, ErrNoRecords)
+	}
+	if _, err := suite.store.GetSessionsRevokedAt(ctx, credential3.UserID, credential3.CredentialID); err != nil {
+		suite.T().Errorf("(*dbstore).GetSessionsRevokedAt(%v, %v) returns error %q", credential3.UserID, credential3.CredentialID, err)
+	}
+	if _, err := suite.store.GetRefreshToken(ctx, tokens[0].TokenHash); err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).GetRefreshToken(%v) of disabled credential returns error %q, want error %q", tokens[0].TokenHash, err, ErrNoRecords)
+	}
+	if _, err := suite.store.GetRefreshToken(ctx, tokens[1].TokenHash); err != nil {
+		suite.T().Errorf("(*dbstore).GetRefreshToken(%v) returns error %q", tokens[1].TokenHash, err)
+	}
+
+	credentialsFromDB, err := suite.store.GetCredentials(ctx, user2.UserID)
+	if err != nil {
+		suite.T().Fatalf("(*dbstore).GetCredentials(%v) returns error %q", user2.UserID, err)
+	}
+	for _, c := range credentialsFromDB {
+		wantDisabled := bytes.Equal(c.CredentialID, credential2.CredentialID)
+		if c.Disabled != wantDisabled {
+			suite.T().Errorf("Got credential %v disabled %t, want %t", c.CredentialID, c.Disabled, wantDisabled)
+		}
+	}
+}
+
+func (suite *DBTestSuite) TestCloneEvents() {
+	ctx := context.Background()
+
+	suite.seedUserCredentialTables(ctx)
+
+	detectedAt := time.Date(2009, time.January, 1, 1, 0, 0, 0, time.UTC)
+	wantEvents := []*CloneEvent{
+		{UserID: credential2.UserID, CredentialID: credential2.CredentialID, PrevCounter: 2, Counter: 1, Action: counterPolicyFlag, DetectedAt: detectedAt},
+		{UserID: credential3.UserID, CredentialID: credential3.CredentialID, PrevCounter: 3, Counter: 3, Action: counterPolicyDisable, DetectedAt: detectedAt.Add(time.Hour)},
+	}
+	otherEvent := &CloneEvent{UserID: credential1.UserID, CredentialID: credential1.CredentialID, PrevCounter: 1, Counter: 0, Action: counterPolicyReject, DetectedAt: detectedAt}
+	for _, e := range append(wantEvents, otherEvent) {
+		if err := suite.store.AddCloneEvent(ctx, e); err != nil {
+			suite.T().Errorf("(*dbstore).AddCloneEvent(%+v) returns error %q", e, err)
+		}
+	}
+
+	events, err := suite.store.GetCloneEvents(ctx, user2.UserID)
+	if err != nil {
+		suite.T().Fatalf("(*dbstore).GetCloneEvents(%v) returns error %q", user2.UserID, err)
+	}
+	if len(events) != len(wantEvents) {
+		suite.T().Fatalf("(*dbstore).GetCloneEvents(%v) returns %d events, want %d", user2.UserID, len(events), len(wantEvents))
+	}
+	for i, e := range events {
+		e.DetectedAt = e.DetectedAt.UTC()
+		if !reflect.DeepEqual(e, wantEvents[i]) {
+			suite.T().Errorf("Got clone event %+v, want %+v", e, wantEvents[i])
+		}
+	}
+}
+
+func (suite *DBTestSuite) TestRefreshTokens() {
+	ctx := context.Background()
+
+	suite.seedUserCredentialTables(ctx)
+
+	createdAt := time.Date(2009, time.January, 1, 1, 0, 0, 0, time.UTC)
+	wantToken := &RefreshToken{
+		TokenHash:    []byte{116, 111, 107, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+		UserID:       credential1.UserID,
+		CredentialID: credential1.CredentialID,
+		UserVerified: true,
+		CreatedAt:    createdAt,
+		ExpiresAt:    createdAt.Add(time.Hour),
+	}
+	tokenNotExist := []byte{116, 111, 107, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+	if err := suite.store.AddRefreshToken(ctx, wantToken); err != nil {
+		suite.T().Fatalf("(*dbstore).AddRefreshToken(%+v) returns error %q", wantToken, err)
+	}
+
+	token, err := suite.store.GetRefreshToken(ctx, wantToken.TokenHash)
+	if err != nil {
+		suite.T().Fatalf("(*dbstore).GetRefreshToken(%v) returns error %q", wantToken.TokenHash, err)
+	}
+	token.CreatedAt, token.ExpiresAt = token.CreatedAt.UTC(), token.ExpiresAt.UTC()
+	if !reflect.DeepEqual(token, wantToken) {
+		suite.T().Errorf("(*dbstore).GetRefreshToken(%v) returns %+v, want %+v", wantToken.TokenHash, token, wantToken)
+	}
+	if _, err := suite.store.GetRefreshToken(ctx, tokenNotExist); err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).GetRefreshToken(%v) returns error %v, want error %q", tokenNotExist, err, ErrNoRecords)
+	}
+
+	if err := suite.store.DeleteRefreshToken(ctx, wantToken.TokenHash); err != nil {
+		suite.T().Errorf("(*dbstore).DeleteRefreshToken(%v) returns error %q", wantToken.TokenHash, err)
+	}
+	if err := suite.store.DeleteRefreshToken(ctx, wantToken.TokenHash); err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).DeleteRefreshToken(%v) of deleted token returns error %v, want error %q", wantToken.TokenHash, err, ErrNoRecords)
+	}
+	if _, err := suite.store.GetRefreshToken(ctx, wantToken.TokenHash); err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).GetRefreshToken(%v) of deleted token returns error %v, want error %q", wantToken.TokenHash, err, ErrNoRecords)
+	}
+}
+
+func (suite *DBTestSuite) TestRecoveryCodes() {
+	ctx := context.Background()
+
+	suite.seedUserCredentialTables(ctx)
+
+	createdAt := time.Date(2009, time.January, 1, 1, 0, 0, 0, time.UTC)
+	salt := []byte{115, 97, 108, 116}
+	oldCodes := []*RecoveryCode{
+		{UserID: credential1.UserID, Salt: salt, CodeHash: []byte{1, 1, 1}, CreatedAt: createdAt},
+		{UserID: credential1.UserID, Salt: salt, CodeHash: []byte{1, 1, 2}, CreatedAt: createdAt},
+	}
+	wantCodes := []*RecoveryCode{
+		{UserID: credential1.UserID, Salt: salt, CodeHash: []byte{2, 2, 1}, CreatedAt: createdAt},
+		{UserID: credential1.UserID, Salt: salt, CodeHash: []byte{2, 2, 2}, CreatedAt: createdAt},
+	}
+
+	if err := suite.store.ReplaceRecoveryCodes(ctx, credential1.UserID, oldCodes); err != nil {
+		suite.T().Fatalf("(*dbstore).ReplaceRecoveryCodes(%v) returns error %q", credential1.UserID, err)
+	}
+	// Regenerated codes replace old codes.
+	if err := suite.store.ReplaceRecoveryCodes(ctx, credential1.UserID, wantCodes); err != nil {
+		suite.T().Fatalf("(*dbstore).ReplaceRecoveryCodes(%v) returns error %q", credential1.UserID, err)
+	}
+	codes, err := suite.store.GetRecoveryCodes(ctx, credential1.UserID)
+	if err != nil {
+		suite.T().Fatalf("(*dbstore).GetRecoveryCodes(%v) returns error %q", credential1.UserID, err)
+	}
+	for _, c := range codes {
+		c.CreatedAt = c.CreatedAt.UTC()
+	}
+	sort.Slice(codes, func(i, j int) bool { return bytes.Compare(codes[i].CodeHash, codes[j].CodeHash) < 0 })
+	if !reflect.DeepEqual(codes, wantCodes) {
+		suite.T().Errorf("(*dbstore).GetRecoveryCodes(%v) returns %v, want %v", credential1.UserID, codes, wantCodes)
+	}
+	if codes, err := suite.store.GetRecoveryCodes(ctx, credential2.UserID); err != nil || len(codes) != 0 {
+		suite.T().Errorf("(*dbstore).GetRecoveryCodes(%v) returns %v, %v, want no codes", credential2.UserID, codes, err)
+	}
+
+	// Recovery code can be deleted only once.
+	if err := suite.store.DeleteRecoveryCode(ctx, credential1.UserID, wantCodes[0].CodeHash); err != nil {
+		suite.T().Errorf("(*dbstore).DeleteRecoveryCode(%v) returns error %q", wantCodes[0].CodeHash, err)
+	}
+	if err := suite.store.DeleteRecoveryCode(ctx, credential1.UserID, wantCodes[0].CodeHash); err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).DeleteRecoveryCode(%v) of deleted code returns error %v, want error %q", wantCodes[0].CodeHash, err, ErrNoRecords)
+	}
+	if err := suite.store.DeleteRecoveryCode(ctx, credential2.UserID, wantCodes[1].CodeHash); err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).DeleteRecoveryCode(%v) of other user's code returns error %v, want error %q", wantCodes[1].CodeHash, err, ErrNoRecords)
+	}
+	if codes, err := suite.store.GetRecoveryCodes(ctx, credential1.UserID); err != nil || len(codes) != 1 {
+		suite.T().Errorf("(*dbstore).GetRecoveryCodes(%v) after delete returns %v, %v, want 1 code", credential1.UserID, codes, err)
+	}
+}
+
+func (suite *DBTestSuite) TestGetUserByID() {
+	ctx := context.Background()
+
+	suite.seedUserCredentialTables(ctx)
+
+	user, err := suite.store.GetUserByID(ctx, credentialNotExist.UserID)
+	if err == nil || err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).GetUserByID(%v) returns error %q, want error %q", credentialNotExist.UserID, err, ErrNoRecords)
+	}
+	if user != nil {
+		suite.T().Errorf("(*dbstore).GetUserByID(%v) returns user %+v, want nil", credentialNotExist.UserID, user)
+	}
+
+	for _, expectedUser := range users {
+		user, err := suite.store.GetUserByID(ctx, expectedUser.UserID)
+		if err != nil {
+			suite.T().Errorf("(*dbstore).GetUserByID(%v) returns error %q", expectedUser.UserID, err)
+		}
+		if !reflect.DeepEqual(*user, expectedUser) {
+			suite.T().Errorf("(*dbstore).GetUserByID(%v) returns user %+v, want %+v", expectedUser.UserID, user, expectedUser)
+		}
+	}
+}
+
+func (suite *DBTestSuite) TestGetCredentialByID() {
+	ctx := context.Background()
+
+	suite.seedUserCredentialTables(ctx)
+
+	c, err := suite.store.GetCredentialByID(ctx, credentialNotExist.CredentialID)
+	if err == nil || err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).GetCredentialByID(%v) returns error %q, want error %q", credentialNotExist.CredentialID, err, ErrNoRecords)
+	}
+	if c != nil {
+		suite.T().Errorf("(*dbstore).GetCredentialByID(%v) returns credential %+v, want nil", credentialNotExist.CredentialID, c)
+	}
+
+	for _, expectedCredential := range credentials {
+		c, err := suite.store.GetCredentialByID(ctx, expectedCredential.CredentialID)
+		if err != nil {
+			suite.T().Errorf("(*dbstore).GetCredentialByID(%v) returns error %q", expectedCredential.CredentialID, err)
+		}
+		if !reflect.DeepEqual(*c, expectedCredential) {
+			suite.T().Errorf("(*dbstore).GetCredentialByID(%v) returns credential %+v, want %+v", expectedCredential.CredentialID, c, expectedCredential)
+		}
+	}
+}
+
+func (suite *DBTestSuite) TestGetCredentials() {
+	ctx := context.Background()
+
+	suite.seedUserCredentialTables(ctx)
+
+	c, err := suite.store.GetCredentials(ctx, userNotExist.UserID)
+	if err != nil {
+		suite.T().Errorf("(*dbstore).GetCredentials(%v) returns error %q", userNotExist.UserID, err)
+	}
+	if len(c) != 0 {
+		suite.T().Errorf("(*dbstore).GetCredentials(%v) returns %d credentials, want 0", userNotExist.UserID, len(c))
+	}
+
+	for _, u := range users {
+		c, err := suite.store.GetCredentials(ctx, u.UserID)
+		if err != nil {
+			suite.T().Errorf("(*dbstore).GetCredentials(%v) returns error %q", u.UserID, err)
+		}
+		var credentialIDs [][]byte
+		for _, credential := range c {
+			credentialIDs = append(credentialIDs, credential.CredentialID)
+			if credential.RegisteredAt.IsZero() || credential.LoggedInAt.IsZero() {
+				suite.T().Errorf("(*dbstore).GetCredentials(%v) returns credential %+v without timestamps", u.UserID, credential)
+			}
+		}
+		if !reflect.DeepEqual(credentialIDs, u.CredentialIDs) {
+			suite.T().Errorf("(*dbstore).GetCredentials(%v) returns credential IDs %v, want %v", u.UserID, credentialIDs, u.CredentialIDs)
+		}
+	}
+}
+
+func (suite *DBTestSuite) TestRenameCredential() {
+	ctx := context.Background()
+
+	suite.seedUserCredentialTables(ctx)
+
+	err := suite.store.RenameCredential(ctx, credentialNotExist.UserID, credentialNotExist.CredentialID, "nickname")
+	if err == nil || err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).RenameCredential(%v, %v) returns error %q, want error %q", credentialNotExist.UserID, credentialNotExist.CredentialID, err, ErrNoRecords)
+	}
+
+	if err := suite.store.RenameCredential(ctx, credential2.UserID, credential2.CredentialID, "nickname"); err != nil {
+		suite.T().Errorf("(*dbstore).RenameCredential(%v, %v) returns error %q", credential2.UserID, credential2.CredentialID, err)
+	}
+
+	c, err := suite.store.GetCredentials(ctx, user2.UserID)
+	if err != nil {
+		suite.T().Fatalf("(*dbstore).GetCredentials(%v) returns error %q", user2.UserID, err)
+	}
+	for _, credential := range c {
+		wantNickname := ""
+		if bytes.Equal(credential.CredentialID, credential2.CredentialID) {
+			wantNickname = "nickname"
+		}
+		if credential.Nickname != wantNickname {
+			suite.T().Errorf("Got credential %v nickname %q, want %q", credential.CredentialID, credential.Nickname, wantNickname)
+		}
+	}
+}
+
+func (suite *DBTestSuite) TestDeleteCredential() {
+	ctx := context.Background()
+
+	suite.seedUserCredentialTables(ctx)
+
+	err := suite.store.DeleteCredential(ctx, credentialNotExist.UserID, credentialNotExist.CredentialID)
+	if err == nil || err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).DeleteCredential(%v, %v) returns error %q, want error %q", credentialNotExist.UserID, credentialNotExist.CredentialID, err, ErrNoRecords)
+	}
+
+	// User has only one credential, return error
+	err = suite.store.DeleteCredential(ctx, credential1.UserID, credential1.CredentialID)
+	if err == nil || err != ErrLastRecord {
+		suite.T().Errorf("(*dbstore).DeleteCredential(%v, %v) returns error %q, want error %q", credential1.UserID, credential1.CredentialID, err, ErrLastRecord)
+	}
+
+	// User has two credentials, delete one of them
+	if err := suite.store.DeleteCredential(ctx, credential2.UserID, credential2.CredentialID); err != nil {
+		suite.T().Errorf("(*dbstore).DeleteCredential(%v, %v) returns error %q", credential2.UserID, credential2.CredentialID, err)
+	}
+
+	// User has one credential left, return error
+	err = suite.store.DeleteCredential(ctx, credential3.UserID, credential3.CredentialID)
+	if err == nil || err != ErrLastRecord {
+		suite.T().Errorf("(*dbstore).DeleteCredential(%v, %v) returns error %q, want error %q", credential3.UserID, credential3.CredentialID, err, ErrLastRecord)
+	}
+
+	_, credentialsFromDB := suite.queryUserCredentialTables(ctx)
+
+	c := []Credential{credential1, credential3}
+
+	sort.Sort(credentialsByID(credentialsFromDB))
+	sort.Sort(credentialsByID(c))
+
+	if !reflect.DeepEqual(c, credentialsFromDB) {
+		suite.T().Errorf("Got credential %+v, want %+v", credentialsFromDB, c)
+	}
+
+	// Sessions logged in with deleted credential are revoked.
+	if _, err := suite.store.GetSessionsRevokedAt(ctx, credential2.UserID, credential2.CredentialID); err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).GetSessionsRevokedAt(%v, %v) of deleted credential returns error %q, want error %q", credential2.UserID, credential2.CredentialID, err, ErrNoRecords)
+	}
+	if revokedAt, err := suite.store.GetSessionsRevokedAt(ctx, credential3.UserID, credential3.CredentialID); err != nil || !revokedAt.IsZero() {
+		suite.T().Errorf("(*dbstore).GetSessionsRevokedAt(%v, %v) returns %v, %v, want zero time", credential3.UserID, credential3.CredentialID, revokedAt, err)
+	}
+}
+
+func (suite *DBTestSuite) TestDeleteCredentialConcurrently() {
+	ctx := context.Background()
+
+	suite.seedUserCredentialTables(ctx)
+
+	// User has two credentials, only one of concurrent deletes succeeds.
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, c := range []Credential{credential2, credential3} {
+		wg.Add(1)
+		go func(i int, c Credential) {
+			defer wg.Done()
+			errs[i] = suite.store.DeleteCredential(ctx, c.UserID, c.CredentialID)
+		}(i, c)
+	}
+	wg.Wait()
+
+	if !(errs[0] == nil && errs[1] == ErrLastRecord) && !(errs[0] == ErrLastRecord && errs[1] == nil) {
+		suite.T().Errorf("Concurrent (*dbstore).DeleteCredential() return errors %v, want one nil and one %q", errs, ErrLastRecord)
+	}
+	credentials, err := suite.store.GetCredentials(ctx, user2.UserID)
+	if err != nil || len(credentials) != 1 {
+		suite.T().Errorf("(*dbstore).GetCredentials(%v) returns %d credentials, %v, want 1 credential", user2.UserID, len(credentials), err)
+	}
+}
+
+func (suite *DBTestSuite) TestGetUsers() {
+	ctx := context.Background()
+
+	suite.seedUserCredentialTables(ctx)
+
+	testCases := []struct {
+		search    string
+		offset    int
+		limit     int
+		wantUsers []User
+		wantTotal int
+	}{
+		{"", 0, 10, []User{user1, user2}, 2},
+		{"USER", 0, 10, []User{user1, user2}, 2},
+		{"2 display", 0, 10, []User{user2}, 1},
+		{"", 0, 1, []User{user1}, 2},
+		{"", 1, 1, []User{user2}, 2},
+		{"", 2, 1, nil, 2},
+		{"%", 0, 10, nil, 0},
+		{"_", 0, 10, nil, 0},
+		{userNotExist.UserName, 0, 10, nil, 0},
+	}
+	for _, tc := range testCases {
+		usersFromDB, total, err := suite.store.GetUsers(ctx, tc.search, tc.offset, tc.limit)
+		if err != nil {
+			suite.T().Errorf("(*dbstore).GetUsers(%q, %d, %d) returns error %q", tc.search, tc.offset, tc.limit, err)
+			continue
+		}
+		if total != tc.wantTotal {
+			suite.T().Errorf("(*dbstore).GetUsers(%q, %d, %d) returns total %d, want %d", tc.search, tc.offset, tc.limit, total, tc.wantTotal)
+		}
+		var gotUsers []User
+		for _, u := range usersFromDB {
+			gotUsers = append(gotUsers, *u)
+		}
+		if !reflect.DeepEqual(gotUsers, tc.wantUsers) {
+			suite.T().Errorf("(*dbstore).GetUsers(%q, %d, %d) returns users %+v, want %+v", tc.search, tc.offset, tc.limit, gotUsers, tc.wantUsers)
+		}
+	}
+}
+
+func (suite *DBTestSuite) TestDeleteUser() {
+	ctx := context.Background()
+
+	suite.seedUserCredentialTables(ctx)
+
+	err := suite.store.DeleteUser(ctx, userNotExist.UserID)
+	if err == nil || err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).DeleteUser(%v) returns error %q, want error %q", userNotExist.UserID, err, ErrNoRecords)
+	}
+
+	if err := suite.store.ReplaceRecoveryCodes(ctx, user2.UserID, []*RecoveryCode{{UserID: user2.UserID, CodeHash: []byte{1}, Salt: []byte{2}, CreatedAt: time.Now()}}); err != nil {
+		suite.T().Fatalf("(*dbstore).ReplaceRecoveryCodes(%v) returns error %q", user2.UserID, err)
+	}
+	if err := suite.store.DeleteUser(ctx, user2.UserID); err != nil {
+		suite.T().Errorf("(*dbstore).DeleteUser(%v) returns error %q", user2.UserID, err)
+	}
+
+	usersFromDB, credentialsFromDB := suite.queryUserCredentialTables(ctx)
+	if !reflect.DeepEqual(usersFromDB, []User{user1}) {
+		suite.T().Errorf("Got users %+v, want %+v", usersFromDB, []User{user1})
+	}
+	if !reflect.DeepEqual(credentialsFromDB, []Credential{credential1}) {
+		suite.T().Errorf("Got credentials %+v, want %+v", credentialsFromDB, []Credential{credential1})
+	}
+	if codes, err := suite.store.GetRecoveryCodes(ctx, user2.UserID); err != nil || len(codes) != 0 {
+		suite.T().Errorf("(*dbstore).GetRecoveryCodes(%v) of deleted user returns %v, %v, want no codes", user2.UserID, codes, err)
+	}
+}
+
+func (suite *DBTestSuite) TestRevokeSessions() {
+	ctx := context.Background()
+
+	suite.seedUserCredentialTables(ctx)
+
+	if err := suite.store.RevokeSessions(ctx, userNotExist.UserID, time.Now()); err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).RevokeSessions(%v) returns error %q, want error %q", userNotExist.UserID, err, ErrNoRecords)
+	}
+	if _, err := suite.store.GetSessionsRevokedAt(ctx, userNotExist.UserID, nil); err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).GetSessionsRevokedAt(%v) returns error %q, want error %q", userNotExist.UserID, err, ErrNoRecords)
+	}
+	if revokedAt, err := suite.store.GetSessionsRevokedAt(ctx, user1.UserID, nil); err != nil || !revokedAt.IsZero() {
+		suite.T().Errorf("(*dbstore).GetSessionsRevokedAt(%v) returns %v, %v, want zero time", user1.UserID, revokedAt, err)
+	}
+
+	createdAt := time.Date(2009, time.January, 1, 1, 0, 0, 0, time.UTC)
+	token := &RefreshToken{
+		TokenHash:    []byte{116, 111, 107, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2},
+		UserID:       credential1.UserID,
+		CredentialID: credential1.CredentialID,
+		CreatedAt:    createdAt,
+		ExpiresAt:    createdAt.Add(time.Hour),
+	}
+	if err := suite.store.AddRefreshToken(ctx, token); err != nil {
+		suite.T().Fatalf("(*dbstore).AddRefreshToken(%+v) returns error %q", token, err)
+	}
+
+	wantRevokedAt := time.Date(2009, time.March, 1, 1, 0, 0, 0, time.UTC)
+	if err := suite.store.RevokeSessions(ctx, user1.UserID, wantRevokedAt); err != nil {
+		suite.T().Fatalf("(*dbstore).RevokeSessions(%v) returns error %q", user1.UserID, err)
+	}
+	if revokedAt, err := suite.store.GetSessionsRevokedAt(ctx, user1.UserID, nil); err != nil || !revokedAt.Equal(wantRevokedAt) {
+		suite.T().Errorf("(*dbstore).GetSessionsRevokedAt(%v) returns %v, %v, want %v", user1.UserID, revokedAt, err, wantRevokedAt)
+	}
+	if revokedAt, err := suite.store.GetSessionsRevokedAt(ctx, user2.UserID, nil); err != nil || !revokedAt.IsZero() {
+		suite.T().Errorf("(*dbstore).GetSessionsRevokedAt(%v) returns %v, %v, want zero time", user2.UserID, revokedAt, err)
+	}
+	if _, err := suite.store.GetRefreshToken(ctx, token.TokenHash); err != ErrNoRecords {
+		suite.T().Errorf("(*dbstore).GetRefreshToken(%v) of revoked user returns error %q, want error %q", token.TokenHash, err, ErrNoRecords)
+	}
+}
+
 func TestDBTestSuite(t *testing.T) {
-	suite.Run(t, new(DBTestSuite))
+	t.Run("memory", func(t *testing.T) {
+		suite.Run(t, &DBTestSuite{driver: dbDriverMemory})
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		suite.Run(t, &DBTestSuite{driver: dbDriverSQLite, connString: filepath.Join(t.TempDir(), "webauthn.db")})
+	})
+	t.Run("postgres", func(t *testing.T) {
+		connString := os.Getenv("DB_CONNSTRING")
+		if connString == "" {
+			t.Skip("Skipping PostgreSQL tests because DB_CONNSTRING isn't set")
+		}
+		suite.Run(t, &DBTestSuite{driver: dbDriverPostgres, connString: connString})
+	})
 }
@@ -0,0 +1,317 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fxamacker/webauthn"
+	"github.com/fxamacker/webauthn-demo/virtualauthenticator"
+)
+
+const e2eOrigin = "https://localhost:8443"
+
+// e2eClient sends requests to test server with cookies, like demo web pages.
+type e2eClient struct {
+	t      *testing.T
+	url    string
+	client *http.Client
+}
+
+func newE2EClient(t *testing.T, ts *httptest.Server) *e2eClient {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Copy test server client, so clients don't share cookie jar.
+	client := *ts.Client()
+	client.Jar = jar
+	return &e2eClient{t: t, url: ts.URL, client: &client}
+}
+
+// do sends request with JSON encoded body and decodes JSON response into v.  It returns response status code.
+func (c *e2eClient) do(method string, path string, body interface{}, v interface{}) int {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, c.url+path, &reqBody)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatalf("%s %s returns error %q", method, path, err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			c.t.Fatalf("%s %s returns invalid JSON: %s", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func attestationOptionsRequest(username string, residentKey webauthn.ResidentKeyRequirement) map[string]interface{} {
+	return map[string]interface{}{
+		"username":    username,
+		"displayName": "John Doe",
+		"authenticatorSelection": map[string]interface{}{
+			"authenticatorAttachment": "cross-platform",
+			"residentKey":             residentKey,
+			"userVerification":        "preferred",
+		},
+		"attestation": "direct",
+	}
+}
+
+// register returns recovery codes generated at user's first registration.
+func (c *e2eClient) register(a *virtualauthenticator.Authenticator, username string, residentKey webauthn.ResidentKeyRequirement) []string {
+	var options webauthn.PublicKeyCredentialCreationOptions
+	if statusCode := c.do("POST", "/attestation/options", attestationOptionsRequest(username, residentKey), &options); statusCode != http.StatusOK {
+		c.t.Fatalf("POST /attestation/options returns status code %d", statusCode)
+	}
+	result, err := a.Create(&options)
+	if err != nil {
+		c.t.Fatalf("Create() returns error %q", err)
+	}
+	var resp recoveryCodesResponse
+	if statusCode := c.do("POST", "/attestation/result", result, &resp); statusCode != http.StatusOK {
+		c.t.Fatalf("POST /attestation/result returns status code %d, error %q", statusCode, resp.ErrorMessage)
+	}
+	return resp.RecoveryCodes
+}
+
+// login returns assertion result so it can be replayed.
+func (c *e2eClient) login(a *virtualauthenticator.Authenticator, username string) *virtualauthenticator.AssertionResult {
+	var options webauthn.PublicKeyCredentialRequestOptions
+	if statusCode := c.do("POST", "/assertion/options", map[string]string{"username": username}, &options); statusCode != http.StatusOK {
+		c.t.Fatalf("POST /assertion/options returns status code %d", statusCode)
+	}
+	result, err := a.Get(&options)
+	if err != nil {
+		c.t.Fatalf("Get() returns error %q", err)
+	}
+	var resp serverResponse
+	if statusCode := c.do("POST", "/assertion/result", result, &resp); statusCode != http.StatusOK {
+		c.t.Fatalf("POST /assertion/result returns status code %d, error %q", statusCode, resp.ErrorMessage)
+	}
+	return result
+}
+
+func (c *e2eClient) userName() (string, int) {
+	var resp struct {
+		Name string `json:"name"`
+	}
+	statusCode := c.do("GET", "/user", nil, &resp)
+	return resp.Name, statusCode
+}
+
+func (c *e2eClient) logout() {
+	if statusCode := c.do("GET", "/logout", nil, nil); statusCode != http.StatusOK {
+		c.t.Fatalf("GET /logout returns status code %d", statusCode)
+	}
+}
+
+func newE2EServer(t *testing.T) (*Server, *httptest.Server) {
+	s, err := NewServer(
+		WithWebAuthnConfig(getWebAuthnConfig()),
+		WithOrigin(e2eOrigin),
+		WithDataStore(newMemStore()),
+		WithSessionStore(getMemSessionStore()),
+	)
+	if err != nil {
+		t.Fatalf("NewServer() returns error %q", err)
+	}
+	return s, httptest.NewTLSServer(s)
+}
+
+func TestE2ERegistrationAndLogin(t *testing.T) {
+	attestationFormats := []string{
+		virtualauthenticator.AttestationFormatNone,
+		virtualauthenticator.AttestationFormatPacked,
+		virtualauthenticator.AttestationFormatFIDOU2F,
+	}
+	for _, attestationFormat := range attestationFormats {
+		t.Run(attestationFormat, func(t *testing.T) {
+			s, ts := newE2EServer(t)
+			defer s.Close()
+			defer ts.Close()
+
+			a, err := virtualauthenticator.New(e2eOrigin, attestationFormat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := newE2EClient(t, ts)
+			username := "johndoe@example.com"
+
+			c.register(a, username, webauthn.ResidentKeyDiscouraged)
+			if name, statusCode := c.userName(); statusCode != http.StatusOK || name != username {
+				t.Errorf("GET /user after registration returns status code %d, name %q, want %d, %q", statusCode, name, http.StatusOK, username)
+			}
+
+			c.logout()
+			if _, statusCode := c.userName(); statusCode != http.StatusUnauthorized {
+				t.Errorf("GET /user after logout returns status code %d, want %d", statusCode, http.StatusUnauthorized)
+			}
+
+			result := c.login(a, username)
+			if name, statusCode := c.userName(); statusCode != http.StatusOK || name != username {
+				t.Errorf("GET /user after login returns status code %d, name %q, want %d, %q", statusCode, name, http.StatusOK, username)
+			}
+
+			// Replayed assertion is rejected.
+			if statusCode := c.do("POST", "/assertion/result", result, nil); statusCode == http.StatusOK {
+				t.Errorf("POST /assertion/result with replayed assertion returns status code %d, want error status code", statusCode)
+			}
+
+			// Second login with the same credential increments signature counter.
+			c.logout()
+			c.login(a, username)
+			if counter := a.Credentials()[0].Counter; counter != 2 {
+				t.Errorf("credential has counter %d, want 2", counter)
+			}
+		})
+	}
+}
+
+func TestE2EUsernamelessLogin(t *testing.T) {
+	s, ts := newE2EServer(t)
+	defer s.Close()
+	defer ts.Close()
+	s.usernamelessLogin = true
+
+	a, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newE2EClient(t, ts)
+	username := "johndoe@example.com"
+
+	c.register(a, username, webauthn.ResidentKeyRequired)
+	c.logout()
+
+	c.login(a, "")
+	if name, statusCode := c.userName(); statusCode != http.StatusOK || name != username {
+		t.Errorf("GET /user after usernameless login returns status code %d, name %q, want %d, %q", statusCode, name, http.StatusOK, username)
+	}
+}
+
+func TestE2EAddCredential(t *testing.T) {
+	s, ts := newE2EServer(t)
+	defer s.Close()
+	defer ts.Close()
+
+	newAuthenticator := func() *virtualauthenticator.Authenticator {
+		a, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	username := "johndoe@example.com"
+	a := newAuthenticator()
+	user := newE2EClient(t, ts)
+	user.register(a, username, webauthn.ResidentKeyDiscouraged)
+
+	// Signup with registered username is rejected.
+	attacker := newE2EClient(t, ts)
+	wantResp := serverResponse{Status: statusFailed, ErrorMessage: "Username is already registered"}
+	var resp serverResponse
+	if statusCode := attacker.do("POST", "/attestation/options", attestationOptionsRequest(username, webauthn.ResidentKeyDiscouraged), &resp); statusCode != http.StatusBadRequest || resp != wantResp {
+		t.Errorf("POST /attestation/options with registered username returns status code %d, %+v, want %d, %+v", statusCode, resp, http.StatusBadRequest, wantResp)
+	}
+
+	// Another logged in user can't add credential to user.
+	attacker.register(newAuthenticator(), "attacker@example.com", webauthn.ResidentKeyDiscouraged)
+	if statusCode := attacker.do("POST", "/attestation/options", attestationOptionsRequest(username, webauthn.ResidentKeyDiscouraged), &resp); statusCode != http.StatusBadRequest || resp != wantResp {
+		t.Errorf("POST /attestation/options with other user's username returns status code %d, %+v, want %d, %+v", statusCode, resp, http.StatusBadRequest, wantResp)
+	}
+
+	// User can't add credential after login options without completing login.
+	user.logout()
+	if statusCode := user.do("POST", "/assertion/options", map[string]string{"username": username}, nil); statusCode != http.StatusOK {
+		t.Fatalf("POST /assertion/options returns status code %d", statusCode)
+	}
+	if statusCode := user.do("POST", "/attestation/options", attestationOptionsRequest(username, webauthn.ResidentKeyDiscouraged), &resp); statusCode != http.StatusBadRequest || resp != wantResp {
+		t.Errorf("POST /attestation/options before login returns status code %d, %+v, want %d, %+v", statusCode, resp, http.StatusBadRequest, wantResp)
+	}
+
+	// Logged in user adds a credential and stays logged in with the same credential.
+	user.login(a, username)
+	var before struct {
+		CredentialID string `json:"credentialID"`
+	}
+	user.do("GET", "/user", nil, &before)
+	a2 := newAuthenticator()
+	if codes := user.register(a2, username, webauthn.ResidentKeyDiscouraged); codes != nil {
+		t.Errorf("POST /attestation/result for additional credential returns recovery codes %v, want none", codes)
+	}
+	var after struct {
+		CredentialID string `json:"credentialID"`
+	}
+	if statusCode := user.do("GET", "/user", nil, &after); statusCode != http.StatusOK || after.CredentialID != before.CredentialID {
+		t.Errorf("GET /user after adding credential returns status code %d, credential %q, want %d, %q", statusCode, after.CredentialID, http.StatusOK, before.CredentialID)
+	}
+	var credentials struct {
+		Credentials []interface{} `json:"credentials"`
+	}
+	if statusCode := user.do("GET", "/credentials", nil, &credentials); statusCode != http.StatusOK || len(credentials.Credentials) != 2 {
+		t.Errorf("GET /credentials returns status code %d, %d credentials, want %d, 2 credentials", statusCode, len(credentials.Credentials), http.StatusOK)
+	}
+
+	// New credential can be used to log in.
+	user.logout()
+	user.login(a2, username)
+	if name, statusCode := user.userName(); statusCode != http.StatusOK || name != username {
+		t.Errorf("GET /user after login with new credential returns status code %d, name %q, want %d, %q", statusCode, name, http.StatusOK, username)
+	}
+}
+
+func TestE2EDeleteCredentialEndsSessions(t *testing.T) {
+	s, ts := newE2EServer(t)
+	defer s.Close()
+	defer ts.Close()
+
+	newAuthenticator := func() *virtualauthenticator.Authenticator {
+		a, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	username := "johndoe@example.com"
+	laptopAuthenticator, phoneAuthenticator := newAuthenticator(), newAuthenticator()
+	laptop := newE2EClient(t, ts)
+	laptop.register(laptopAuthenticator, username, webauthn.ResidentKeyDiscouraged)
+	laptop.register(phoneAuthenticator, username, webauthn.ResidentKeyDiscouraged)
+
+	phone := newE2EClient(t, ts)
+	phone.login(phoneAuthenticator, username)
+	var phoneUser struct {
+		CredentialID string `json:"credentialID"`
+	}
+	if statusCode := phone.do("GET", "/user", nil, &phoneUser); statusCode != http.StatusOK {
+		t.Fatalf("GET /user returns status code %d", statusCode)
+	}
+
+	// Credential used by phone is deleted from laptop, which ends phone's session.
+	if statusCode := laptop.do("DELETE", "/credentials/"+phoneUser.CredentialID, nil, nil); statusCode != http.StatusOK {
+		t.Fatalf("DELETE /credentials/%s returns status code %d", phoneUser.CredentialID, statusCode)
+	}
+	if _, statusCode := phone.userName(); statusCode != http.StatusUnauthorized {
+		t.Errorf("GET /user with session logged in with deleted credential returns status code %d, want %d", statusCode, http.StatusUnauthorized)
+	}
+	if name, statusCode := laptop.userName(); statusCode != http.StatusOK || name != username {
+		t.Errorf("GET /user with session logged in with other credential returns status code %d, name %q, want %d, %q", statusCode, name, http.StatusOK, username)
+	}
+}
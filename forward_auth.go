@@ -0,0 +1,144 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// forwardAuthConfig has forward authentication settings from config file.
+type forwardAuthConfig struct {
+	BaseURL      string   // URL of this server, default is Origin.  It must include path prefix if server is mounted under one.
+	AllowedHosts []string // Hosts of protected apps that browser can return to after login.  Origin host is always allowed.
+}
+
+func (c *forwardAuthConfig) valid() error {
+	if c.BaseURL != "" {
+		u, err := url.Parse(c.BaseURL)
+		if err != nil || !u.IsAbs() {
+			return errors.New("forward auth base URL \"" + c.BaseURL + "\" is not an absolute URL")
+		}
+	}
+	for _, host := range c.AllowedHosts {
+		if host == "" || strings.ContainsAny(host, "/?#@") {
+			return errors.New("forward auth allowed host \"" + host + "\" is invalid")
+		}
+	}
+	return nil
+}
+
+// forwardAuth authenticates requests forwarded by reverse proxies, such as nginx auth_request
+// and Traefik ForwardAuth, with login session.
+type forwardAuth struct {
+	baseURL      string
+	allowedHosts map[string]bool
+}
+
+func newForwardAuth(c *forwardAuthConfig, origin string) (*forwardAuth, error) {
+	if c == nil {
+		c = &forwardAuthConfig{}
+	}
+	if err := c.valid(); err != nil {
+		return nil, err
+	}
+	fa := &forwardAuth{
+		baseURL:      strings.TrimRight(c.BaseURL, "/"),
+		allowedHosts: make(map[string]bool),
+	}
+	if fa.baseURL == "" {
+		fa.baseURL = strings.TrimRight(origin, "/")
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return nil, err
+	}
+	fa.allowedHosts[strings.ToLower(u.Host)] = true
+	for _, host := range c.AllowedHosts {
+		fa.allowedHosts[strings.ToLower(host)] = true
+	}
+	return fa, nil
+}
+
+// returnURL returns rawurl if browser can be redirected to it after login.
+func (fa *forwardAuth) returnURL(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", errors.New("return URL is invalid")
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "", errors.New("return URL must be http or https")
+	}
+	if !fa.allowedHosts[strings.ToLower(u.Host)] {
+		return "", errors.New("return URL host " + u.Host + " is not allowed")
+	}
+	return u.String(), nil
+}
+
+// originalURL returns URL requested by browser from headers set by reverse proxy.  Traefik sets
+// X-Forwarded-Proto, X-Forwarded-Host, and X-Forwarded-Uri.  nginx can be configured to set X-Original-URL.
+func originalURL(r *http.Request) string {
+	if u := r.Header.Get("X-Original-URL"); u != "" {
+		return u
+	}
+	proto, host := r.Header.Get("X-Forwarded-Proto"), r.Header.Get("X-Forwarded-Host")
+	if proto == "" || host == "" {
+		return ""
+	}
+	return proto + "://" + host + r.Header.Get("X-Forwarded-Uri")
+}
+
+func loggedInUser(r *http.Request) (*User, bool) {
+	session, ok := r.Context().Value(contextKeyLoginSession).(*sessions.Session)
+	if !ok {
+		panic("Failed to get session data from context")
+	}
+	uSession, ok := session.Values[sessionMapKeyUserSession].(*userSession)
+	if !ok || len(uSession.LoggedInCredentialID) == 0 {
+		return nil, false
+	}
+	return uSession.User, true
+}
+
+// handleForwardAuthVerify responds with 200 and user headers if user is logged in.  Otherwise it
+// responds with 401, or with a redirect to sign-in page if redirect=true is in query.
+func (s *Server) handleForwardAuthVerify(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if u, ok := loggedInUser(r); ok {
+		w.Header().Set("X-Auth-User", u.UserName)
+		w.Header().Set("X-Auth-Display-Name", u.DisplayName)
+		writeOKServerResponse(w)
+		return
+	}
+
+	if r.URL.Query().Get("redirect") == "true" {
+		if returnURL, err := s.forwardAuth.returnURL(originalURL(r)); err == nil {
+			http.Redirect(w, r, s.forwardAuth.baseURL+"/auth/signin?url="+url.QueryEscape(returnURL), http.StatusFound)
+			return
+		}
+	}
+	writeFailedServerResponse(w, http.StatusUnauthorized, "User is not logged in")
+}
+
+// handleForwardAuthSignIn redirects browser to url in query if user is logged in.  Otherwise it
+// redirects to sign-in page, which returns to this request after login.
+func (s *Server) handleForwardAuthSignIn(w http.ResponseWriter, r *http.Request) {
+	returnURL, err := s.forwardAuth.returnURL(r.URL.Query().Get("url"))
+	if err != nil {
+		writeFailedServerResponse(w, http.StatusBadRequest, "Invalid url: "+err.Error())
+		return
+	}
+	if _, ok := loggedInUser(r); ok {
+		http.Redirect(w, r, returnURL, http.StatusFound)
+		return
+	}
+	// Location is relative to this request, so it works when server is mounted under a path prefix.
+	w.Header().Set("Location", "../signin.html?next="+url.QueryEscape("auth/signin?url="+url.QueryEscape(returnURL)))
+	w.WriteHeader(http.StatusFound)
+}
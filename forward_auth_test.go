@@ -0,0 +1,99 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/fxamacker/webauthn"
+	"github.com/fxamacker/webauthn-demo/virtualauthenticator"
+)
+
+func TestForwardAuth(t *testing.T) {
+	s, ts := newE2EServer(t)
+	defer s.Close()
+	defer ts.Close()
+	var err error
+	if s.forwardAuth, err = newForwardAuth(&forwardAuthConfig{AllowedHosts: []string{"wiki.example.com"}}, e2eOrigin); err != nil {
+		t.Fatalf("newForwardAuth() returns error %q", err)
+	}
+
+	c := newE2EClient(t, ts)
+	noRedirectClient := *c.client
+	noRedirectClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	get := func(path string, header http.Header) *http.Response {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := noRedirectClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s returns error %q", path, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	const returnURL = "https://wiki.example.com/page?id=1&rev=2"
+	traefikHeader := http.Header{
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Host":  {"wiki.example.com"},
+		"X-Forwarded-Uri":   {"/page?id=1&rev=2"},
+	}
+	signInLocation := e2eOrigin + "/auth/signin?url=" + url.QueryEscape(returnURL)
+
+	testCases := []struct {
+		name         string
+		path         string
+		header       http.Header
+		wantStatus   int
+		wantLocation string
+	}{
+		{name: "verify", path: "/auth/verify", header: traefikHeader, wantStatus: http.StatusUnauthorized},
+		{name: "verify with redirect", path: "/auth/verify?redirect=true", header: traefikHeader, wantStatus: http.StatusFound, wantLocation: signInLocation},
+		{name: "verify with redirect and X-Original-URL", path: "/auth/verify?redirect=true", header: http.Header{"X-Original-Url": {returnURL}}, wantStatus: http.StatusFound, wantLocation: signInLocation},
+		{name: "verify with redirect to disallowed host", path: "/auth/verify?redirect=true", header: http.Header{"X-Original-Url": {"https://evil.example.com/"}}, wantStatus: http.StatusUnauthorized},
+		{name: "verify with redirect without original URL", path: "/auth/verify?redirect=true", wantStatus: http.StatusUnauthorized},
+		{name: "sign in", path: "/auth/signin?url=" + url.QueryEscape(returnURL), wantStatus: http.StatusFound, wantLocation: "../signin.html?next=" + url.QueryEscape("auth/signin?url="+url.QueryEscape(returnURL))},
+		{name: "sign in to disallowed host", path: "/auth/signin?url=" + url.QueryEscape("https://evil.example.com/"), wantStatus: http.StatusBadRequest},
+		{name: "sign in to javascript URL", path: "/auth/signin?url=" + url.QueryEscape("javascript:alert(1)"), wantStatus: http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		resp := get(tc.path, tc.header)
+		if resp.StatusCode != tc.wantStatus || resp.Header.Get("Location") != tc.wantLocation {
+			t.Errorf("%s: GET %s returns status code %d, location %q, want %d, %q", tc.name, tc.path, resp.StatusCode, resp.Header.Get("Location"), tc.wantStatus, tc.wantLocation)
+		}
+	}
+
+	// Logged in user is verified with user headers, and sign-in returns to original URL.
+	a, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.register(a, "johndoe@example.com", webauthn.ResidentKeyDiscouraged)
+
+	resp := get("/auth/verify?redirect=true", traefikHeader)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /auth/verify after login returns status code %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if user, displayName := resp.Header.Get("X-Auth-User"), resp.Header.Get("X-Auth-Display-Name"); user != "johndoe@example.com" || displayName != "John Doe" {
+		t.Errorf("GET /auth/verify after login returns X-Auth-User %q, X-Auth-Display-Name %q, want %q, %q", user, displayName, "johndoe@example.com", "John Doe")
+	}
+	resp = get("/auth/signin?url="+url.QueryEscape(returnURL), nil)
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != returnURL {
+		t.Errorf("GET /auth/signin after login returns status code %d, location %q, want %d, %q", resp.StatusCode, resp.Header.Get("Location"), http.StatusFound, returnURL)
+	}
+
+	c.logout()
+	if resp := get("/auth/verify", nil); resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("X-Auth-User") != "" {
+		t.Errorf("GET /auth/verify after logout returns status code %d, X-Auth-User %q, want %d", resp.StatusCode, resp.Header.Get("X-Auth-User"), http.StatusUnauthorized)
+	}
+}
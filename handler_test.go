@@ -1,7 +1,7 @@
 // Copyright (c) 2019 Faye Amacker. All rights reserved.
 // Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
 
-package main
+package webauthndemo
 
 import (
 	"encoding/json"
@@ -15,22 +15,25 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"github.com/stretchr/testify/mock"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 type (
-	initMockDataStoreFunc    func(*MockDataStore)
-	initMockSessionStoreFunc func(*MockSessionStore)
-	getSessionFunc           func(sessions.Store) *sessions.Session
-	equalResponseBodyFunc    func([]byte, []byte) (bool, error)
+	initMockDataStoreFunc      func(*MockDataStore)
+	initMockSessionStoreFunc   func(*MockSessionStore)
+	initMockChallengeStoreFunc func(*MockChallengeStore)
+	getSessionFunc             func(sessions.Store) *sessions.Session
+	equalResponseBodyFunc      func([]byte, []byte) (bool, error)
 
 	handlerTestData struct {
-		name                 string
-		server               *server
-		initMockDataStore    initMockDataStoreFunc
-		initMockSessionStore initMockSessionStoreFunc
-		requestBody          string
-		wantStatusCode       int
-		wantResponseBody     string
+		name                   string
+		server                 *Server
+		initMockDataStore      initMockDataStoreFunc
+		initMockSessionStore   initMockSessionStoreFunc
+		initMockChallengeStore initMockChallengeStoreFunc // initChallengeStore is used if nil
+		requestBody            string
+		wantStatusCode         int
+		wantResponseBody       string
 	}
 	handlerTest struct {
 		requestMethod     string
@@ -44,10 +47,22 @@ var (
 	handlerTests = []handlerTest{
 		attestationOptionsTests,
 		attestationResultTests,
+		attestationPolicyTests,
+		metadataTests,
 		assertionOptionsTests,
 		assertionResultTests,
+		usernamelessAssertionOptionsTests,
+		usernamelessAssertionResultTests,
+		counterPolicyTests,
+		challengeAttestationResultTests,
+		challengeAssertionResultTests,
 		logoutTests,
 		userTests,
+		activityTests,
+		credentialsTests,
+		renameCredentialTests,
+		deleteCredentialTests,
+		deleteOtherCredentialTests,
 	}
 )
 
@@ -70,11 +85,13 @@ func getWebAuthnConfig() *webauthn.Config {
 	return config
 }
 
-func getMockServer() *server {
-	return &server{
+func getMockServer() *Server {
+	return &Server{
 		webAuthnConfig: getWebAuthnConfig(),
-		dataStore:      &MockDataStore{},
+		dataStore:      newMockDataStore(),
 		sessionStore:   &MockSessionStore{},
+		challengeStore: &MockChallengeStore{},
+		tracer:         noop.Tracer{},
 		router:         mux.NewRouter(),
 		rpOrigin:       "http://localhost:3000",
 	}
@@ -147,6 +164,11 @@ func TestHandlers(t *testing.T) {
 				if tc.initMockSessionStore != nil {
 					tc.initMockSessionStore(tc.server.sessionStore.(*MockSessionStore))
 				}
+				if tc.initMockChallengeStore != nil {
+					tc.initMockChallengeStore(tc.server.challengeStore.(*MockChallengeStore))
+				} else {
+					initChallengeStore(tc.server.challengeStore.(*MockChallengeStore))
+				}
 
 				tc.server.routes()
 
@@ -166,7 +188,7 @@ func TestHandlers(t *testing.T) {
 
 				// Verify response body
 				if responseEqual, err := equalResponseBody(recorder.Body.Bytes(), []byte(tc.wantResponseBody)); err != nil {
-					t.Errorf("Failed to test response body: " + err.Error())
+					t.Errorf("Failed to test response body: %s", err)
 				} else if !responseEqual {
 					t.Errorf("%s response is %s, want %s", requestURL, recorder.Body.String(), tc.wantResponseBody)
 				}
@@ -0,0 +1,153 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// jwsHeader is the protected header of a JWS in compact serialization.
+type jwsHeader struct {
+	Alg string   `json:"alg"`
+	Typ string   `json:"typ,omitempty"`
+	Kid string   `json:"kid,omitempty"`
+	X5c []string `json:"x5c,omitempty"` // base64 (not base64url) encoded DER certificates, leaf first
+}
+
+// jws is a parsed JWS in compact serialization.
+type jws struct {
+	header       jwsHeader
+	payload      []byte
+	signingInput []byte
+	signature    []byte
+}
+
+func parseJWS(token string) (*jws, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return nil, errors.New("jws: expected 3 parts, got " + strconv.Itoa(len(parts)))
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("jws: failed to base64 decode header: " + err.Error())
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("jws: failed to base64 decode payload: " + err.Error())
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("jws: failed to base64 decode signature: " + err.Error())
+	}
+	t := &jws{
+		payload:      payload,
+		signingInput: []byte(parts[0] + "." + parts[1]),
+		signature:    signature,
+	}
+	if err := json.Unmarshal(headerJSON, &t.header); err != nil {
+		return nil, errors.New("jws: failed to json decode header: " + err.Error())
+	}
+	return t, nil
+}
+
+// x5cCertificates returns certificates in x5c header, leaf first.
+func (t *jws) x5cCertificates() ([]*x509.Certificate, error) {
+	if len(t.header.X5c) == 0 {
+		return nil, errors.New("jws: header doesn't have x5c")
+	}
+	certs := make([]*x509.Certificate, len(t.header.X5c))
+	for i, s := range t.header.X5c {
+		der, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, errors.New("jws: failed to base64 decode x5c certificate: " + err.Error())
+		}
+		if certs[i], err = x509.ParseCertificate(der); err != nil {
+			return nil, errors.New("jws: failed to parse x5c certificate: " + err.Error())
+		}
+	}
+	return certs, nil
+}
+
+// verify verifies JWS signature with public key.
+func (t *jws) verify(pub crypto.PublicKey) error {
+	if pk, ok := pub.(ed25519.PublicKey); ok {
+		if t.header.Alg != "EdDSA" {
+			return errors.New("jws: alg " + t.header.Alg + " doesn't match Ed25519 public key")
+		}
+		if !ed25519.Verify(pk, t.signingInput, t.signature) {
+			return errors.New("jws: Ed25519 signature verification failed")
+		}
+		return nil
+	}
+
+	var hash crypto.Hash
+	switch t.header.Alg {
+	case "ES256", "RS256", "PS256":
+		hash = crypto.SHA256
+	case "ES384", "RS384", "PS384":
+		hash = crypto.SHA384
+	case "ES512", "RS512", "PS512":
+		hash = crypto.SHA512
+	default:
+		return errors.New("jws: unsupported alg \"" + t.header.Alg + "\"")
+	}
+	h := hash.New()
+	h.Write(t.signingInput)
+	digest := h.Sum(nil)
+
+	switch pk := pub.(type) {
+	case *ecdsa.PublicKey:
+		if t.header.Alg[0] != 'E' {
+			return errors.New("jws: alg " + t.header.Alg + " doesn't match ECDSA public key")
+		}
+		size := (pk.Curve.Params().BitSize + 7) / 8
+		if len(t.signature) != 2*size {
+			return errors.New("jws: invalid ECDSA signature size")
+		}
+		r := new(big.Int).SetBytes(t.signature[:size])
+		s := new(big.Int).SetBytes(t.signature[size:])
+		if !ecdsa.Verify(pk, digest, r, s) {
+			return errors.New("jws: ECDSA signature verification failed")
+		}
+		return nil
+	case *rsa.PublicKey:
+		switch t.header.Alg[0] {
+		case 'R':
+			return rsa.VerifyPKCS1v15(pk, hash, digest, t.signature)
+		case 'P':
+			return rsa.VerifyPSS(pk, hash, digest, t.signature, nil)
+		}
+		return errors.New("jws: alg " + t.header.Alg + " doesn't match RSA public key")
+	default:
+		return errors.New("jws: unsupported public key type")
+	}
+}
+
+// signJWS returns JWS in compact serialization of JSON encoded payload signed by key.
+func signJWS(key *signingKey, typ string, payload interface{}) (string, error) {
+	headerJSON, err := json.Marshal(jwsHeader{Alg: key.alg, Typ: typ, Kid: key.kid})
+	if err != nil {
+		return "", err
+	}
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(payloadJSON)
+	signature, err := key.sign([]byte(signingInput))
+	if err != nil {
+		return "", errors.New("jws: failed to sign: " + err.Error())
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
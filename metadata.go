@@ -0,0 +1,360 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fxamacker/webauthn"
+)
+
+// metadataServiceConfig has FIDO Metadata Service (MDS3) settings from config file.
+type metadataServiceConfig struct {
+	BLOBFile     string // Path of MDS3 BLOB (JWT) downloaded from FIDO Metadata Service.
+	RootCertFile string // Path of PEM encoded root certificate used to verify MDS3 BLOB signature.
+}
+
+func (c *metadataServiceConfig) valid() error {
+	if c.BLOBFile == "" {
+		return errors.New("metadata service BLOB file is empty")
+	}
+	if c.RootCertFile == "" {
+		return errors.New("metadata service root certificate file is empty")
+	}
+	return nil
+}
+
+// Authenticator status values that make authenticators untrusted, as defined in
+// https://fidoalliance.org/specs/mds/fido-metadata-service-v3.0-ps-20210518.html#authenticatorstatus-enum
+var untrustedAuthenticatorStatus = map[string]bool{
+	"REVOKED":                      true,
+	"USER_VERIFICATION_BYPASS":     true,
+	"ATTESTATION_KEY_COMPROMISE":   true,
+	"USER_KEY_REMOTE_COMPROMISE":   true,
+	"USER_KEY_PHYSICAL_COMPROMISE": true,
+}
+
+type metadataStatusReport struct {
+	Status        string `json:"status"`
+	EffectiveDate string `json:"effectiveDate"`
+}
+
+type metadataStatement struct {
+	Description                 string   `json:"description"`
+	AttestationRootCertificates []string `json:"attestationRootCertificates"` // base64 encoded DER certificates
+}
+
+// metadataBLOBEntry represents MDS3 metadataBLOBPayloadEntry.
+type metadataBLOBEntry struct {
+	AAGUID                               string                 `json:"aaguid"`
+	AttestationCertificateKeyIdentifiers []string               `json:"attestationCertificateKeyIdentifiers"`
+	MetadataStatement                    *metadataStatement     `json:"metadataStatement"`
+	StatusReports                        []metadataStatusReport `json:"statusReports"`
+	TimeOfLastStatusChange               string                 `json:"timeOfLastStatusChange"`
+
+	roots *x509.CertPool // attestation root certificates, nil if metadata statement doesn't have any
+}
+
+// metadataBLOBPayload represents MDS3 metadataBLOBPayload.
+type metadataBLOBPayload struct {
+	LegalHeader string               `json:"legalHeader"`
+	No          int                  `json:"no"`
+	NextUpdate  string               `json:"nextUpdate"`
+	Entries     []*metadataBLOBEntry `json:"entries"`
+}
+
+// description returns authenticator description from metadata statement.
+func (e *metadataBLOBEntry) description() string {
+	if e.MetadataStatement == nil {
+		return ""
+	}
+	return e.MetadataStatement.Description
+}
+
+// status returns the most recent status report's status.
+func (e *metadataBLOBEntry) status() string {
+	var latest *metadataStatusReport
+	for i := range e.StatusReports {
+		if latest == nil || e.StatusReports[i].EffectiveDate >= latest.EffectiveDate {
+			latest = &e.StatusReports[i]
+		}
+	}
+	if latest == nil {
+		return ""
+	}
+	return latest.Status
+}
+
+// metadataBLOBDateLayout is the layout of dates in MDS3 BLOB, such as nextUpdate.
+const metadataBLOBDateLayout = "2006-01-02"
+
+// metadataReloadInterval is how often MDS3 BLOB file is reloaded.
+const metadataReloadInterval = time.Hour
+
+// metadataService looks up authenticator metadata from a verified MDS3 BLOB.
+// A nil *metadataService doesn't have any metadata.
+type metadataService struct {
+	no         int
+	nextUpdate time.Time                     // BLOB is stale after this time and needs to be downloaded again
+	byAAGUID   map[string]*metadataBLOBEntry // key is hex encoded AAGUID
+	byKeyID    map[string]*metadataBLOBEntry // key is hex encoded attestation certificate key identifier
+}
+
+// loadMetadataService reads MDS3 BLOB and root certificate from files specified in config.
+func loadMetadataService(c *metadataServiceConfig) (*metadataService, error) {
+	if c == nil {
+		return nil, nil
+	}
+	blob, err := os.ReadFile(c.BLOBFile)
+	if err != nil {
+		return nil, errors.New("failed to read metadata BLOB file: " + err.Error())
+	}
+	pemData, err := os.ReadFile(c.RootCertFile)
+	if err != nil {
+		return nil, errors.New("failed to read metadata root certificate file: " + err.Error())
+	}
+	block, _ := pem.Decode(pemData)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("failed to decode metadata root certificate file " + c.RootCertFile)
+	}
+	root, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.New("failed to parse metadata root certificate: " + err.Error())
+	}
+	return newMetadataService(blob, root)
+}
+
+// metadataSource holds metadataService of the most recent BLOB loaded from BLOB file, so a new BLOB
+// downloaded from FIDO Metadata Service is used without restarting server.
+// A nil *metadataSource doesn't have any metadata.
+type metadataSource struct {
+	config  *metadataServiceConfig
+	current atomic.Pointer[metadataService]
+}
+
+// newMetadataSource loads metadataService from files specified in config.  It returns nil if config is nil.
+func newMetadataSource(c *metadataServiceConfig) (*metadataSource, error) {
+	if c == nil {
+		return nil, nil
+	}
+	m, err := loadMetadataService(c)
+	if err != nil {
+		return nil, err
+	}
+	s := &metadataSource{config: c}
+	s.current.Store(m)
+	return s, nil
+}
+
+// get returns current metadataService.
+func (s *metadataSource) get() *metadataService {
+	if s == nil {
+		return nil
+	}
+	return s.current.Load()
+}
+
+// reload replaces current metadataService if BLOB file has a BLOB with greater serial number.
+// Current metadataService is kept if BLOB file can't be loaded, such as when BLOB file is stale.
+func (s *metadataSource) reload() error {
+	m, err := loadMetadataService(s.config)
+	if err != nil {
+		return err
+	}
+	if m.no > s.get().no {
+		s.current.Store(m)
+	}
+	return nil
+}
+
+// startReload reloads BLOB file every interval until returned stop function is called.  A stale BLOB
+// is logged as a warning instead of rejecting registrations, so a late download doesn't stop signups.
+func (s *metadataSource) startReload(interval time.Duration, logger *slog.Logger) (stop func() error) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.reload(); err != nil {
+					logger.Error("failed to reload metadata BLOB", "error", err)
+				}
+				if err := s.get().checkNextUpdate(); err != nil {
+					logger.Warn("authenticator status can be out of date", "error", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() error {
+		close(done)
+		<-stopped
+		return nil
+	}
+}
+
+// newMetadataService verifies MDS3 BLOB signature with root certificate and indexes metadata by
+// AAGUID and attestation certificate key identifier.  It returns an error if BLOB is stale.
+func newMetadataService(blob []byte, root *x509.Certificate) (*metadataService, error) {
+	token, err := parseJWS(string(blob))
+	if err != nil {
+		return nil, errors.New("failed to parse metadata BLOB: " + err.Error())
+	}
+	certs, err := token.x5cCertificates()
+	if err != nil {
+		return nil, errors.New("failed to parse metadata BLOB: " + err.Error())
+	}
+	verifyOptions := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	verifyOptions.Roots.AddCert(root)
+	for _, c := range certs[1:] {
+		verifyOptions.Intermediates.AddCert(c)
+	}
+	if _, err := certs[0].Verify(verifyOptions); err != nil {
+		return nil, errors.New("failed to verify metadata BLOB signing certificate: " + err.Error())
+	}
+	if err := token.verify(certs[0].PublicKey); err != nil {
+		return nil, errors.New("failed to verify metadata BLOB signature: " + err.Error())
+	}
+
+	var payload metadataBLOBPayload
+	if err := json.Unmarshal(token.payload, &payload); err != nil {
+		return nil, errors.New("failed to json decode metadata BLOB payload: " + err.Error())
+	}
+
+	nextUpdate, err := time.Parse(metadataBLOBDateLayout, payload.NextUpdate)
+	if err != nil {
+		return nil, errors.New("failed to parse metadata BLOB nextUpdate: " + err.Error())
+	}
+
+	m := &metadataService{
+		no:         payload.No,
+		nextUpdate: nextUpdate,
+		byAAGUID:   make(map[string]*metadataBLOBEntry),
+		byKeyID:    make(map[string]*metadataBLOBEntry),
+	}
+	if err := m.checkNextUpdate(); err != nil {
+		return nil, err
+	}
+	for _, e := range payload.Entries {
+		if e.MetadataStatement != nil && len(e.MetadataStatement.AttestationRootCertificates) > 0 {
+			e.roots = x509.NewCertPool()
+			for _, s := range e.MetadataStatement.AttestationRootCertificates {
+				der, err := base64.StdEncoding.DecodeString(s)
+				if err != nil {
+					return nil, errors.New("failed to base64 decode attestation root certificate: " + err.Error())
+				}
+				c, err := x509.ParseCertificate(der)
+				if err != nil {
+					return nil, errors.New("failed to parse attestation root certificate: " + err.Error())
+				}
+				e.roots.AddCert(c)
+			}
+		}
+		if e.AAGUID != "" {
+			m.byAAGUID[strings.ToLower(strings.Replace(e.AAGUID, "-", "", -1))] = e
+		}
+		for _, keyID := range e.AttestationCertificateKeyIdentifiers {
+			m.byKeyID[strings.ToLower(keyID)] = e
+		}
+	}
+	return m, nil
+}
+
+// checkNextUpdate returns an error if BLOB's nextUpdate is in the past.  Authenticator status in a
+// stale BLOB can be out of date, so a new BLOB needs to be downloaded from FIDO Metadata Service.
+func (m *metadataService) checkNextUpdate() error {
+	if time.Now().After(m.nextUpdate) {
+		return errors.New("metadata BLOB is stale, next update was due on " + m.nextUpdate.Format(metadataBLOBDateLayout))
+	}
+	return nil
+}
+
+// lookup returns metadata entry by AAGUID, or by attestation certificate key identifier if AAGUID is
+// zero (FIDO U2F authenticators).  It returns nil if metadata isn't found.
+func (m *metadataService) lookup(aaguid []byte, trustPath interface{}) *metadataBLOBEntry {
+	if m == nil {
+		return nil
+	}
+	if len(aaguid) > 0 && !bytes.Equal(aaguid, make([]byte, len(aaguid))) {
+		return m.byAAGUID[hex.EncodeToString(aaguid)]
+	}
+	if certs, ok := trustPath.([]*x509.Certificate); ok && len(certs) > 0 {
+		if keyID, err := attestationCertificateKeyIdentifier(certs[0]); err == nil {
+			return m.byKeyID[keyID]
+		}
+	}
+	return nil
+}
+
+// verify looks up authenticator metadata and returns an error if authenticator status is untrusted, or
+// attestation trust path doesn't chain to attestation root certificates in metadata statement.  It returns
+// nil entry and nil error if metadata isn't found or attestation isn't verified to attestation root
+// certificates in metadata statement, because None and Self attestations can claim any AAGUID.
+func (m *metadataService) verify(aaguid []byte, attType webauthn.AttestationType, trustPath interface{}) (*metadataBLOBEntry, error) {
+	if m == nil {
+		return nil, nil
+	}
+	e := m.lookup(aaguid, trustPath)
+	if e == nil {
+		return nil, nil
+	}
+	if status := e.status(); untrustedAuthenticatorStatus[status] {
+		return nil, errors.New("authenticator status is " + status)
+	}
+	if e.roots == nil || (attType != webauthn.AttestationTypeBasic && attType != webauthn.AttestationTypeCA) {
+		return nil, nil
+	}
+	certs, ok := trustPath.([]*x509.Certificate)
+	if !ok || len(certs) == 0 {
+		return nil, errors.New("attestation doesn't have trust path")
+	}
+	verifyOptions := x509.VerifyOptions{
+		Roots:         e.roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, c := range certs[1:] {
+		verifyOptions.Intermediates.AddCert(c)
+	}
+	if _, err := certs[0].Verify(verifyOptions); err != nil {
+		return nil, errors.New("attestation trust path doesn't chain to metadata attestation root: " + err.Error())
+	}
+	return e, nil
+}
+
+// attestationCertificateKeyIdentifier returns hex encoded SHA-1 hash of certificate's subject public key,
+// as defined in https://fidoalliance.org/specs/mds/fido-metadata-statement-v3.0-ps-20210518.html#dom-metadatastatement-attestationcertificatekeyidentifiers
+func attestationCertificateKeyIdentifier(c *x509.Certificate) (string, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(c.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return "", err
+	}
+	h := sha1.Sum(spki.PublicKey.Bytes)
+	return hex.EncodeToString(h[:]), nil
+}
@@ -0,0 +1,249 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/webauthn"
+)
+
+// metadataSigner signs MDS3 BLOBs with a test root and signing certificate.
+type metadataSigner struct {
+	root   *x509.Certificate
+	signer *x509.Certificate
+	key    *ecdsa.PrivateKey
+}
+
+func newMetadataSigner() *metadataSigner {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test MDS Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		panic(err)
+	}
+	root, _ := x509.ParseCertificate(rootDER)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	signerTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test MDS Signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	signerDER, err := x509.CreateCertificate(rand.Reader, signerTemplate, root, &key.PublicKey, rootKey)
+	if err != nil {
+		panic(err)
+	}
+	signer, _ := x509.ParseCertificate(signerDER)
+
+	return &metadataSigner{root: root, signer: signer, key: key}
+}
+
+// sign returns MDS3 BLOB signed with ES256.
+func (s *metadataSigner) sign(payload *metadataBLOBPayload) []byte {
+	header, _ := json.Marshal(jwsHeader{Alg: "ES256", Typ: "JWT", X5c: []string{base64.StdEncoding.EncodeToString(s.signer.Raw)}})
+	body, _ := json.Marshal(payload)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, ss, err := ecdsa.Sign(rand.Reader, s.key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	ss.FillBytes(sig[32:])
+	return []byte(signingInput + "." + base64.RawURLEncoding.EncodeToString(sig))
+}
+
+// readTestCertificate returns base64 encoded DER certificate from PEM file.
+func readTestCertificate(fileName string) string {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		panic(err)
+	}
+	block, _ := pem.Decode(data)
+	return base64.StdEncoding.EncodeToString(block.Bytes)
+}
+
+func TestMetadataService(t *testing.T) {
+	s := newMetadataSigner()
+	payload := &metadataBLOBPayload{
+		No:         7,
+		NextUpdate: "2099-01-01",
+		Entries: []*metadataBLOBEntry{
+			{
+				AAGUID:            "42383245-4437-3343-3846-423445354132",
+				MetadataStatement: &metadataStatement{Description: "Feitian BioPass FIDO2 Authenticator"},
+				StatusReports: []metadataStatusReport{
+					{Status: "FIDO_CERTIFIED", EffectiveDate: "2019-01-01"},
+					{Status: "REVOKED", EffectiveDate: "2019-06-01"},
+					{Status: "NOT_FIDO_CERTIFIED", EffectiveDate: "2018-01-01"},
+				},
+			},
+			{
+				AttestationCertificateKeyIdentifiers: []string{"A72096772326B1B282B286C3E7D64089BD7AAAD9"},
+				MetadataStatement:                    &metadataStatement{Description: "Yubico U2F"},
+			},
+		},
+	}
+
+	m, err := newMetadataService(s.sign(payload), s.root)
+	if err != nil {
+		t.Fatalf("newMetadataService() returns error %q", err)
+	}
+	if wantNextUpdate := time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC); m.no != 7 || !m.nextUpdate.Equal(wantNextUpdate) {
+		t.Errorf("newMetadataService() returns no %d and nextUpdate %v, want 7 and %v", m.no, m.nextUpdate, wantNextUpdate)
+	}
+
+	aaguid := []byte("B82ED73C8FB4E5A2")
+	e := m.lookup(aaguid, nil)
+	if e == nil || e.description() != "Feitian BioPass FIDO2 Authenticator" {
+		t.Fatalf("lookup(%x) returns %+v, want entry for Feitian BioPass FIDO2 Authenticator", aaguid, e)
+	}
+	if status := e.status(); status != "REVOKED" {
+		t.Errorf("status() returns %q, want \"REVOKED\"", status)
+	}
+	if _, err := m.verify(aaguid, webauthn.AttestationTypeSelf, nil); err == nil || err.Error() != "authenticator status is REVOKED" {
+		t.Errorf("verify(%x) returns error %v, want \"authenticator status is REVOKED\"", aaguid, err)
+	}
+
+	if e := m.lookup(make([]byte, 16), nil); e != nil {
+		t.Errorf("lookup(zero AAGUID) without trust path returns %+v, want nil", e)
+	}
+	if e, err := m.verify([]byte("0123456789abcdef"), webauthn.AttestationTypeNone, nil); e != nil || err != nil {
+		t.Errorf("verify(unknown AAGUID) returns (%+v, %v), want (nil, nil)", e, err)
+	}
+
+	// Stale BLOB is still used to verify authenticators until a new BLOB is loaded.
+	m.nextUpdate = time.Now().AddDate(0, 0, -1)
+	if _, err := m.verify(aaguid, webauthn.AttestationTypeSelf, nil); err == nil || err.Error() != "authenticator status is REVOKED" {
+		t.Errorf("verify(%x) with stale BLOB returns error %v, want \"authenticator status is REVOKED\"", aaguid, err)
+	}
+	if e, err := m.verify([]byte("0123456789abcdef"), webauthn.AttestationTypeNone, nil); e != nil || err != nil {
+		t.Errorf("verify(unknown AAGUID) with stale BLOB returns (%+v, %v), want (nil, nil)", e, err)
+	}
+
+	var nilMetadataService *metadataService
+	if e, err := nilMetadataService.verify(aaguid, webauthn.AttestationTypeSelf, nil); e != nil || err != nil {
+		t.Errorf("(*metadataService)(nil).verify() returns (%+v, %v), want (nil, nil)", e, err)
+	}
+}
+
+func TestNewMetadataServiceError(t *testing.T) {
+	s := newMetadataSigner()
+	blob := s.sign(&metadataBLOBPayload{No: 1, NextUpdate: "2099-01-01"})
+	otherSigner := newMetadataSigner()
+
+	tamperedBLOB := make([]byte, len(blob))
+	copy(tamperedBLOB, blob)
+	payloadStart := strings.IndexByte(string(blob), '.') + 1
+	tamperedBLOB[payloadStart+1] ^= 0x01
+
+	testCases := []struct {
+		name         string
+		blob         []byte
+		root         *x509.Certificate
+		wantErrorMsg string
+	}{
+		{"malformed BLOB", []byte("not a jwt"), s.root, "failed to parse metadata BLOB"},
+		{"untrusted signing certificate", blob, otherSigner.root, "failed to verify metadata BLOB signing certificate"},
+		{"tampered payload", tamperedBLOB, s.root, "failed to verify metadata BLOB signature"},
+		{"missing nextUpdate", s.sign(&metadataBLOBPayload{No: 1}), s.root, "failed to parse metadata BLOB nextUpdate"},
+		{"stale BLOB", s.sign(&metadataBLOBPayload{No: 1, NextUpdate: "2019-01-01"}), s.root, "metadata BLOB is stale, next update was due on 2019-01-01"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newMetadataService(tc.blob, tc.root); err == nil {
+				t.Errorf("newMetadataService() returns no error, want error containing substring %q", tc.wantErrorMsg)
+			} else if !strings.Contains(err.Error(), tc.wantErrorMsg) {
+				t.Errorf("newMetadataService() returns error %q, want error containing substring %q", err, tc.wantErrorMsg)
+			}
+		})
+	}
+}
+
+func TestMetadataSourceReload(t *testing.T) {
+	s := newMetadataSigner()
+	dir := t.TempDir()
+	c := &metadataServiceConfig{
+		BLOBFile:     filepath.Join(dir, "blob.jwt"),
+		RootCertFile: filepath.Join(dir, "root.pem"),
+	}
+	if err := os.WriteFile(c.RootCertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.root.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeBLOB := func(no int, nextUpdate string) {
+		if err := os.WriteFile(c.BLOBFile, s.sign(&metadataBLOBPayload{No: no, NextUpdate: nextUpdate}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeBLOB(1, "2099-01-01")
+	source, err := newMetadataSource(c)
+	if err != nil {
+		t.Fatalf("newMetadataSource() returns error %q", err)
+	}
+	if no := source.get().no; no != 1 {
+		t.Fatalf("newMetadataSource() loads BLOB %d, want 1", no)
+	}
+
+	testCases := []struct {
+		name         string
+		no           int
+		nextUpdate   string
+		wantNo       int
+		wantErrorMsg string
+	}{
+		{"newer BLOB", 3, "2099-01-01", 3, ""},
+		{"older BLOB", 2, "2099-01-01", 3, ""},
+		{"stale BLOB", 4, "2019-01-01", 3, "metadata BLOB is stale, next update was due on 2019-01-01"},
+	}
+	for _, tc := range testCases {
+		writeBLOB(tc.no, tc.nextUpdate)
+		err := source.reload()
+		if tc.wantErrorMsg == "" && err != nil {
+			t.Errorf("reload() with %s returns error %q", tc.name, err)
+		} else if tc.wantErrorMsg != "" && (err == nil || err.Error() != tc.wantErrorMsg) {
+			t.Errorf("reload() with %s returns error %v, want %q", tc.name, err, tc.wantErrorMsg)
+		}
+		if no := source.get().no; no != tc.wantNo {
+			t.Errorf("reload() with %s uses BLOB %d, want %d", tc.name, no, tc.wantNo)
+		}
+	}
+
+	var nilMetadataSource *metadataSource
+	if m := nilMetadataSource.get(); m != nil {
+		t.Errorf("(*metadataSource)(nil).get() returns %+v, want nil", m)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"encoding/base64"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/mock"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	metadataErrorResponseRevoked = `{
+		"status": "failed",
+		"errorMessage": "Authenticator is rejected by metadata: authenticator status is REVOKED"
+	}`
+
+	metadataErrorResponseUserVerificationBypass = `{
+		"status": "failed",
+		"errorMessage": "Authenticator is rejected by metadata: authenticator status is USER_VERIFICATION_BYPASS"
+	}`
+
+	metadataErrorResponseUntrustedRoot = `{
+		"status": "failed",
+		"errorMessage": "Authenticator is rejected by metadata: attestation trust path doesn't chain to metadata attestation root: x509: certificate signed by unknown authority"
+	}`
+
+	feitianDescription = "FT BioPass FIDO2 USB"
+)
+
+var (
+	testMetadataSigner = newMetadataSigner()
+
+	feitianRootCertificate = readTestCertificate("testdata/attestation_roots/feitian_fido_root_ca.pem")
+
+	feitianMetadataEntry = &metadataBLOBEntry{
+		AAGUID: "42383245-4437-3343-3846-423445354132",
+		MetadataStatement: &metadataStatement{
+			Description:                 feitianDescription,
+			AttestationRootCertificates: []string{feitianRootCertificate},
+		},
+		StatusReports: []metadataStatusReport{{Status: "FIDO_CERTIFIED_L1", EffectiveDate: "2019-01-01"}},
+	}
+
+	revokedFeitianMetadataEntry = &metadataBLOBEntry{
+		AAGUID:            "42383245-4437-3343-3846-423445354132",
+		MetadataStatement: &metadataStatement{Description: feitianDescription},
+		StatusReports: []metadataStatusReport{
+			{Status: "FIDO_CERTIFIED_L1", EffectiveDate: "2019-01-01"},
+			{Status: "REVOKED", EffectiveDate: "2019-06-01"},
+		},
+	}
+
+	wrongRootFeitianMetadataEntry = &metadataBLOBEntry{
+		AAGUID: "42383245-4437-3343-3846-423445354132",
+		MetadataStatement: &metadataStatement{
+			Description:                 feitianDescription,
+			AttestationRootCertificates: []string{base64.StdEncoding.EncodeToString(testMetadataSigner.root.Raw)},
+		},
+	}
+
+	// selfAttestationMetadataEntry has AAGUID of packed self attestation fixture.
+	selfAttestationMetadataEntry = &metadataBLOBEntry{
+		AAGUID:            "a8d59924-63b7-49ea-b9de-34a753de1e01",
+		MetadataStatement: &metadataStatement{Description: "Self attested authenticator"},
+		StatusReports:     []metadataStatusReport{{Status: "FIDO_CERTIFIED_L1", EffectiveDate: "2019-01-01"}},
+	}
+
+	bypassU2FMetadataEntry = &metadataBLOBEntry{
+		AttestationCertificateKeyIdentifiers: []string{"a72096772326b1b282b286c3e7d64089bd7aaad9"},
+		MetadataStatement:                    &metadataStatement{Description: "Yubico U2F"},
+		StatusReports:                        []metadataStatusReport{{Status: "USER_VERIFICATION_BYPASS", EffectiveDate: "2019-01-01"}},
+	}
+
+	metadataTests = handlerTest{
+		requestMethod:     "POST",
+		requestURL:        "/attestation/result",
+		equalResponseBody: equalServerResponse,
+		testcases: []handlerTestData{
+			{
+				name:                 "packed basic attestation with metadata",
+				server:               getMockServerWithMetadata(packedBasicAttestation.origin, feitianMetadataEntry),
+				initMockDataStore:    initDataStoreAddUserCredentialWithDescription(feitianDescription),
+				initMockSessionStore: initSessionStore(getAttestationFixtureSession(packedBasicAttestation), getAttestationFixtureUserSession(packedBasicAttestation)),
+				requestBody:          packedBasicAttestationRequest,
+				wantStatusCode:       http.StatusOK,
+				wantResponseBody:     attestationResultSuccessResponse,
+			},
+			{
+				name:                 "packed basic attestation with revoked authenticator",
+				server:               getMockServerWithMetadata(packedBasicAttestation.origin, revokedFeitianMetadataEntry),
+				initMockDataStore:    initDataStoreAddUserCredentialNotCalled,
+				initMockSessionStore: initSessionStore(getAttestationFixtureSession(packedBasicAttestation), getEmptySession),
+				requestBody:          packedBasicAttestationRequest,
+				wantStatusCode:       http.StatusBadRequest,
+				wantResponseBody:     metadataErrorResponseRevoked,
+			},
+			{
+				name:                 "packed basic attestation without metadata attestation root",
+				server:               getMockServerWithMetadata(packedBasicAttestation.origin, wrongRootFeitianMetadataEntry),
+				initMockDataStore:    initDataStoreAddUserCredentialNotCalled,
+				initMockSessionStore: initSessionStore(getAttestationFixtureSession(packedBasicAttestation), getEmptySession),
+				requestBody:          packedBasicAttestationRequest,
+				wantStatusCode:       http.StatusBadRequest,
+				wantResponseBody:     metadataErrorResponseUntrustedRoot,
+			},
+			{
+				name:                 "fido-u2f attestation with user verification bypass",
+				server:               getMockServerWithMetadata(fidoU2FAttestation.origin, bypassU2FMetadataEntry),
+				initMockDataStore:    initDataStoreAddUserCredentialNotCalled,
+				initMockSessionStore: initSessionStore(getAttestationFixtureSession(fidoU2FAttestation), getEmptySession),
+				requestBody:          fidoU2FAttestationRequest,
+				wantStatusCode:       http.StatusBadRequest,
+				wantResponseBody:     metadataErrorResponseUserVerificationBypass,
+			},
+			{
+				name:                 "self attestation with metadata doesn't save description",
+				server:               getMockServerWithMetadata(packedSelfAttestation.origin, selfAttestationMetadataEntry),
+				initMockDataStore:    initDataStoreAddUserCredentialWithDescription(""),
+				initMockSessionStore: initSessionStore(getAttestationFixtureSession(packedSelfAttestation), getAttestationFixtureUserSession(packedSelfAttestation)),
+				requestBody:          packedSelfAttestationRequest,
+				wantStatusCode:       http.StatusOK,
+				wantResponseBody:     attestationResultSuccessResponse,
+			},
+			{
+				name:                 "self attestation without metadata",
+				server:               getMockServerWithMetadata(packedSelfAttestation.origin, feitianMetadataEntry),
+				initMockDataStore:    initDataStoreAddUserCredentialWithDescription(""),
+				initMockSessionStore: initSessionStore(getAttestationFixtureSession(packedSelfAttestation), getAttestationFixtureUserSession(packedSelfAttestation)),
+				requestBody:          packedSelfAttestationRequest,
+				wantStatusCode:       http.StatusOK,
+				wantResponseBody:     attestationResultSuccessResponse,
+			},
+		},
+	}
+)
+
+func getMockServerWithMetadata(origin string, entry *metadataBLOBEntry) *Server {
+	blob := testMetadataSigner.sign(&metadataBLOBPayload{No: 1, NextUpdate: "2099-01-01", Entries: []*metadataBLOBEntry{entry}})
+	metadataService, err := newMetadataService(blob, testMetadataSigner.root)
+	if err != nil {
+		panic(err)
+	}
+	metadata := &metadataSource{}
+	metadata.current.Store(metadataService)
+	return &Server{
+		webAuthnConfig: getWebAuthnConfig(),
+		metadata:       metadata,
+		dataStore:      newMockDataStore(),
+		sessionStore:   &MockSessionStore{},
+		challengeStore: &MockChallengeStore{},
+		tracer:         noop.Tracer{},
+		router:         mux.NewRouter(),
+		rpOrigin:       origin,
+	}
+}
+
+func initDataStoreAddUserCredentialWithDescription(description string) initMockDataStoreFunc {
+	return func(mockDataStore *MockDataStore) {
+		mockDataStore.On("AddUserCredential", mock.Anything, mockNewUser, mock.MatchedBy(func(c *Credential) bool {
+			return c.Description == description && len(c.AAGUID) == 16
+		})).Return(nil).Once()
+		mockDataStore.On("ReplaceRecoveryCodes", mock.Anything, mockNewUser.UserID, mock.Anything).Return(nil).Once()
+	}
+}
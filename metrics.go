@@ -0,0 +1,188 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Ceremony failure reasons in metrics.
+const (
+	failureReasonRequest   = "request"
+	failureReasonParse     = "parse"
+	failureReasonVerify    = "verify"
+	failureReasonPolicy    = "policy"
+	failureReasonSession   = "session"
+	failureReasonDataStore = "datastore"
+	failureReasonRateLimit = "ratelimit"
+	failureReasonOther     = "other"
+)
+
+// ceremonyFailureReasons maps error message prefixes of ceremony handlers to failure reasons.
+var ceremonyFailureReasons = []struct {
+	prefix string
+	reason string
+}{
+	{"Failed to json decode request body", failureReasonRequest},
+	{"Missing ", failureReasonRequest},
+	{"Username is already registered", failureReasonRequest},
+	{"Failed to parse ", failureReasonParse},
+	{"Assertion doesn't have user handle", failureReasonParse},
+	{"Failed to verify ", failureReasonVerify},
+	{"Challenge ", failureReasonVerify},
+	{"Credential is ", failureReasonVerify},
+	{"User handle doesn't match", failureReasonVerify},
+	{"Attestation is rejected", failureReasonPolicy},
+	{"Authenticator is rejected", failureReasonPolicy},
+	{"Session doesn't have", failureReasonSession},
+	{"Failed to retrieve session", failureReasonSession},
+	{"Failed to save session", failureReasonSession},
+	{"Failed to save challenge", failureReasonSession},
+	{"Failed to consume challenge", failureReasonSession},
+	{"Failed to query ", failureReasonDataStore},
+	{"Failed to find ", failureReasonDataStore},
+	{"Failed to save user credential", failureReasonDataStore},
+	{"Failed to save recovery codes", failureReasonDataStore},
+	{"Failed to update credential", failureReasonDataStore},
+	{"Failed to disable credential", failureReasonDataStore},
+	{"Failed to record clone event", failureReasonDataStore},
+	{"User credential exists", failureReasonDataStore},
+}
+
+// ceremonyFailureReason returns failure reason of ceremony response with status code and error message.
+func ceremonyFailureReason(status int, errMsg string) string {
+	if status == http.StatusTooManyRequests {
+		return failureReasonRateLimit
+	}
+	for _, r := range ceremonyFailureReasons {
+		if strings.HasPrefix(errMsg, r.prefix) {
+			return r.reason
+		}
+	}
+	return failureReasonOther
+}
+
+// ceremonySteps maps routes of WebAuthn ceremonies to ceremony and step labels.
+var ceremonySteps = map[string][2]string{
+	"/attestation/options": {"attestation", "options"},
+	"/attestation/result":  {"attestation", "result"},
+	"/assertion/options":   {"assertion", "options"},
+	"/assertion/result":    {"assertion", "result"},
+}
+
+// metrics has Prometheus metrics of server.  Metrics are registered in their own registry, so
+// servers in the same process don't share metrics.
+type metrics struct {
+	registry          *prometheus.Registry
+	ceremonies        *prometheus.CounterVec
+	requestDuration   *prometheus.HistogramVec
+	dataStoreDuration *prometheus.HistogramVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		ceremonies: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webauthn_ceremony_attempts_total",
+			Help: "WebAuthn registration (attestation) and login (assertion) attempts by step, outcome, and failure reason.",
+		}, []string{"ceremony", "step", "outcome", "reason"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "webauthn_http_request_duration_seconds",
+			Help:    "HTTP request latency by route, method, and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+		dataStoreDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "webauthn_datastore_call_duration_seconds",
+			Help:    "Data store call latency by method.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"method"}),
+	}
+	m.registry.MustRegister(
+		m.ceremonies,
+		m.requestDuration,
+		m.dataStoreDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// registerDBStats adds gauges of connection pool stats of db.
+func (m *metrics) registerDBStats(db *dbStore) {
+	m.registry.MustRegister(collectors.NewDBStatsCollector(db.DB, "webauthn"))
+}
+
+// handler returns handler of /metrics.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// middleware is a mux middleware that records request latency, and outcome of WebAuthn ceremony requests.
+func (m *metrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if tmpl, err := cr.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		ceremonyStep, isCeremony := ceremonySteps[route]
+
+		mw := &metricsWriter{ResponseWriter: w, keepErrorBody: isCeremony}
+		start := time.Now()
+		next.ServeHTTP(mw, r)
+		status := mw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		m.requestDuration.WithLabelValues(route, r.Method, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+
+		if isCeremony {
+			outcome, reason := auditOutcomeSuccess, ""
+			if status >= http.StatusBadRequest {
+				var resp serverResponse
+				json.Unmarshal(mw.errorBody.Bytes(), &resp)
+				outcome, reason = auditOutcomeFailure, ceremonyFailureReason(status, resp.ErrorMessage)
+			}
+			m.ceremonies.WithLabelValues(ceremonyStep[0], ceremonyStep[1], outcome, reason).Inc()
+		}
+	})
+}
+
+// maxMetricsErrorBodySize is size limit of failed response kept to find failure reason.
+const maxMetricsErrorBodySize = 4096
+
+// metricsWriter hijacks ResponseWriter to get response status code and failed response body.
+type metricsWriter struct {
+	http.ResponseWriter
+	status        int
+	keepErrorBody bool
+	errorBody     bytes.Buffer
+}
+
+func (w *metricsWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *metricsWriter) Write(b []byte) (int, error) {
+	if w.keepErrorBody && w.status >= http.StatusBadRequest && w.errorBody.Len()+len(b) <= maxMetricsErrorBodySize {
+		w.errorBody.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
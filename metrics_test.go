@@ -0,0 +1,123 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/webauthn"
+	"github.com/fxamacker/webauthn-demo/virtualauthenticator"
+)
+
+func TestCeremonyFailureReason(t *testing.T) {
+	testCases := []struct {
+		status     int
+		errMsg     string
+		wantReason string
+	}{
+		{http.StatusBadRequest, "Missing username", failureReasonRequest},
+		{http.StatusBadRequest, "Failed to parse assertion: invalid JSON", failureReasonParse},
+		{http.StatusBadRequest, "Failed to verify attestation: invalid signature", failureReasonVerify},
+		{http.StatusBadRequest, "Credential is not registered", failureReasonVerify},
+		{http.StatusBadRequest, "Attestation is rejected by policy: untrusted root", failureReasonPolicy},
+		{http.StatusUnauthorized, "Session doesn't have user data", failureReasonSession},
+		{http.StatusInternalServerError, "Failed to retrieve session \"LoginSession\": connection refused", failureReasonSession},
+		{http.StatusInternalServerError, "Failed to query user in database: connection refused", failureReasonDataStore},
+		{http.StatusTooManyRequests, "Too many requests", failureReasonRateLimit},
+		{http.StatusInternalServerError, "Failed to json encode response body: unsupported type", failureReasonOther},
+	}
+	for _, tc := range testCases {
+		if reason := ceremonyFailureReason(tc.status, tc.errMsg); reason != tc.wantReason {
+			t.Errorf("ceremonyFailureReason(%d, %q) returns %q, want %q", tc.status, tc.errMsg, reason, tc.wantReason)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	sqliteStore, err := newSQLiteStore(filepath.Join(t.TempDir(), "webauthn.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqliteStore.Close()
+	s, err := NewServer(
+		WithConfig(&Config{CounterPolicy: counterPolicyReject, AuditLog: auditLogMemory, Metrics: true}),
+		WithWebAuthnConfig(getWebAuthnConfig()),
+		WithOrigin(e2eOrigin),
+		WithDataStore(sqliteStore),
+		WithSessionStore(getMemSessionStore()),
+	)
+	if err != nil {
+		t.Fatalf("NewServer() returns error %q", err)
+	}
+	defer s.Close()
+	ts := httptest.NewTLSServer(s)
+	defer ts.Close()
+
+	a, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username := "johndoe@example.com"
+	c := newE2EClient(t, ts)
+	c.register(a, username, webauthn.ResidentKeyDiscouraged)
+	c.logout()
+	c.login(a, username)
+	if statusCode := c.do("POST", "/assertion/options", map[string]string{}, nil); statusCode != http.StatusBadRequest {
+		t.Fatalf("POST /assertion/options without username returns status code %d, want %d", statusCode, http.StatusBadRequest)
+	}
+	if statusCode := c.do("POST", "/assertion/options", map[string]string{"username": username}, nil); statusCode != http.StatusOK {
+		t.Fatalf("POST /assertion/options returns status code %d", statusCode)
+	}
+	if statusCode := c.do("POST", "/assertion/result", map[string]string{}, nil); statusCode != http.StatusBadRequest {
+		t.Fatalf("POST /assertion/result with invalid assertion returns status code %d, want %d", statusCode, http.StatusBadRequest)
+	}
+
+	resp, err := ts.Client().Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics returns error %q", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /metrics returns status code %d", resp.StatusCode)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(b)
+
+	wantMetrics := []string{
+		`webauthn_ceremony_attempts_total{ceremony="attestation",outcome="success",reason="",step="options"} 1`,
+		`webauthn_ceremony_attempts_total{ceremony="attestation",outcome="success",reason="",step="result"} 1`,
+		`webauthn_ceremony_attempts_total{ceremony="assertion",outcome="success",reason="",step="options"} 2`,
+		`webauthn_ceremony_attempts_total{ceremony="assertion",outcome="success",reason="",step="result"} 1`,
+		`webauthn_ceremony_attempts_total{ceremony="assertion",outcome="failure",reason="request",step="options"} 1`,
+		`webauthn_ceremony_attempts_total{ceremony="assertion",outcome="failure",reason="parse",step="result"} 1`,
+		`webauthn_http_request_duration_seconds_count{code="200",method="GET",route="/logout"} 1`,
+		`webauthn_http_request_duration_seconds_count{code="400",method="POST",route="/assertion/result"} 1`,
+		`webauthn_datastore_call_duration_seconds_count{method="AddUserCredential"} 1`,
+		`webauthn_datastore_call_duration_seconds_count{method="UpdateCredential"} 1`,
+		`go_sql_max_open_connections{db_name="webauthn"}`,
+	}
+	for _, want := range wantMetrics {
+		if !strings.Contains(body, want) {
+			t.Errorf("GET /metrics doesn't return %s", want)
+		}
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	s, ts := newE2EServer(t)
+	defer s.Close()
+	defer ts.Close()
+
+	if statusCode := newE2EClient(t, ts).do("GET", "/metrics", nil, nil); statusCode != http.StatusNotFound {
+		t.Errorf("GET /metrics returns status code %d, want %d", statusCode, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations are embedded from db/migrations/<driver>/<version>_<name>.up.sql and
+// db/migrations/<driver>/<version>_<name>.down.sql.  Each driver has the same versions.
+//
+//go:embed db/migrations
+var migrationFiles embed.FS
+
+// schemaMigrationsTables creates table of applied migrations by driver.
+var schemaMigrationsTables = map[string]string{
+	dbDriverPostgres: "CREATE TABLE IF NOT EXISTS schema_migrations (version INT PRIMARY KEY, name TEXT NOT NULL, applied_at TIMESTAMP WITH TIME ZONE NOT NULL)",
+	dbDriverSQLite:   "CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, name TEXT NOT NULL, applied_at TIMESTAMP NOT NULL)",
+}
+
+// migration is a versioned schema change with SQL to apply and revert it.
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// MigrationStatus is a migration and time it was applied.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time // zero if migration is pending
+}
+
+// loadMigrations returns embedded migrations of driver sorted by version.
+func loadMigrations(driver string) ([]*migration, error) {
+	dir := path.Join("db/migrations", driver)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, errors.New("failed to read migrations of \"" + driver + "\": " + err.Error())
+	}
+	migrationsByVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, errors.New("migration file " + fileName + " doesn't end with .up.sql or .down.sql")
+		}
+		versionName := strings.TrimSuffix(fileName, "."+direction+".sql")
+		i := strings.IndexByte(versionName, '_')
+		if i <= 0 {
+			return nil, errors.New("migration file " + fileName + " doesn't start with version")
+		}
+		version, err := strconv.Atoi(versionName[:i])
+		if err != nil || version <= 0 {
+			return nil, errors.New("migration file " + fileName + " doesn't start with positive version")
+		}
+		b, err := fs.ReadFile(migrationFiles, path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := migrationsByVersion[version]
+		if !ok {
+			m = &migration{version: version, name: versionName[i+1:]}
+			migrationsByVersion[version] = m
+		} else if m.name != versionName[i+1:] {
+			return nil, errors.New("migration version " + strconv.Itoa(version) + " has different names")
+		}
+		if direction == "up" {
+			m.up = string(b)
+		} else {
+			m.down = string(b)
+		}
+	}
+	migrations := make([]*migration, 0, len(migrationsByVersion))
+	for _, m := range migrationsByVersion {
+		if m.up == "" || m.down == "" {
+			return nil, errors.New("migration " + strconv.Itoa(m.version) + "_" + m.name + " doesn't have both up and down SQL")
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// Migrator applies and reverts schema migrations of PostgreSQL or SQLite database.  Applied
+// migrations are recorded in schema_migrations table.  Memory data store doesn't have schema,
+// so Migrator of memory driver doesn't have migrations.
+type Migrator struct {
+	db         *sql.DB // nil for memory driver
+	driver     string
+	migrations []*migration
+	closeDB    bool
+}
+
+// NewMigrator opens database of driver and connString to migrate its schema.  Migrator must be
+// closed after use.
+func NewMigrator(driver string, connString string) (*Migrator, error) {
+	switch driver {
+	case dbDriverPostgres:
+		db, err := openPostgres(connString)
+		if err != nil {
+			return nil, err
+		}
+		return newMigratorWithCloser(db, driver)
+	case dbDriverSQLite:
+		db, err := openSQLite(connString)
+		if err != nil {
+			return nil, err
+		}
+		return newMigratorWithCloser(db, driver)
+	case dbDriverMemory:
+		return &Migrator{driver: driver}, nil
+	}
+	return nil, errors.New("unsupported database driver \"" + driver + "\"")
+}
+
+func newMigratorWithCloser(db *sql.DB, driver string) (*Migrator, error) {
+	m, err := newMigrator(db, driver)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	m.closeDB = true
+	return m, nil
+}
+
+// newMigrator returns Migrator of opened database.
+func newMigrator(db *sql.DB, driver string) (*Migrator, error) {
+	migrations, err := loadMigrations(driver)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, driver: driver, migrations: migrations}, nil
+}
+
+// Close closes database opened by NewMigrator.
+func (m *Migrator) Close() error {
+	if m.closeDB {
+		return m.db.Close()
+	}
+	return nil
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// appliedMigrations returns applied time of migrations by version.
+func (m *Migrator) appliedMigrations(ctx context.Context, q queryer) (map[int]time.Time, error) {
+	rows, err := q.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// Status returns all migrations and their applied time.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	if m.db == nil {
+		return nil, nil
+	}
+	if _, err := m.db.ExecContext(ctx, schemaMigrationsTables[m.driver]); err != nil {
+		return nil, err
+	}
+	applied, err := m.appliedMigrations(ctx, m.db)
+	if err != nil {
+		return nil, err
+	}
+	status := make([]MigrationStatus, len(m.migrations))
+	for i, migration := range m.migrations {
+		status[i] = MigrationStatus{Version: migration.version, Name: migration.name, AppliedAt: applied[migration.version]}
+	}
+	return status, nil
+}
+
+// Up applies pending migrations in version order and returns applied migrations.
+func (m *Migrator) Up(ctx context.Context) ([]MigrationStatus, error) {
+	var applied []MigrationStatus
+	for _, migration := range m.migrations {
+		ok, err := m.migrate(ctx, migration, true)
+		if err != nil {
+			return applied, errors.New("failed to apply migration " + strconv.Itoa(migration.version) + "_" + migration.name + ": " + err.Error())
+		}
+		if ok {
+			applied = append(applied, MigrationStatus{Version: migration.version, Name: migration.name})
+		}
+	}
+	return applied, nil
+}
+
+// Down reverts the latest applied migration and returns it.  It returns nil if no migration is applied.
+func (m *Migrator) Down(ctx context.Context) (*MigrationStatus, error) {
+	status, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(status) - 1; i >= 0; i-- {
+		if status[i].AppliedAt.IsZero() {
+			continue
+		}
+		if _, err := m.migrate(ctx, m.migrations[i], false); err != nil {
+			return nil, errors.New("failed to revert migration " + strconv.Itoa(status[i].Version) + "_" + status[i].Name + ": " + err.Error())
+		}
+		return &status[i], nil
+	}
+	return nil, nil
+}
+
+// migrate applies or reverts migration in a transaction.  It returns false if migration is
+// already applied or reverted, possibly by another server instance.
+func (m *Migrator) migrate(ctx context.Context, migration *migration, up bool) (bool, error) {
+	if _, err := m.db.ExecContext(ctx, schemaMigrationsTables[m.driver]); err != nil {
+		return false, err
+	}
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Serialize migrations of server instances sharing PostgreSQL database.
+	if m.driver == dbDriverPostgres {
+		if _, err = tx.ExecContext(ctx, "LOCK TABLE schema_migrations IN EXCLUSIVE MODE"); err != nil {
+			return false, err
+		}
+	}
+	applied, err := m.appliedMigrations(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := applied[migration.version]; ok == up {
+		return false, nil
+	}
+	if up {
+		if _, err = tx.ExecContext(ctx, migration.up); err != nil {
+			return false, err
+		}
+		if _, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)", migration.version, migration.name, time.Now().UTC()); err != nil {
+			return false, err
+		}
+	} else {
+		if _, err = tx.ExecContext(ctx, migration.down); err != nil {
+			return false, err
+		}
+		if _, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", migration.version); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
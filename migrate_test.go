@@ -0,0 +1,110 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	postgresMigrations, err := loadMigrations(dbDriverPostgres)
+	if err != nil {
+		t.Fatalf("loadMigrations(%q) returns error %q", dbDriverPostgres, err)
+	}
+	sqliteMigrations, err := loadMigrations(dbDriverSQLite)
+	if err != nil {
+		t.Fatalf("loadMigrations(%q) returns error %q", dbDriverSQLite, err)
+	}
+	if len(postgresMigrations) == 0 || len(postgresMigrations) != len(sqliteMigrations) {
+		t.Fatalf("loadMigrations() returns %d PostgreSQL migrations and %d SQLite migrations, want the same number", len(postgresMigrations), len(sqliteMigrations))
+	}
+	for i := range postgresMigrations {
+		p, s := postgresMigrations[i], sqliteMigrations[i]
+		if p.version != i+1 || s.version != p.version || s.name != p.name {
+			t.Errorf("migration %d is %d_%s for PostgreSQL and %d_%s for SQLite, want version %d with the same name", i, p.version, p.name, s.version, s.name, i+1)
+		}
+	}
+	if _, err := loadMigrations("mysql"); err == nil {
+		t.Errorf("loadMigrations(%q) doesn't return error", "mysql")
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+	m, err := NewMigrator(dbDriverSQLite, filepath.Join(t.TempDir(), "webauthn.db"))
+	if err != nil {
+		t.Fatalf("NewMigrator() returns error %q", err)
+	}
+	defer m.Close()
+
+	checkStatus := func(wantApplied int) {
+		t.Helper()
+		status, err := m.Status(ctx)
+		if err != nil {
+			t.Fatalf("Status() returns error %q", err)
+		}
+		if len(status) != len(m.migrations) {
+			t.Fatalf("Status() returns %d migrations, want %d", len(status), len(m.migrations))
+		}
+		for i, s := range status {
+			if applied := !s.AppliedAt.IsZero(); applied != (i < wantApplied) {
+				t.Errorf("Status() returns migration %d_%s applied %t, want %t", s.Version, s.Name, applied, i < wantApplied)
+			}
+		}
+	}
+	tableExists := func(table string) bool {
+		var n int
+		if err := m.db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = $1", table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n > 0
+	}
+
+	checkStatus(0)
+	applied, err := m.Up(ctx)
+	if err != nil {
+		t.Fatalf("Up() returns error %q", err)
+	}
+	if len(applied) != len(m.migrations) {
+		t.Errorf("Up() applies %d migrations, want %d", len(applied), len(m.migrations))
+	}
+	checkStatus(len(m.migrations))
+	if !tableExists("credentials") {
+		t.Errorf("Up() doesn't create credentials table")
+	}
+	if applied, err := m.Up(ctx); err != nil || len(applied) != 0 {
+		t.Errorf("Up() without pending migrations returns %v, %v, want no migrations", applied, err)
+	}
+
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		reverted, err := m.Down(ctx)
+		if err != nil {
+			t.Fatalf("Down() returns error %q", err)
+		}
+		if reverted == nil || reverted.Version != m.migrations[i].version {
+			t.Fatalf("Down() reverts %+v, want version %d", reverted, m.migrations[i].version)
+		}
+		checkStatus(i)
+	}
+	if tableExists("credentials") {
+		t.Errorf("Down() doesn't drop credentials table")
+	}
+	if reverted, err := m.Down(ctx); err != nil || reverted != nil {
+		t.Errorf("Down() without applied migrations returns %+v, %v, want nil", reverted, err)
+	}
+
+	// Memory data store doesn't have migrations.
+	memMigrator, err := NewMigrator(dbDriverMemory, "")
+	if err != nil {
+		t.Fatalf("NewMigrator() returns error %q", err)
+	}
+	if status, err := memMigrator.Status(ctx); err != nil || len(status) != 0 {
+		t.Errorf("Status() of memory driver returns %v, %v, want no migrations", status, err)
+	}
+	if applied, err := memMigrator.Up(ctx); err != nil || len(applied) != 0 {
+		t.Errorf("Up() of memory driver returns %v, %v, want no migrations", applied, err)
+	}
+}
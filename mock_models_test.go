@@ -1,7 +1,7 @@
 // Copyright (c) 2019 Faye Amacker. All rights reserved.
 // Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
 
-package main
+package webauthndemo
 
 import (
 	"encoding/base64"
@@ -12,13 +12,13 @@ import (
 )
 
 var (
-	mockNewUser = &user{
+	mockNewUser = &User{
 		UserID:      []byte{1, 2, 3},
 		UserName:    "johndoe@example.com",
 		DisplayName: "John Doe",
 	}
 
-	mockExistingUser = &user{
+	mockExistingUser = &User{
 		UserID:      []byte{1, 2, 3},
 		UserName:    "johndoe@example.com",
 		DisplayName: "John Doe",
@@ -27,7 +27,7 @@ var (
 		},
 	}
 
-	mockCredential = &credential{
+	mockCredential = &Credential{
 		CredentialID: base64RawURLDecodeString("LFdoCFJTyB82ZzSJUHc-c72yraRc_1mPvGX8ToE8su39xX26Jcqd31LUkKOS36FIAWgWl6itMKqmDvruha6ywA"),
 		UserID:       []byte{1, 2, 3},
 		Counter:      uint32(0),
@@ -115,7 +115,10 @@ func getAttestationOptionsExistingUserSession(store sessions.Store) *sessions.Se
 	for _, id := range mockExistingUserCopy.CredentialIDs {
 		excludeCredentials = append(excludeCredentials, webauthn.PublicKeyCredentialDescriptor{Type: webauthn.PublicKeyCredentialTypePublicKey, ID: id})
 	}
-	session.Values[sessionMapKeyUserSession] = &userSession{User: &mockExistingUserCopy}
+	session.Values[sessionMapKeyUserSession] = &userSession{
+		User:                 &mockExistingUserCopy,
+		LoggedInCredentialID: mockExistingUserCopy.CredentialIDs[0],
+	}
 	session.Values[sessionMapKeyWebAuthnCreationOptions] = &webauthn.PublicKeyCredentialCreationOptions{
 		RP: webauthn.PublicKeyCredentialRpEntity{
 			Name: "WebAuthn local server",
@@ -179,6 +182,21 @@ func getUserSession(store sessions.Store) *sessions.Session {
 	return session
 }
 
+// getOtherUserSession returns login session of a user other than mockExistingUser.
+func getOtherUserSession(store sessions.Store) *sessions.Session {
+	session := sessions.NewSession(store, sessionNameLoginSession)
+	session.Values[sessionMapKeyUserSession] = &userSession{
+		User: &User{
+			UserID:        []byte{4, 5, 6},
+			UserName:      "janedoe@example.com",
+			DisplayName:   "Jane Doe",
+			CredentialIDs: [][]byte{{4, 5, 6}},
+		},
+		LoggedInCredentialID: []byte{4, 5, 6},
+	}
+	return session
+}
+
 func base64RawURLDecodeString(s string) []byte {
 	b, err := base64.RawURLEncoding.DecodeString(s)
 	if err != nil {
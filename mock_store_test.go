@@ -1,7 +1,7 @@
 // Copyright (c) 2019 Faye Amacker. All rights reserved.
 // Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
 
-package main
+package webauthndemo
 
 import (
 	"context"
@@ -18,23 +18,62 @@ type MockDataStore struct {
 	mock.Mock
 }
 
-func (m *MockDataStore) getUser(ctx context.Context, username string) (*user, error) {
+// newMockDataStore returns MockDataStore of users whose sessions are never revoked.
+func newMockDataStore() *MockDataStore {
+	m := &MockDataStore{}
+	m.On("GetSessionsRevokedAt", mock.Anything, mock.Anything, mock.Anything).Return(time.Time{}, nil).Maybe()
+	return m
+}
+
+func (m *MockDataStore) GetUser(ctx context.Context, username string) (*User, error) {
 	args := m.Called(ctx, username)
 	if args.Get(1) != nil {
 		return nil, args.Error(1)
 	}
-	return args.Get(0).(*user), args.Error(1)
+	return args.Get(0).(*User), args.Error(1)
+}
+
+func (m *MockDataStore) GetUserByID(ctx context.Context, userID []byte) (*User, error) {
+	args := m.Called(ctx, userID)
+	if args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*User), args.Error(1)
+}
+
+func (m *MockDataStore) GetUsers(ctx context.Context, search string, offset int, limit int) ([]*User, int, error) {
+	args := m.Called(ctx, search, offset, limit)
+	if args.Get(2) != nil {
+		return nil, 0, args.Error(2)
+	}
+	return args.Get(0).([]*User), args.Int(1), args.Error(2)
+}
+
+func (m *MockDataStore) GetCredentialByID(ctx context.Context, credentialID []byte) (*Credential, error) {
+	args := m.Called(ctx, credentialID)
+	if args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*Credential), args.Error(1)
 }
 
-func (m *MockDataStore) getCredential(ctx context.Context, userID []byte, credentialID []byte) (*credential, error) {
+func (m *MockDataStore) GetCredential(ctx context.Context, userID []byte, credentialID []byte) (*Credential, error) {
 	args := m.Called(ctx, userID, credentialID)
 	if args.Get(1) != nil {
 		return nil, args.Error(1)
 	}
-	return args.Get(0).(*credential), args.Error(1)
+	return args.Get(0).(*Credential), args.Error(1)
+}
+
+func (m *MockDataStore) GetCredentials(ctx context.Context, userID []byte) ([]*Credential, error) {
+	args := m.Called(ctx, userID)
+	if args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*Credential), args.Error(1)
 }
 
-func (m *MockDataStore) getCredentialTimestamp(ctx context.Context, userID []byte, credentialID []byte) (registeredAt time.Time, loggedInAt time.Time, err error) {
+func (m *MockDataStore) GetCredentialTimestamp(ctx context.Context, userID []byte, credentialID []byte) (registeredAt time.Time, loggedInAt time.Time, err error) {
 	args := m.Called(ctx, userID, credentialID)
 	if args.Get(2) != nil {
 		return time.Time{}, time.Time{}, args.Error(1)
@@ -42,16 +81,98 @@ func (m *MockDataStore) getCredentialTimestamp(ctx context.Context, userID []byt
 	return args.Get(0).(time.Time), args.Get(1).(time.Time), args.Error(2)
 }
 
-func (m *MockDataStore) addUserCredential(ctx context.Context, u *user, c *credential) error {
+func (m *MockDataStore) AddUserCredential(ctx context.Context, u *User, c *Credential) error {
 	args := m.Called(ctx, u, c)
 	return args.Error(0)
 }
 
-func (m *MockDataStore) updateCredential(ctx context.Context, c *credential) error {
-	args := m.Called(ctx, c)
+func (m *MockDataStore) UpdateCredential(ctx context.Context, c *Credential, prevCounter uint32) error {
+	args := m.Called(ctx, c, prevCounter)
+	return args.Error(0)
+}
+
+func (m *MockDataStore) DisableCredential(ctx context.Context, userID []byte, credentialID []byte) error {
+	args := m.Called(ctx, userID, credentialID)
+	return args.Error(0)
+}
+
+func (m *MockDataStore) AddCloneEvent(ctx context.Context, e *CloneEvent) error {
+	args := m.Called(ctx, e)
+	return args.Error(0)
+}
+
+func (m *MockDataStore) GetCloneEvents(ctx context.Context, userID []byte) ([]*CloneEvent, error) {
+	args := m.Called(ctx, userID)
+	if args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*CloneEvent), args.Error(1)
+}
+
+func (m *MockDataStore) AddRefreshToken(ctx context.Context, t *RefreshToken) error {
+	args := m.Called(ctx, t)
 	return args.Error(0)
 }
 
+func (m *MockDataStore) GetRefreshToken(ctx context.Context, tokenHash []byte) (*RefreshToken, error) {
+	args := m.Called(ctx, tokenHash)
+	if args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*RefreshToken), args.Error(1)
+}
+
+func (m *MockDataStore) DeleteRefreshToken(ctx context.Context, tokenHash []byte) error {
+	args := m.Called(ctx, tokenHash)
+	return args.Error(0)
+}
+
+func (m *MockDataStore) ReplaceRecoveryCodes(ctx context.Context, userID []byte, codes []*RecoveryCode) error {
+	args := m.Called(ctx, userID, codes)
+	return args.Error(0)
+}
+
+func (m *MockDataStore) GetRecoveryCodes(ctx context.Context, userID []byte) ([]*RecoveryCode, error) {
+	args := m.Called(ctx, userID)
+	if args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*RecoveryCode), args.Error(1)
+}
+
+func (m *MockDataStore) DeleteRecoveryCode(ctx context.Context, userID []byte, codeHash []byte) error {
+	args := m.Called(ctx, userID, codeHash)
+	return args.Error(0)
+}
+
+func (m *MockDataStore) RenameCredential(ctx context.Context, userID []byte, credentialID []byte, nickname string) error {
+	args := m.Called(ctx, userID, credentialID, nickname)
+	return args.Error(0)
+}
+
+func (m *MockDataStore) DeleteCredential(ctx context.Context, userID []byte, credentialID []byte) error {
+	args := m.Called(ctx, userID, credentialID)
+	return args.Error(0)
+}
+
+func (m *MockDataStore) DeleteUser(ctx context.Context, userID []byte) error {
+	args := m.Called(ctx, userID)
+	return args.Error(0)
+}
+
+func (m *MockDataStore) RevokeSessions(ctx context.Context, userID []byte, revokedAt time.Time) error {
+	args := m.Called(ctx, userID, revokedAt)
+	return args.Error(0)
+}
+
+func (m *MockDataStore) GetSessionsRevokedAt(ctx context.Context, userID []byte, credentialID []byte) (time.Time, error) {
+	args := m.Called(ctx, userID, credentialID)
+	if args.Get(1) != nil {
+		return time.Time{}, args.Error(1)
+	}
+	return args.Get(0).(time.Time), nil
+}
+
 type MockSessionStore struct {
 	mock.Mock
 }
@@ -71,38 +192,70 @@ func (m *MockSessionStore) Save(r *http.Request, w http.ResponseWriter, s *sessi
 	return args.Error(0)
 }
 
+type MockAuditLog struct {
+	mock.Mock
+}
+
+func (m *MockAuditLog) record(ctx context.Context, e *auditEvent) error {
+	args := m.Called(ctx, e)
+	return args.Error(0)
+}
+
+func (m *MockAuditLog) getEvents(ctx context.Context, userID []byte, limit int) ([]*auditEvent, error) {
+	args := m.Called(ctx, userID, limit)
+	if args.Get(1) != nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*auditEvent), args.Error(1)
+}
+
+type MockChallengeStore struct {
+	mock.Mock
+}
+
+func (m *MockChallengeStore) add(ctx context.Context, challenge []byte, ttl time.Duration) error {
+	args := m.Called(ctx, challenge, ttl)
+	return args.Error(0)
+}
+
+func (m *MockChallengeStore) consume(ctx context.Context, challenge []byte) error {
+	args := m.Called(ctx, challenge)
+	return args.Error(0)
+}
+
 func initDataStoreGetUserNone(mockDataStore *MockDataStore) {
-	mockDataStore.On("getUser", mock.Anything, mock.Anything).Return(nil, errNoRecords)
+	mockDataStore.On("GetUser", mock.Anything, mock.Anything).Return(nil, ErrNoRecords)
 }
 
 func initDataStoreGetUser(mockDataStore *MockDataStore) {
-	mockDataStore.On("getUser", mock.Anything, mockExistingUser.UserName).Return(mockExistingUser, nil).Once()
+	mockDataStore.On("GetUser", mock.Anything, mockExistingUser.UserName).Return(mockExistingUser, nil).Once()
 }
 
 func initDataStoreAddUserCredentialNotCalled(mockDataStore *MockDataStore) {
-	mockDataStore.On("addUserCredential", mock.Anything, mock.Anything, mock.Anything).Times(0)
+	mockDataStore.On("AddUserCredential", mock.Anything, mock.Anything, mock.Anything).Times(0)
 }
 
 func initDataStoreAddUserCredential(mockDataStore *MockDataStore) {
-	mockDataStore.On("addUserCredential", mock.Anything, mockNewUser, mockCredential).Return(nil).Once()
+	mockDataStore.On("AddUserCredential", mock.Anything, mockNewUser, mockCredential).Return(nil).Once()
+	mockDataStore.On("ReplaceRecoveryCodes", mock.Anything, mockNewUser.UserID, mock.Anything).Return(nil).Once()
 }
 
 func initDataStoreGetAndUpdateCredential(mockDataStore *MockDataStore) {
 	c2 := *mockCredential // make a copy of credentialMock
 	c2.Counter = 0
-	mockDataStore.On("getCredential", mock.Anything, mockCredential.UserID, mockCredential.CredentialID).Return(mockCredential, nil).Once()
-	mockDataStore.On("updateCredential", mock.Anything, &c2).Return(nil).Maybe()
+	mockDataStore.On("GetCredential", mock.Anything, mockCredential.UserID, mockCredential.CredentialID).Return(mockCredential, nil).Once()
+	mockDataStore.On("UpdateCredential", mock.Anything, &c2, uint32(0)).Return(nil).Maybe()
 }
 
 func initDataStoreGetAndUpdateCredentialNotCalled(mockDataStore *MockDataStore) {
-	mockDataStore.On("getCredential", mock.Anything, mock.Anything, mock.Anything).Times(0)
-	mockDataStore.On("updateCredential", mock.Anything, mock.Anything).Times(0)
+	mockDataStore.On("GetCredential", mock.Anything, mock.Anything, mock.Anything).Times(0)
+	mockDataStore.On("UpdateCredential", mock.Anything, mock.Anything, mock.Anything).Times(0)
 }
 
 func initDataStoreGetCredentialTimestamp(mockDataStore *MockDataStore) {
 	t1 := time.Date(2009, time.January, 1, 1, 0, 0, 0, time.UTC)
 	t2 := time.Date(2009, time.February, 1, 1, 0, 0, 0, time.UTC)
-	mockDataStore.On("getCredentialTimestamp", mock.Anything, mock.Anything, mock.Anything).Return(t1, t2, nil).Once()
+	mockDataStore.On("GetCredentialTimestamp", mock.Anything, mock.Anything, mock.Anything).Return(t1, t2, nil).Once()
 }
 
 func initSessionStore(getSession getSessionFunc, saveSession getSessionFunc) func(mockSessionStore *MockSessionStore) {
@@ -112,11 +265,18 @@ func initSessionStore(getSession getSessionFunc, saveSession getSessionFunc) fun
 	}
 }
 
+// initChallengeStore accepts any challenge, so that handler tests not about replay protection don't need to set challenge store expectations.
+func initChallengeStore(mockChallengeStore *MockChallengeStore) {
+	mockChallengeStore.On("add", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockChallengeStore.On("consume", mock.Anything, mock.Anything).Return(nil)
+}
+
 func removeSessionRandomData(session *sessions.Session) *sessions.Session {
 	if s, ok := session.Values[sessionMapKeyUserSession].(*userSession); ok {
 		if s.User.CredentialIDs == nil { // new user
 			s.User.UserID = nil
 		}
+		s.LoggedInAt = time.Time{}
 	}
 	if s, ok := session.Values[sessionMapKeyWebAuthnCreationOptions].(*webauthn.PublicKeyCredentialCreationOptions); ok {
 		s.Challenge = nil
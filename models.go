@@ -1,23 +1,65 @@
 // Copyright (c) 2019 Faye Amacker. All rights reserved.
 // Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
 
-package main
+package webauthndemo
 
-type user struct {
+import "time"
+
+// User is a registered user.
+type User struct {
 	UserID        []byte
 	UserName      string
 	DisplayName   string
 	CredentialIDs [][]byte
 }
 
-type credential struct {
+// Credential is a registered public key credential.
+type Credential struct {
 	CredentialID []byte
 	UserID       []byte
 	Counter      uint32
 	CoseKey      []byte
+	AAGUID       []byte // nil if authenticator doesn't provide AAGUID
+	Description  string // authenticator description from metadata service
+	Nickname     string // user assigned friendly name
+	RegisteredAt time.Time
+	LoggedInAt   time.Time
+	Flagged      bool // possible cloned authenticator is detected
+	Disabled     bool // credential can't be used to log in
+}
+
+// CloneEvent records signature counter regression detected at login.
+type CloneEvent struct {
+	UserID       []byte
+	CredentialID []byte
+	PrevCounter  uint32 // stored signature counter
+	Counter      uint32 // signature counter in assertion
+	Action       string // counter policy applied
+	DetectedAt   time.Time
+}
+
+// RefreshToken is an opaque API refresh token.  Only SHA-256 hash of token is stored.
+type RefreshToken struct {
+	TokenHash    []byte
+	UserID       []byte
+	CredentialID []byte // credential used to log in
+	UserVerified bool   // user verification was performed at login
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+}
+
+// RecoveryCode is a one-time account recovery code.  Only PBKDF2 hash of code is stored.
+type RecoveryCode struct {
+	UserID    []byte
+	Salt      []byte
+	CodeHash  []byte
+	CreatedAt time.Time
 }
 
 type userSession struct {
-	User                 *user
+	User                 *User
 	LoggedInCredentialID []byte
+	LoggedInAt           time.Time // login or recovery time, session is ended if user's sessions are revoked after it
+	UserVerified         bool      // user verification was performed at login
+	Recovery             bool      // user logged in with recovery code and can only register a new credential
 }
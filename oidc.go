@@ -0,0 +1,553 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	defaultOIDCTokenTTL            = 60 * 5 // ID and access tokens expire after 5 minutes
+	oidcAuthorizationCodeTTL       = time.Minute
+	oidcAccessTokenType            = "at+jwt"
+	oidcCodeChallengeMethodS256    = "S256"
+	oidcGrantTypeAuthorizationCode = "authorization_code"
+)
+
+// oidcConfig has OpenID Connect provider settings from config file.
+type oidcConfig struct {
+	Issuer         string              // Issuer identifier, default is Origin.  It must include path prefix if server is mounted under one.
+	SigningKeyFile string              // PEM file with private keys.  The first key signs tokens, others are published for rotation.  Ephemeral key is used if empty.
+	TokenTTL       int                 // ID and access token lifetime in seconds.
+	Clients        []*oidcClientConfig // Registered relying parties.
+}
+
+// oidcClientConfig is a registered OpenID Connect relying party.
+type oidcClientConfig struct {
+	ClientID     string
+	ClientSecret string // empty for public clients, which are authenticated by PKCE only
+	RedirectURIs []string
+}
+
+func (c *oidcConfig) valid() error {
+	if c.TokenTTL < 0 {
+		return errors.New("OIDC token TTL is negative")
+	}
+	if len(c.Clients) == 0 {
+		return errors.New("OIDC config doesn't have clients")
+	}
+	clientIDs := make(map[string]bool)
+	for _, client := range c.Clients {
+		if client.ClientID == "" {
+			return errors.New("OIDC client ID is empty")
+		}
+		if clientIDs[client.ClientID] {
+			return errors.New("OIDC client ID \"" + client.ClientID + "\" is duplicated")
+		}
+		clientIDs[client.ClientID] = true
+		if len(client.RedirectURIs) == 0 {
+			return errors.New("OIDC client \"" + client.ClientID + "\" doesn't have redirect URIs")
+		}
+		for _, redirectURI := range client.RedirectURIs {
+			u, err := url.Parse(redirectURI)
+			if err != nil || !u.IsAbs() || u.Fragment != "" {
+				return errors.New("OIDC client \"" + client.ClientID + "\" has invalid redirect URI \"" + redirectURI + "\"")
+			}
+		}
+	}
+	return nil
+}
+
+func (c *oidcClientConfig) validRedirectURI(redirectURI string) bool {
+	for _, uri := range c.RedirectURIs {
+		if uri == redirectURI {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcProvider is an OpenID Connect provider that issues tokens for users logged in with WebAuthn.
+type oidcProvider struct {
+	issuer   string
+	tokenTTL time.Duration
+	keys     *signingKeySet
+	clients  map[string]*oidcClientConfig
+	codes    *oidcCodeStore
+}
+
+func newOIDCProvider(c *oidcConfig, origin string) (*oidcProvider, error) {
+	if err := c.valid(); err != nil {
+		return nil, err
+	}
+	p := &oidcProvider{
+		issuer:   strings.TrimRight(c.Issuer, "/"),
+		tokenTTL: time.Duration(c.TokenTTL) * time.Second,
+		clients:  make(map[string]*oidcClientConfig),
+		codes:    &oidcCodeStore{codes: make(map[string]*oidcAuthorizationCode)},
+	}
+	if p.issuer == "" {
+		p.issuer = strings.TrimRight(origin, "/")
+	}
+	if p.tokenTTL == 0 {
+		p.tokenTTL = defaultOIDCTokenTTL * time.Second
+	}
+	var err error
+	if c.SigningKeyFile != "" {
+		p.keys, err = loadSigningKeySet(c.SigningKeyFile)
+	} else {
+		p.keys, err = newEphemeralSigningKeySet()
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, client := range c.Clients {
+		p.clients[client.ClientID] = client
+	}
+	return p, nil
+}
+
+// oidcAuthorizationCode is authorization request data bound to an issued authorization code.
+type oidcAuthorizationCode struct {
+	clientID      string
+	redirectURI   string
+	scope         string
+	nonce         string
+	codeChallenge string
+	userID        []byte
+	authTime      time.Time
+	userVerified  bool
+	expiresAt     time.Time
+}
+
+// oidcCodeStore keeps single-use authorization codes in memory.  Authorization codes are short-lived,
+// so they aren't shared by server instances; token requests must reach the instance that issued the code.
+type oidcCodeStore struct {
+	mu    sync.Mutex
+	codes map[string]*oidcAuthorizationCode
+}
+
+func (cs *oidcCodeStore) add(c *oidcAuthorizationCode) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := base64.RawURLEncoding.EncodeToString(b)
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range cs.codes {
+		if now.After(v.expiresAt) {
+			delete(cs.codes, k)
+		}
+	}
+	cs.codes[code] = c
+	return code, nil
+}
+
+// consume removes code from store and returns its data, or nil if code doesn't exist or is expired.
+func (cs *oidcCodeStore) consume(code string) *oidcAuthorizationCode {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	c, ok := cs.codes[code]
+	if !ok {
+		return nil
+	}
+	delete(cs.codes, code)
+	if time.Now().After(c.expiresAt) {
+		return nil
+	}
+	return c
+}
+
+// idTokenClaims are claims in ID token.
+type idTokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          string   `json:"aud"`
+	ExpiresAt         int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	AuthTime          int64    `json:"auth_time"`
+	Nonce             string   `json:"nonce,omitempty"`
+	AMR               []string `json:"amr"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+}
+
+// accessTokenClaims are claims in JWT access token, as defined in RFC 9068.
+type accessTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+	ClientID  string `json:"client_id"`
+	Scope     string `json:"scope"`
+	JTI       string `json:"jti"`
+}
+
+// authenticationMethods returns amr claim values (RFC 8176) for WebAuthn login.  WebAuthn proves
+// possession of hardware-secured key and user presence; with user verification it's multi-factor.
+func authenticationMethods(userVerified bool) []string {
+	if userVerified {
+		return []string{"hwk", "user", "mfa"}
+	}
+	return []string{"hwk", "user"}
+}
+
+// oidcSubject returns sub claim value of user ID.
+func oidcSubject(userID []byte) string {
+	return base64.RawURLEncoding.EncodeToString(userID)
+}
+
+func writeOAuthError(w http.ResponseWriter, httpStatusCode int, errCode string, description string) {
+	b, _ := json.Marshal(map[string]string{"error": errCode, "error_description": description})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(httpStatusCode)
+	w.Write(b)
+}
+
+func writeOAuthJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to json marshal response body")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(b)
+}
+
+func (s *Server) handleOIDCDiscovery() http.HandlerFunc {
+	type response struct {
+		Issuer                            string   `json:"issuer"`
+		AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+		TokenEndpoint                     string   `json:"token_endpoint"`
+		UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+		JWKSURI                           string   `json:"jwks_uri"`
+		ScopesSupported                   []string `json:"scopes_supported"`
+		ResponseTypesSupported            []string `json:"response_types_supported"`
+		GrantTypesSupported               []string `json:"grant_types_supported"`
+		SubjectTypesSupported             []string `json:"subject_types_supported"`
+		IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+		TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+		CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+		ClaimsSupported                   []string `json:"claims_supported"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := s.oidc
+		writeOAuthJSON(w, response{
+			Issuer:                            p.issuer,
+			AuthorizationEndpoint:             p.issuer + "/authorize",
+			TokenEndpoint:                     p.issuer + "/token",
+			UserInfoEndpoint:                  p.issuer + "/userinfo",
+			JWKSURI:                           p.issuer + "/jwks",
+			ScopesSupported:                   []string{"openid", "profile"},
+			ResponseTypesSupported:            []string{"code"},
+			GrantTypesSupported:               []string{oidcGrantTypeAuthorizationCode},
+			SubjectTypesSupported:             []string{"public"},
+			IDTokenSigningAlgValuesSupported:  p.keys.algs(),
+			TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+			CodeChallengeMethodsSupported:     []string{oidcCodeChallengeMethodS256},
+			ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "amr", "name", "preferred_username"},
+		})
+	}
+}
+
+func (s *Server) handleOIDCJWKS(w http.ResponseWriter, r *http.Request) {
+	b, err := s.oidc.keys.jwksJSON()
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to json marshal JWKS")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// handleOIDCAuthorize handles authorization code request with PKCE.  User who isn't logged in is
+// redirected to sign-in page, which returns to this request after login.
+func (s *Server) handleOIDCAuthorize(w http.ResponseWriter, r *http.Request) {
+	p := s.oidc
+	q := r.URL.Query()
+
+	// Errors in client ID and redirect URI are not redirected to client.
+	client, ok := p.clients[q.Get("client_id")]
+	if !ok {
+		writeFailedServerResponse(w, http.StatusBadRequest, "Unknown client_id")
+		return
+	}
+	redirectURI := q.Get("redirect_uri")
+	if !client.validRedirectURI(redirectURI) {
+		writeFailedServerResponse(w, http.StatusBadRequest, "Invalid redirect_uri")
+		return
+	}
+
+	redirectToClient := func(params url.Values) {
+		u, _ := url.Parse(redirectURI)
+		values := u.Query()
+		for k, v := range params {
+			values[k] = v
+		}
+		if state := q.Get("state"); state != "" {
+			values.Set("state", state)
+		}
+		u.RawQuery = values.Encode()
+		http.Redirect(w, r, u.String(), http.StatusFound)
+	}
+	redirectError := func(errCode string, description string) {
+		redirectToClient(url.Values{"error": {errCode}, "error_description": {description}})
+	}
+
+	if q.Get("response_type") != "code" {
+		redirectError("unsupported_response_type", "response_type must be code")
+		return
+	}
+	scopes := strings.Fields(q.Get("scope"))
+	hasOpenIDScope := false
+	for _, scope := range scopes {
+		if scope == "openid" {
+			hasOpenIDScope = true
+		}
+	}
+	if !hasOpenIDScope {
+		redirectError("invalid_scope", "scope must include openid")
+		return
+	}
+	codeChallenge := q.Get("code_challenge")
+	if codeChallenge == "" {
+		redirectError("invalid_request", "code_challenge is required")
+		return
+	}
+	if q.Get("code_challenge_method") != oidcCodeChallengeMethodS256 {
+		redirectError("invalid_request", "code_challenge_method must be S256")
+		return
+	}
+	// Get logged in user.
+	session, ok := r.Context().Value(contextKeyLoginSession).(*sessions.Session)
+	if !ok {
+		panic("Failed to get session data from context")
+	}
+	uSession, ok := session.Values[sessionMapKeyUserSession].(*userSession)
+	if !ok || len(uSession.LoggedInCredentialID) == 0 {
+		if q.Get("prompt") == "none" {
+			redirectError("login_required", "user is not logged in")
+			return
+		}
+		// Location is relative to this request, so it works when server is mounted under a path prefix.
+		w.Header().Set("Location", "signin.html?next="+url.QueryEscape("authorize?"+r.URL.RawQuery))
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	_, loggedInAt, err := s.dataStore.GetCredentialTimestamp(r.Context(), uSession.User.UserID, uSession.LoggedInCredentialID)
+	if err != nil {
+		redirectError("server_error", "failed to find credential")
+		return
+	}
+
+	code, err := p.codes.add(&oidcAuthorizationCode{
+		clientID:      client.ClientID,
+		redirectURI:   redirectURI,
+		scope:         strings.Join(scopes, " "),
+		nonce:         q.Get("nonce"),
+		codeChallenge: codeChallenge,
+		userID:        uSession.User.UserID,
+		authTime:      loggedInAt,
+		userVerified:  uSession.UserVerified,
+		expiresAt:     time.Now().Add(oidcAuthorizationCodeTTL),
+	})
+	if err != nil {
+		redirectError("server_error", "failed to create authorization code")
+		return
+	}
+	redirectToClient(url.Values{"code": {code}})
+}
+
+// handleOIDCToken exchanges authorization code for ID token and access token.
+func (s *Server) handleOIDCToken(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Scope       string `json:"scope"`
+		IDToken     string `json:"id_token"`
+	}
+	p := s.oidc
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "failed to parse form: "+err.Error())
+		return
+	}
+	if r.PostForm.Get("grant_type") != oidcGrantTypeAuthorizationCode {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "grant_type must be "+oidcGrantTypeAuthorizationCode)
+		return
+	}
+
+	// Authenticate client with client_secret_basic, client_secret_post, or none for public clients.
+	clientID, clientSecret, basicAuth := r.BasicAuth()
+	if basicAuth {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+	client, ok := p.clients[clientID]
+	if !ok || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(client.ClientSecret)) != 1 {
+		if basicAuth {
+			w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+		}
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+
+	code := p.codes.consume(r.PostForm.Get("code"))
+	if code == nil || code.clientID != client.ClientID {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "authorization code is invalid or expired")
+		return
+	}
+	if r.PostForm.Get("redirect_uri") != code.redirectURI {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri doesn't match authorization request")
+		return
+	}
+	verifierHash := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(verifierHash[:]) != code.codeChallenge {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "code_verifier doesn't match code_challenge")
+		return
+	}
+
+	u, err := s.dataStore.GetUserByID(r.Context(), code.userID)
+	if err == ErrNoRecords {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "user doesn't exist")
+		return
+	} else if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to find user")
+		return
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(p.tokenTTL)
+	idToken, err := signJWS(p.keys.current(), "JWT", idTokenClaims{
+		Issuer:            p.issuer,
+		Subject:           oidcSubject(u.UserID),
+		Audience:          client.ClientID,
+		ExpiresAt:         expiresAt.Unix(),
+		IssuedAt:          now.Unix(),
+		AuthTime:          code.authTime.Unix(),
+		Nonce:             code.nonce,
+		AMR:               authenticationMethods(code.userVerified),
+		Name:              u.DisplayName,
+		PreferredUsername: u.UserName,
+	})
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to sign ID token")
+		return
+	}
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to create access token ID")
+		return
+	}
+	accessToken, err := signJWS(p.keys.current(), oidcAccessTokenType, accessTokenClaims{
+		Issuer:    p.issuer,
+		Subject:   oidcSubject(u.UserID),
+		Audience:  p.issuer,
+		ExpiresAt: expiresAt.Unix(),
+		IssuedAt:  now.Unix(),
+		ClientID:  client.ClientID,
+		Scope:     code.scope,
+		JTI:       base64.RawURLEncoding.EncodeToString(jti),
+	})
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to sign access token")
+		return
+	}
+
+	writeOAuthJSON(w, response{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(p.tokenTTL / time.Second),
+		Scope:       code.scope,
+		IDToken:     idToken,
+	})
+}
+
+// verifyAccessToken returns claims of access token issued by provider.
+func (p *oidcProvider) verifyAccessToken(token string) (*accessTokenClaims, error) {
+	t, err := p.keys.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if t.header.Typ != oidcAccessTokenType {
+		return nil, errors.New("token type is not " + oidcAccessTokenType)
+	}
+	var claims accessTokenClaims
+	if err := json.Unmarshal(t.payload, &claims); err != nil {
+		return nil, errors.New("failed to json decode token claims: " + err.Error())
+	}
+	if claims.Issuer != p.issuer || claims.Audience != p.issuer {
+		return nil, errors.New("token isn't issued for this server")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errors.New("token is expired")
+	}
+	return &claims, nil
+}
+
+// handleOIDCUserInfo returns claims of user identified by Bearer access token.
+func (s *Server) handleOIDCUserInfo(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Subject           string `json:"sub"`
+		Name              string `json:"name"`
+		PreferredUsername string `json:"preferred_username"`
+	}
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", "access token is missing")
+		return
+	}
+	claims, err := s.oidc.verifyAccessToken(auth[7:])
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", err.Error())
+		return
+	}
+	userID, err := base64.RawURLEncoding.DecodeString(claims.Subject)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", "token has invalid subject")
+		return
+	}
+	u, err := s.dataStore.GetUserByID(r.Context(), userID)
+	if err == ErrNoRecords {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", "user doesn't exist")
+		return
+	} else if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "failed to find user")
+		return
+	}
+	writeOAuthJSON(w, response{
+		Subject:           claims.Subject,
+		Name:              u.DisplayName,
+		PreferredUsername: u.UserName,
+	})
+}
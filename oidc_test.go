@@ -0,0 +1,396 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/webauthn"
+	"github.com/fxamacker/webauthn-demo/virtualauthenticator"
+)
+
+const (
+	oidcTestClientID     = "wiki"
+	oidcTestClientSecret = "wiki_secret"
+	oidcTestRedirectURI  = "https://wiki.example.com/callback"
+)
+
+// writeSigningKeyFile writes PEM encoded PKCS #8 private keys to file in dir.
+func writeSigningKeyFile(t *testing.T, dir string, keys ...crypto.Signer) string {
+	var data []byte
+	for _, key := range keys {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})...)
+	}
+	path := filepath.Join(dir, "signing_keys.pem")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func pkceChallenge(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+func TestSigningKeySetRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks, err := loadSigningKeySet(writeSigningKeyFile(t, dir, oldKey))
+	if err != nil {
+		t.Fatalf("loadSigningKeySet() returns error %q", err)
+	}
+	token, err := signJWS(ks.current(), "JWT", map[string]string{"sub": "johndoe"})
+	if err != nil {
+		t.Fatalf("signJWS() returns error %q", err)
+	}
+
+	// New key signs new tokens, and tokens signed by old key are still verified.
+	rotated, err := loadSigningKeySet(writeSigningKeyFile(t, dir, newKey, oldKey))
+	if err != nil {
+		t.Fatalf("loadSigningKeySet() returns error %q", err)
+	}
+	if alg := rotated.current().alg; alg != "RS256" {
+		t.Errorf("current signing key has alg %s, want RS256", alg)
+	}
+	if _, err := rotated.verify(token); err != nil {
+		t.Errorf("verify() token signed by old key returns error %q", err)
+	}
+	newToken, err := signJWS(rotated.current(), "JWT", map[string]string{"sub": "johndoe"})
+	if err != nil {
+		t.Fatalf("signJWS() returns error %q", err)
+	}
+	if _, err := rotated.verify(newToken); err != nil {
+		t.Errorf("verify() token signed by new key returns error %q", err)
+	}
+
+	// Tokens signed by removed key are rejected.
+	retired, err := loadSigningKeySet(writeSigningKeyFile(t, dir, newKey))
+	if err != nil {
+		t.Fatalf("loadSigningKeySet() returns error %q", err)
+	}
+	if _, err := retired.verify(token); err == nil {
+		t.Errorf("verify() token signed by removed key returns no error")
+	}
+}
+
+func TestOIDCAuthorizationCodeFlow(t *testing.T) {
+	currentKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		CounterPolicy: counterPolicyReject,
+		AuditLog:      auditLogMemory,
+		OIDC: &oidcConfig{
+			SigningKeyFile: writeSigningKeyFile(t, t.TempDir(), currentKey, previousKey),
+			Clients: []*oidcClientConfig{
+				{ClientID: oidcTestClientID, ClientSecret: oidcTestClientSecret, RedirectURIs: []string{oidcTestRedirectURI}},
+			},
+		},
+	}
+	webAuthnConfig := getWebAuthnConfig()
+	webAuthnConfig.UserVerification = webauthn.UserVerificationRequired
+	s, err := NewServer(
+		WithConfig(c),
+		WithWebAuthnConfig(webAuthnConfig),
+		WithOrigin(e2eOrigin),
+		WithDataStore(newMemStore()),
+		WithSessionStore(getMemSessionStore()),
+	)
+	if err != nil {
+		t.Fatalf("NewServer() returns error %q", err)
+	}
+	defer s.Close()
+	ts := httptest.NewTLSServer(s)
+	defer ts.Close()
+
+	ec := newE2EClient(t, ts)
+	noRedirectClient := *ec.client
+	noRedirectClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	authorize := func(params url.Values) *http.Response {
+		resp, err := noRedirectClient.Get(ts.URL + "/authorize?" + params.Encode())
+		if err != nil {
+			t.Fatalf("GET /authorize returns error %q", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	token := func(form url.Values) (int, map[string]interface{}) {
+		req, err := http.NewRequest("POST", ts.URL+"/token", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(oidcTestClientID, oidcTestClientSecret)
+		resp, err := noRedirectClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /token returns error %q", err)
+		}
+		defer resp.Body.Close()
+		var v map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+			t.Fatalf("POST /token returns invalid JSON: %s", err)
+		}
+		return resp.StatusCode, v
+	}
+
+	// Discovery document advertises endpoints under issuer.
+	var discovery map[string]interface{}
+	if statusCode := ec.do("GET", "/.well-known/openid-configuration", nil, &discovery); statusCode != http.StatusOK {
+		t.Fatalf("GET /.well-known/openid-configuration returns status code %d", statusCode)
+	}
+	if discovery["issuer"] != e2eOrigin || discovery["token_endpoint"] != e2eOrigin+"/token" {
+		t.Errorf("discovery document has issuer %v and token endpoint %v, want %s", discovery["issuer"], discovery["token_endpoint"], e2eOrigin)
+	}
+
+	// JWKS publishes current and previous signing keys.
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if statusCode := ec.do("GET", "/jwks", nil, &jwks); statusCode != http.StatusOK {
+		t.Fatalf("GET /jwks returns status code %d", statusCode)
+	}
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kid != s.oidc.keys.current().kid {
+		t.Fatalf("JWKS has keys %+v, want 2 keys with current key first", jwks.Keys)
+	}
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	authorizeParams := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidcTestClientID},
+		"redirect_uri":          {oidcTestRedirectURI},
+		"scope":                 {"openid profile"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	// Authorization request errors.
+	errorTestCases := []struct {
+		name         string
+		param        string
+		value        string
+		wantStatus   int
+		wantLocation string
+	}{
+		{name: "unknown client", param: "client_id", value: "blog", wantStatus: http.StatusBadRequest},
+		{name: "unregistered redirect URI", param: "redirect_uri", value: "https://evil.example.com/callback", wantStatus: http.StatusBadRequest},
+		{name: "missing code challenge", param: "code_challenge", value: "", wantStatus: http.StatusFound, wantLocation: oidcTestRedirectURI + "?error=invalid_request"},
+		{name: "plain code challenge", param: "code_challenge_method", value: "plain", wantStatus: http.StatusFound, wantLocation: oidcTestRedirectURI + "?error=invalid_request"},
+		{name: "missing openid scope", param: "scope", value: "profile", wantStatus: http.StatusFound, wantLocation: oidcTestRedirectURI + "?error=invalid_scope"},
+	}
+	for _, tc := range errorTestCases {
+		params := url.Values{}
+		for k, v := range authorizeParams {
+			params[k] = v
+		}
+		params.Set(tc.param, tc.value)
+		resp := authorize(params)
+		if resp.StatusCode != tc.wantStatus {
+			t.Errorf("%s: GET /authorize returns status code %d, want %d", tc.name, resp.StatusCode, tc.wantStatus)
+		}
+		if location := resp.Header.Get("Location"); !strings.HasPrefix(location, tc.wantLocation) {
+			t.Errorf("%s: GET /authorize redirects to %q, want %q", tc.name, location, tc.wantLocation)
+		}
+	}
+
+	// User who isn't logged in is redirected to sign-in page.
+	resp := authorize(authorizeParams)
+	wantLocation := "signin.html?next=" + url.QueryEscape("authorize?"+authorizeParams.Encode())
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != wantLocation {
+		t.Fatalf("GET /authorize without login returns status code %d, location %q, want %d, %q", resp.StatusCode, resp.Header.Get("Location"), http.StatusFound, wantLocation)
+	}
+
+	// Logged in user is redirected to client with authorization code.
+	a, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username := "johndoe@example.com"
+	ec.register(a, username, webauthn.ResidentKeyDiscouraged)
+	ec.logout()
+	ec.login(a, username)
+
+	getCode := func() string {
+		resp := authorize(authorizeParams)
+		if resp.StatusCode != http.StatusFound {
+			t.Fatalf("GET /authorize returns status code %d, want %d", resp.StatusCode, http.StatusFound)
+		}
+		location, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if location.Query().Get("state") != "xyz" || location.Query().Get("code") == "" {
+			t.Fatalf("GET /authorize redirects to %s, want code and state", location)
+		}
+		return location.Query().Get("code")
+	}
+
+	// Token request with wrong code verifier is rejected.
+	tokenForm := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {getCode()},
+		"redirect_uri":  {oidcTestRedirectURI},
+		"code_verifier": {"wrong verifier"},
+	}
+	if statusCode, v := token(tokenForm); statusCode != http.StatusBadRequest || v["error"] != "invalid_grant" {
+		t.Errorf("POST /token with wrong code verifier returns status code %d, error %v, want %d, invalid_grant", statusCode, v["error"], http.StatusBadRequest)
+	}
+
+	// Token request with code verifier returns tokens.
+	tokenForm.Set("code", getCode())
+	tokenForm.Set("code_verifier", verifier)
+	statusCode, tokenResp := token(tokenForm)
+	if statusCode != http.StatusOK {
+		t.Fatalf("POST /token returns status code %d, error %v", statusCode, tokenResp["error_description"])
+	}
+	if tokenResp["token_type"] != "Bearer" {
+		t.Errorf("POST /token returns token type %v, want Bearer", tokenResp["token_type"])
+	}
+
+	// Authorization code can be used only once.
+	if statusCode, v := token(tokenForm); statusCode != http.StatusBadRequest || v["error"] != "invalid_grant" {
+		t.Errorf("POST /token with used code returns status code %d, error %v, want %d, invalid_grant", statusCode, v["error"], http.StatusBadRequest)
+	}
+
+	// ID token has user claims and amr with user verification.
+	u, err := s.dataStore.GetUser(context.Background(), username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idToken, err := s.oidc.keys.verify(tokenResp["id_token"].(string))
+	if err != nil {
+		t.Fatalf("ID token verification returns error %q", err)
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(idToken.payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	wantClaims := idTokenClaims{
+		Issuer:            e2eOrigin,
+		Subject:           base64.RawURLEncoding.EncodeToString(u.UserID),
+		Audience:          oidcTestClientID,
+		Nonce:             "n-0S6_WzA2Mj",
+		AMR:               []string{"hwk", "user", "mfa"},
+		Name:              "John Doe",
+		PreferredUsername: username,
+	}
+	if claims.ExpiresAt <= time.Now().Unix() || claims.AuthTime == 0 {
+		t.Errorf("ID token has exp %d and auth_time %d", claims.ExpiresAt, claims.AuthTime)
+	}
+	claims.ExpiresAt, claims.IssuedAt, claims.AuthTime = 0, 0, 0
+	if !reflect.DeepEqual(claims, wantClaims) {
+		t.Errorf("ID token has claims %+v, want %+v", claims, wantClaims)
+	}
+
+	// Access token is accepted by userinfo endpoint.
+	userInfo := func(accessToken string) (int, map[string]string) {
+		req, err := http.NewRequest("GET", ts.URL+"/userinfo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		resp, err := noRedirectClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /userinfo returns error %q", err)
+		}
+		defer resp.Body.Close()
+		var v map[string]string
+		if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+			t.Fatalf("GET /userinfo returns invalid JSON: %s", err)
+		}
+		return resp.StatusCode, v
+	}
+	if statusCode, v := userInfo(tokenResp["access_token"].(string)); statusCode != http.StatusOK || v["preferred_username"] != username || v["sub"] != wantClaims.Subject {
+		t.Errorf("GET /userinfo returns status code %d, claims %v, want %d, %s", statusCode, v, http.StatusOK, username)
+	}
+	// ID token isn't an access token.
+	if statusCode, _ := userInfo(tokenResp["id_token"].(string)); statusCode != http.StatusUnauthorized {
+		t.Errorf("GET /userinfo with ID token returns status code %d, want %d", statusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestOIDCConfigError(t *testing.T) {
+	testCases := []struct {
+		name         string
+		config       *oidcConfig
+		wantErrorMsg string
+	}{
+		{
+			name:         "no clients",
+			config:       &oidcConfig{},
+			wantErrorMsg: "OIDC config doesn't have clients",
+		},
+		{
+			name:         "empty client ID",
+			config:       &oidcConfig{Clients: []*oidcClientConfig{{RedirectURIs: []string{oidcTestRedirectURI}}}},
+			wantErrorMsg: "OIDC client ID is empty",
+		},
+		{
+			name: "duplicate client ID",
+			config: &oidcConfig{Clients: []*oidcClientConfig{
+				{ClientID: oidcTestClientID, RedirectURIs: []string{oidcTestRedirectURI}},
+				{ClientID: oidcTestClientID, RedirectURIs: []string{oidcTestRedirectURI}},
+			}},
+			wantErrorMsg: "OIDC client ID \"wiki\" is duplicated",
+		},
+		{
+			name:         "no redirect URIs",
+			config:       &oidcConfig{Clients: []*oidcClientConfig{{ClientID: oidcTestClientID}}},
+			wantErrorMsg: "OIDC client \"wiki\" doesn't have redirect URIs",
+		},
+		{
+			name:         "missing signing key file",
+			config:       &oidcConfig{SigningKeyFile: "testdata/no_such_file.pem", Clients: []*oidcClientConfig{{ClientID: oidcTestClientID, RedirectURIs: []string{oidcTestRedirectURI}}}},
+			wantErrorMsg: "failed to read signing key file",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newOIDCProvider(tc.config, e2eOrigin); err == nil || !strings.HasPrefix(err.Error(), tc.wantErrorMsg) {
+				t.Errorf("newOIDCProvider() returns error %v, want error %q", err, tc.wantErrorMsg)
+			}
+		})
+	}
+}
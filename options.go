@@ -0,0 +1,85 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"log/slog"
+
+	"github.com/fxamacker/webauthn"
+	"github.com/gorilla/sessions"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Option configures Server created by NewServer.
+type Option func(*serverOptions)
+
+type serverOptions struct {
+	config         *Config
+	webAuthnConfig *webauthn.Config
+	origin         string
+	dataStore      DataStore
+	sessionStore   sessions.Store
+	logger         *slog.Logger
+	tracerProvider trace.TracerProvider
+	staticDir      string
+}
+
+// WithConfig configures Server with Config returned by NewConfig.  Other options override
+// corresponding Config settings.
+func WithConfig(c *Config) Option {
+	return func(o *serverOptions) {
+		o.config = c
+	}
+}
+
+// WithWebAuthnConfig sets relying party and WebAuthn ceremony settings.
+func WithWebAuthnConfig(c *webauthn.Config) Option {
+	return func(o *serverOptions) {
+		o.webAuthnConfig = c
+	}
+}
+
+// WithOrigin sets expected origin of client data, such as "https://example.com".
+func WithOrigin(origin string) Option {
+	return func(o *serverOptions) {
+		o.origin = origin
+	}
+}
+
+// WithDataStore sets data store for users and credentials.
+func WithDataStore(dataStore DataStore) Option {
+	return func(o *serverOptions) {
+		o.dataStore = dataStore
+	}
+}
+
+// WithSessionStore sets session store for login sessions.
+func WithSessionStore(sessionStore sessions.Store) Option {
+	return func(o *serverOptions) {
+		o.sessionStore = sessionStore
+	}
+}
+
+// WithLogger sets structured logger for request logs, SQL queries, and errors that can't be returned
+// in responses.  Default logger writes JSON to stderr.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *serverOptions) {
+		o.logger = logger
+	}
+}
+
+// WithTracerProvider sets OpenTelemetry tracer provider for spans of requests, sessions, data store
+// calls, and WebAuthn verification.  It overrides Config.Tracing.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(o *serverOptions) {
+		o.tracerProvider = tp
+	}
+}
+
+// WithStaticDir serves demo web pages from dir.  Static files aren't served by default.
+func WithStaticDir(dir string) Option {
+	return func(o *serverOptions) {
+		o.staticDir = dir
+	}
+}
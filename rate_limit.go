@@ -0,0 +1,590 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+)
+
+const (
+	contextKeyClientIP contextKey = "ClientIP" // context key for client IP resolved from X-Forwarded-For header
+
+	defaultLockoutDuration    = 60      // first lockout lasts 1 minute
+	defaultMaxLockoutDuration = 60 * 60 // lockout is at most 1 hour
+
+	// lockoutFailureTTL is how long failed logins are counted after the last failure.
+	lockoutFailureTTL = 24 * time.Hour
+)
+
+// rateLimitConfig has settings of rate limits of WebAuthn ceremony requests and lockout after failed logins.
+type rateLimitConfig struct {
+	IPRequestsPerMinute       int // Ceremony requests per minute from a client IP, unlimited if 0.
+	IPBurst                   int // Ceremony requests from a client IP allowed at once, defaults to IPRequestsPerMinute.
+	UsernameRequestsPerMinute int // Options and recovery requests per minute for a username, unlimited if 0.
+	UsernameBurst             int // Options and recovery requests for a username allowed at once, defaults to UsernameRequestsPerMinute.
+	LockoutThreshold          int // Failed logins before username is locked out, no lockout if 0.
+	LockoutDuration           int // First lockout duration in seconds.  Each further failed login doubles it.
+	MaxLockoutDuration        int // Maximum lockout duration in seconds.
+}
+
+func (c *rateLimitConfig) valid() error {
+	if c.IPRequestsPerMinute < 0 || c.IPBurst < 0 || c.UsernameRequestsPerMinute < 0 || c.UsernameBurst < 0 {
+		return errors.New("rate limit is negative")
+	}
+	if c.LockoutThreshold < 0 || c.LockoutDuration < 0 || c.MaxLockoutDuration < 0 {
+		return errors.New("lockout setting is negative")
+	}
+	return nil
+}
+
+// rateLimitStore keeps token buckets, failed login counts, and lockouts by key.
+type rateLimitStore interface {
+	// take takes a token from bucket key, which is refilled with rate tokens per second up to burst tokens.
+	// It returns 0 if a token is taken, or time until a token is available.
+	take(ctx context.Context, key string, rate float64, burst int) (time.Duration, error)
+	// addFailure increments failure count of key and returns the new count.  Count expires after ttl.
+	addFailure(ctx context.Context, key string, ttl time.Duration) (int, error)
+	// lock locks key for d.
+	lock(ctx context.Context, key string, d time.Duration) error
+	// lockedFor returns remaining lockout of key, or 0 if key isn't locked.
+	lockedFor(ctx context.Context, key string) (time.Duration, error)
+	// reset deletes failure count and lockout of key.
+	reset(ctx context.Context, key string) error
+}
+
+// rateLimiter limits WebAuthn ceremony requests by client IP and by username, and locks out
+// username after repeated failed logins.
+type rateLimiter struct {
+	store              rateLimitStore
+	ipRate             float64 // tokens per second
+	ipBurst            int
+	usernameRate       float64 // tokens per second
+	usernameBurst      int
+	lockoutThreshold   int
+	lockoutDuration    time.Duration
+	maxLockoutDuration time.Duration
+}
+
+func newRateLimiter(c *rateLimitConfig, store rateLimitStore) (*rateLimiter, error) {
+	if err := c.valid(); err != nil {
+		return nil, err
+	}
+	l := &rateLimiter{
+		store:              store,
+		ipRate:             float64(c.IPRequestsPerMinute) / 60,
+		ipBurst:            c.IPBurst,
+		usernameRate:       float64(c.UsernameRequestsPerMinute) / 60,
+		usernameBurst:      c.UsernameBurst,
+		lockoutThreshold:   c.LockoutThreshold,
+		lockoutDuration:    time.Duration(c.LockoutDuration) * time.Second,
+		maxLockoutDuration: time.Duration(c.MaxLockoutDuration) * time.Second,
+	}
+	if l.ipBurst == 0 {
+		l.ipBurst = c.IPRequestsPerMinute
+	}
+	if l.usernameBurst == 0 {
+		l.usernameBurst = c.UsernameRequestsPerMinute
+	}
+	if l.lockoutDuration == 0 {
+		l.lockoutDuration = defaultLockoutDuration * time.Second
+	}
+	if l.maxLockoutDuration == 0 {
+		l.maxLockoutDuration = defaultMaxLockoutDuration * time.Second
+	}
+	if l.maxLockoutDuration < l.lockoutDuration {
+		l.maxLockoutDuration = l.lockoutDuration
+	}
+	return l, nil
+}
+
+func ipRateLimitKey(ip string) string {
+	return "ip:" + ip
+}
+
+func usernameRateLimitKey(username string) string {
+	return "user:" + username
+}
+
+// allowIP returns 0 if request from client IP is allowed, or time until it is allowed.
+func (l *rateLimiter) allowIP(ctx context.Context, ip string) (time.Duration, error) {
+	if l.ipRate == 0 {
+		return 0, nil
+	}
+	return l.store.take(ctx, ipRateLimitKey(ip), l.ipRate, l.ipBurst)
+}
+
+// allowUsername returns 0 if request for username is allowed, or time until it is allowed.
+// Locked out username isn't allowed until lockout expires.
+func (l *rateLimiter) allowUsername(ctx context.Context, username string) (time.Duration, error) {
+	if d, err := l.lockedFor(ctx, username); err != nil || d > 0 {
+		return d, err
+	}
+	if l.usernameRate == 0 {
+		return 0, nil
+	}
+	return l.store.take(ctx, usernameRateLimitKey(username), l.usernameRate, l.usernameBurst)
+}
+
+// lockedFor returns remaining lockout of username, or 0 if username isn't locked out.
+func (l *rateLimiter) lockedFor(ctx context.Context, username string) (time.Duration, error) {
+	if l.lockoutThreshold == 0 {
+		return 0, nil
+	}
+	return l.store.lockedFor(ctx, usernameRateLimitKey(username))
+}
+
+// lockoutFor returns lockout duration after failures failed logins.  Lockout starts at threshold
+// and doubles with each further failure.
+func (l *rateLimiter) lockoutFor(failures int) time.Duration {
+	if l.lockoutThreshold == 0 || failures < l.lockoutThreshold {
+		return 0
+	}
+	d := l.lockoutDuration
+	for i := l.lockoutThreshold; i < failures && d < l.maxLockoutDuration; i++ {
+		d *= 2
+	}
+	if d > l.maxLockoutDuration {
+		d = l.maxLockoutDuration
+	}
+	return d
+}
+
+// loginFailed counts failed login of username, and locks out username if there are too many failures.
+func (l *rateLimiter) loginFailed(ctx context.Context, username string) error {
+	if l.lockoutThreshold == 0 {
+		return nil
+	}
+	key := usernameRateLimitKey(username)
+	failures, err := l.store.addFailure(ctx, key, lockoutFailureTTL)
+	if err != nil {
+		return err
+	}
+	if d := l.lockoutFor(failures); d > 0 {
+		return l.store.lock(ctx, key, d)
+	}
+	return nil
+}
+
+// loginSucceeded resets failed logins of username.
+func (l *rateLimiter) loginSucceeded(ctx context.Context, username string) error {
+	if l.lockoutThreshold == 0 {
+		return nil
+	}
+	return l.store.reset(ctx, usernameRateLimitKey(username))
+}
+
+// unlock removes lockout and failed logins of username.
+func (l *rateLimiter) unlock(ctx context.Context, username string) error {
+	return l.store.reset(ctx, usernameRateLimitKey(username))
+}
+
+// clientIP returns IP address of request's client.  It is the address resolved from X-Forwarded-For
+// header by resolveClientIP if request is from a trusted proxy, or remote address otherwise.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(contextKeyClientIP).(string); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// trustedProxies are networks of reverse proxies whose X-Forwarded-For header is trusted.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies returns trustedProxies of CIDRs or IP addresses.
+func parseTrustedProxies(proxies []string) (trustedProxies, error) {
+	var p trustedProxies
+	for _, proxy := range proxies {
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			p = append(p, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, errors.New("trusted proxy \"" + proxy + "\" is not an IP address or CIDR")
+		}
+		p = append(p, ipNet)
+	}
+	return p, nil
+}
+
+func (p trustedProxies) contains(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range p {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the right-most address in X-Forwarded-For header that isn't a trusted proxy, if
+// request is from a trusted proxy.  Addresses left of it are set by client and can be forged.
+func (p trustedProxies) clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	var forwardedFor []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		forwardedFor = append(forwardedFor, strings.Split(h, ",")...)
+	}
+	for i := len(forwardedFor) - 1; i >= 0 && p.contains(ip); i-- {
+		forwarded := strings.TrimSpace(forwardedFor[i])
+		if net.ParseIP(forwarded) == nil {
+			break
+		}
+		ip = forwarded
+	}
+	return ip
+}
+
+// resolveClientIP returns a handler that saves client IP resolved from X-Forwarded-For header in
+// request context, if trusted proxies are configured.
+func (s *Server) resolveClientIP(next http.Handler) http.Handler {
+	if len(s.trustedProxies) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), contextKeyClientIP, s.trustedProxies.clientIP(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// writeTooManyRequestsResponse writes 429 failed response with Retry-After header in seconds.
+func writeTooManyRequestsResponse(w http.ResponseWriter, retryAfter time.Duration, errMsg string) (int, error) {
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10))
+	return writeFailedServerResponse(w, http.StatusTooManyRequests, errMsg)
+}
+
+// rateLimitedByIP returns a handler that responds with a 429 error if client IP sends too many requests.
+func (s *Server) rateLimitedByIP(next http.HandlerFunc) http.HandlerFunc {
+	if s.rateLimiter == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		retryAfter, err := s.rateLimiter.allowIP(r.Context(), clientIP(r))
+		if err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to check rate limit: "+err.Error())
+			return
+		}
+		if retryAfter > 0 {
+			writeTooManyRequestsResponse(w, retryAfter, "Too many requests")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// allowUsername writes a 429 error and returns false if there are too many requests for username or
+// username is locked out.
+func (s *Server) allowUsername(w http.ResponseWriter, r *http.Request, username string) bool {
+	if s.rateLimiter == nil {
+		return true
+	}
+	retryAfter, err := s.rateLimiter.allowUsername(r.Context(), username)
+	if err != nil {
+		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to check rate limit: "+err.Error())
+		return false
+	}
+	if retryAfter > 0 {
+		writeTooManyRequestsResponse(w, retryAfter, "Too many requests for "+username)
+		return false
+	}
+	return true
+}
+
+// checkLockout writes a 429 error and returns false if username is locked out.
+func (s *Server) checkLockout(w http.ResponseWriter, r *http.Request, username string) bool {
+	if s.rateLimiter == nil {
+		return true
+	}
+	retryAfter, err := s.rateLimiter.lockedFor(r.Context(), username)
+	if err != nil {
+		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to check lockout: "+err.Error())
+		return false
+	}
+	if retryAfter > 0 {
+		writeTooManyRequestsResponse(w, retryAfter, "Too many failed logins for "+username)
+		return false
+	}
+	return true
+}
+
+// countLogin counts successful or failed login of username.  Login handler counts a failed login
+// only if assertion of a registered credential of username fails verification, so an attacker
+// can't lock out username with its own or unregistered credentials.
+func (s *Server) countLogin(r *http.Request, username string, succeeded bool) {
+	if s.rateLimiter == nil {
+		return
+	}
+	var err error
+	if succeeded {
+		err = s.rateLimiter.loginSucceeded(r.Context(), username)
+	} else {
+		err = s.rateLimiter.loginFailed(r.Context(), username)
+	}
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to count login", "username", username, "error", err)
+	}
+}
+
+// handleUnlock removes lockout of username in request path.
+func (s *Server) handleUnlock(w http.ResponseWriter, r *http.Request) {
+	aw := s.startAudit(w, r, auditEventAdminUnlock)
+	defer aw.record()
+	w = aw
+	aw.event.ActorUserID = adminUserID(r)
+
+	username := mux.Vars(r)["username"]
+	if u, err := s.dataStore.GetUser(r.Context(), username); err == nil {
+		aw.event.UserID = u.UserID
+	} else if err != ErrNoRecords {
+		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to find user: "+err.Error())
+		return
+	}
+
+	if err := s.rateLimiter.unlock(r.Context(), username); err != nil {
+		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to unlock "+username+": "+err.Error())
+		return
+	}
+	writeOKServerResponse(w)
+}
+
+// memRateLimitStore is a concurrency-safe in-memory rateLimitStore.
+type memRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memTokenBucket
+	failures  map[string]*memFailures
+	locks     map[string]time.Time // lockout expiration by key
+	lastSweep time.Time
+}
+
+type memTokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	expiresAt time.Time // bucket is full after expiresAt
+}
+
+type memFailures struct {
+	count     int
+	expiresAt time.Time
+}
+
+const memRateLimitSweepInterval = time.Minute
+
+func newMemRateLimitStore() *memRateLimitStore {
+	return &memRateLimitStore{
+		buckets:  make(map[string]*memTokenBucket),
+		failures: make(map[string]*memFailures),
+		locks:    make(map[string]time.Time),
+	}
+}
+
+// sweep deletes expired buckets, failure counts, and lockouts.  Caller must hold m.mu.
+func (m *memRateLimitStore) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < memRateLimitSweepInterval {
+		return
+	}
+	for k, b := range m.buckets {
+		if !now.Before(b.expiresAt) {
+			delete(m.buckets, k)
+		}
+	}
+	for k, f := range m.failures {
+		if !now.Before(f.expiresAt) {
+			delete(m.failures, k)
+		}
+	}
+	for k, expiresAt := range m.locks {
+		if !now.Before(expiresAt) {
+			delete(m.locks, k)
+		}
+	}
+	m.lastSweep = now
+}
+
+func (m *memRateLimitStore) take(ctx context.Context, key string, rate float64, burst int) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.sweep(now)
+	b, ok := m.buckets[key]
+	if !ok || !now.Before(b.expiresAt) {
+		b = &memTokenBucket{tokens: float64(burst), updatedAt: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.updatedAt).Seconds()*rate)
+	b.updatedAt = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rate * float64(time.Second)), nil
+	}
+	b.tokens--
+	b.expiresAt = now.Add(time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second)))
+	return 0, nil
+}
+
+func (m *memRateLimitStore) addFailure(ctx context.Context, key string, ttl time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.sweep(now)
+	f, ok := m.failures[key]
+	if !ok || !now.Before(f.expiresAt) {
+		f = &memFailures{}
+		m.failures[key] = f
+	}
+	f.count++
+	f.expiresAt = now.Add(ttl)
+	return f.count, nil
+}
+
+func (m *memRateLimitStore) lock(ctx context.Context, key string, d time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.locks[key] = time.Now().Add(d)
+	return nil
+}
+
+func (m *memRateLimitStore) lockedFor(ctx context.Context, key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expiresAt, ok := m.locks[key]
+	if !ok {
+		return 0, nil
+	}
+	d := time.Until(expiresAt)
+	if d <= 0 {
+		delete(m.locks, key)
+		return 0, nil
+	}
+	return d, nil
+}
+
+func (m *memRateLimitStore) reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.failures, key)
+	delete(m.locks, key)
+	return nil
+}
+
+// redisRateLimitStore is a rateLimitStore using Redis keys that expire with buckets, failure counts,
+// and lockouts.  It is used with Redis session store so that limits are shared by all server instances.
+type redisRateLimitStore struct {
+	pool *redis.Pool
+}
+
+const (
+	redisRateLimitBucketKeyPrefix  = "ratelimit_bucket_"
+	redisRateLimitFailureKeyPrefix = "ratelimit_failures_"
+	redisRateLimitLockKeyPrefix    = "ratelimit_lock_"
+)
+
+// redisTakeTokenScript atomically refills token bucket and takes a token.  ARGV are rate in tokens
+// per millisecond, burst, and current time in milliseconds.  It returns 0 if a token is taken, or
+// milliseconds until a token is available.
+var redisTakeTokenScript = redis.NewScript(1, `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if not tokens or not ts then
+	tokens = burst
+	ts = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+if tokens < 1 then
+	return math.ceil((1 - tokens) / rate)
+end
+tokens = tokens - 1
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) / rate))
+return 0
+`)
+
+// redisAddFailureScript atomically increments failure count and sets its expiration in milliseconds.
+var redisAddFailureScript = redis.NewScript(1, `
+local count = redis.call("INCR", KEYS[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[1])
+return count
+`)
+
+func (s *redisRateLimitStore) take(ctx context.Context, key string, rate float64, burst int) (time.Duration, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	ms, err := redis.Int64(redisTakeTokenScript.Do(conn, redisRateLimitBucketKeyPrefix+key, strconv.FormatFloat(rate/1000, 'g', -1, 64), burst, now))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+func (s *redisRateLimitStore) addFailure(ctx context.Context, key string, ttl time.Duration) (int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return redis.Int(redisAddFailureScript.Do(conn, redisRateLimitFailureKeyPrefix+key, int64(ttl/time.Millisecond)))
+}
+
+func (s *redisRateLimitStore) lock(ctx context.Context, key string, d time.Duration) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", redisRateLimitLockKeyPrefix+key, "locked", "PX", int64(d/time.Millisecond))
+	return err
+}
+
+func (s *redisRateLimitStore) lockedFor(ctx context.Context, key string) (time.Duration, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	ms, err := redis.Int64(conn.Do("PTTL", redisRateLimitLockKeyPrefix+key))
+	if err != nil {
+		return 0, err
+	}
+	if ms <= 0 {
+		return 0, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+func (s *redisRateLimitStore) reset(ctx context.Context, key string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", redisRateLimitFailureKeyPrefix+key, redisRateLimitLockKeyPrefix+key)
+	return err
+}
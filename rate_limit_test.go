@@ -0,0 +1,425 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/webauthn"
+	"github.com/fxamacker/webauthn-demo/virtualauthenticator"
+)
+
+func TestLockoutFor(t *testing.T) {
+	l, err := newRateLimiter(&rateLimitConfig{LockoutThreshold: 3, LockoutDuration: 60, MaxLockoutDuration: 300}, newMemRateLimitStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		failures    int
+		wantLockout time.Duration
+	}{
+		{1, 0},
+		{2, 0},
+		{3, time.Minute},
+		{4, 2 * time.Minute},
+		{5, 4 * time.Minute},
+		{6, 5 * time.Minute},
+		{100, 5 * time.Minute},
+	}
+	for _, tc := range testCases {
+		if d := l.lockoutFor(tc.failures); d != tc.wantLockout {
+			t.Errorf("lockoutFor(%d) returns %s, want %s", tc.failures, d, tc.wantLockout)
+		}
+	}
+}
+
+func TestMemRateLimitStore(t *testing.T) {
+	ctx := context.Background()
+	store := newMemRateLimitStore()
+
+	// Bucket allows burst, then a token every 1/rate seconds.
+	for i := 0; i < 3; i++ {
+		if d, err := store.take(ctx, "key", 1, 3); err != nil || d != 0 {
+			t.Fatalf("take() %d returns %s, %v, want 0", i, d, err)
+		}
+	}
+	if d, err := store.take(ctx, "key", 1, 3); err != nil || d <= 0 || d > time.Second {
+		t.Errorf("take() from empty bucket returns %s, %v, want (0, 1s]", d, err)
+	}
+	if d, err := store.take(ctx, "other key", 1, 3); err != nil || d != 0 {
+		t.Errorf("take() from other bucket returns %s, %v, want 0", d, err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if n, err := store.addFailure(ctx, "key", time.Minute); err != nil || n != i {
+			t.Errorf("addFailure() returns %d, %v, want %d", n, err, i)
+		}
+	}
+	if n, err := store.addFailure(ctx, "expired key", -time.Second); err != nil || n != 1 {
+		t.Fatalf("addFailure() returns %d, %v, want 1", n, err)
+	}
+	if n, err := store.addFailure(ctx, "expired key", time.Minute); err != nil || n != 1 {
+		t.Errorf("addFailure() after expiration returns %d, %v, want 1", n, err)
+	}
+
+	if err := store.lock(ctx, "key", time.Minute); err != nil {
+		t.Fatalf("lock() returns error %q", err)
+	}
+	if d, err := store.lockedFor(ctx, "key"); err != nil || d <= 0 || d > time.Minute {
+		t.Errorf("lockedFor() locked key returns %s, %v, want (0, 1m]", d, err)
+	}
+	if err := store.reset(ctx, "key"); err != nil {
+		t.Fatalf("reset() returns error %q", err)
+	}
+	if d, err := store.lockedFor(ctx, "key"); err != nil || d != 0 {
+		t.Errorf("lockedFor() reset key returns %s, %v, want 0", d, err)
+	}
+	if n, err := store.addFailure(ctx, "key", time.Minute); err != nil || n != 1 {
+		t.Errorf("addFailure() after reset returns %d, %v, want 1", n, err)
+	}
+}
+
+func TestRateLimitConfigError(t *testing.T) {
+	testCases := []struct {
+		name         string
+		config       *rateLimitConfig
+		wantErrorMsg string
+	}{
+		{"negative rate", &rateLimitConfig{IPRequestsPerMinute: -1}, "rate limit is negative"},
+		{"negative burst", &rateLimitConfig{UsernameBurst: -1}, "rate limit is negative"},
+		{"negative lockout threshold", &rateLimitConfig{LockoutThreshold: -1}, "lockout setting is negative"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newRateLimiter(tc.config, newMemRateLimitStore()); err == nil || err.Error() != tc.wantErrorMsg {
+				t.Errorf("newRateLimiter() returns error %v, want error %q", err, tc.wantErrorMsg)
+			}
+		})
+	}
+}
+
+func newRateLimitServer(t *testing.T, c *rateLimitConfig, admins []string) *Server {
+	s, err := NewServer(
+		WithConfig(&Config{CounterPolicy: counterPolicyReject, AuditLog: auditLogMemory, RateLimit: c, Admins: admins, AdminSignup: true}),
+		WithWebAuthnConfig(getWebAuthnConfig()),
+		WithOrigin(e2eOrigin),
+		WithDataStore(newMemStore()),
+		WithSessionStore(getMemSessionStore()),
+	)
+	if err != nil {
+		t.Fatalf("NewServer() returns error %q", err)
+	}
+	return s
+}
+
+func TestRateLimit(t *testing.T) {
+	s := newRateLimitServer(t, &rateLimitConfig{IPRequestsPerMinute: 3, UsernameRequestsPerMinute: 2}, nil)
+	defer s.Close()
+
+	postOptions := func(clientIP string, username string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/assertion/options", strings.NewReader(`{"username":"`+username+`"}`))
+		r.RemoteAddr = clientIP + ":1234"
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	checkTooManyRequests := func(w *httptest.ResponseRecorder, wantRetryAfter string, wantErrorMsg string) {
+		t.Helper()
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("POST /assertion/options returns status code %d, want %d", w.Code, http.StatusTooManyRequests)
+		}
+		if retryAfter := w.Header().Get("Retry-After"); retryAfter != wantRetryAfter {
+			t.Errorf("POST /assertion/options returns Retry-After %q, want %q", retryAfter, wantRetryAfter)
+		}
+		var resp serverResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("POST /assertion/options returns invalid JSON: %s", err)
+		}
+		if wantResp := (serverResponse{Status: statusFailed, ErrorMessage: wantErrorMsg}); resp != wantResp {
+			t.Errorf("POST /assertion/options returns %+v, want %+v", resp, wantResp)
+		}
+	}
+
+	// Client IP is limited to 3 requests, and a request is allowed every 20 seconds after that.
+	for i, username := range []string{"user1", "user2", "user3"} {
+		if w := postOptions("192.0.2.1", username); w.Code == http.StatusTooManyRequests {
+			t.Fatalf("POST /assertion/options %d returns status code %d", i, w.Code)
+		}
+	}
+	checkTooManyRequests(postOptions("192.0.2.1", "user4"), "20", "Too many requests")
+
+	// Username is limited to 2 requests from any client IP, and a request is allowed every 30 seconds after that.
+	for i, clientIP := range []string{"192.0.2.2", "192.0.2.3"} {
+		if w := postOptions(clientIP, "user5"); w.Code == http.StatusTooManyRequests {
+			t.Fatalf("POST /assertion/options %d returns status code %d", i, w.Code)
+		}
+	}
+	checkTooManyRequests(postOptions("192.0.2.4", "user5"), "30", "Too many requests for user5")
+}
+
+func TestLockout(t *testing.T) {
+	const username, adminUsername = "johndoe@example.com", "admin@example.com"
+	s := newRateLimitServer(t, &rateLimitConfig{LockoutThreshold: 2, LockoutDuration: 60}, []string{adminUsername})
+	defer s.Close()
+	ts := httptest.NewTLSServer(s)
+	defer ts.Close()
+
+	newAuthenticator := func() *virtualauthenticator.Authenticator {
+		a, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	a, attacker, adminAuthenticator := newAuthenticator(), newAuthenticator(), newAuthenticator()
+	c := newE2EClient(t, ts)
+	c.register(a, username, webauthn.ResidentKeyDiscouraged)
+	c.logout()
+	attackerClient := newE2EClient(t, ts)
+	attackerClient.register(attacker, "attacker@example.com", webauthn.ResidentKeyDiscouraged)
+	admin := newE2EClient(t, ts)
+	admin.register(adminAuthenticator, adminUsername, webauthn.ResidentKeyDiscouraged)
+
+	// Attacker fails to log in as user with its own credential, or with user's credential ID.
+	failLogin := func(replayCredentialID bool) {
+		var credentialID []byte
+		if replayCredentialID {
+			credentialID = a.Credentials()[0].ID
+		}
+		if statusCode := sendAttackerAssertion(t, ts, attacker, username, credentialID, nil); statusCode != http.StatusBadRequest {
+			t.Fatalf("POST /assertion/result with attacker credential returns status code %d, want %d", statusCode, http.StatusBadRequest)
+		}
+	}
+
+	// Attacker's own credential isn't user's credential, so it isn't counted as failed login.
+	for i := 0; i < 3; i++ {
+		failLogin(false)
+	}
+	if d, err := s.rateLimiter.lockedFor(context.Background(), username); err != nil || d != 0 {
+		t.Errorf("lockedFor() after logins with attacker credential returns %s, %v, want 0", d, err)
+	}
+
+	failLogin(true)
+	failLogin(true)
+
+	// User is locked out after 2 failed logins.
+	var resp serverResponse
+	if statusCode := c.do("POST", "/assertion/options", map[string]string{"username": username}, &resp); statusCode != http.StatusTooManyRequests {
+		t.Fatalf("POST /assertion/options for locked out user returns status code %d, want %d", statusCode, http.StatusTooManyRequests)
+	}
+	if d, err := s.rateLimiter.lockedFor(context.Background(), username); err != nil || d <= 0 || d > time.Minute {
+		t.Errorf("lockedFor() returns %s, %v, want (0, 1m]", d, err)
+	}
+
+	// Only administrators can unlock user.
+	if statusCode := attackerClient.do("DELETE", "/admin/lockouts/"+username, nil, &resp); statusCode != http.StatusForbidden {
+		t.Errorf("DELETE /admin/lockouts/%s by non-admin returns status code %d, want %d", username, statusCode, http.StatusForbidden)
+	}
+	if statusCode := newE2EClient(t, ts).do("DELETE", "/admin/lockouts/"+username, nil, &resp); statusCode != http.StatusUnauthorized {
+		t.Errorf("DELETE /admin/lockouts/%s without login returns status code %d, want %d", username, statusCode, http.StatusUnauthorized)
+	}
+	if statusCode := admin.do("DELETE", "/admin/lockouts/"+username, nil, &resp); statusCode != http.StatusOK {
+		t.Fatalf("DELETE /admin/lockouts/%s returns status code %d, error %q", username, statusCode, resp.ErrorMessage)
+	}
+	u, err := s.dataStore.GetUser(context.Background(), username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminUser, err := s.dataStore.GetUser(context.Background(), adminUsername)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events, err := s.auditLog.getEvents(context.Background(), u.UserID, 1); err != nil || len(events) != 1 || events[0].Type != auditEventAdminUnlock || events[0].Outcome != auditOutcomeSuccess || !bytes.Equal(events[0].ActorUserID, adminUser.UserID) {
+		t.Errorf("getEvents() after unlock returns %v, %v, want %s event with administrator %x as actor", events, err, auditEventAdminUnlock, adminUser.UserID)
+	}
+	c.login(a, username)
+
+	// Successful login resets failed logins.
+	c.logout()
+	failLogin(true)
+	c.login(a, username)
+	failLogin(true)
+	if d, err := s.rateLimiter.lockedFor(context.Background(), username); err != nil || d != 0 {
+		t.Errorf("lockedFor() after successful login returns %s, %v, want 0", d, err)
+	}
+}
+
+func TestLockoutUsernamelessLogin(t *testing.T) {
+	const username = "johndoe@example.com"
+	s := newRateLimitServer(t, &rateLimitConfig{LockoutThreshold: 2, LockoutDuration: 60}, nil)
+	defer s.Close()
+	s.usernamelessLogin = true
+	ts := httptest.NewTLSServer(s)
+	defer ts.Close()
+
+	a, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attacker, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newE2EClient(t, ts)
+	c.register(a, username, webauthn.ResidentKeyRequired)
+	c.logout()
+	newE2EClient(t, ts).register(attacker, "attacker@example.com", webauthn.ResidentKeyDiscouraged)
+
+	// Failed usernameless logins with user's credential ID and user handle are counted for user.
+	for i := 0; i < 2; i++ {
+		if statusCode := sendAttackerAssertion(t, ts, attacker, "", a.Credentials()[0].ID, a.Credentials()[0].UserHandle); statusCode != http.StatusBadRequest {
+			t.Fatalf("POST /assertion/result with attacker signature returns status code %d, want %d", statusCode, http.StatusBadRequest)
+		}
+	}
+	if d, err := s.rateLimiter.lockedFor(context.Background(), username); err != nil || d <= 0 {
+		t.Errorf("lockedFor() returns %s, %v, want lockout", d, err)
+	}
+
+	// Locked out user can't log in without username.
+	var options webauthn.PublicKeyCredentialRequestOptions
+	if statusCode := c.do("POST", "/assertion/options", map[string]string{"username": ""}, &options); statusCode != http.StatusOK {
+		t.Fatalf("POST /assertion/options returns status code %d", statusCode)
+	}
+	result, err := a.Get(&options)
+	if err != nil {
+		t.Fatalf("Get() returns error %q", err)
+	}
+	var resp serverResponse
+	if statusCode := c.do("POST", "/assertion/result", result, &resp); statusCode != http.StatusTooManyRequests {
+		t.Errorf("POST /assertion/result for locked out user returns status code %d, want %d", statusCode, http.StatusTooManyRequests)
+	}
+}
+
+func TestLockoutFakeUser(t *testing.T) {
+	const unknownUser = "janedoe@example.com"
+	s := newRateLimitServer(t, &rateLimitConfig{LockoutThreshold: 2, LockoutDuration: 60}, nil)
+	defer s.Close()
+	var err error
+	if s.fakeUsers, err = newFakeUsers([]byte("session key")); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewTLSServer(s)
+	defer ts.Close()
+
+	attacker, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newE2EClient(t, ts).register(attacker, "attacker@example.com", webauthn.ResidentKeyDiscouraged)
+
+	// Unknown username is locked out like a registered username after failed logins with its
+	// credential ID from allowCredentials, but not with attacker's credential.
+	for _, credentialID := range [][]byte{nil, nil, nil, s.fakeUsers.get(unknownUser).CredentialIDs[0], s.fakeUsers.get(unknownUser).CredentialIDs[0]} {
+		if statusCode := sendAttackerAssertion(t, ts, attacker, unknownUser, credentialID, nil); statusCode != http.StatusBadRequest {
+			t.Fatalf("POST /assertion/result for unknown user returns status code %d, want %d", statusCode, http.StatusBadRequest)
+		}
+	}
+	if statusCode := sendAttackerAssertion(t, ts, attacker, unknownUser, nil, nil); statusCode != http.StatusTooManyRequests {
+		t.Errorf("POST /assertion/options for locked out unknown user returns status code %d, want %d", statusCode, http.StatusTooManyRequests)
+	}
+}
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	p, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.10", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		wantClientIP string
+	}{
+		{"no proxy", "198.51.100.1:1234", nil, "198.51.100.1"},
+		{"untrusted proxy", "198.51.100.1:1234", []string{"203.0.113.1"}, "198.51.100.1"},
+		{"trusted proxy", "192.0.2.10:1234", []string{"203.0.113.1"}, "203.0.113.1"},
+		{"trusted proxy without header", "192.0.2.10:1234", nil, "192.0.2.10"},
+		{"forged address", "192.0.2.10:1234", []string{"198.51.100.2, 203.0.113.1"}, "203.0.113.1"},
+		{"chained trusted proxies", "10.0.0.1:1234", []string{"198.51.100.2, 203.0.113.1", "10.1.2.3"}, "203.0.113.1"},
+		{"all trusted proxies", "10.0.0.1:1234", []string{"10.1.2.3"}, "10.1.2.3"},
+		{"invalid address", "10.0.0.1:1234", []string{"203.0.113.1, unknown"}, "10.0.0.1"},
+		{"IPv6", "[2001:db8::1]:1234", []string{"2001:db8:1::1, 2001:db9::1"}, "2001:db9::1"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for _, h := range tc.forwardedFor {
+				r.Header.Add("X-Forwarded-For", h)
+			}
+			if ip := p.clientIP(r); ip != tc.wantClientIP {
+				t.Errorf("clientIP() returns %q, want %q", ip, tc.wantClientIP)
+			}
+		})
+	}
+
+	if _, err := parseTrustedProxies([]string{"proxy.example.com"}); err == nil || err.Error() != `trusted proxy "proxy.example.com" is not an IP address or CIDR` {
+		t.Errorf("parseTrustedProxies() returns error %v", err)
+	}
+}
+
+func TestTrustedProxiesRateLimit(t *testing.T) {
+	s, err := NewServer(
+		WithConfig(&Config{CounterPolicy: counterPolicyReject, AuditLog: auditLogMemory, RateLimit: &rateLimitConfig{IPRequestsPerMinute: 1}, TrustedProxies: []string{"192.0.2.10"}}),
+		WithWebAuthnConfig(getWebAuthnConfig()),
+		WithOrigin(e2eOrigin),
+		WithDataStore(newMemStore()),
+		WithSessionStore(getMemSessionStore()),
+	)
+	if err != nil {
+		t.Fatalf("NewServer() returns error %q", err)
+	}
+	defer s.Close()
+
+	postOptions := func(forwardedFor string) int {
+		r := httptest.NewRequest("POST", "/assertion/options", strings.NewReader(`{"username":"johndoe@example.com"}`))
+		r.RemoteAddr = "192.0.2.10:1234"
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Clients behind trusted proxy are limited separately.
+	for _, ip := range []string{"203.0.113.1", "203.0.113.2"} {
+		if statusCode := postOptions(ip); statusCode == http.StatusTooManyRequests {
+			t.Errorf("POST /assertion/options from %s returns status code %d", ip, statusCode)
+		}
+	}
+	if statusCode := postOptions("203.0.113.1"); statusCode != http.StatusTooManyRequests {
+		t.Errorf("POST /assertion/options from 203.0.113.1 again returns status code %d, want %d", statusCode, http.StatusTooManyRequests)
+	}
+}
+
+// sendAttackerAssertion sends assertion signed by attacker's credential to log in as username, and
+// returns status code.  Assertion has credentialID and userHandle instead of attacker's if they
+// aren't nil.  Username is empty for usernameless login.
+func sendAttackerAssertion(t *testing.T, ts *httptest.Server, attacker *virtualauthenticator.Authenticator, username string, credentialID []byte, userHandle []byte) int {
+	c := newE2EClient(t, ts)
+	var options webauthn.PublicKeyCredentialRequestOptions
+	if statusCode := c.do("POST", "/assertion/options", map[string]string{"username": username}, &options); statusCode != http.StatusOK {
+		return statusCode
+	}
+	options.AllowCredentials = []webauthn.PublicKeyCredentialDescriptor{{Type: webauthn.PublicKeyCredentialTypePublicKey, ID: attacker.Credentials()[0].ID}}
+	result, err := attacker.Get(&options)
+	if err != nil {
+		t.Fatalf("Get() returns error %q", err)
+	}
+	if credentialID != nil {
+		result.ID = base64.RawURLEncoding.EncodeToString(credentialID)
+		result.RawID = result.ID
+	}
+	if userHandle != nil {
+		result.Response.UserHandle = base64.RawURLEncoding.EncodeToString(userHandle)
+	}
+	return c.do("POST", "/assertion/result", result, nil)
+}
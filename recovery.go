@@ -0,0 +1,227 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	recoveryCodeCount      = 10
+	recoveryCodeLength     = 10 // random bytes, encoded as 16 base32 characters
+	recoveryCodeSaltLength = 16
+	recoveryCodeHashLength = 32
+)
+
+// recoveryCodeKDFIterations is PBKDF2-HMAC-SHA256 iteration count used to hash recovery codes.
+// Recovery codes are random, so they don't need as many iterations as passwords.
+var recoveryCodeKDFIterations = 100000
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newRecoveryCodes returns new recovery codes for user, and their hashes to be stored.  Codes share
+// a random salt, so a code can be verified with one KDF computation.
+func newRecoveryCodes(userID []byte) ([]string, []*RecoveryCode, error) {
+	salt := make([]byte, recoveryCodeSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	codes := make([]string, recoveryCodeCount)
+	hashedCodes := make([]*RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, recoveryCodeLength)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := recoveryCodeEncoding.EncodeToString(b)
+		codeHash, err := hashRecoveryCode(code, salt)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes[i] = code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16]
+		hashedCodes[i] = &RecoveryCode{UserID: userID, Salt: salt, CodeHash: codeHash, CreatedAt: now}
+	}
+	return codes, hashedCodes, nil
+}
+
+// hashRecoveryCode returns PBKDF2 hash of code.  Code is normalized, so it can be entered without
+// dashes and in lower case.
+func hashRecoveryCode(code string, salt []byte) ([]byte, error) {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return pbkdf2.Key(sha256.New, code, salt, recoveryCodeKDFIterations, recoveryCodeHashLength)
+}
+
+// findRecoveryCode returns stored recovery code matching code, or nil if code doesn't match.  Code is
+// hashed even if there are no stored codes, so response time doesn't reveal whether user has codes.
+func findRecoveryCode(code string, storedCodes []*RecoveryCode) (*RecoveryCode, error) {
+	if len(storedCodes) == 0 {
+		_, err := hashRecoveryCode(code, make([]byte, recoveryCodeSaltLength))
+		return nil, err
+	}
+	hashes := make(map[string][]byte) // key is salt
+	for _, c := range storedCodes {
+		codeHash, ok := hashes[string(c.Salt)]
+		if !ok {
+			var err error
+			if codeHash, err = hashRecoveryCode(code, c.Salt); err != nil {
+				return nil, err
+			}
+			hashes[string(c.Salt)] = codeHash
+		}
+		if subtle.ConstantTimeCompare(codeHash, c.CodeHash) == 1 {
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+type recoveryCodesResponse struct {
+	serverResponse
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+}
+
+// writeRecoveryCodesResponse writes ok response with recovery codes.  Codes are shown only once, so
+// response isn't cached.
+func writeRecoveryCodesResponse(w http.ResponseWriter, codes []string) {
+	b, err := json.Marshal(&recoveryCodesResponse{serverResponse: serverResponse{Status: statusOK}, RecoveryCodes: codes})
+	if err != nil {
+		writeFailedServerResponse(w, http.StatusInternalServerError, "failed to json marshal response body")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(b)
+}
+
+// handleRecoveryLogin verifies recovery code and establishes a recovery session, which can only be used
+// to register a new credential.  Recovery code is invalidated when it is used.
+func (s *Server) handleRecoveryLogin() http.HandlerFunc {
+	type request struct {
+		Username     string `json:"username"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+	type response struct {
+		serverResponse
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		aw := s.startAudit(w, r, auditEventRecoveryLogin)
+		defer aw.record()
+		w = aw
+
+		session, ok := r.Context().Value(contextKeyLoginSession).(*sessions.Session)
+		if !ok {
+			panic("Failed to get session data from context")
+		}
+
+		// Parse and verify request.
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeFailedServerResponse(w, http.StatusBadRequest, "Failed to json decode request body: "+err.Error())
+			return
+		}
+		if req.Username == "" {
+			writeFailedServerResponse(w, http.StatusBadRequest, "Missing username")
+			return
+		}
+		if req.RecoveryCode == "" {
+			writeFailedServerResponse(w, http.StatusBadRequest, "Missing recoveryCode")
+			return
+		}
+		if !s.allowUsername(w, r, req.Username) {
+			return
+		}
+
+		// Unknown user and wrong code get the same error, so recovery can't be used to find registered users.
+		u, err := s.dataStore.GetUser(r.Context(), req.Username)
+		if err == ErrNoRecords {
+			findRecoveryCode(req.RecoveryCode, nil)
+			writeFailedServerResponse(w, http.StatusUnauthorized, "Invalid username or recovery code")
+			return
+		} else if err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to query user in database: "+err.Error())
+			return
+		}
+		aw.event.UserID = u.UserID
+
+		storedCodes, err := s.dataStore.GetRecoveryCodes(r.Context(), u.UserID)
+		if err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to query recovery codes: "+err.Error())
+			return
+		}
+		c, err := findRecoveryCode(req.RecoveryCode, storedCodes)
+		if err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to hash recovery code: "+err.Error())
+			return
+		}
+		if c == nil {
+			writeFailedServerResponse(w, http.StatusUnauthorized, "Invalid username or recovery code")
+			return
+		}
+		if err = s.dataStore.DeleteRecoveryCode(r.Context(), u.UserID, c.CodeHash); err == ErrNoRecords {
+			writeFailedServerResponse(w, http.StatusUnauthorized, "Invalid username or recovery code")
+			return
+		} else if err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to invalidate recovery code: "+err.Error())
+			return
+		}
+
+		// Recovery session doesn't have logged in credential, so it isn't accepted by handlers requiring login.
+		session.Values[sessionMapKeyUserSession] = &userSession{User: u, LoggedInAt: time.Now(), Recovery: true}
+
+		b, err := json.Marshal(&response{
+			serverResponse: serverResponse{Status: statusOK},
+			Name:           u.UserName,
+			DisplayName:    u.DisplayName,
+		})
+		if err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "failed to json marshal response body")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// handleRegenerateRecoveryCodes replaces logged in user's recovery codes with new codes.
+func (s *Server) handleRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	aw := s.startAudit(w, r, auditEventRecoveryCodesRegen)
+	defer aw.record()
+	w = aw
+
+	session, ok := r.Context().Value(contextKeyLoginSession).(*sessions.Session)
+	if !ok {
+		panic("Failed to get session data from context")
+	}
+	uSession, ok := session.Values[sessionMapKeyUserSession].(*userSession)
+	if !ok {
+		writeFailedServerResponse(w, http.StatusUnauthorized, "Session doesn't have user credential")
+		return
+	}
+	aw.event.UserID = uSession.User.UserID
+	aw.event.CredentialID = uSession.LoggedInCredentialID
+
+	codes, hashedCodes, err := newRecoveryCodes(uSession.User.UserID)
+	if err != nil {
+		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to generate recovery codes: "+err.Error())
+		return
+	}
+	if err = s.dataStore.ReplaceRecoveryCodes(r.Context(), uSession.User.UserID, hashedCodes); err != nil {
+		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to save recovery codes: "+err.Error())
+		return
+	}
+	writeRecoveryCodesResponse(w, codes)
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/webauthn"
+	"github.com/fxamacker/webauthn-demo/virtualauthenticator"
+)
+
+func init() {
+	// Tests register many users, and each registration hashes recovery codes.
+	recoveryCodeKDFIterations = 1000
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	s, ts := newE2EServer(t)
+	defer s.Close()
+	defer ts.Close()
+
+	username := "johndoe@example.com"
+	lostAuthenticator, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newAuthenticator, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Recovery codes are returned only at user's first registration.
+	c := newE2EClient(t, ts)
+	codes := c.register(lostAuthenticator, username, webauthn.ResidentKeyDiscouraged)
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("POST /attestation/result returns %d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+	codeFormat := regexp.MustCompile(`^[A-Z2-7]{4}-[A-Z2-7]{4}-[A-Z2-7]{4}-[A-Z2-7]{4}$`)
+	for _, code := range codes {
+		if !codeFormat.MatchString(code) {
+			t.Errorf("recovery code %q doesn't match %s", code, codeFormat)
+		}
+	}
+	c.logout()
+
+	recoveryLogin := func(c *e2eClient, username string, code string) (int, serverResponse) {
+		var resp serverResponse
+		statusCode := c.do("POST", "/recovery/login", map[string]string{"username": username, "recoveryCode": code}, &resp)
+		return statusCode, resp
+	}
+
+	// Unknown user and wrong code get the same response.
+	c = newE2EClient(t, ts)
+	wantResp := serverResponse{Status: statusFailed, ErrorMessage: "Invalid username or recovery code"}
+	if statusCode, resp := recoveryLogin(c, username, "AAAA-AAAA-AAAA-AAAA"); statusCode != http.StatusUnauthorized || resp != wantResp {
+		t.Errorf("POST /recovery/login with wrong code returns status code %d, %+v, want %d, %+v", statusCode, resp, http.StatusUnauthorized, wantResp)
+	}
+	if statusCode, resp := recoveryLogin(c, "janedoe@example.com", codes[0]); statusCode != http.StatusUnauthorized || resp != wantResp {
+		t.Errorf("POST /recovery/login with unknown user returns status code %d, %+v, want %d, %+v", statusCode, resp, http.StatusUnauthorized, wantResp)
+	}
+
+	// Code is accepted without dashes and in lower case.
+	if statusCode, resp := recoveryLogin(c, username, strings.ToLower(strings.ReplaceAll(codes[0], "-", ""))); statusCode != http.StatusOK {
+		t.Fatalf("POST /recovery/login returns status code %d, error %q", statusCode, resp.ErrorMessage)
+	}
+
+	// Recovery session can't be used as a login session.
+	if _, statusCode := c.userName(); statusCode != http.StatusUnauthorized {
+		t.Errorf("GET /user with recovery session returns status code %d, want %d", statusCode, http.StatusUnauthorized)
+	}
+	if statusCode := c.do("GET", "/credentials", nil, nil); statusCode != http.StatusUnauthorized {
+		t.Errorf("GET /credentials with recovery session returns status code %d, want %d", statusCode, http.StatusUnauthorized)
+	}
+	if statusCode := c.do("POST", "/recovery/codes", nil, nil); statusCode != http.StatusUnauthorized {
+		t.Errorf("POST /recovery/codes with recovery session returns status code %d, want %d", statusCode, http.StatusUnauthorized)
+	}
+
+	// Registering a new credential with recovery session logs user in.
+	if codes := c.register(newAuthenticator, username, webauthn.ResidentKeyDiscouraged); codes != nil {
+		t.Errorf("POST /attestation/result after recovery returns recovery codes %v, want none", codes)
+	}
+	if name, statusCode := c.userName(); statusCode != http.StatusOK || name != username {
+		t.Errorf("GET /user after recovery returns status code %d, name %q, want %d, %q", statusCode, name, http.StatusOK, username)
+	}
+
+	// Used code is invalidated.
+	if statusCode, _ := recoveryLogin(newE2EClient(t, ts), username, codes[0]); statusCode != http.StatusUnauthorized {
+		t.Errorf("POST /recovery/login with used code returns status code %d, want %d", statusCode, http.StatusUnauthorized)
+	}
+
+	// Regenerated codes replace unused codes.
+	var regenerated recoveryCodesResponse
+	if statusCode := c.do("POST", "/recovery/codes", nil, &regenerated); statusCode != http.StatusOK || len(regenerated.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("POST /recovery/codes returns status code %d, %d codes, error %q, want %d, %d codes", statusCode, len(regenerated.RecoveryCodes), regenerated.ErrorMessage, http.StatusOK, recoveryCodeCount)
+	}
+	if statusCode, _ := recoveryLogin(newE2EClient(t, ts), username, codes[1]); statusCode != http.StatusUnauthorized {
+		t.Errorf("POST /recovery/login with replaced code returns status code %d, want %d", statusCode, http.StatusUnauthorized)
+	}
+	if statusCode, resp := recoveryLogin(newE2EClient(t, ts), username, regenerated.RecoveryCodes[0]); statusCode != http.StatusOK {
+		t.Errorf("POST /recovery/login with regenerated code returns status code %d, error %q", statusCode, resp.ErrorMessage)
+	}
+
+	// Each use is audited.
+	u, err := s.dataStore.GetUser(context.Background(), username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := s.auditLog.getEvents(context.Background(), u.UserID, maxActivityEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for _, e := range events {
+		counts[e.Type+" "+e.Outcome]++
+	}
+	wantCounts := map[string]int{
+		auditEventRecoveryLogin + " " + auditOutcomeSuccess:      2,
+		auditEventRecoveryLogin + " " + auditOutcomeFailure:      3,
+		auditEventRecoveryCodesRegen + " " + auditOutcomeSuccess: 1,
+	}
+	for k, want := range wantCounts {
+		if counts[k] != want {
+			t.Errorf("audit log has %d %s events, want %d", counts[k], k, want)
+		}
+	}
+}
@@ -1,19 +1,21 @@
 // Copyright (c) 2019 Faye Amacker. All rights reserved.
 // Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
 
-package main
+package webauthndemo
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/fxamacker/webauthn"
 	"github.com/gorilla/sessions"
 )
 
-func (s *server) handleAttestationOptions() http.HandlerFunc {
+func (s *Server) handleAttestationOptions() http.HandlerFunc {
 	type request struct {
 		Username               string                                   `json:"username"`
 		DisplayName            string                                   `json:"displayName"`
@@ -25,6 +27,10 @@ func (s *server) handleAttestationOptions() http.HandlerFunc {
 		*webauthn.PublicKeyCredentialCreationOptions
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
+		aw := s.startAudit(w, r, auditEventRegistrationOptions)
+		defer aw.record()
+		w = aw
+
 		session, ok := r.Context().Value(contextKeyLoginSession).(*sessions.Session)
 		if !ok {
 			panic("Failed to get session data from context")
@@ -44,6 +50,9 @@ func (s *server) handleAttestationOptions() http.HandlerFunc {
 			writeFailedServerResponse(w, http.StatusBadRequest, "Missing displayName")
 			return
 		}
+		if !s.allowUsername(w, r, optionsRequest.Username) {
+			return
+		}
 		if optionsRequest.AuthenticatorSelection.UserVerification == "" {
 			optionsRequest.AuthenticatorSelection.UserVerification = webauthn.UserVerificationPreferred
 		}
@@ -51,16 +60,34 @@ func (s *server) handleAttestationOptions() http.HandlerFunc {
 			optionsRequest.Attestation = webauthn.AttestationNone
 		}
 
-		// Get user from datastore.
-		u, err := s.dataStore.getUser(r.Context(), optionsRequest.Username)
-		if err == errNoRecords {
-			u = &user{
+		// Get user from datastore.  A credential can be added to existing user only from user's login
+		// session or recovery session, so signup with a registered username is rejected.
+		uSession := &userSession{}
+		u, err := s.dataStore.GetUser(r.Context(), optionsRequest.Username)
+		if err == ErrNoRecords && s.reservedAdminUsername(optionsRequest.Username) {
+			writeFailedServerResponse(w, http.StatusBadRequest, "Username is already registered")
+			setFailureReason(w, "Username is reserved for administrator")
+			return
+		} else if err == ErrNoRecords {
+			u = &User{
 				UserName:    optionsRequest.Username,
 				DisplayName: optionsRequest.DisplayName,
 			}
 		} else if err != nil {
 			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to query user in database: "+err.Error())
 			return
+		} else {
+			cur, ok := session.Values[sessionMapKeyUserSession].(*userSession)
+			if !ok || !bytes.Equal(cur.User.UserID, u.UserID) || (len(cur.LoggedInCredentialID) == 0 && !cur.Recovery) {
+				aw.event.UserID = u.UserID
+				writeFailedServerResponse(w, http.StatusBadRequest, "Username is already registered")
+				return
+			}
+			// Keep user logged in while new credential is registered.
+			uSession.LoggedInCredentialID = cur.LoggedInCredentialID
+			uSession.LoggedInAt = cur.LoggedInAt
+			uSession.UserVerified = cur.UserVerified
+			uSession.Recovery = cur.Recovery
 		}
 
 		// Generate user ID for new user.
@@ -74,6 +101,7 @@ func (s *server) handleAttestationOptions() http.HandlerFunc {
 				return
 			}
 		}
+		aw.event.UserID = u.UserID
 
 		// Generate PublicKeyCredentialCreationOptions from WebAuthn config and user input.
 		creationOptions, err := webauthn.NewAttestationOptions(s.webAuthnConfig, &webauthn.User{ID: u.UserID, Name: u.UserName, DisplayName: u.DisplayName, CredentialIDs: u.CredentialIDs})
@@ -84,9 +112,16 @@ func (s *server) handleAttestationOptions() http.HandlerFunc {
 		creationOptions.AuthenticatorSelection = optionsRequest.AuthenticatorSelection
 		creationOptions.Attestation = optionsRequest.Attestation
 
+		// Register challenge so that it can only be used once before it expires.
+		if err = s.challengeStore.add(r.Context(), creationOptions.Challenge, challengeTTL(creationOptions.Timeout)); err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to save challenge: "+err.Error())
+			return
+		}
+
 		// Save creationOptions and user info in session to verify new credential later.
+		uSession.User = u
 		session.Values[sessionMapKeyWebAuthnCreationOptions] = creationOptions
-		session.Values[sessionMapKeyUserSession] = &userSession{User: u}
+		session.Values[sessionMapKeyUserSession] = uSession
 
 		// Write response.
 		creationOptionsResponse := &response{
@@ -103,7 +138,11 @@ func (s *server) handleAttestationOptions() http.HandlerFunc {
 	}
 }
 
-func (s *server) handleAttestationResult(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleAttestationResult(w http.ResponseWriter, r *http.Request) {
+	aw := s.startAudit(w, r, auditEventRegistration)
+	defer aw.record()
+	w = aw
+
 	// Get saved creationOptions and user info.
 	session, ok := r.Context().Value(contextKeyLoginSession).(*sessions.Session)
 	if !ok {
@@ -121,14 +160,29 @@ func (s *server) handleAttestationResult(w http.ResponseWriter, r *http.Request)
 		writeFailedServerResponse(w, http.StatusUnauthorized, "Session doesn't have user data")
 		return
 	}
+	aw.event.UserID = uSession.User.UserID
 
 	// Parse and verify request.
-	credentialAttestation, err := webauthn.ParseAttestation(r.Body)
+	credentialAttestation, err := s.parseAttestation(r.Context(), r.Body)
 	if err != nil {
 		delete(session.Values, sessionMapKeyWebAuthnCreationOptions)
 		writeFailedServerResponse(w, http.StatusBadRequest, "Failed to parse attestation: "+err.Error())
 		return
 	}
+	aw.event.CredentialID = credentialAttestation.RawID
+	if err = s.challengeStore.consume(r.Context(), savedCreationOptions.Challenge); err == errChallengeExpired {
+		delete(session.Values, sessionMapKeyWebAuthnCreationOptions)
+		writeFailedServerResponse(w, http.StatusBadRequest, "Challenge expired")
+		return
+	} else if err == errChallengeUsed {
+		delete(session.Values, sessionMapKeyWebAuthnCreationOptions)
+		writeFailedServerResponse(w, http.StatusBadRequest, "Challenge already used")
+		return
+	} else if err != nil {
+		delete(session.Values, sessionMapKeyWebAuthnCreationOptions)
+		writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to consume challenge: "+err.Error())
+		return
+	}
 	var credentialAlgs []int
 	for _, param := range savedCreationOptions.PubKeyCredParams {
 		credentialAlgs = append(credentialAlgs, param.Alg)
@@ -140,23 +194,53 @@ func (s *server) handleAttestationResult(w http.ResponseWriter, r *http.Request)
 		Challenge:        base64.RawURLEncoding.EncodeToString(savedCreationOptions.Challenge),
 		UserVerification: savedCreationOptions.AuthenticatorSelection.UserVerification,
 	}
-	// todo: VerifyAttestation returns attestationType and trustPath.  Need to verify that
-	// attestation type is acceptable and trust path can be trusted.
-	_, _, err = webauthn.VerifyAttestation(credentialAttestation, expected)
+	attType, trustPath, err := s.verifyAttestation(r.Context(), credentialAttestation, expected)
 	if err != nil {
 		delete(session.Values, sessionMapKeyWebAuthnCreationOptions)
 		writeFailedServerResponse(w, http.StatusBadRequest, "Failed to verify attestation: "+err.Error())
 		return
 	}
 
+	// Verify that attestation type is acceptable and trust path can be trusted.
+	if err = s.attestationPolicy.verify(attType, trustPath); err != nil {
+		delete(session.Values, sessionMapKeyWebAuthnCreationOptions)
+		writeFailedServerResponse(w, http.StatusBadRequest, "Attestation is rejected by policy: "+err.Error())
+		return
+	}
+
+	// Verify authenticator status and attestation root with authenticator metadata, if available.
+	metadata, err := s.metadata.get().verify(credentialAttestation.AuthnData.AAGUID, attType, trustPath)
+	if err != nil {
+		delete(session.Values, sessionMapKeyWebAuthnCreationOptions)
+		writeFailedServerResponse(w, http.StatusBadRequest, "Authenticator is rejected by metadata: "+err.Error())
+		return
+	}
+
+	// Generate recovery codes at user's first registration.  Codes are shown only once in response.
+	var recoveryCodes []string
+	var hashedRecoveryCodes []*RecoveryCode
+	if len(uSession.User.CredentialIDs) == 0 && !uSession.Recovery {
+		if recoveryCodes, hashedRecoveryCodes, err = newRecoveryCodes(uSession.User.UserID); err != nil {
+			delete(session.Values, sessionMapKeyWebAuthnCreationOptions)
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to generate recovery codes: "+err.Error())
+			return
+		}
+	}
+
 	// Save user credential in datastore.
-	c := &credential{
+	c := &Credential{
 		CredentialID: credentialAttestation.RawID,
 		UserID:       uSession.User.UserID,
 		Counter:      credentialAttestation.AuthnData.Counter,
 		CoseKey:      credentialAttestation.AuthnData.Credential.Raw,
 	}
-	if err = s.dataStore.addUserCredential(r.Context(), uSession.User, c); err == errRecordExists {
+	if aaguid := credentialAttestation.AuthnData.AAGUID; !bytes.Equal(aaguid, make([]byte, len(aaguid))) {
+		c.AAGUID = aaguid
+	}
+	if metadata != nil {
+		c.Description = metadata.description()
+	}
+	if err = s.dataStore.AddUserCredential(r.Context(), uSession.User, c); err == ErrRecordExists {
 		delete(session.Values, sessionMapKeyWebAuthnCreationOptions)
 		writeFailedServerResponse(w, http.StatusInternalServerError, "User credential exists in the system")
 		return
@@ -166,13 +250,31 @@ func (s *server) handleAttestationResult(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Delete creationOptions and update user info in session.
+	s.registerAdmin(uSession.User)
+
+	if hashedRecoveryCodes != nil {
+		if err = s.dataStore.ReplaceRecoveryCodes(r.Context(), uSession.User.UserID, hashedRecoveryCodes); err != nil {
+			delete(session.Values, sessionMapKeyWebAuthnCreationOptions)
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to save recovery codes: "+err.Error())
+			return
+		}
+	}
+
+	// Delete creationOptions and update user info in session.  Recovery session becomes a login session
+	// with the new credential.
 	delete(session.Values, sessionMapKeyWebAuthnCreationOptions)
 	uSession.User.CredentialIDs = append(uSession.User.CredentialIDs, credentialAttestation.RawID)
 	if len(uSession.LoggedInCredentialID) == 0 {
 		uSession.LoggedInCredentialID = credentialAttestation.RawID
+		uSession.LoggedInAt = time.Now()
+		uSession.UserVerified = credentialAttestation.AuthnData.UserVerified
 	}
+	uSession.Recovery = false
 
 	// Write response.
+	if recoveryCodes != nil {
+		writeRecoveryCodesResponse(w, recoveryCodes)
+		return
+	}
 	writeOKServerResponse(w)
 }
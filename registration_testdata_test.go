@@ -1,7 +1,7 @@
 // Copyright (c) 2019 Faye Amacker. All rights reserved.
 // Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
 
-package main
+package webauthndemo
 
 import (
 	"net/http"
@@ -162,6 +162,11 @@ const (
 		"errorMessage": "Missing displayName"
 	}`
 
+	attestationOptionsErrorResponseUsernameRegistered = `{
+		"status": "failed",
+		"errorMessage": "Username is already registered"
+	}`
+
 	attestationResultRequest = `{
 		"id": "LFdoCFJTyB82ZzSJUHc-c72yraRc_1mPvGX8ToE8su39xX26Jcqd31LUkKOS36FIAWgWl6itMKqmDvruha6ywA",
 		"rawId": "LFdoCFJTyB82ZzSJUHc-c72yraRc_1mPvGX8ToE8su39xX26Jcqd31LUkKOS36FIAWgWl6itMKqmDvruha6ywA",
@@ -226,14 +231,41 @@ var (
 				wantResponseBody:     attestationOptionsSuccessResponse2,
 			},
 			{
-				name:                 "user exists",
+				name:                 "user exists and is logged in",
 				server:               getMockServer(),
 				initMockDataStore:    initDataStoreGetUser,
-				initMockSessionStore: initSessionStore(getEmptySession, getAttestationOptionsExistingUserSession),
+				initMockSessionStore: initSessionStore(getUserSession, getAttestationOptionsExistingUserSession),
 				requestBody:          attestationOptionsRequest1,
 				wantStatusCode:       http.StatusOK,
 				wantResponseBody:     attestationOptionsSuccessResponseExistingUser,
 			},
+			{
+				name:                 "user exists and is not logged in",
+				server:               getMockServer(),
+				initMockDataStore:    initDataStoreGetUser,
+				initMockSessionStore: initSessionStore(getEmptySession, getEmptySession),
+				requestBody:          attestationOptionsRequest1,
+				wantStatusCode:       http.StatusBadRequest,
+				wantResponseBody:     attestationOptionsErrorResponseUsernameRegistered,
+			},
+			{
+				name:                 "user exists and login is not completed",
+				server:               getMockServer(),
+				initMockDataStore:    initDataStoreGetUser,
+				initMockSessionStore: initSessionStore(getAssertionOptionsExistingUserSession, getAssertionOptionsExistingUserSession),
+				requestBody:          attestationOptionsRequest1,
+				wantStatusCode:       http.StatusBadRequest,
+				wantResponseBody:     attestationOptionsErrorResponseUsernameRegistered,
+			},
+			{
+				name:                 "user exists and another user is logged in",
+				server:               getMockServer(),
+				initMockDataStore:    initDataStoreGetUser,
+				initMockSessionStore: initSessionStore(getOtherUserSession, getOtherUserSession),
+				requestBody:          attestationOptionsRequest1,
+				wantStatusCode:       http.StatusBadRequest,
+				wantResponseBody:     attestationOptionsErrorResponseUsernameRegistered,
+			},
 			{
 				name:                 "request missing user name",
 				server:               getMockServer(),
@@ -0,0 +1,167 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	requestIDHeader    = "X-Request-ID"
+	maxRequestIDLength = 128
+
+	contextKeyRequestLog contextKey = "RequestLog" // context key for *requestLog
+)
+
+// requestLog has request data logged when request is completed.  Route, user ID, and failure
+// reason are set by middleware and handlers.
+type requestLog struct {
+	id            string
+	route         string
+	userID        []byte
+	failureReason string
+}
+
+func requestLogFromContext(ctx context.Context) *requestLog {
+	rl, _ := ctx.Value(contextKeyRequestLog).(*requestLog)
+	return rl
+}
+
+// setRequestLogUserID sets user ID of request log in ctx.
+func setRequestLogUserID(ctx context.Context, userID []byte) {
+	if rl := requestLogFromContext(ctx); rl != nil && userID != nil {
+		rl.userID = userID
+	}
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// validRequestID returns true if request ID from client can be logged and returned as is.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDLogHandler is a slog.Handler that adds request ID of request log in context to log records,
+// so logs of the same request can be found by request ID.
+type requestIDLogHandler struct {
+	slog.Handler
+}
+
+func (h requestIDLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if rl := requestLogFromContext(ctx); rl != nil {
+		r.AddAttrs(slog.String("request_id", rl.id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDLogHandler) WithGroup(name string) slog.Handler {
+	return requestIDLogHandler{h.Handler.WithGroup(name)}
+}
+
+// logRequests returns a handler that assigns request ID and logs every request when it is completed.
+// Request ID from client's X-Request-ID header is kept if it is valid.  Request ID is returned in
+// X-Request-ID response header.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rl := &requestLog{id: r.Header.Get(requestIDHeader)}
+		if !validRequestID(rl.id) {
+			rl.id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, rl.id)
+
+		ctx := context.WithValue(r.Context(), contextKeyRequestLog, rl)
+		lw := &logWriter{ResponseWriter: w, log: rl}
+		next.ServeHTTP(lw, r.WithContext(ctx))
+
+		status := lw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", rl.route),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("client_ip", clientIP(r)),
+		}
+		if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+			attrs = append(attrs, slog.String("trace_id", spanContext.TraceID().String()))
+		}
+		if rl.userID != nil {
+			attrs = append(attrs, slog.String("user_id", base64.RawURLEncoding.EncodeToString(rl.userID)))
+		}
+		if rl.failureReason != "" {
+			attrs = append(attrs, slog.String("error", rl.failureReason))
+		}
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		} else if status >= http.StatusBadRequest {
+			level = slog.LevelWarn
+		}
+		s.logger.LogAttrs(ctx, level, "request", attrs...)
+	})
+}
+
+// recordRoute is a mux middleware that sets matched route of request log and request span.
+func recordRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			path, _ := route.GetPathTemplate()
+			if rl := requestLogFromContext(r.Context()); rl != nil {
+				rl.route = path
+			}
+			span := trace.SpanFromContext(r.Context())
+			span.SetName(r.Method + " " + path)
+			span.SetAttributes(attribute.String("http.route", path))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logWriter hijacks ResponseWriter to get response status code for request log.
+type logWriter struct {
+	http.ResponseWriter
+	log    *requestLog
+	status int
+}
+
+func (w *logWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *logWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fxamacker/webauthn"
+	"github.com/fxamacker/webauthn-demo/virtualauthenticator"
+)
+
+func TestValidRequestID(t *testing.T) {
+	testCases := []struct {
+		id   string
+		want bool
+	}{
+		{"", false},
+		{"f3a1c2d4-0b7e-4c55-9a1e-5d7c2e8b9f10", true},
+		{"req_1.2", true},
+		{"request id", false},
+		{"request\nid", false},
+		{strings.Repeat("a", maxRequestIDLength), true},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+	for _, tc := range testCases {
+		if valid := validRequestID(tc.id); valid != tc.want {
+			t.Errorf("validRequestID(%q) returns %t, want %t", tc.id, valid, tc.want)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer that can be written by concurrent requests.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records returns decoded JSON log records.
+func (b *syncBuffer) records(t *testing.T) []map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("log has invalid JSON %q: %s", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestRequestLog(t *testing.T) {
+	var logs syncBuffer
+	c := &Config{
+		CounterPolicy: counterPolicyReject,
+		SessionKey:    []byte("session key"),
+		SessionStore:  sessionStoreMemory,
+		SessionMaxAge: defaultSessionMaxAge,
+		DBDriver:      dbDriverSQLite,
+		DBConnString:  filepath.Join(t.TempDir(), "webauthn.db"),
+		AuditLog:      auditLogMemory,
+	}
+	s, err := NewServer(
+		WithConfig(c),
+		WithWebAuthnConfig(getWebAuthnConfig()),
+		WithOrigin(e2eOrigin),
+		WithLogger(slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+	)
+	if err != nil {
+		t.Fatalf("NewServer() returns error %q", err)
+	}
+	defer s.Close()
+	ts := httptest.NewTLSServer(s)
+	defer ts.Close()
+
+	a, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username := "johndoe@example.com"
+	client := newE2EClient(t, ts)
+	client.register(a, username, webauthn.ResidentKeyDiscouraged)
+
+	send := func(method string, path string, requestID string, body string) string {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if requestID != "" {
+			req.Header.Set(requestIDHeader, requestID)
+		}
+		resp, err := client.client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s returns error %q", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get(requestIDHeader)
+	}
+
+	// Valid request ID from client is kept, and invalid request ID is replaced.
+	if id := send("POST", "/assertion/options", "failed-request", `{}`); id != "failed-request" {
+		t.Errorf("response has request ID %q, want %q", id, "failed-request")
+	}
+	if id := send("GET", "/user", "user-request", ""); id != "user-request" {
+		t.Errorf("response has request ID %q, want %q", id, "user-request")
+	}
+	generatedID := send("GET", "/user", "invalid request ID", "")
+	if !validRequestID(generatedID) || generatedID == "invalid request ID" {
+		t.Errorf("response has request ID %q, want generated request ID", generatedID)
+	}
+
+	requests := make(map[string]map[string]interface{}) // request logs by request ID
+	sqlRequestIDs := make(map[string]bool)
+	for _, record := range logs.records(t) {
+		id, _ := record["request_id"].(string)
+		if id == "" {
+			t.Errorf("log record %v doesn't have request ID", record)
+			continue
+		}
+		switch record["msg"] {
+		case "request":
+			requests[id] = record
+		case "SQL query":
+			sqlRequestIDs[id] = true
+		}
+	}
+
+	u, err := s.dataStore.GetUser(t.Context(), username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := base64.RawURLEncoding.EncodeToString(u.UserID)
+	testCases := []struct {
+		requestID string
+		want      map[string]interface{}
+	}{
+		{
+			requestID: "failed-request",
+			want: map[string]interface{}{
+				"level":  "WARN",
+				"method": "POST",
+				"path":   "/assertion/options",
+				"route":  "/assertion/options",
+				"status": float64(http.StatusBadRequest),
+				"error":  "Missing username",
+			},
+		},
+		{
+			requestID: "user-request",
+			want: map[string]interface{}{
+				"level":   "INFO",
+				"method":  "GET",
+				"route":   "/user",
+				"status":  float64(http.StatusOK),
+				"user_id": userID,
+			},
+		},
+		{
+			requestID: generatedID,
+			want: map[string]interface{}{
+				"level":   "INFO",
+				"route":   "/user",
+				"user_id": userID,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		record, ok := requests[tc.requestID]
+		if !ok {
+			t.Errorf("request %s isn't logged", tc.requestID)
+			continue
+		}
+		for k, v := range tc.want {
+			if record[k] != v {
+				t.Errorf("request %s log has %s %v, want %v", tc.requestID, k, record[k], v)
+			}
+		}
+	}
+
+	// SQL queries are logged with request ID of the request that sends them.
+	if !sqlRequestIDs["user-request"] {
+		t.Errorf("SQL queries of request %s aren't logged", "user-request")
+	}
+}
@@ -1,24 +1,89 @@
 // Copyright (c) 2019 Faye Amacker. All rights reserved.
 // Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
 
-package main
+package webauthndemo
 
 import (
 	"net/http"
 )
 
-func (s *server) routes() {
-	s.router.HandleFunc("/attestation/options", s.handleAuthnSession(s.handleAttestationOptions())).Methods("POST")
+func (s *Server) routes() {
+	s.router.Use(recordRoute)
 
-	s.router.HandleFunc("/assertion/options", s.handleAuthnSession(s.handleAssertionOptions())).Methods("POST")
+	if s.metrics != nil {
+		s.router.Use(s.metrics.middleware)
 
-	s.router.HandleFunc("/attestation/result", s.handleAuthnSession(s.handleAttestationResult)).Methods("POST")
+		s.router.Handle("/metrics", s.metrics.handler()).Methods("GET")
+	}
 
-	s.router.HandleFunc("/assertion/result", s.handleAuthnSession(s.handleAssertionResult)).Methods("POST")
+	s.router.HandleFunc("/attestation/options", s.rateLimitedByIP(s.handleAuthnSession(s.handleAttestationOptions()))).Methods("POST")
+
+	s.router.HandleFunc("/assertion/options", s.rateLimitedByIP(s.handleAuthnSession(s.handleAssertionOptions()))).Methods("POST")
+
+	s.router.HandleFunc("/attestation/result", s.rateLimitedByIP(s.handleAuthnSession(s.handleAttestationResult))).Methods("POST")
+
+	s.router.HandleFunc("/assertion/result", s.rateLimitedByIP(s.handleAuthnSession(s.handleAssertionResult))).Methods("POST")
 
 	s.router.HandleFunc("/logout", s.handleAuthnSession(s.handleLogout)).Methods("GET")
 
-	s.router.HandleFunc("/user", s.loggedInUserOnly(s.handleSession(nil, []string{sessionNameLoginSession}, s.handleUser()))).Methods("GET")
+	s.router.HandleFunc("/user", s.loggedInUserOrBearerToken(s.handleSession(nil, []string{sessionNameLoginSession}, s.handleUser()))).Methods("GET")
+
+	s.router.HandleFunc("/user/activity", s.loggedInUserOrBearerToken(s.handleSession(nil, []string{sessionNameLoginSession}, s.handleActivity()))).Methods("GET")
+
+	s.router.HandleFunc("/credentials", s.loggedInUserOrBearerToken(s.handleSession(nil, []string{sessionNameLoginSession}, s.handleCredentials()))).Methods("GET")
+
+	s.router.HandleFunc("/credentials/{id}", s.loggedInUserOrBearerToken(s.handleSession(nil, []string{sessionNameLoginSession}, s.handleRenameCredential()))).Methods("PATCH")
+
+	s.router.HandleFunc("/credentials/{id}", s.loggedInUserOrBearerToken(s.handleAuthnSession(s.handleDeleteCredential))).Methods("DELETE")
+
+	s.router.HandleFunc("/recovery/login", s.rateLimitedByIP(s.handleAuthnSession(s.handleRecoveryLogin()))).Methods("POST")
+
+	s.router.HandleFunc("/recovery/codes", s.loggedInUserOrBearerToken(s.handleSession(nil, []string{sessionNameLoginSession}, s.handleRegenerateRecoveryCodes))).Methods("POST")
+
+	s.router.HandleFunc("/admin/users", s.adminOnly(s.handleAdminUsers())).Methods("GET")
+
+	s.router.HandleFunc("/admin/users/{userID}", s.adminOnly(s.handleAdminUser())).Methods("GET")
+
+	s.router.HandleFunc("/admin/users/{userID}", s.adminOnly(s.handleAdminDeleteUser)).Methods("DELETE")
+
+	s.router.HandleFunc("/admin/users/{userID}/sessions", s.adminOnly(s.handleAdminRevokeSessions)).Methods("DELETE")
+
+	s.router.HandleFunc("/admin/users/{userID}/credentials/{id}/disable", s.adminOnly(s.handleAdminDisableCredential)).Methods("POST")
+
+	s.router.HandleFunc("/admin/users/{userID}/credentials/{id}", s.adminOnly(s.handleAdminDeleteCredential)).Methods("DELETE")
+
+	if s.rateLimiter != nil {
+		s.router.HandleFunc("/admin/lockouts/{username}", s.adminOnly(s.handleUnlock)).Methods("DELETE")
+	}
+
+	if s.apiTokens != nil {
+		s.router.HandleFunc("/token/refresh", s.handleTokenRefresh).Methods("POST")
+
+		s.router.HandleFunc("/token/revoke", s.handleTokenRevoke).Methods("POST")
+	}
+
+	s.router.HandleFunc("/auth/verify", s.handleSession(nil, []string{sessionNameLoginSession}, s.handleForwardAuthVerify))
+
+	s.router.HandleFunc("/auth/signin", s.handleSession(nil, []string{sessionNameLoginSession}, s.handleForwardAuthSignIn)).Methods("GET")
+
+	if s.oidc != nil {
+		s.router.HandleFunc("/.well-known/openid-configuration", s.handleOIDCDiscovery()).Methods("GET")
+
+		s.router.HandleFunc("/jwks", s.handleOIDCJWKS).Methods("GET")
+
+		s.router.HandleFunc("/authorize", s.handleSession(nil, []string{sessionNameLoginSession}, s.handleOIDCAuthorize)).Methods("GET")
+
+		s.router.HandleFunc("/token", s.handleOIDCToken).Methods("POST")
+
+		s.router.HandleFunc("/userinfo", s.handleOIDCUserInfo).Methods("GET", "POST")
+	}
+
+	if s.staticDir != "" {
+		fileServer := http.FileServer(http.Dir(s.staticDir))
+
+		// Admin console is only served to administrators.
+		s.router.HandleFunc("/admin.html", s.adminOnly(fileServer.ServeHTTP))
 
-	s.router.PathPrefix("/").Handler(http.FileServer(http.Dir("./static")))
+		s.router.PathPrefix("/").Handler(fileServer)
+	}
 }
@@ -1,32 +1,114 @@
 // Copyright (c) 2019 Faye Amacker. All rights reserved.
 // Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
 
-package main
+// Package webauthndemo implements WebAuthn registration and login flows as an http.Handler
+// that can be mounted in other web servers.
+package webauthndemo
 
 import (
-	"database/sql"
+	"context"
 	"encoding/gob"
 	"errors"
+	"log/slog"
+	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/fxamacker/webauthn"
+	_ "github.com/fxamacker/webauthn/androidkeystore"
+	_ "github.com/fxamacker/webauthn/androidsafetynet"
+	_ "github.com/fxamacker/webauthn/fidou2f"
+	_ "github.com/fxamacker/webauthn/packed"
+	_ "github.com/fxamacker/webauthn/tpm"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
+	_ "github.com/lib/pq"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 	redistore "gopkg.in/boj/redistore.v1"
 )
 
-type server struct {
-	webAuthnConfig *webauthn.Config
-	rpOrigin       string
-	dataStore      dataStore
-	sessionStore   sessions.Store
-	router         *mux.Router
+type contextKey string
+
+const (
+	sessionNameLoginSession              string = "LoginSession"            // session store name for login session
+	sessionMapKeyUserSession             string = "UserSession"             // session map key for *userSession
+	sessionMapKeyWebAuthnCreationOptions string = "WebAuthnCreationOptions" // session map key for *webauthn.PublicKeyCredentialCreationOptions
+	sessionMapKeyWebAuthnRequestOptions  string = "WebAuthnRequestOptions"  // session map key for *webauthn.PublicKeyCredentialRequestOptions
+
+	contextKeyLoginSession    contextKey = contextKey(sessionNameLoginSession) // context key for login session
+	contextKeyRevocationCache contextKey = "RevocationCache"                   // context key for revocationCache of request
+	contextKeyAdminUserID     contextKey = "AdminUserID"                       // context key for user ID of administrator making request
+)
+
+// Server is a WebAuthn relying party server.  Server is an http.Handler, so it can be mounted
+// under a path prefix with http.StripPrefix.
+type Server struct {
+	webAuthnConfig    *webauthn.Config
+	rpOrigin          string
+	attestationPolicy *attestationPolicy
+	metadata          *metadataSource // nil if metadata service is disabled
+	usernamelessLogin bool
+	fakeUsers         *fakeUsers // nil if username enumeration protection is disabled
+	counterPolicy     string
+	dataStore         DataStore
+	sessionStore      sessions.Store
+	challengeStore    challengeStore
+	auditLog          auditLog
+	oidc              *oidcProvider // nil if OpenID Connect provider is disabled
+	forwardAuth       *forwardAuth
+	apiTokens         *apiTokenIssuer   // nil if API tokens are disabled
+	rateLimiter       *rateLimiter      // nil if rate limiting is disabled
+	trustedProxies    trustedProxies    // X-Forwarded-For isn't used if empty
+	admins            map[string][]byte // user IDs of administrators by username, nil if administrator isn't registered
+	adminSignup       bool              // usernames in admins can sign up
+	adminsMu          sync.RWMutex      // protects admins
+	metrics           *metrics          // nil if metrics are disabled
+	logger            *slog.Logger
+	tracer            trace.Tracer // noop tracer if tracing is disabled
+	staticDir         string
+	router            *mux.Router
+	handler           http.Handler   // router wrapped by client IP resolution, tracing, request logging, and revocation cache
+	closers           []func() error // close resources created by NewServer
 }
 
-func newServer(c *config) (*server, error) {
+// NewServer returns Server configured by opts.  WebAuthn config and origin are required,
+// either from WithConfig or from WithWebAuthnConfig and WithOrigin.  Data store and session
+// store are created from Config if they are not provided by WithDataStore and WithSessionStore.
+func NewServer(opts ...Option) (*Server, error) {
+	o := &serverOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	c := o.config
+	if c == nil {
+		c = &Config{CounterPolicy: counterPolicyReject, AuditLog: auditLogMemory}
+	}
+
+	// Initialize WebAuthn config.
+	webAuthnConfig := o.webAuthnConfig
+	if webAuthnConfig == nil {
+		webAuthnConfig = c.WebAuthn
+	}
+	if webAuthnConfig == nil {
+		return nil, errors.New("WebAuthn config is missing")
+	}
+	if err := webAuthnConfig.Valid(); err != nil {
+		return nil, err
+	}
+
 	// Initialize origin.
-	origin := c.Origin
+	origin := o.origin
+	if origin == "" {
+		origin = c.Origin
+	}
+	if origin == "" {
+		return nil, errors.New("origin is empty")
+	}
 	u, err := url.Parse(origin)
 	if err != nil {
 		return nil, err
@@ -35,40 +117,227 @@ func newServer(c *config) (*server, error) {
 		return nil, errors.New("WebAuthn origin must be https")
 	}
 
-	// Initialize data store.
-	db, err := sql.Open("postgres", c.DBConnString)
+	// Initialize attestation policy.
+	attestationPolicy, err := newAttestationPolicy(c.AttestationPolicy)
 	if err != nil {
 		return nil, err
 	}
-	if err = db.Ping(); err != nil {
+
+	// Initialize authenticator metadata.
+	metadata, err := newMetadataSource(c.MetadataService)
+	if err != nil {
 		return nil, err
 	}
-	dataStore := &dbStore{db}
 
-	// Initialize session store.
-	rediStore, err := redistore.NewRediStore(10, c.RedisNetwork, c.RedisAddr, c.RedisPwd, c.SessionKey)
+	// Initialize OpenID Connect provider.
+	var oidc *oidcProvider
+	if c.OIDC != nil {
+		if oidc, err = newOIDCProvider(c.OIDC, origin); err != nil {
+			return nil, err
+		}
+	}
+
+	// Initialize forward authentication.
+	forwardAuth, err := newForwardAuth(c.ForwardAuth, origin)
 	if err != nil {
 		return nil, err
 	}
-	rediStore.SetMaxAge(60 * 5) // expires after 5 minutes
+
+	// Initialize API token issuer.
+	var apiTokens *apiTokenIssuer
+	if c.APITokens != nil {
+		if apiTokens, err = newAPITokenIssuer(c.APITokens, origin); err != nil {
+			return nil, err
+		}
+	}
+
+	// Initialize fake users for username enumeration protection.
+	var fakeUsers *fakeUsers
+	if c.FakeLoginOptions {
+		if fakeUsers, err = newFakeUsers(c.SessionKey); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Server{
+		webAuthnConfig:    webAuthnConfig,
+		rpOrigin:          origin,
+		attestationPolicy: attestationPolicy,
+		metadata:          metadata,
+		usernamelessLogin: c.UsernamelessLogin,
+		fakeUsers:         fakeUsers,
+		counterPolicy:     c.CounterPolicy,
+		oidc:              oidc,
+		forwardAuth:       forwardAuth,
+		apiTokens:         apiTokens,
+		admins:            make(map[string][]byte),
+		adminSignup:       c.AdminSignup,
+		logger:            o.logger,
+		staticDir:         o.staticDir,
+		router:            mux.NewRouter(),
+	}
+	if s.logger == nil {
+		s.logger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	}
+	s.logger = slog.New(requestIDLogHandler{s.logger.Handler()})
+	if s.metadata != nil {
+		s.closers = append(s.closers, s.metadata.startReload(metadataReloadInterval, s.logger))
+	}
+
+	// Initialize tracer.
+	tracerProvider := o.tracerProvider
+	if tracerProvider == nil && c.Tracing != nil {
+		tp, err := newTracerProvider(c.Tracing)
+		if err != nil {
+			return nil, err
+		}
+		s.closers = append(s.closers, func() error { return tp.Shutdown(context.Background()) })
+		tracerProvider = tp
+	}
+	if tracerProvider == nil {
+		tracerProvider = noop.NewTracerProvider()
+	}
+	s.tracer = tracerProvider.Tracer(tracerName)
+
+	// Initialize data store.
+	s.dataStore = o.dataStore
+	if s.dataStore == nil {
+		if o.config == nil {
+			s.Close()
+			return nil, errors.New("data store is missing")
+		}
+		if s.dataStore, err = newDataStore(c.DBDriver, c.DBConnString); err != nil {
+			s.Close()
+			return nil, err
+		}
+		if dbStore, ok := s.dataStore.(*dbStore); ok {
+			dbStore.logger = s.logger
+			s.closers = append(s.closers, dbStore.Close)
+		}
+	}
+
+	// Apply pending schema migrations.  SQLite data store is already migrated when it is opened.
+	// Server doesn't start with pending migrations, because queries of missing tables and columns fail.
+	if dbStore, ok := s.dataStore.(*dbStore); ok {
+		if c.DBAutoMigrate {
+			applied, err := dbStore.migrate(context.Background())
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+			for _, m := range applied {
+				s.logger.Info("applied schema migration", "version", m.Version, "name", m.Name)
+			}
+		}
+		pending, err := dbStore.pendingMigrations(context.Background())
+		if err != nil {
+			s.Close()
+			return nil, errors.New("failed to check schema migrations: " + err.Error())
+		}
+		if len(pending) > 0 {
+			s.Close()
+			return nil, errors.New("database has " + strconv.Itoa(len(pending)) + " pending schema migrations, run \"webauthn-demo migrate up\" or set DB_AUTO_MIGRATE=true")
+		}
+	}
+
+	// Initialize administrators with their registered user IDs.
+	if err = s.loadAdmins(context.Background(), c.Admins); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	// Initialize session store.
+	s.sessionStore = o.sessionStore
+	if s.sessionStore == nil {
+		if o.config == nil {
+			s.Close()
+			return nil, errors.New("session store is missing")
+		}
+		if s.sessionStore, err = newSessionStore(c, s.dataStore); err != nil {
+			s.Close()
+			return nil, err
+		}
+		if rediStore, ok := s.sessionStore.(*redistore.RediStore); ok {
+			s.closers = append(s.closers, rediStore.Close)
+		}
+		if serverSessionStore, ok := s.sessionStore.(*serverSessionStore); ok {
+			s.closers = append(s.closers, serverSessionStore.startCleanup(sessionCleanupInterval, s.logger))
+		}
+	}
+
+	// Initialize challenge store.  Challenges are shared by server instances if sessions are stored in Redis.
+	s.challengeStore = newMemChallengeStore()
+	if rediStore, ok := s.sessionStore.(*redistore.RediStore); ok {
+		s.challengeStore = &redisChallengeStore{pool: rediStore.Pool}
+	}
+
+	// Initialize rate limiter.  Like challenges, limits are shared by server instances if sessions are stored in Redis.
+	if c.RateLimit != nil {
+		var store rateLimitStore = newMemRateLimitStore()
+		if rediStore, ok := s.sessionStore.(*redistore.RediStore); ok {
+			store = &redisRateLimitStore{pool: rediStore.Pool}
+		}
+		if s.rateLimiter, err = newRateLimiter(c.RateLimit, store); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	if s.trustedProxies, err = parseTrustedProxies(c.TrustedProxies); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	// Initialize audit log.
+	if s.auditLog, err = newAuditLog(c, s.dataStore); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if fileAuditLog, ok := s.auditLog.(*fileAuditLog); ok {
+		s.closers = append(s.closers, fileAuditLog.close)
+	}
+
+	// Initialize metrics.
+	if c.Metrics {
+		s.metrics = newMetrics()
+		if dbStore, ok := s.dataStore.(*dbStore); ok {
+			s.metrics.registerDBStats(dbStore)
+		}
+	}
+
+	// Instrument data store after session store and audit log are created from it.
+	if s.metrics != nil || o.tracerProvider != nil || c.Tracing != nil {
+		ids := &instrumentedDataStore{DataStore: s.dataStore, tracer: s.tracer}
+		if s.metrics != nil {
+			ids.duration = s.metrics.dataStoreDuration
+		}
+		s.dataStore = ids
+	}
+
 	gob.Register(&userSession{})
 	gob.Register(&webauthn.PublicKeyCredentialCreationOptions{})
 	gob.Register(&webauthn.PublicKeyCredentialRequestOptions{})
 
-	return &server{
-		webAuthnConfig: c.WebAuthn,
-		rpOrigin:       origin,
-		dataStore:      dataStore,
-		sessionStore:   rediStore,
-		router:         mux.NewRouter(),
-	}, nil
+	s.routes()
+	s.handler = s.resolveClientIP(s.traceRequests(s.logRequests(cacheRevocations(s.router))))
+
+	return s, nil
 }
 
-func (s *server) close() {
-	if dbStore, ok := s.dataStore.(*dbStore); ok {
-		dbStore.Close()
-	}
-	if rediStore, ok := s.sessionStore.(*redistore.RediStore); ok {
-		rediStore.Close()
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Close closes data store, session store, and audit log created by NewServer in reverse order of creation,
+// so resources aren't closed while others still use them.  Stores provided by options are not closed.
+func (s *Server) Close() error {
+	var firstErr error
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		if err := s.closers[i](); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
+	s.closers = nil
+	return firstErr
 }
@@ -0,0 +1,161 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func getMemSessionStore() *serverSessionStore {
+	return newServerSessionStore(newMemSessionBackend(), 60, []byte("session_key"))
+}
+
+func TestNewServer(t *testing.T) {
+	s, err := NewServer(
+		WithWebAuthnConfig(getWebAuthnConfig()),
+		WithOrigin("https://localhost:8443"),
+		WithDataStore(newMemStore()),
+		WithSessionStore(getMemSessionStore()),
+	)
+	if err != nil {
+		t.Fatalf("NewServer() returns error %q", err)
+	}
+	defer s.Close()
+
+	if s.counterPolicy != counterPolicyReject {
+		t.Errorf("NewServer() returns server with counter policy %q, want %q", s.counterPolicy, counterPolicyReject)
+	}
+	if _, ok := s.auditLog.(*memAuditLog); !ok {
+		t.Errorf("NewServer() returns server with audit log %T, want *memAuditLog", s.auditLog)
+	}
+	if _, ok := s.challengeStore.(*memChallengeStore); !ok {
+		t.Errorf("NewServer() returns server with challenge store %T, want *memChallengeStore", s.challengeStore)
+	}
+	if s.logger == nil {
+		t.Errorf("NewServer() returns server without logger")
+	}
+}
+
+func TestNewServerError(t *testing.T) {
+	testCases := []struct {
+		name         string
+		opts         []Option
+		wantErrorMsg string
+	}{
+		{
+			name:         "missing WebAuthn config",
+			opts:         []Option{WithOrigin("https://localhost:8443"), WithDataStore(newMemStore()), WithSessionStore(getMemSessionStore())},
+			wantErrorMsg: "WebAuthn config is missing",
+		},
+		{
+			name:         "missing origin",
+			opts:         []Option{WithWebAuthnConfig(getWebAuthnConfig()), WithDataStore(newMemStore()), WithSessionStore(getMemSessionStore())},
+			wantErrorMsg: "origin is empty",
+		},
+		{
+			name:         "http origin",
+			opts:         []Option{WithWebAuthnConfig(getWebAuthnConfig()), WithOrigin("http://localhost:8443"), WithDataStore(newMemStore()), WithSessionStore(getMemSessionStore())},
+			wantErrorMsg: "WebAuthn origin must be https",
+		},
+		{
+			name:         "missing data store",
+			opts:         []Option{WithWebAuthnConfig(getWebAuthnConfig()), WithOrigin("https://localhost:8443"), WithSessionStore(getMemSessionStore())},
+			wantErrorMsg: "data store is missing",
+		},
+		{
+			name:         "missing session store",
+			opts:         []Option{WithWebAuthnConfig(getWebAuthnConfig()), WithOrigin("https://localhost:8443"), WithDataStore(newMemStore())},
+			wantErrorMsg: "session store is missing",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewServer(tc.opts...); err == nil || err.Error() != tc.wantErrorMsg {
+				t.Errorf("NewServer() returns error %v, want %q", err, tc.wantErrorMsg)
+			}
+		})
+	}
+}
+
+func TestNewServerPendingMigrations(t *testing.T) {
+	store, err := newSQLiteStore(filepath.Join(t.TempDir(), "webauthn.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	m, err := newMigrator(store.DB, store.driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Down(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	newServer := func(c *Config) (*Server, error) {
+		return NewServer(
+			WithConfig(c),
+			WithWebAuthnConfig(getWebAuthnConfig()),
+			WithOrigin("https://localhost:8443"),
+			WithDataStore(store),
+			WithSessionStore(getMemSessionStore()),
+		)
+	}
+
+	// Server doesn't start with pending migrations.
+	wantErrorMsg := `database has 1 pending schema migrations, run "webauthn-demo migrate up" or set DB_AUTO_MIGRATE=true`
+	if _, err := newServer(&Config{CounterPolicy: counterPolicyReject, AuditLog: auditLogMemory}); err == nil || err.Error() != wantErrorMsg {
+		t.Errorf("NewServer() returns error %v, want %q", err, wantErrorMsg)
+	}
+
+	// Server applies pending migrations if DBAutoMigrate is true.
+	s, err := newServer(&Config{CounterPolicy: counterPolicyReject, AuditLog: auditLogMemory, DBAutoMigrate: true})
+	if err != nil {
+		t.Fatalf("NewServer() with DBAutoMigrate returns error %q", err)
+	}
+	defer s.Close()
+	if pending, err := store.pendingMigrations(context.Background()); err != nil || len(pending) != 0 {
+		t.Errorf("pendingMigrations() after NewServer() with DBAutoMigrate returns %v, %v, want no migrations", pending, err)
+	}
+}
+
+func TestServerMountedWithPathPrefix(t *testing.T) {
+	s, err := NewServer(
+		WithWebAuthnConfig(getWebAuthnConfig()),
+		WithOrigin("https://localhost:8443"),
+		WithDataStore(newMemStore()),
+		WithSessionStore(getMemSessionStore()),
+	)
+	if err != nil {
+		t.Fatalf("NewServer() returns error %q", err)
+	}
+	defer s.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/webauthn/", http.StripPrefix("/webauthn", s))
+
+	testCases := []struct {
+		requestMethod  string
+		requestURL     string
+		requestBody    string
+		wantStatusCode int
+	}{
+		{"POST", "/webauthn/attestation/options", attestationOptionsRequest1, http.StatusOK},
+		{"GET", "/webauthn/user", "", http.StatusUnauthorized},
+		{"POST", "/attestation/options", attestationOptionsRequest1, http.StatusNotFound},
+		{"GET", "/webauthn/index.html", "", http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(tc.requestMethod, tc.requestURL, strings.NewReader(tc.requestBody))
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, r)
+		if recorder.Code != tc.wantStatusCode {
+			t.Errorf("%s %s returns status code %d, want %d", tc.requestMethod, tc.requestURL, recorder.Code, tc.wantStatusCode)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 // Copyright (c) 2019 Faye Amacker. All rights reserved.
 // Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
 
-package main
+package webauthndemo
 
 import (
 	"encoding/json"
@@ -21,6 +21,7 @@ const (
 )
 
 func writeFailedServerResponse(w http.ResponseWriter, httpStatusCode int, errMsg string) (int, error) {
+	setFailureReason(w, errMsg)
 	b, err := json.Marshal(serverResponse{statusFailed, errMsg})
 	if err != nil {
 		return 0, err
@@ -30,6 +31,23 @@ func writeFailedServerResponse(w http.ResponseWriter, httpStatusCode int, errMsg
 	return w.Write(b)
 }
 
+// setFailureReason sets failure reason of audit event and request log of ResponseWriters wrapped by w.
+func setFailureReason(w http.ResponseWriter, errMsg string) {
+	for {
+		switch rw := w.(type) {
+		case *auditWriter:
+			rw.event.FailureReason = errMsg
+		case *logWriter:
+			rw.log.failureReason = errMsg
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = u.Unwrap()
+	}
+}
+
 func writeOKServerResponse(w http.ResponseWriter) (int, error) {
 	w.Header().Set("Content-Type", "application/json")
 	return w.Write([]byte(serverResponseOKJSONString))
@@ -1,14 +1,17 @@
 // Copyright (c) 2019 Faye Amacker. All rights reserved.
 // Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
 
-package main
+package webauthndemo
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/sessions"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // sessionHandler is a middleware handler that stores session data in request context and
@@ -17,13 +20,17 @@ type sessionHandler struct {
 	rwSessionNames []string
 	rSessionNames  []string
 	next           http.HandlerFunc
-	server         *server
+	server         *Server
 }
 
 func (m *sessionHandler) storeSessionInContext(ctx context.Context, r *http.Request, sessionNames []string) (context.Context, error) {
 	for _, sessionName := range sessionNames {
+		// Keep session created for request authenticated by Bearer access token.
+		if _, ok := ctx.Value(contextKey(sessionName)).(*sessions.Session); ok {
+			continue
+		}
 		// Get session data.
-		session, err := m.server.sessionStore.Get(r, sessionName)
+		session, err := m.server.getSession(r, sessionName)
 		if err != nil {
 			return nil, errors.New("failed to retrieve session \"" + sessionName + "\": " + err.Error())
 		}
@@ -37,7 +44,8 @@ func (m *sessionHandler) storeSessionInContext(ctx context.Context, r *http.Requ
 // if response code is 200.
 func (m *sessionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var err error
-	ctx := r.Context()
+	ctx, span := m.server.startSpan(r.Context(), "sessionHandler.ServeHTTP")
+	defer func() { endSpan(span, err) }()
 
 	// Get session data and store it in context.
 	if ctx, err = m.storeSessionInContext(ctx, r, m.rwSessionNames); err != nil {
@@ -52,9 +60,9 @@ func (m *sessionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Store context for next handler.
 	r = r.WithContext(ctx)
 
-	// Save session by hijacking ResponseWriter.
-	if len(m.rwSessionNames) > 0 {
-		w = &sessionWriter{ResponseWriter: w, r: r, rwSession: m.rwSessionNames}
+	// Save session by hijacking ResponseWriter.  Session of request authenticated by Bearer access token isn't saved.
+	if len(m.rwSessionNames) > 0 && ctx.Value(contextKeyBearerToken) == nil {
+		w = &sessionWriter{ResponseWriter: w, r: r, rwSession: m.rwSessionNames, tracer: m.server.tracer}
 	}
 
 	m.next(w, r)
@@ -66,6 +74,7 @@ type sessionWriter struct {
 	r         *http.Request
 	status    int
 	rwSession []string
+	tracer    trace.Tracer
 }
 
 func (w *sessionWriter) WriteHeader(status int) {
@@ -73,26 +82,33 @@ func (w *sessionWriter) WriteHeader(status int) {
 	w.ResponseWriter.WriteHeader(status)
 }
 
+func (w *sessionWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func (w *sessionWriter) Write(b []byte) (int, error) {
 	if w.status != 0 {
 		return w.ResponseWriter.Write(b)
 	}
 
+	_, span := w.tracer.Start(w.r.Context(), "sessionHandler.saveSession")
 	for _, sessionName := range w.rwSession {
 		session, ok := w.r.Context().Value(contextKey(sessionName)).(*sessions.Session)
 		if !ok {
 			panic("Failed to get session " + sessionName + " from context")
 		}
 		if err := session.Save(w.r, w.ResponseWriter); err != nil {
+			endSpan(span, err)
 			return writeFailedServerResponse(w.ResponseWriter, http.StatusInternalServerError, "Failed to save session "+session.Name()+": "+err.Error())
 		}
 	}
+	endSpan(span, nil)
 
 	return w.ResponseWriter.Write(b)
 }
 
 // handleSession returns a session middleware handler.
-func (s *server) handleSession(rwSessionNames []string, rSessionNames []string, next http.HandlerFunc) http.HandlerFunc {
+func (s *Server) handleSession(rwSessionNames []string, rSessionNames []string, next http.HandlerFunc) http.HandlerFunc {
 	h := &sessionHandler{
 		rwSessionNames: rwSessionNames,
 		rSessionNames:  rSessionNames,
@@ -105,22 +121,110 @@ func (s *server) handleSession(rwSessionNames []string, rSessionNames []string,
 }
 
 // handleAuthnSession returns a session middleware handler used by registration, authentication, and logout handlers.
-func (s *server) handleAuthnSession(next http.HandlerFunc) http.HandlerFunc {
+func (s *Server) handleAuthnSession(next http.HandlerFunc) http.HandlerFunc {
 	return s.handleSession([]string{sessionNameLoginSession}, []string{sessionNameLoginSession}, next)
 }
 
+// getSession returns session from sessionStore.  User session of login session is removed if it was
+// logged in before user's sessions are revoked, or if user or user's logged in credential is deleted.
+func (s *Server) getSession(r *http.Request, sessionName string) (*sessions.Session, error) {
+	session, err := s.sessionStore.Get(r, sessionName)
+	if err != nil || sessionName != sessionNameLoginSession {
+		return session, err
+	}
+	u, ok := session.Values[sessionMapKeyUserSession].(*userSession)
+	if !ok || (len(u.LoggedInCredentialID) == 0 && !u.Recovery) {
+		return session, nil
+	}
+	revoked, err := s.sessionsRevoked(r.Context(), u.User.UserID, u.LoggedInCredentialID, u.LoggedInAt)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		delete(session.Values, sessionMapKeyUserSession)
+	}
+	return session, nil
+}
+
+// revocationLookup is result of a GetSessionsRevokedAt query.
+type revocationLookup struct {
+	revokedAt time.Time
+	err       error
+}
+
+// revocationCache keeps revocation lookups of a request by user ID and credential ID, so middleware
+// handlers that read login session of the same request query data store once.
+type revocationCache map[string]revocationLookup
+
+// cacheRevocations returns a handler that stores revocationCache in request context.
+func cacheRevocations(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), contextKeyRevocationCache, make(revocationCache))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// getSessionsRevokedAt returns GetSessionsRevokedAt result from revocationCache of request context,
+// or queries data store and caches result.  Data store is queried every time if context doesn't
+// have revocationCache.
+func (s *Server) getSessionsRevokedAt(ctx context.Context, userID []byte, credentialID []byte) (time.Time, error) {
+	cache, ok := ctx.Value(contextKeyRevocationCache).(revocationCache)
+	if !ok {
+		return s.dataStore.GetSessionsRevokedAt(ctx, userID, credentialID)
+	}
+	key := base64.RawURLEncoding.EncodeToString(userID) + "." + base64.RawURLEncoding.EncodeToString(credentialID)
+	if l, ok := cache[key]; ok {
+		return l.revokedAt, l.err
+	}
+	revokedAt, err := s.dataStore.GetSessionsRevokedAt(ctx, userID, credentialID)
+	cache[key] = revocationLookup{revokedAt: revokedAt, err: err}
+	return revokedAt, err
+}
+
+// sessionsRevoked returns true if user's sessions are revoked after loggedInAt, or if user or user's credential
+// is deleted or disabled.  credentialID is empty if session isn't logged in with a credential.
+func (s *Server) sessionsRevoked(ctx context.Context, userID []byte, credentialID []byte, loggedInAt time.Time) (bool, error) {
+	revokedAt, err := s.getSessionsRevokedAt(ctx, userID, credentialID)
+	if err == ErrNoRecords {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return !revokedAt.IsZero() && !loggedInAt.After(revokedAt), nil
+}
+
 // loggedInUserOnly returns a handler that responds with a 401 unauthorized error if user is not logged in.
-func (s *server) loggedInUserOnly(next http.HandlerFunc) http.HandlerFunc {
+func (s *Server) loggedInUserOnly(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		loginSession, err := s.sessionStore.Get(r, sessionNameLoginSession)
+		loginSession, err := s.getSession(r, sessionNameLoginSession)
 		if err != nil {
 			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to retrieve session \""+sessionNameLoginSession+"\": "+err.Error())
 			return
 		}
-		if u, ok := loginSession.Values[sessionMapKeyUserSession].(*userSession); !ok || len(u.LoggedInCredentialID) == 0 {
+		u, ok := loginSession.Values[sessionMapKeyUserSession].(*userSession)
+		if !ok || len(u.LoggedInCredentialID) == 0 {
 			writeFailedServerResponse(w, http.StatusUnauthorized, "User is not logged in")
 			return
 		}
+		setRequestLogUserID(r.Context(), u.User.UserID)
 		next(w, r)
 	}
 }
+
+// adminOnly returns a handler that responds with a 403 forbidden error if logged in user is not an administrator.
+// Administrator's user ID is saved in request context for audit events.
+func (s *Server) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return s.loggedInUserOnly(func(w http.ResponseWriter, r *http.Request) {
+		loginSession, err := s.getSession(r, sessionNameLoginSession)
+		if err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to retrieve session \""+sessionNameLoginSession+"\": "+err.Error())
+			return
+		}
+		u, ok := loginSession.Values[sessionMapKeyUserSession].(*userSession)
+		if !ok || !s.isAdmin(u.User) {
+			writeFailedServerResponse(w, http.StatusForbidden, "User is not an administrator")
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), contextKeyAdminUserID, u.User.UserID)))
+	})
+}
@@ -0,0 +1,301 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	redistore "gopkg.in/boj/redistore.v1"
+)
+
+// Supported SESSION_STORE values.
+const (
+	sessionStoreRedis    = "redis"
+	sessionStoreMemory   = "memory"
+	sessionStoreCookie   = "cookie"
+	sessionStoreDatabase = "database"
+)
+
+// newSessionStore returns sessions.Store selected by config.  Database session store
+// keeps sessions in the same database as DataStore.
+func newSessionStore(c *Config, dataStore DataStore) (sessions.Store, error) {
+	switch c.SessionStore {
+	case sessionStoreRedis:
+		rediStore, err := redistore.NewRediStore(10, c.RedisNetwork, c.RedisAddr, c.RedisPwd, c.SessionKey)
+		if err != nil {
+			return nil, err
+		}
+		rediStore.Options = newSessionOptions(c.SessionMaxAge)
+		rediStore.SetMaxAge(c.SessionMaxAge)
+		return rediStore, nil
+	case sessionStoreMemory:
+		return newServerSessionStore(newMemSessionBackend(), c.SessionMaxAge, c.SessionKey), nil
+	case sessionStoreCookie:
+		// Cookie contains session data, so it is encrypted as well as authenticated.
+		encryptionKey := sha256.Sum256(append([]byte("webauthn-demo session encryption key:"), c.SessionKey...))
+		cookieStore := sessions.NewCookieStore(c.SessionKey, encryptionKey[:])
+		cookieStore.Options = newSessionOptions(c.SessionMaxAge)
+		cookieStore.MaxAge(c.SessionMaxAge)
+		return cookieStore, nil
+	case sessionStoreDatabase:
+		db, ok := dataStore.(*dbStore)
+		if !ok {
+			return nil, errors.New("database session store requires " + dbDriverPostgres + " or " + dbDriverSQLite + " data store")
+		}
+		return newServerSessionStore(&sqlSessionBackend{db: db.DB}, c.SessionMaxAge, c.SessionKey), nil
+	}
+	return nil, errors.New("unsupported session store \"" + c.SessionStore + "\"")
+}
+
+// newSessionOptions returns cookie options used by all session stores.  Session cookie is only sent
+// over https, isn't accessible to JavaScript, and isn't sent with cross-site subrequests.
+func newSessionOptions(maxAge int) *sessions.Options {
+	return &sessions.Options{
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// sessionBackend stores gob encoded session values by session ID.
+type sessionBackend interface {
+	// load returns session data, or ErrNoRecords if session doesn't exist or is expired.
+	load(ctx context.Context, id string) ([]byte, error)
+	save(ctx context.Context, id string, data []byte, expiresAt time.Time) error
+	delete(ctx context.Context, id string) error
+	// deleteExpired deletes expired sessions so that backend doesn't grow indefinitely.
+	deleteExpired(ctx context.Context) error
+}
+
+// sessionCleanupInterval is how often expired sessions are deleted from sessionBackend.
+const sessionCleanupInterval = time.Minute
+
+// serverSessionStore is a sessions.Store that keeps session data in sessionBackend and
+// only authenticated session ID in cookie.
+type serverSessionStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	backend sessionBackend
+}
+
+func newServerSessionStore(backend sessionBackend, maxAge int, keyPairs ...[]byte) *serverSessionStore {
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	for _, c := range codecs {
+		if sc, ok := c.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(maxAge)
+		}
+	}
+	return &serverSessionStore{
+		Codecs:  codecs,
+		Options: newSessionOptions(maxAge),
+		backend: backend,
+	}
+}
+
+// startCleanup deletes expired sessions from backend every interval until returned stop function is called.
+func (s *serverSessionStore) startCleanup(interval time.Duration, logger *slog.Logger) (stop func() error) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.backend.deleteExpired(context.Background()); err != nil {
+					logger.Error("failed to delete expired sessions", "error", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() error {
+		close(done)
+		<-stopped
+		return nil
+	}
+}
+
+// Get returns session from request registry, or creates a new session.
+func (s *serverSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns session with values loaded from backend.  Invalid cookies and expired sessions
+// result in a new session, so users can start over without clearing cookies.
+func (s *serverSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var id string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &id, s.Codecs...); err != nil {
+		return session, nil
+	}
+	data, err := s.backend.load(r.Context(), id)
+	if err == ErrNoRecords {
+		return session, nil
+	} else if err != nil {
+		return session, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&session.Values); err != nil {
+		return session, errors.New("failed to gob decode session data: " + err.Error())
+	}
+	session.ID = id
+	session.IsNew = false
+	return session, nil
+}
+
+// Save saves session values in backend and writes session ID cookie.  Session is deleted if MaxAge < 0.
+func (s *serverSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.backend.delete(r.Context(), session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return errors.New("failed to generate session ID: " + err.Error())
+		}
+		session.ID = base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(session.Values); err != nil {
+		return errors.New("failed to gob encode session data: " + err.Error())
+	}
+	expiresAt := time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second)
+	if err := s.backend.save(r.Context(), session.ID, buf.Bytes(), expiresAt); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// memSessionBackend is a concurrency-safe in-memory sessionBackend.  Expired sessions are
+// removed when they are loaded and by deleteExpired.
+type memSessionBackend struct {
+	mu       sync.Mutex
+	sessions map[string]memSession
+}
+
+type memSession struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+func newMemSessionBackend() *memSessionBackend {
+	return &memSessionBackend{sessions: make(map[string]memSession)}
+}
+
+func (m *memSessionBackend) load(ctx context.Context, id string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrNoRecords
+	}
+	if !time.Now().Before(s.expiresAt) {
+		delete(m.sessions, id)
+		return nil, ErrNoRecords
+	}
+	return s.data, nil
+}
+
+func (m *memSessionBackend) save(ctx context.Context, id string, data []byte, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[id] = memSession{data: data, expiresAt: expiresAt}
+	return nil
+}
+
+func (m *memSessionBackend) delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *memSessionBackend) deleteExpired(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for id, s := range m.sessions {
+		if !now.Before(s.expiresAt) {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+// sqlSessionBackend is a sessionBackend using sessions table in PostgreSQL or SQLite.
+// Timestamps are stored in UTC so that SQLite can compare them.
+type sqlSessionBackend struct {
+	db *sql.DB
+}
+
+func (b *sqlSessionBackend) load(ctx context.Context, id string) ([]byte, error) {
+	var data []byte
+	query := "SELECT data FROM sessions WHERE id = $1 AND expires_at > $2"
+	row := b.db.QueryRowContext(ctx, query, id, time.Now().UTC())
+	if err := row.Scan(&data); err == sql.ErrNoRows {
+		return nil, ErrNoRecords
+	} else if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (b *sqlSessionBackend) save(ctx context.Context, id string, data []byte, expiresAt time.Time) error {
+	query := "INSERT INTO sessions (id, data, expires_at) VALUES ($1, $2, $3) ON CONFLICT (id) DO UPDATE SET data = excluded.data, expires_at = excluded.expires_at"
+	_, err := b.db.ExecContext(ctx, query, id, data, expiresAt.UTC())
+	return err
+}
+
+func (b *sqlSessionBackend) delete(ctx context.Context, id string) error {
+	_, err := b.db.ExecContext(ctx, "DELETE FROM sessions WHERE id = $1", id)
+	return err
+}
+
+func (b *sqlSessionBackend) deleteExpired(ctx context.Context) error {
+	_, err := b.db.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at <= $1", time.Now().UTC())
+	return err
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// saveAndReload saves session values with store and returns session read from a new request with saved cookie.
+func saveAndReload(t *testing.T, store sessions.Store, values map[interface{}]interface{}) *sessions.Session {
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := store.Get(r, sessionNameLoginSession)
+	if err != nil {
+		t.Fatalf("Get() returns error %q", err)
+	}
+	if !session.IsNew {
+		t.Errorf("Get() without cookie returns session that isn't new")
+	}
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	w := httptest.NewRecorder()
+	if err := session.Save(r, w); err != nil {
+		t.Fatalf("Save() returns error %q", err)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	session, err = store.Get(r, sessionNameLoginSession)
+	if err != nil {
+		t.Fatalf("Get() returns error %q", err)
+	}
+	return session
+}
+
+func TestSessionStore(t *testing.T) {
+	sqliteStore, err := newSQLiteStore(filepath.Join(t.TempDir(), "webauthn.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqliteStore.Close()
+
+	testCases := []struct {
+		name      string
+		config    *Config
+		dataStore DataStore
+	}{
+		{"memory", &Config{SessionStore: sessionStoreMemory, SessionKey: []byte("session_key"), SessionMaxAge: 60}, nil},
+		{"cookie", &Config{SessionStore: sessionStoreCookie, SessionKey: []byte("session_key"), SessionMaxAge: 60}, nil},
+		{"database", &Config{SessionStore: sessionStoreDatabase, SessionKey: []byte("session_key"), SessionMaxAge: 60}, sqliteStore},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store, err := newSessionStore(tc.config, tc.dataStore)
+			if err != nil {
+				t.Fatalf("newSessionStore() returns error %q", err)
+			}
+			session := saveAndReload(t, store, map[interface{}]interface{}{"name": "johndoe@example.com"})
+			if session.IsNew {
+				t.Errorf("Get() with saved cookie returns new session")
+			}
+			if name, _ := session.Values["name"].(string); name != "johndoe@example.com" {
+				t.Errorf("Get() with saved cookie returns session values %v, want name \"johndoe@example.com\"", session.Values)
+			}
+			if session.Options.MaxAge != 60 {
+				t.Errorf("session max age is %d, want 60", session.Options.MaxAge)
+			}
+			if !session.Options.Secure || !session.Options.HttpOnly || session.Options.SameSite != http.SameSiteLaxMode {
+				t.Errorf("session options are %+v, want Secure, HttpOnly, and SameSite Lax", session.Options)
+			}
+		})
+	}
+}
+
+func TestSessionStoreError(t *testing.T) {
+	c := &Config{SessionStore: sessionStoreDatabase, SessionKey: []byte("session_key"), SessionMaxAge: 60}
+	wantErrorMsg := "database session store requires postgres or sqlite data store"
+	if _, err := newSessionStore(c, newMemStore()); err == nil || err.Error() != wantErrorMsg {
+		t.Errorf("newSessionStore() returns error %v, want %q", err, wantErrorMsg)
+	}
+}
+
+func TestServerSessionStoreExpiredSession(t *testing.T) {
+	backend := newMemSessionBackend()
+	store := newServerSessionStore(backend, 60, []byte("session_key"))
+
+	session := saveAndReload(t, store, map[interface{}]interface{}{"name": "johndoe@example.com"})
+	if session.IsNew {
+		t.Fatalf("Get() with saved cookie returns new session")
+	}
+
+	// Expire session in backend.
+	data, err := backend.load(context.Background(), session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.save(context.Background(), session.ID, data, time.Now().Add(-time.Second))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	encoded, _ := store.Codecs[0].Encode(sessionNameLoginSession, session.ID)
+	r.AddCookie(&http.Cookie{Name: sessionNameLoginSession, Value: encoded})
+	session, err = store.Get(r, sessionNameLoginSession)
+	if err != nil {
+		t.Fatalf("Get() returns error %q", err)
+	}
+	if !session.IsNew || len(session.Values) != 0 {
+		t.Errorf("Get() with expired session returns %+v, want new session", session)
+	}
+}
+
+func TestServerSessionStoreInvalidCookie(t *testing.T) {
+	store := newServerSessionStore(newMemSessionBackend(), 60, []byte("session_key"))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionNameLoginSession, Value: "tampered"})
+	session, err := store.Get(r, sessionNameLoginSession)
+	if err != nil {
+		t.Fatalf("Get() returns error %q", err)
+	}
+	if !session.IsNew {
+		t.Errorf("Get() with invalid cookie returns session that isn't new")
+	}
+}
+
+func TestServerSessionStoreDeleteSession(t *testing.T) {
+	backend := newMemSessionBackend()
+	store := newServerSessionStore(backend, 60, []byte("session_key"))
+
+	session := saveAndReload(t, store, map[interface{}]interface{}{"name": "johndoe@example.com"})
+	session.Options.MaxAge = -1
+	if err := store.Save(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save() returns error %q", err)
+	}
+	if _, err := backend.load(context.Background(), session.ID); err != ErrNoRecords {
+		t.Errorf("load() deleted session returns error %v, want %q", err, ErrNoRecords)
+	}
+}
+
+func TestSessionBackendDeleteExpired(t *testing.T) {
+	sqliteStore, err := newSQLiteStore(filepath.Join(t.TempDir(), "webauthn.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqliteStore.Close()
+
+	memBackend := newMemSessionBackend()
+	testCases := []struct {
+		name    string
+		backend sessionBackend
+		count   func() int
+	}{
+		{"memory", memBackend, func() int { return len(memBackend.sessions) }},
+		{"database", &sqlSessionBackend{db: sqliteStore.DB}, func() int {
+			var count int
+			if err := sqliteStore.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&count); err != nil {
+				t.Fatal(err)
+			}
+			return count
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if err := tc.backend.save(ctx, "expired", []byte("data"), time.Now().Add(-time.Second)); err != nil {
+				t.Fatalf("save() returns error %q", err)
+			}
+			if err := tc.backend.save(ctx, "valid", []byte("data"), time.Now().Add(time.Minute)); err != nil {
+				t.Fatalf("save() returns error %q", err)
+			}
+			// Saving a session doesn't delete expired sessions.
+			if count := tc.count(); count != 2 {
+				t.Errorf("backend has %d sessions after save(), want 2", count)
+			}
+			if err := tc.backend.deleteExpired(ctx); err != nil {
+				t.Fatalf("deleteExpired() returns error %q", err)
+			}
+			if count := tc.count(); count != 1 {
+				t.Errorf("backend has %d sessions after deleteExpired(), want 1", count)
+			}
+			if _, err := tc.backend.load(ctx, "valid"); err != nil {
+				t.Errorf("load() valid session returns error %q", err)
+			}
+		})
+	}
+}
+
+func TestServerSessionStoreCleanup(t *testing.T) {
+	backend := newMemSessionBackend()
+	store := newServerSessionStore(backend, 60, []byte("session_key"))
+	backend.save(context.Background(), "expired", []byte("data"), time.Now().Add(-time.Second))
+
+	stop := store.startCleanup(10*time.Millisecond, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		backend.mu.Lock()
+		count := len(backend.sessions)
+		backend.mu.Unlock()
+		if count == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expired session isn't deleted by cleanup job")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
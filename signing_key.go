@@ -0,0 +1,243 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+)
+
+// signingKey is a private key used to sign tokens.  kid is the JWK thumbprint (RFC 7638) of public key.
+type signingKey struct {
+	kid    string
+	alg    string
+	signer crypto.Signer
+}
+
+func newSigningKey(signer crypto.Signer) (*signingKey, error) {
+	k := &signingKey{signer: signer}
+	switch pub := signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			k.alg = "ES256"
+		case elliptic.P384():
+			k.alg = "ES384"
+		default:
+			return nil, errors.New("signing key has unsupported elliptic curve " + pub.Curve.Params().Name)
+		}
+	case ed25519.PublicKey:
+		k.alg = "EdDSA"
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, errors.New("signing key has RSA key size less than 2048 bits")
+		}
+		k.alg = "RS256"
+	default:
+		return nil, errors.New("signing key has unsupported key type")
+	}
+
+	// JWK thumbprint is SHA-256 hash of required JWK members in lexicographic order.
+	jwk := k.jwk()
+	var thumbprintInput string
+	switch jwk.Kty {
+	case "EC":
+		thumbprintInput = `{"crv":"` + jwk.Crv + `","kty":"EC","x":"` + jwk.X + `","y":"` + jwk.Y + `"}`
+	case "OKP":
+		thumbprintInput = `{"crv":"` + jwk.Crv + `","kty":"OKP","x":"` + jwk.X + `"}`
+	default:
+		thumbprintInput = `{"e":"` + jwk.E + `","kty":"RSA","n":"` + jwk.N + `"}`
+	}
+	thumbprint := sha256.Sum256([]byte(thumbprintInput))
+	k.kid = base64.RawURLEncoding.EncodeToString(thumbprint[:])
+	return k, nil
+}
+
+// jsonWebKey is a public key in JWK format.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+func (k *signingKey) jwk() jsonWebKey {
+	jwk := jsonWebKey{Kid: k.kid, Use: "sig", Alg: k.alg}
+	switch pub := k.signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	}
+	return jwk
+}
+
+// sign returns JWS signature of signing input.  ECDSA signature is r || s as required by JWS.
+func (k *signingKey) sign(signingInput []byte) ([]byte, error) {
+	if priv, ok := k.signer.(ed25519.PrivateKey); ok {
+		return ed25519.Sign(priv, signingInput), nil
+	}
+
+	hash := crypto.SHA256
+	if k.alg == "ES384" {
+		hash = crypto.SHA384
+	}
+	h := hash.New()
+	h.Write(signingInput)
+	digest := h.Sum(nil)
+
+	if priv, ok := k.signer.(*ecdsa.PrivateKey); ok {
+		r, s, err := ecdsa.Sign(rand.Reader, priv, digest)
+		if err != nil {
+			return nil, err
+		}
+		size := (priv.Curve.Params().BitSize + 7) / 8
+		signature := make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+		return signature, nil
+	}
+	return k.signer.Sign(rand.Reader, digest, hash)
+}
+
+// signingKeySet has keys used to sign and verify tokens.  The first key signs new tokens.  Other keys
+// only verify tokens and are published in JWKS, so a new key can be rotated in without invalidating
+// issued tokens.
+type signingKeySet struct {
+	keys []*signingKey
+}
+
+// loadSigningKeySet returns signingKeySet with PEM encoded private keys in file, in file order.
+// Supported PEM blocks are "PRIVATE KEY" (PKCS #8, including Ed25519), "EC PRIVATE KEY", and "RSA PRIVATE KEY".
+func loadSigningKeySet(path string) (*signingKeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("failed to read signing key file: " + err.Error())
+	}
+	ks := &signingKeySet{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var key interface{}
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, errors.New("failed to parse signing key: " + err.Error())
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("signing key has unsupported key type")
+		}
+		k, err := newSigningKey(signer)
+		if err != nil {
+			return nil, err
+		}
+		ks.keys = append(ks.keys, k)
+	}
+	if len(ks.keys) == 0 {
+		return nil, errors.New("signing key file " + path + " doesn't have private keys")
+	}
+	return ks, nil
+}
+
+// newEphemeralSigningKeySet returns signingKeySet with a new P-256 key.  Tokens signed with
+// ephemeral key can't be verified after server restarts.
+func newEphemeralSigningKeySet() (*signingKeySet, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	k, err := newSigningKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	return &signingKeySet{keys: []*signingKey{k}}, nil
+}
+
+// current returns key used to sign new tokens.
+func (ks *signingKeySet) current() *signingKey {
+	return ks.keys[0]
+}
+
+// verify parses JWS and verifies its signature with key identified by kid header.
+func (ks *signingKeySet) verify(token string) (*jws, error) {
+	t, err := parseJWS(token)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range ks.keys {
+		if k.kid == t.header.Kid {
+			if t.header.Alg != k.alg {
+				return nil, errors.New("jws: alg " + t.header.Alg + " doesn't match signing key")
+			}
+			if err := t.verify(k.signer.Public()); err != nil {
+				return nil, err
+			}
+			return t, nil
+		}
+	}
+	return nil, errors.New("jws: unknown kid \"" + t.header.Kid + "\"")
+}
+
+// algs returns signing algorithms of keys in set.
+func (ks *signingKeySet) algs() []string {
+	var algs []string
+	seen := make(map[string]bool)
+	for _, k := range ks.keys {
+		if !seen[k.alg] {
+			seen[k.alg] = true
+			algs = append(algs, k.alg)
+		}
+	}
+	return algs
+}
+
+// jwksJSON returns public keys in JWK Set format.
+func (ks *signingKeySet) jwksJSON() ([]byte, error) {
+	jwks := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	for _, k := range ks.keys {
+		jwks.Keys = append(jwks.Keys, k.jwk())
+	}
+	return json.Marshal(jwks)
+}
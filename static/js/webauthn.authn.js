@@ -23,11 +23,22 @@ $('#login').submit(function(event) {
         .then((credential) => {
             return sendAssertionResult(credential)
         }).then(() => {
-            window.location.href = "/"
+            window.location.href = nextURL()
         })
         .catch((error) => alert(error))
 })
 
+// nextURL returns page that requested login, such as OpenID Connect authorization request or
+// forward auth sign-in.  Only these relative URLs are followed to prevent open redirects; forward
+// auth sign-in verifies return URL on server.
+function nextURL() {
+    const next = new URLSearchParams(window.location.search).get('next');
+    if (next !== null && (next.startsWith('authorize?') || next.startsWith('auth/signin?'))) {
+        return next;
+    }
+    return "/";
+}
+
 async function getAssertionOptions(optionsRequest) {
     const response = await fetch('/assertion/options', {
         method: 'POST',
@@ -58,7 +69,7 @@ async function sendAssertionResult(credential) {
     credentialResponse['authenticatorData'] = base64url.encode(credential.response.authenticatorData)
     credentialResponse['clientDataJSON'] = base64url.encode(credential.response.clientDataJSON)
     credentialResponse['signature'] = base64url.encode(credential.response.signature)
-    credentialResponse['userHandle'] = credential.response.userHandle
+    credentialResponse['userHandle'] = credential.response.userHandle ? base64url.encode(credential.response.userHandle) : ""
     let resultRequest = {}
     resultRequest['id'] = credential.id
     resultRequest['rawId'] = base64url.encode(credential.rawId)
@@ -0,0 +1,56 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+'use strict';
+
+// Recovery logs in with recovery code, then registers a new credential with restricted recovery session.
+$('#recover').submit(function(event) {
+    event.preventDefault();
+
+    if (this.checkValidity() === false) {
+        this.classList.add('was-validated');
+        return
+    }
+
+    const username = this.username.value
+
+    sendRecoveryLogin(username, this.recoveryCode.value)
+        .then((recoveryResponse) => {
+            return getAttestationOptions({
+                "username": username,
+                "displayName": recoveryResponse.displayName,
+                "authenticatorSelection": {
+                    "userVerification": "preferred",
+                },
+                "attestation": "none",
+            })
+        })
+        .then((options) => {
+            return navigator.credentials.create({"publicKey": options})
+        })
+        .then((credential) => {
+            return sendAttestationResult(credential)
+        })
+        .then(() => {
+            window.location.href = "/"
+        })
+        .catch((error) => alert(error))
+})
+
+async function sendRecoveryLogin(username, recoveryCode) {
+    const response = await fetch('/recovery/login', {
+        method: 'POST',
+        credentials: 'include',
+        headers: {
+            'Content-Type': 'application/json'
+        },
+        body: JSON.stringify({"username": username, "recoveryCode": recoveryCode})
+    });
+    if (response.headers.get('Content-Type') !== 'application/json') {
+        throw new TypeError("/recovery/login response header has unexpected Content-Type: " + response.headers.get('Content-Type'));
+    }
+    const recoveryResponse = await response.json();
+    if (recoveryResponse.status !== 'ok')
+        throw new Error(`${recoveryResponse.errorMessage}`);
+    return recoveryResponse;
+}
@@ -30,12 +30,20 @@ $('#register').submit(function(event) {
         .then((credential) => {
             return sendAttestationResult(credential)
         })
-        .then(() => {
+        .then((resultResponse) => {
+            showRecoveryCodes(resultResponse.recoveryCodes)
             window.location.href = "/"
         })
         .catch((error) => alert(error))        
 })
 
+// showRecoveryCodes shows recovery codes generated at first registration.  Codes are shown only once.
+function showRecoveryCodes(recoveryCodes) {
+    if (typeof recoveryCodes !== "undefined") {
+        alert("Save these recovery codes in a safe place.  Each code can be used once to sign in and register a new security key if you lose your security keys.\n\n" + recoveryCodes.join("\n"))
+    }
+}
+
 async function getAttestationOptions(optionsRequest) {
     const response = await fetch('/attestation/options', {
         method: 'POST',
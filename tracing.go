@@ -0,0 +1,194 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/fxamacker/webauthn"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Supported tracing exporters.
+const (
+	tracingExporterOTLP   = "otlp"
+	tracingExporterStdout = "stdout"
+)
+
+const (
+	tracerName                = "github.com/fxamacker/webauthn-demo"
+	defaultTracingServiceName = "webauthn-demo"
+)
+
+// Span attribute keys.
+const (
+	attrRPID             = attribute.Key("webauthn.rp_id")
+	attrCredentialIDHash = attribute.Key("webauthn.credential_id_hash")
+	attrOutcome          = attribute.Key("webauthn.outcome")
+)
+
+// tracingConfig has settings of OpenTelemetry tracing.
+type tracingConfig struct {
+	Exporter    string // "otlp" to send spans with OTLP over HTTP, or "stdout" to write spans to stdout.
+	Endpoint    string // OTLP endpoint host and port, such as "localhost:4318".  Defaults to OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4318.
+	Insecure    bool   // Send spans to OTLP endpoint without TLS.
+	ServiceName string // Service name of spans, defaults to "webauthn-demo".
+}
+
+func (c *tracingConfig) valid() error {
+	switch c.Exporter {
+	case tracingExporterOTLP, tracingExporterStdout:
+		return nil
+	}
+	return errors.New("tracing exporter \"" + c.Exporter + "\" is not supported")
+}
+
+// newTracerProvider returns tracer provider exporting spans with exporter selected by config.
+func newTracerProvider(c *tracingConfig) (*sdktrace.TracerProvider, error) {
+	if err := c.valid(); err != nil {
+		return nil, err
+	}
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch c.Exporter {
+	case tracingExporterOTLP:
+		var opts []otlptracehttp.Option
+		if c.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case tracingExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	}
+	if err != nil {
+		return nil, err
+	}
+	serviceName := c.ServiceName
+	if serviceName == "" {
+		serviceName = defaultTracingServiceName
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	), nil
+}
+
+// credentialIDHash returns truncated SHA-256 hash of credential ID, so spans can be correlated by
+// credential without exporting credential IDs.
+func credentialIDHash(credentialID []byte) string {
+	h := sha256.Sum256(credentialID)
+	return base64.RawURLEncoding.EncodeToString(h[:12])
+}
+
+// startSpan starts span with relying party ID attribute.
+func (s *Server) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, name, trace.WithAttributes(append(attrs, attrRPID.String(s.webAuthnConfig.RPID))...))
+}
+
+// endSpan ends span with outcome of err.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetAttributes(attrOutcome.String(auditOutcomeFailure))
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetAttributes(attrOutcome.String(auditOutcomeSuccess))
+	}
+	span.End()
+}
+
+// traceRequests returns a handler that starts a server span for every request.  Span continues
+// trace of W3C traceparent header in request.  Span name is set to route by recordRoute.
+func (s *Server) traceRequests(next http.Handler) http.Handler {
+	propagator := propagation.TraceContext{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := s.tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("client.address", clientIP(r)),
+		))
+		defer span.End()
+
+		tw := &traceWriter{ResponseWriter: w}
+		next.ServeHTTP(tw, r.WithContext(ctx))
+
+		status := tw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// traceWriter hijacks ResponseWriter to get response status code for server span.
+type traceWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *traceWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *traceWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// parseAttestation calls webauthn.ParseAttestation in a span.
+func (s *Server) parseAttestation(ctx context.Context, r io.Reader) (*webauthn.PublicKeyCredentialAttestation, error) {
+	_, span := s.startSpan(ctx, "webauthn.ParseAttestation")
+	credentialAttestation, err := webauthn.ParseAttestation(r)
+	if err == nil {
+		span.SetAttributes(attrCredentialIDHash.String(credentialIDHash(credentialAttestation.RawID)))
+	}
+	endSpan(span, err)
+	return credentialAttestation, err
+}
+
+// verifyAttestation calls webauthn.VerifyAttestation in a span.
+func (s *Server) verifyAttestation(ctx context.Context, credentialAttestation *webauthn.PublicKeyCredentialAttestation, expected *webauthn.AttestationExpectedData) (webauthn.AttestationType, interface{}, error) {
+	_, span := s.startSpan(ctx, "webauthn.VerifyAttestation", attrCredentialIDHash.String(credentialIDHash(credentialAttestation.RawID)))
+	attType, trustPath, err := webauthn.VerifyAttestation(credentialAttestation, expected)
+	endSpan(span, err)
+	return attType, trustPath, err
+}
+
+// parseAssertion calls webauthn.ParseAssertion in a span.
+func (s *Server) parseAssertion(ctx context.Context, r io.Reader) (*webauthn.PublicKeyCredentialAssertion, error) {
+	_, span := s.startSpan(ctx, "webauthn.ParseAssertion")
+	credentialAssertion, err := webauthn.ParseAssertion(r)
+	if err == nil {
+		span.SetAttributes(attrCredentialIDHash.String(credentialIDHash(credentialAssertion.RawID)))
+	}
+	endSpan(span, err)
+	return credentialAssertion, err
+}
+
+// verifyAssertion calls webauthn.VerifyAssertion in a span.
+func (s *Server) verifyAssertion(ctx context.Context, credentialAssertion *webauthn.PublicKeyCredentialAssertion, expected *webauthn.AssertionExpectedData) error {
+	_, span := s.startSpan(ctx, "webauthn.VerifyAssertion", attrCredentialIDHash.String(credentialIDHash(credentialAssertion.RawID)))
+	err := webauthn.VerifyAssertion(credentialAssertion, expected)
+	endSpan(span, err)
+	return err
+}
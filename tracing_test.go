@@ -0,0 +1,145 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/webauthn"
+	"github.com/fxamacker/webauthn-demo/virtualauthenticator"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracingConfigError(t *testing.T) {
+	if _, err := newTracerProvider(&tracingConfig{Exporter: "jaeger"}); err == nil || err.Error() != `tracing exporter "jaeger" is not supported` {
+		t.Errorf("newTracerProvider() returns error %v, want error %q", err, `tracing exporter "jaeger" is not supported`)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	sqliteStore, err := newSQLiteStore(filepath.Join(t.TempDir(), "webauthn.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqliteStore.Close()
+	recorder := tracetest.NewSpanRecorder()
+	s, err := NewServer(
+		WithConfig(&Config{CounterPolicy: counterPolicyReject, AuditLog: auditLogMemory}),
+		WithWebAuthnConfig(getWebAuthnConfig()),
+		WithOrigin(e2eOrigin),
+		WithDataStore(sqliteStore),
+		WithSessionStore(getMemSessionStore()),
+		WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))),
+	)
+	if err != nil {
+		t.Fatalf("NewServer() returns error %q", err)
+	}
+	defer s.Close()
+	ts := httptest.NewTLSServer(s)
+	defer ts.Close()
+
+	a, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username := "johndoe@example.com"
+	c := newE2EClient(t, ts)
+	c.register(a, username, webauthn.ResidentKeyDiscouraged)
+	c.logout()
+	c.login(a, username)
+
+	// Server span continues trace of traceparent header.
+	const traceID, parentSpanID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req, err := http.NewRequest("GET", ts.URL+"/user", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentSpanID+"-01")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		t.Fatalf("GET /user returns error %q", err)
+	}
+	resp.Body.Close()
+
+	credentialIDHashValue := credentialIDHash(a.Credentials()[0].ID)
+	spans := make(map[string]sdktrace.ReadOnlySpan) // last ended span by name
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	testCases := []struct {
+		name      string
+		wantKind  trace.SpanKind
+		wantAttrs map[string]string
+	}{
+		{"POST /attestation/result", trace.SpanKindServer, map[string]string{"http.route": "/attestation/result"}},
+		{"sessionHandler.ServeHTTP", trace.SpanKindInternal, map[string]string{"webauthn.rp_id": "localhost", "webauthn.outcome": "success"}},
+		{"sessionHandler.saveSession", trace.SpanKindInternal, map[string]string{"webauthn.outcome": "success"}},
+		{"webauthn.ParseAttestation", trace.SpanKindInternal, map[string]string{"webauthn.rp_id": "localhost", "webauthn.credential_id_hash": credentialIDHashValue, "webauthn.outcome": "success"}},
+		{"webauthn.VerifyAttestation", trace.SpanKindInternal, map[string]string{"webauthn.credential_id_hash": credentialIDHashValue, "webauthn.outcome": "success"}},
+		{"webauthn.ParseAssertion", trace.SpanKindInternal, map[string]string{"webauthn.credential_id_hash": credentialIDHashValue, "webauthn.outcome": "success"}},
+		{"webauthn.VerifyAssertion", trace.SpanKindInternal, map[string]string{"webauthn.credential_id_hash": credentialIDHashValue, "webauthn.outcome": "success"}},
+		{"DataStore.AddUserCredential", trace.SpanKindClient, map[string]string{"webauthn.credential_id_hash": credentialIDHashValue, "webauthn.outcome": "success"}},
+		{"DataStore.GetCredential", trace.SpanKindClient, map[string]string{"webauthn.credential_id_hash": credentialIDHashValue, "webauthn.outcome": "success"}},
+	}
+	for _, tc := range testCases {
+		span, ok := spans[tc.name]
+		if !ok {
+			t.Errorf("span %q isn't recorded", tc.name)
+			continue
+		}
+		if span.SpanKind() != tc.wantKind {
+			t.Errorf("span %q has kind %s, want %s", tc.name, span.SpanKind(), tc.wantKind)
+		}
+		attrs := make(map[string]string)
+		for _, attr := range span.Attributes() {
+			attrs[string(attr.Key)] = attr.Value.Emit()
+		}
+		for k, v := range tc.wantAttrs {
+			if attrs[k] != v {
+				t.Errorf("span %q has attribute %s %q, want %q", tc.name, k, attrs[k], v)
+			}
+		}
+	}
+
+	// Data store call missing record has no_records outcome.
+	if _, err := s.dataStore.GetUser(t.Context(), "unknown@example.com"); err != ErrNoRecords {
+		t.Fatalf("GetUser() returns error %v, want %v", err, ErrNoRecords)
+	}
+	ended := recorder.Ended()
+	if span := ended[len(ended)-1]; span.Name() != "DataStore.GetUser" || !hasAttribute(span, "webauthn.outcome", "no_records") {
+		t.Errorf("GetUser() records span %q with attributes %v, want DataStore.GetUser with no_records outcome", span.Name(), span.Attributes())
+	}
+
+	userSpan, ok := spans["GET /user"]
+	if !ok {
+		t.Fatalf("span %q isn't recorded", "GET /user")
+	}
+	if id := userSpan.SpanContext().TraceID().String(); id != traceID {
+		t.Errorf("GET /user span has trace ID %s, want %s", id, traceID)
+	}
+	if id := userSpan.Parent().SpanID().String(); id != parentSpanID || !userSpan.Parent().IsRemote() {
+		t.Errorf("GET /user span has parent span ID %s, want remote parent %s", id, parentSpanID)
+	}
+	for _, span := range recorder.Ended() {
+		if strings.HasPrefix(span.Name(), "DataStore.") && span.Parent().IsValid() && span.SpanContext().TraceID().String() == traceID {
+			return // data store span of GET /user is in propagated trace
+		}
+	}
+	t.Errorf("GET /user doesn't record data store span in trace %s", traceID)
+}
+
+func hasAttribute(span sdktrace.ReadOnlySpan, key string, value string) bool {
+	for _, attr := range span.Attributes() {
+		if string(attr.Key) == key && attr.Value.Emit() == value {
+			return true
+		}
+	}
+	return false
+}
@@ -1,7 +1,7 @@
 // Copyright (c) 2019 Faye Amacker. All rights reserved.
 // Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
 
-package main
+package webauthndemo
 
 import (
 	"encoding/base64"
@@ -11,16 +11,24 @@ import (
 	"github.com/gorilla/sessions"
 )
 
-func (s *server) handleLogout(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	aw := s.startAudit(w, r, auditEventLogout)
+	defer aw.record()
+	w = aw
+
 	session, ok := r.Context().Value(contextKeyLoginSession).(*sessions.Session)
 	if !ok {
 		panic("Failed to get session data from context")
 	}
+	if uSession, ok := session.Values[sessionMapKeyUserSession].(*userSession); ok {
+		aw.event.UserID = uSession.User.UserID
+		aw.event.CredentialID = uSession.LoggedInCredentialID
+	}
 	delete(session.Values, sessionMapKeyUserSession)
 	writeOKServerResponse(w)
 }
 
-func (s *server) handleUser() http.HandlerFunc {
+func (s *Server) handleUser() http.HandlerFunc {
 	type response struct {
 		Status       string `json:"status"`
 		Name         string `json:"name"`
@@ -40,7 +48,7 @@ func (s *server) handleUser() http.HandlerFunc {
 			return
 		}
 
-		registeredAt, loggedInAt, err := s.dataStore.getCredentialTimestamp(r.Context(), uSession.User.UserID, uSession.LoggedInCredentialID)
+		registeredAt, loggedInAt, err := s.dataStore.GetCredentialTimestamp(r.Context(), uSession.User.UserID, uSession.LoggedInCredentialID)
 		if err != nil {
 			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to find credential: "+err.Error())
 			return
@@ -62,3 +70,61 @@ func (s *server) handleUser() http.HandlerFunc {
 		w.Write(b)
 	}
 }
+
+// maxActivityEvents is the number of recent audit events returned by activity handler.
+const maxActivityEvents = 50
+
+func (s *Server) handleActivity() http.HandlerFunc {
+	type activityResponse struct {
+		Type          string `json:"type"`
+		Outcome       string `json:"outcome"`
+		FailureReason string `json:"failureReason"`
+		CredentialID  string `json:"credentialID"`
+		ClientIP      string `json:"clientIP"`
+		UserAgent     string `json:"userAgent"`
+		Time          string `json:"time"`
+	}
+	type response struct {
+		Status string             `json:"status"`
+		Events []activityResponse `json:"events"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := r.Context().Value(contextKeyLoginSession).(*sessions.Session)
+		if !ok {
+			panic("Failed to get session data from context")
+		}
+		uSession, ok := session.Values[sessionMapKeyUserSession].(*userSession)
+		if !ok {
+			writeFailedServerResponse(w, http.StatusUnauthorized, "Session doesn't have user credential")
+			return
+		}
+
+		events, err := s.auditLog.getEvents(r.Context(), uSession.User.UserID, maxActivityEvents)
+		if err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "Failed to query activity: "+err.Error())
+			return
+		}
+		resp := response{
+			Status: statusOK,
+			Events: make([]activityResponse, len(events)),
+		}
+		for i, e := range events {
+			resp.Events[i] = activityResponse{
+				Type:          e.Type,
+				Outcome:       e.Outcome,
+				FailureReason: e.FailureReason,
+				CredentialID:  base64.RawURLEncoding.EncodeToString(e.CredentialID),
+				ClientIP:      e.ClientIP,
+				UserAgent:     e.UserAgent,
+				Time:          e.CreatedAt.Format("02 Jan 06 15:04 MST"),
+			}
+		}
+		b, err := json.Marshal(resp)
+		if err != nil {
+			writeFailedServerResponse(w, http.StatusInternalServerError, "failed to json marshal response body")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net/http"
+
+	"github.com/fxamacker/webauthn"
+)
+
+// assertionFailureMessage is the error message of all assertion failures that depend on whether
+// username or credential is registered, when username enumeration protection is enabled.
+const assertionFailureMessage = "Failed to verify assertion"
+
+// weightedValue is a value of a discrete distribution with weight.
+type weightedValue struct {
+	value  int
+	weight int
+}
+
+// fakeCredentialCounts is distribution of number of credentials per user.  Most users register one
+// authenticator, some register a backup authenticator.
+var fakeCredentialCounts = []weightedValue{
+	{value: 1, weight: 60},
+	{value: 2, weight: 30},
+	{value: 3, weight: 10},
+}
+
+// fakeCredentialIDLengths is distribution of credential ID lengths of common authenticators.
+// Platform authenticators use 16 to 32-byte credential IDs, security keys and FIDO U2F key
+// handles are usually 64 or 96 bytes.
+var fakeCredentialIDLengths = []weightedValue{
+	{value: 16, weight: 10},
+	{value: 20, weight: 15},
+	{value: 32, weight: 35},
+	{value: 64, weight: 30},
+	{value: 96, weight: 10},
+}
+
+// pick returns value of distribution selected by r.
+func pick(distribution []weightedValue, r uint32) int {
+	total := 0
+	for _, v := range distribution {
+		total += v.weight
+	}
+	n := int(r % uint32(total))
+	for _, v := range distribution {
+		if n < v.weight {
+			return v.value
+		}
+		n -= v.weight
+	}
+	return distribution[len(distribution)-1].value
+}
+
+// fakeUsers creates deterministic fake users for unknown usernames, so login options of unknown
+// usernames can't be told apart from login options of registered users.
+type fakeUsers struct {
+	key []byte
+}
+
+// newFakeUsers returns fakeUsers with key derived from session key, so fake users don't change when
+// server restarts.  A random key is used if session key is empty.
+func newFakeUsers(sessionKey []byte) (*fakeUsers, error) {
+	if len(sessionKey) == 0 {
+		key := make([]byte, sha256.Size)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		return &fakeUsers{key: key}, nil
+	}
+	h := hmac.New(sha256.New, sessionKey)
+	h.Write([]byte("webauthn-demo fake users"))
+	return &fakeUsers{key: h.Sum(nil)}, nil
+}
+
+func (f *fakeUsers) mac(label string, i byte, block byte, username string) []byte {
+	h := hmac.New(sha256.New, f.key)
+	h.Write([]byte(label))
+	h.Write([]byte{i, block})
+	h.Write([]byte(username))
+	return h.Sum(nil)
+}
+
+// derive returns n bytes derived from label, i, and username.
+func (f *fakeUsers) derive(label string, i byte, username string, n int) []byte {
+	var b []byte
+	for block := byte(0); len(b) < n; block++ {
+		b = append(b, f.mac(label, i, block, username)...)
+	}
+	return b[:n]
+}
+
+// get returns fake user with 64-byte user ID and credential IDs derived from username.  Number of
+// credentials and credential ID lengths follow fakeCredentialCounts and fakeCredentialIDLengths.
+// Fake user isn't in data store, so its credentials can't be found when assertion is verified.
+func (f *fakeUsers) get(username string) *User {
+	u := &User{
+		UserID:   f.derive("user id", 0, username, 64),
+		UserName: username,
+	}
+	credentialCount := pick(fakeCredentialCounts, binary.BigEndian.Uint32(f.derive("credential count", 0, username, 4)))
+	for i := 0; i < credentialCount; i++ {
+		length := pick(fakeCredentialIDLengths, binary.BigEndian.Uint32(f.derive("credential id length", byte(i), username, 4)))
+		u.CredentialIDs = append(u.CredentialIDs, f.derive("credential id", byte(i), username, length))
+	}
+	return u
+}
+
+// writeAssertionFailure writes failed assertion response.  If username enumeration protection is
+// enabled, response has the same status code and error message whether username or credential is
+// registered, disabled, or signed by another authenticator.  Detailed error message is kept in
+// audit log and request log.
+func (s *Server) writeAssertionFailure(w http.ResponseWriter, httpStatusCode int, errMsg string) {
+	if s.fakeUsers == nil {
+		writeFailedServerResponse(w, httpStatusCode, errMsg)
+		return
+	}
+	writeFailedServerResponse(w, http.StatusBadRequest, assertionFailureMessage)
+	setFailureReason(w, errMsg)
+}
+
+// allowedCredential returns true if credentialID is in allowCredentials.
+func allowedCredential(allowCredentials []webauthn.PublicKeyCredentialDescriptor, credentialID []byte) bool {
+	for _, desc := range allowCredentials {
+		if bytes.Equal(desc.ID, credentialID) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/fxamacker/webauthn"
+	"github.com/fxamacker/webauthn-demo/virtualauthenticator"
+)
+
+func TestFakeUsers(t *testing.T) {
+	f1, err := newFakeUsers([]byte("session key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := newFakeUsers([]byte("session key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f3, err := newFakeUsers([]byte("other session key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := f1.get("johndoe@example.com")
+	if len(u.UserID) != 64 {
+		t.Errorf("fake user ID has %d bytes, want 64", len(u.UserID))
+	}
+	if u2 := f2.get("johndoe@example.com"); !reflect.DeepEqual(u, u2) {
+		t.Errorf("fake users with the same session key return %+v and %+v, want the same user", u, u2)
+	}
+	if u2 := f1.get("janedoe@example.com"); reflect.DeepEqual(u.CredentialIDs, u2.CredentialIDs) {
+		t.Errorf("fake users of different usernames have the same credential IDs %v", u.CredentialIDs)
+	}
+	if u2 := f3.get("johndoe@example.com"); reflect.DeepEqual(u.CredentialIDs, u2.CredentialIDs) {
+		t.Errorf("fake users with different session keys have the same credential IDs %v", u.CredentialIDs)
+	}
+
+	// Credential counts and credential ID lengths of fake users follow their distributions.
+	const userCount = 10000
+	counts, lengths := make(map[int]int), make(map[int]int)
+	for i := 0; i < userCount; i++ {
+		u := f1.get(fmt.Sprintf("user%d@example.com", i))
+		counts[len(u.CredentialIDs)]++
+		for _, id := range u.CredentialIDs {
+			lengths[len(id)]++
+		}
+	}
+	testDistribution(t, "credential count", counts, fakeCredentialCounts)
+	testDistribution(t, "credential ID length", lengths, fakeCredentialIDLengths)
+}
+
+// testDistribution checks that observed frequency of each value is within 20% of its expected frequency.
+func testDistribution(t *testing.T, name string, observed map[int]int, distribution []weightedValue) {
+	total, totalWeight := 0, 0
+	for _, n := range observed {
+		total += n
+	}
+	for _, v := range distribution {
+		totalWeight += v.weight
+	}
+	for _, v := range distribution {
+		want := float64(total) * float64(v.weight) / float64(totalWeight)
+		if got := float64(observed[v.value]); math.Abs(got-want) > want*0.2 {
+			t.Errorf("fake users have %s %d %d times, want about %.0f times", name, v.value, observed[v.value], want)
+		}
+		delete(observed, v.value)
+	}
+	if len(observed) > 0 {
+		t.Errorf("fake users have unexpected %s %v", name, observed)
+	}
+}
+
+func TestFakeLoginOptions(t *testing.T) {
+	s, ts := newE2EServer(t)
+	defer s.Close()
+	defer ts.Close()
+	var err error
+	if s.fakeUsers, err = newFakeUsers([]byte("session key")); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const knownUser, unknownUser = "johndoe@example.com", "janedoe@example.com"
+	c := newE2EClient(t, ts)
+	c.register(a, knownUser, webauthn.ResidentKeyDiscouraged)
+	c.logout()
+
+	getOptions := func(username string) (int, []byte) {
+		var raw json.RawMessage
+		statusCode := newE2EClient(t, ts).do("POST", "/assertion/options", map[string]string{"username": username}, &raw)
+		return statusCode, raw
+	}
+
+	// Known and unknown usernames get responses of the same status and keys.
+	knownStatusCode, knownOptions := getOptions(knownUser)
+	unknownStatusCode, unknownOptions := getOptions(unknownUser)
+	if knownStatusCode != http.StatusOK || unknownStatusCode != http.StatusOK {
+		t.Fatalf("POST /assertion/options returns status code %d for known user and %d for unknown user, want %d", knownStatusCode, unknownStatusCode, http.StatusOK)
+	}
+	knownKeys, unknownKeys := jsonKeys(t, knownOptions), jsonKeys(t, unknownOptions)
+	if !reflect.DeepEqual(knownKeys, unknownKeys) {
+		t.Errorf("POST /assertion/options returns keys %v for known user and %v for unknown user", knownKeys, unknownKeys)
+	}
+
+	// Byte length of known user's options is a common byte length of unknown users' options.
+	unknownLengths := make(map[int]int)
+	const unknownUserCount = 200
+	for i := 0; i < unknownUserCount; i++ {
+		_, b := getOptions(fmt.Sprintf("user%d@example.com", i))
+		unknownLengths[len(b)]++
+	}
+	if n := unknownLengths[len(knownOptions)]; n < unknownUserCount/20 {
+		t.Errorf("POST /assertion/options returns %d bytes for known user, returns %d bytes for %d of %d unknown users (byte lengths %v)", len(knownOptions), len(knownOptions), n, unknownUserCount, unknownLengths)
+	}
+
+	// Unknown username gets the same allowCredentials every time.
+	var options1, options2 webauthn.PublicKeyCredentialRequestOptions
+	_, b := getOptions(unknownUser)
+	json.Unmarshal(b, &options1)
+	_, b = getOptions(unknownUser)
+	json.Unmarshal(b, &options2)
+	if !reflect.DeepEqual(options1.AllowCredentials, options2.AllowCredentials) {
+		t.Errorf("POST /assertion/options returns allowCredentials %v and %v for the same unknown user", options1.AllowCredentials, options2.AllowCredentials)
+	}
+
+	// Assertion signed by attacker fails with the same status code and error body for unknown user
+	// and for known user, whether credential ID is attacker's or from allowCredentials.
+	attacker, err := virtualauthenticator.New(e2eOrigin, virtualauthenticator.AttestationFormatNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newE2EClient(t, ts).register(attacker, "attacker@example.com", webauthn.ResidentKeyDiscouraged)
+	attackerCredential := []webauthn.PublicKeyCredentialDescriptor{{Type: webauthn.PublicKeyCredentialTypePublicKey, ID: attacker.Credentials()[0].ID}}
+	sendAssertions := func(username string) (results []string) {
+		for i := -1; ; i++ {
+			c := newE2EClient(t, ts)
+			var options webauthn.PublicKeyCredentialRequestOptions
+			if statusCode := c.do("POST", "/assertion/options", map[string]string{"username": username}, &options); statusCode != http.StatusOK {
+				t.Fatalf("POST /assertion/options returns status code %d", statusCode)
+			}
+			if i == len(options.AllowCredentials) {
+				return results
+			}
+			allowCredentials := options.AllowCredentials
+			options.AllowCredentials = attackerCredential
+			result, err := attacker.Get(&options)
+			if err != nil {
+				t.Fatalf("Get() returns error %q", err)
+			}
+			if i >= 0 {
+				// Replay credential ID from allowCredentials.
+				result.ID = base64.RawURLEncoding.EncodeToString(allowCredentials[i].ID)
+				result.RawID = result.ID
+			}
+			var resp json.RawMessage
+			statusCode := c.do("POST", "/assertion/result", result, &resp)
+			results = append(results, fmt.Sprintf("%d %s", statusCode, resp))
+		}
+	}
+	wantResult := fmt.Sprintf(`%d {"status":"failed","errorMessage":"%s"}`, http.StatusBadRequest, assertionFailureMessage)
+	testResults := func(name string, results []string) {
+		for _, result := range results {
+			if result != wantResult {
+				t.Errorf("POST /assertion/result for %s returns %s, want %s", name, result, wantResult)
+			}
+		}
+	}
+	testResults("known user", sendAssertions(knownUser))
+	testResults("unknown user", sendAssertions(unknownUser))
+
+	// Disabled credential fails with the same status code and error body.
+	u, err := s.dataStore.GetUser(context.Background(), knownUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.dataStore.DisableCredential(context.Background(), u.UserID, a.Credentials()[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	testResults("known user with disabled credential", sendAssertions(knownUser))
+}
+
+func jsonKeys(t *testing.T, b []byte) []string {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package webauthndemo
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/fxamacker/webauthn"
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/mock"
+)
+
+const (
+	usernamelessAssertionOptionsRequest = `{
+		"username": "",
+		"userVerification": "preferred"
+	}`
+
+	usernamelessAssertionOptionsSuccessResponse = `{
+		"status": "ok",
+		"errorMessage": "",
+		"challenge": "6283u0svT-YIF3pSolzkQHStwkJCaLKx",
+		"timeout": 10000,
+		"rpId": "localhost",
+		"userVerification": "preferred"
+	}`
+
+	usernamelessAssertionResultErrorResponseMissingUserHandle = `{
+		"status": "failed",
+		"errorMessage": "Assertion doesn't have user handle"
+	}`
+
+	usernamelessAssertionResultErrorResponseUserHandleMismatch = `{
+		"status": "failed",
+		"errorMessage": "User handle doesn't match credential owner"
+	}`
+
+	usernamelessAssertionResultErrorResponseCredentialNotRegistered = `{
+		"status": "failed",
+		"errorMessage": "Credential is not registered"
+	}`
+
+	usernamelessAssertionResultErrorResponseMissingUserData = `{
+		"status": "failed",
+		"errorMessage": "Session doesn't have user data"
+	}`
+)
+
+var (
+	// User handle isn't signed by authenticator, so fixture assertion can be modified to return any user handle.
+	usernamelessAssertionResultRequest = strings.Replace(assertionResultRequest, `"userHandle":""`, `"userHandle":"AQID"`, 1)
+
+	usernamelessAssertionResultRequestWrongUserHandle = strings.Replace(assertionResultRequest, `"userHandle":""`, `"userHandle":"BAUG"`, 1)
+
+	usernamelessAssertionOptionsTests = handlerTest{
+		requestMethod:     "POST",
+		requestURL:        "/assertion/options",
+		equalResponseBody: equalAssertionOptionsResponse(),
+		testcases: []handlerTestData{
+			{
+				name:                 "usernameless login",
+				server:               getMockServerWithUsernamelessLogin(),
+				initMockDataStore:    initDataStoreGetUserNotCalled,
+				initMockSessionStore: initSessionStore(getUserSession, getUsernamelessAssertionOptionsSession),
+				requestBody:          usernamelessAssertionOptionsRequest,
+				wantStatusCode:       http.StatusOK,
+				wantResponseBody:     usernamelessAssertionOptionsSuccessResponse,
+			},
+			{
+				name:                 "usernameless login with username",
+				server:               getMockServerWithUsernamelessLogin(),
+				initMockDataStore:    initDataStoreGetUser,
+				initMockSessionStore: initSessionStore(getEmptySession, getAssertionOptionsExistingUserSession),
+				requestBody:          assertionOptionsRequest1,
+				wantStatusCode:       http.StatusOK,
+				wantResponseBody:     assertionOptionsSuccessResponse1,
+			},
+		},
+	}
+
+	usernamelessAssertionResultTests = handlerTest{
+		requestMethod:     "POST",
+		requestURL:        "/assertion/result",
+		equalResponseBody: equalServerResponse,
+		testcases: []handlerTestData{
+			{
+				name:                 "success",
+				server:               getMockServerWithUsernamelessLogin(),
+				initMockDataStore:    initDataStoreGetCredentialByIDAndUserByID,
+				initMockSessionStore: initSessionStore(getUsernamelessAssertionOptionsSession, getUserSession),
+				requestBody:          usernamelessAssertionResultRequest,
+				wantStatusCode:       http.StatusOK,
+				wantResponseBody:     assertionResultSuccessResponse,
+			},
+			{
+				name:                 "user handle doesn't match credential owner",
+				server:               getMockServerWithUsernamelessLogin(),
+				initMockDataStore:    initDataStoreGetCredentialByID,
+				initMockSessionStore: initSessionStore(getUsernamelessAssertionOptionsSession, getUsernamelessAssertionOptionsSession),
+				requestBody:          usernamelessAssertionResultRequestWrongUserHandle,
+				wantStatusCode:       http.StatusBadRequest,
+				wantResponseBody:     usernamelessAssertionResultErrorResponseUserHandleMismatch,
+			},
+			{
+				name:                 "missing user handle",
+				server:               getMockServerWithUsernamelessLogin(),
+				initMockDataStore:    initDataStoreGetCredentialByIDNotCalled,
+				initMockSessionStore: initSessionStore(getUsernamelessAssertionOptionsSession, getUsernamelessAssertionOptionsSession),
+				requestBody:          assertionResultRequest,
+				wantStatusCode:       http.StatusBadRequest,
+				wantResponseBody:     usernamelessAssertionResultErrorResponseMissingUserHandle,
+			},
+			{
+				name:                 "credential is not registered",
+				server:               getMockServerWithUsernamelessLogin(),
+				initMockDataStore:    initDataStoreGetCredentialByIDNone,
+				initMockSessionStore: initSessionStore(getUsernamelessAssertionOptionsSession, getUsernamelessAssertionOptionsSession),
+				requestBody:          usernamelessAssertionResultRequest,
+				wantStatusCode:       http.StatusBadRequest,
+				wantResponseBody:     usernamelessAssertionResultErrorResponseCredentialNotRegistered,
+			},
+			{
+				name:                 "usernameless login is disabled",
+				server:               getMockServer(),
+				initMockDataStore:    initDataStoreGetCredentialByIDNotCalled,
+				initMockSessionStore: initSessionStore(getUsernamelessAssertionOptionsSession, getUsernamelessAssertionOptionsSession),
+				requestBody:          usernamelessAssertionResultRequest,
+				wantStatusCode:       http.StatusUnauthorized,
+				wantResponseBody:     usernamelessAssertionResultErrorResponseMissingUserData,
+			},
+		},
+	}
+)
+
+func getMockServerWithUsernamelessLogin() *Server {
+	s := getMockServer()
+	s.usernamelessLogin = true
+	return s
+}
+
+func getUsernamelessAssertionOptionsSession(store sessions.Store) *sessions.Session {
+	session := sessions.NewSession(store, sessionNameLoginSession)
+	session.Values[sessionMapKeyWebAuthnRequestOptions] = &webauthn.PublicKeyCredentialRequestOptions{
+		Challenge:        base64RawURLDecodeString("xdj0CBfX692qsATpy0kNc8533JdvdLUpqYP8wDTX_ZE"),
+		Timeout:          uint64(10000),
+		RPID:             "localhost",
+		UserVerification: webauthn.UserVerificationPreferred,
+	}
+	return session
+}
+
+func initDataStoreGetUserNotCalled(mockDataStore *MockDataStore) {
+	mockDataStore.On("GetUser", mock.Anything, mock.Anything).Times(0)
+}
+
+func initDataStoreGetCredentialByID(mockDataStore *MockDataStore) {
+	mockDataStore.On("GetCredentialByID", mock.Anything, mockCredential.CredentialID).Return(mockCredential, nil).Once()
+	mockDataStore.On("GetUserByID", mock.Anything, mock.Anything).Times(0)
+}
+
+func initDataStoreGetCredentialByIDAndUserByID(mockDataStore *MockDataStore) {
+	c2 := *mockCredential // make a copy of credentialMock
+	c2.Counter = 0
+	mockDataStore.On("GetCredentialByID", mock.Anything, mockCredential.CredentialID).Return(mockCredential, nil).Once()
+	mockDataStore.On("GetUserByID", mock.Anything, mockCredential.UserID).Return(mockExistingUser, nil).Once()
+	mockDataStore.On("UpdateCredential", mock.Anything, &c2, uint32(0)).Return(nil).Once()
+}
+
+func initDataStoreGetCredentialByIDNone(mockDataStore *MockDataStore) {
+	mockDataStore.On("GetCredentialByID", mock.Anything, mock.Anything).Return(nil, ErrNoRecords).Once()
+}
+
+func initDataStoreGetCredentialByIDNotCalled(mockDataStore *MockDataStore) {
+	mockDataStore.On("GetCredentialByID", mock.Anything, mock.Anything).Times(0)
+}
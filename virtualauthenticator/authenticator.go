@@ -0,0 +1,397 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+// Package virtualauthenticator implements a software WebAuthn authenticator for tests and scripts.
+// It creates ES256 credentials with "none", "packed" self, or "fido-u2f" attestation, and
+// returns attestation and assertion results in the same JSON format as the demo web pages.
+package virtualauthenticator
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor"
+	"github.com/fxamacker/webauthn"
+)
+
+// Supported attestation statement formats.
+const (
+	AttestationFormatNone    = "none"
+	AttestationFormatPacked  = "packed" // self attestation
+	AttestationFormatFIDOU2F = "fido-u2f"
+)
+
+// Authenticator data flags.
+const (
+	flagUserPresent            = 0x01
+	flagUserVerified           = 0x04
+	flagAttestedCredentialData = 0x40
+)
+
+var (
+	errUnsupportedAlgorithm = errors.New("virtualauthenticator: ES256 isn't in pubKeyCredParams")
+	errCredentialExcluded   = errors.New("virtualauthenticator: credential in excludeCredentials exists")
+	errNoCredentials        = errors.New("virtualauthenticator: no credentials are available")
+)
+
+// Credential is a public key credential created by Authenticator.
+type Credential struct {
+	ID           []byte
+	RPID         string
+	UserHandle   []byte
+	PrivateKey   *ecdsa.PrivateKey
+	Counter      uint32 // signature counter, incremented before each assertion
+	Discoverable bool   // client-side discoverable (resident) credential
+}
+
+// Authenticator is a concurrency-safe software authenticator.  It always performs user
+// verification unless it is discouraged by relying party.
+type Authenticator struct {
+	Origin            string // origin in client data, such as "https://localhost:8443"
+	AttestationFormat string
+	AAGUID            []byte // 16 bytes, all zeros for "fido-u2f"
+
+	mu          sync.Mutex
+	credentials []*Credential
+	attestnKey  *ecdsa.PrivateKey // fido-u2f attestation key
+	attestnCert []byte            // fido-u2f attestation certificate in DER
+}
+
+// New returns Authenticator for origin with attestation format.
+func New(origin string, attestationFormat string) (*Authenticator, error) {
+	if _, err := url.Parse(origin); err != nil {
+		return nil, err
+	}
+	a := &Authenticator{Origin: origin, AttestationFormat: attestationFormat, AAGUID: make([]byte, 16)}
+	switch attestationFormat {
+	case AttestationFormatNone, AttestationFormatPacked:
+		if _, err := rand.Read(a.AAGUID); err != nil {
+			return nil, err
+		}
+	case AttestationFormatFIDOU2F:
+		var err error
+		if a.attestnKey, a.attestnCert, err = newAttestationCert(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("virtualauthenticator: attestation format \"" + attestationFormat + "\" is not supported")
+	}
+	return a, nil
+}
+
+// Credentials returns credentials created by authenticator.
+func (a *Authenticator) Credentials() []*Credential {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return append([]*Credential(nil), a.credentials...)
+}
+
+// AddCredential adds an existing credential, such as a credential loaded from a file.
+func (a *Authenticator) AddCredential(c *Credential) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.credentials = append(a.credentials, c)
+}
+
+// AttestationResult is the JSON request body of /attestation/result.
+type AttestationResult struct {
+	ID       string                  `json:"id"`
+	RawID    string                  `json:"rawId"`
+	Response AttestationResponseData `json:"response"`
+	Type     string                  `json:"type"`
+}
+
+// AttestationResponseData is AuthenticatorAttestationResponse with base64url encoded fields.
+type AttestationResponseData struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+}
+
+// AssertionResult is the JSON request body of /assertion/result.
+type AssertionResult struct {
+	ID       string                `json:"id"`
+	RawID    string                `json:"rawId"`
+	Response AssertionResponseData `json:"response"`
+	Type     string                `json:"type"`
+}
+
+// AssertionResponseData is AuthenticatorAssertionResponse with base64url encoded fields.
+type AssertionResponseData struct {
+	AuthenticatorData string `json:"authenticatorData"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle"`
+}
+
+// Create creates a new credential for options, like navigator.credentials.create().
+func (a *Authenticator) Create(options *webauthn.PublicKeyCredentialCreationOptions) (*AttestationResult, error) {
+	supported := false
+	for _, param := range options.PubKeyCredParams {
+		if param.Type == webauthn.PublicKeyCredentialTypePublicKey && param.Alg == webauthn.COSEAlgES256 {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return nil, errUnsupportedAlgorithm
+	}
+
+	rpID, err := a.rpID(options.RP.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, excluded := range options.ExcludeCredentials {
+		for _, c := range a.credentials {
+			if c.RPID == rpID && bytes.Equal(c.ID, excluded.ID) {
+				return nil, errCredentialExcluded
+			}
+		}
+	}
+
+	c := &Credential{
+		ID:         make([]byte, 32),
+		RPID:       rpID,
+		UserHandle: append([]byte(nil), options.User.ID...),
+		Discoverable: options.AuthenticatorSelection.RequireResidentKey ||
+			options.AuthenticatorSelection.ResidentKey == webauthn.ResidentKeyRequired ||
+			options.AuthenticatorSelection.ResidentKey == webauthn.ResidentKeyPreferred,
+	}
+	if _, err := rand.Read(c.ID); err != nil {
+		return nil, err
+	}
+	if c.PrivateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return nil, err
+	}
+
+	clientDataJSON, err := newClientDataJSON("webauthn.create", options.Challenge, a.Origin)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+
+	coseKey, err := marshalCOSEKey(&c.PrivateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Attested credential data: AAGUID || credential ID length || credential ID || credential public key.
+	var authnData bytes.Buffer
+	authnData.Write(newAuthenticatorData(rpID, a.flags(options.AuthenticatorSelection.UserVerification)|flagAttestedCredentialData, c.Counter))
+	authnData.Write(a.AAGUID)
+	binary.Write(&authnData, binary.BigEndian, uint16(len(c.ID)))
+	authnData.Write(c.ID)
+	authnData.Write(coseKey)
+
+	attStmt, err := a.attestationStatement(authnData.Bytes(), clientDataHash[:], rpID, c)
+	if err != nil {
+		return nil, err
+	}
+	attestationObject, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      a.AttestationFormat,
+		"attStmt":  attStmt,
+		"authData": authnData.Bytes(),
+	}, cbor.EncOptions{Canonical: true})
+	if err != nil {
+		return nil, err
+	}
+
+	a.credentials = append(a.credentials, c)
+
+	id := base64.RawURLEncoding.EncodeToString(c.ID)
+	return &AttestationResult{
+		ID:    id,
+		RawID: id,
+		Response: AttestationResponseData{
+			ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientDataJSON),
+			AttestationObject: base64.RawURLEncoding.EncodeToString(attestationObject),
+		},
+		Type: string(webauthn.PublicKeyCredentialTypePublicKey),
+	}, nil
+}
+
+// Get returns an assertion signed by a credential in allowCredentials, or by a discoverable
+// credential if allowCredentials is empty, like navigator.credentials.get().
+func (a *Authenticator) Get(options *webauthn.PublicKeyCredentialRequestOptions) (*AssertionResult, error) {
+	rpID, err := a.rpID(options.RPID)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c := a.findCredential(rpID, options.AllowCredentials)
+	if c == nil {
+		return nil, errNoCredentials
+	}
+	c.Counter++
+
+	clientDataJSON, err := newClientDataJSON("webauthn.get", options.Challenge, a.Origin)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+
+	authnData := newAuthenticatorData(rpID, a.flags(options.UserVerification), c.Counter)
+
+	digest := sha256.Sum256(append(append([]byte(nil), authnData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, c.PrivateKey, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(c.ID)
+	return &AssertionResult{
+		ID:    id,
+		RawID: id,
+		Response: AssertionResponseData{
+			AuthenticatorData: base64.RawURLEncoding.EncodeToString(authnData),
+			ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientDataJSON),
+			Signature:         base64.RawURLEncoding.EncodeToString(sig),
+			UserHandle:        base64.RawURLEncoding.EncodeToString(c.UserHandle),
+		},
+		Type: string(webauthn.PublicKeyCredentialTypePublicKey),
+	}, nil
+}
+
+// rpID returns rpID, or effective domain of origin if rpID is empty.
+func (a *Authenticator) rpID(rpID string) (string, error) {
+	if rpID != "" {
+		return rpID, nil
+	}
+	u, err := url.Parse(a.Origin)
+	if err != nil {
+		return "", err
+	}
+	return u.Hostname(), nil
+}
+
+func (a *Authenticator) flags(userVerification webauthn.UserVerificationRequirement) byte {
+	if userVerification == webauthn.UserVerificationDiscouraged {
+		return flagUserPresent
+	}
+	return flagUserPresent | flagUserVerified
+}
+
+func (a *Authenticator) findCredential(rpID string, allowCredentials []webauthn.PublicKeyCredentialDescriptor) *Credential {
+	for _, c := range a.credentials {
+		if c.RPID != rpID {
+			continue
+		}
+		if len(allowCredentials) == 0 {
+			if c.Discoverable {
+				return c
+			}
+			continue
+		}
+		for _, allowed := range allowCredentials {
+			if bytes.Equal(c.ID, allowed.ID) {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+func (a *Authenticator) attestationStatement(authnData []byte, clientDataHash []byte, rpID string, c *Credential) (map[string]interface{}, error) {
+	switch a.AttestationFormat {
+	case AttestationFormatPacked:
+		digest := sha256.Sum256(append(append([]byte(nil), authnData...), clientDataHash...))
+		sig, err := ecdsa.SignASN1(rand.Reader, c.PrivateKey, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"alg": webauthn.COSEAlgES256, "sig": sig}, nil
+	case AttestationFormatFIDOU2F:
+		// Signed data is 0x00 || rpIdHash || clientDataHash || credentialId || publicKeyU2F.
+		rpIDHash := sha256.Sum256([]byte(rpID))
+		var signed bytes.Buffer
+		signed.WriteByte(0x00)
+		signed.Write(rpIDHash[:])
+		signed.Write(clientDataHash)
+		signed.Write(c.ID)
+		signed.Write(elliptic.Marshal(elliptic.P256(), c.PrivateKey.X, c.PrivateKey.Y))
+		digest := sha256.Sum256(signed.Bytes())
+		sig, err := ecdsa.SignASN1(rand.Reader, a.attestnKey, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"sig": sig, "x5c": [][]byte{a.attestnCert}}, nil
+	}
+	return map[string]interface{}{}, nil
+}
+
+// newAuthenticatorData returns authenticator data without attested credential data.
+func newAuthenticatorData(rpID string, flags byte, counter uint32) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := make([]byte, 37)
+	copy(data, rpIDHash[:])
+	data[32] = flags
+	binary.BigEndian.PutUint32(data[33:], counter)
+	return data
+}
+
+func newClientDataJSON(typ string, challenge []byte, origin string) ([]byte, error) {
+	return json.Marshal(&webauthn.CollectedClientData{
+		Type:      typ,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    origin,
+	})
+}
+
+// marshalCOSEKey returns ES256 public key in COSE_Key format.
+func marshalCOSEKey(pub *ecdsa.PublicKey) ([]byte, error) {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	pub.X.FillBytes(x)
+	pub.Y.FillBytes(y)
+	return cbor.Marshal(map[int]interface{}{
+		1:  2,                     // kty: EC2
+		3:  webauthn.COSEAlgES256, // alg
+		-1: 1,                     // crv: P-256
+		-2: x,
+		-3: y,
+	}, cbor.EncOptions{Canonical: true})
+}
+
+// newAttestationCert returns a self-signed P-256 attestation certificate for fido-u2f attestation.
+func newAttestationCert() (*ecdsa.PrivateKey, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: "Virtual U2F Authenticator"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, cert, nil
+}
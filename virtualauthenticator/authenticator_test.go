@@ -0,0 +1,270 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package virtualauthenticator
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/fxamacker/webauthn"
+	_ "github.com/fxamacker/webauthn/fidou2f"
+	_ "github.com/fxamacker/webauthn/packed"
+)
+
+const testOrigin = "https://localhost:8443"
+
+func getWebAuthnConfig() *webauthn.Config {
+	config := &webauthn.Config{
+		RPID:                    "localhost",
+		RPName:                  "WebAuthn local server",
+		Timeout:                 uint64(10000),
+		ChallengeLength:         32,
+		AuthenticatorAttachment: webauthn.AuthenticatorCrossPlatform,
+		ResidentKey:             webauthn.ResidentKeyPreferred,
+		UserVerification:        webauthn.UserVerificationRequired,
+		Attestation:             webauthn.AttestationDirect,
+		CredentialAlgs:          []int{webauthn.COSEAlgES256},
+	}
+	if err := config.Valid(); err != nil {
+		panic(err)
+	}
+	return config
+}
+
+func TestAuthenticator(t *testing.T) {
+	testCases := []struct {
+		attestationFormat string
+		wantAttType       webauthn.AttestationType
+	}{
+		{AttestationFormatNone, webauthn.AttestationTypeNone},
+		{AttestationFormatPacked, webauthn.AttestationTypeSelf},
+		{AttestationFormatFIDOU2F, webauthn.AttestationTypeBasic},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.attestationFormat, func(t *testing.T) {
+			config := getWebAuthnConfig()
+			user := &webauthn.User{ID: []byte("user id"), Name: "johndoe@example.com", DisplayName: "John Doe"}
+
+			a, err := New(testOrigin, tc.attestationFormat)
+			if err != nil {
+				t.Fatalf("New() returns error %q", err)
+			}
+
+			// Registration
+			creationOptions, err := webauthn.NewAttestationOptions(config, user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			attestationResult, err := a.Create(creationOptions)
+			if err != nil {
+				t.Fatalf("Create() returns error %q", err)
+			}
+			attestation, err := webauthn.ParseAttestation(marshalJSON(t, attestationResult))
+			if err != nil {
+				t.Fatalf("ParseAttestation() returns error %q", err)
+			}
+			attType, _, err := webauthn.VerifyAttestation(attestation, &webauthn.AttestationExpectedData{
+				Origin:           testOrigin,
+				RPID:             config.RPID,
+				CredentialAlgs:   config.CredentialAlgs,
+				Challenge:        base64.RawURLEncoding.EncodeToString(creationOptions.Challenge),
+				UserVerification: config.UserVerification,
+			})
+			if err != nil {
+				t.Fatalf("VerifyAttestation() returns error %q", err)
+			}
+			if attType != tc.wantAttType {
+				t.Errorf("VerifyAttestation() returns attestation type %s, want %s", attType, tc.wantAttType)
+			}
+			if !bytes.Equal(attestation.AuthnData.AAGUID, a.AAGUID) {
+				t.Errorf("attestation has AAGUID %x, want %x", attestation.AuthnData.AAGUID, a.AAGUID)
+			}
+
+			// Authentication
+			user.CredentialIDs = [][]byte{attestation.RawID}
+			for wantCounter := uint32(1); wantCounter <= 2; wantCounter++ {
+				requestOptions, err := webauthn.NewAssertionOptions(config, user)
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertionResult, err := a.Get(requestOptions)
+				if err != nil {
+					t.Fatalf("Get() returns error %q", err)
+				}
+				assertion, err := webauthn.ParseAssertion(marshalJSON(t, assertionResult))
+				if err != nil {
+					t.Fatalf("ParseAssertion() returns error %q", err)
+				}
+				err = webauthn.VerifyAssertion(assertion, &webauthn.AssertionExpectedData{
+					Origin:            testOrigin,
+					RPID:              config.RPID,
+					Challenge:         base64.RawURLEncoding.EncodeToString(requestOptions.Challenge),
+					UserVerification:  config.UserVerification,
+					UserID:            user.ID,
+					UserCredentialIDs: user.CredentialIDs,
+					PrevCounter:       wantCounter - 1,
+					Credential:        attestation.AuthnData.Credential,
+				})
+				if err != nil {
+					t.Fatalf("VerifyAssertion() returns error %q", err)
+				}
+				if assertion.AuthnData.Counter != wantCounter {
+					t.Errorf("assertion has counter %d, want %d", assertion.AuthnData.Counter, wantCounter)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthenticatorDiscoverableCredential(t *testing.T) {
+	config := getWebAuthnConfig()
+	user := &webauthn.User{ID: []byte("user id"), Name: "johndoe@example.com", DisplayName: "John Doe"}
+
+	a, err := New(testOrigin, AttestationFormatNone)
+	if err != nil {
+		t.Fatalf("New() returns error %q", err)
+	}
+	creationOptions, err := webauthn.NewAttestationOptions(config, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Create(creationOptions); err != nil {
+		t.Fatalf("Create() returns error %q", err)
+	}
+
+	// Request options without allowCredentials selects discoverable credential.
+	requestOptions, err := webauthn.NewAssertionOptions(config, &webauthn.User{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertionResult, err := a.Get(requestOptions)
+	if err != nil {
+		t.Fatalf("Get() returns error %q", err)
+	}
+	if assertionResult.Response.UserHandle != base64.RawURLEncoding.EncodeToString(user.ID) {
+		t.Errorf("Get() returns user handle %s, want %s", assertionResult.Response.UserHandle, base64.RawURLEncoding.EncodeToString(user.ID))
+	}
+}
+
+func TestAuthenticatorError(t *testing.T) {
+	config := getWebAuthnConfig()
+	config.ResidentKey = webauthn.ResidentKeyDiscouraged
+	user := &webauthn.User{ID: []byte("user id"), Name: "johndoe@example.com", DisplayName: "John Doe"}
+
+	if _, err := New(testOrigin, "tpm"); err == nil {
+		t.Errorf("New() with tpm attestation format returns no error")
+	}
+
+	a, err := New(testOrigin, AttestationFormatNone)
+	if err != nil {
+		t.Fatalf("New() returns error %q", err)
+	}
+	requestOptions, err := webauthn.NewAssertionOptions(config, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Get(requestOptions); err != errNoCredentials {
+		t.Errorf("Get() without credentials returns error %v, want %q", err, errNoCredentials)
+	}
+
+	creationOptions, err := webauthn.NewAttestationOptions(config, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Create(creationOptions); err != nil {
+		t.Fatalf("Create() returns error %q", err)
+	}
+
+	// Non-discoverable credential isn't selected without allowCredentials.
+	if _, err := a.Get(requestOptions); err != errNoCredentials {
+		t.Errorf("Get() without allowCredentials returns error %v, want %q", err, errNoCredentials)
+	}
+
+	user.CredentialIDs = [][]byte{a.Credentials()[0].ID}
+	creationOptions, err = webauthn.NewAttestationOptions(config, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Create(creationOptions); err != errCredentialExcluded {
+		t.Errorf("Create() with excluded credential returns error %v, want %q", err, errCredentialExcluded)
+	}
+
+	creationOptions.ExcludeCredentials = nil
+	creationOptions.PubKeyCredParams = []webauthn.PublicKeyCredentialParameters{{Type: webauthn.PublicKeyCredentialTypePublicKey, Alg: webauthn.COSEAlgRS256}}
+	if _, err := a.Create(creationOptions); err != errUnsupportedAlgorithm {
+		t.Errorf("Create() with RS256 returns error %v, want %q", err, errUnsupportedAlgorithm)
+	}
+}
+
+func marshalJSON(t *testing.T, v interface{}) *bytes.Reader {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(b)
+}
+
+func TestAuthenticatorFile(t *testing.T) {
+	config := getWebAuthnConfig()
+	user := &webauthn.User{ID: []byte("user id"), Name: "johndoe@example.com", DisplayName: "John Doe"}
+	path := filepath.Join(t.TempDir(), "authenticator.json")
+
+	a, err := LoadFile(path, testOrigin, AttestationFormatFIDOU2F)
+	if err != nil {
+		t.Fatalf("LoadFile() returns error %q", err)
+	}
+	creationOptions, err := webauthn.NewAttestationOptions(config, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attestationResult, err := a.Create(creationOptions)
+	if err != nil {
+		t.Fatalf("Create() returns error %q", err)
+	}
+	attestation, err := webauthn.ParseAttestation(marshalJSON(t, attestationResult))
+	if err != nil {
+		t.Fatalf("ParseAttestation() returns error %q", err)
+	}
+	if err := a.SaveFile(path); err != nil {
+		t.Fatalf("SaveFile() returns error %q", err)
+	}
+
+	a2, err := LoadFile(path, testOrigin, AttestationFormatNone)
+	if err != nil {
+		t.Fatalf("LoadFile() returns error %q", err)
+	}
+	if a2.AttestationFormat != AttestationFormatFIDOU2F || !bytes.Equal(a2.attestnCert, a.attestnCert) {
+		t.Errorf("LoadFile() returns authenticator with attestation format %q, want %q and saved attestation certificate", a2.AttestationFormat, AttestationFormatFIDOU2F)
+	}
+
+	// Loaded credential signs assertions verified by registered public key.
+	user.CredentialIDs = [][]byte{attestation.RawID}
+	requestOptions, err := webauthn.NewAssertionOptions(config, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertionResult, err := a2.Get(requestOptions)
+	if err != nil {
+		t.Fatalf("Get() returns error %q", err)
+	}
+	assertion, err := webauthn.ParseAssertion(marshalJSON(t, assertionResult))
+	if err != nil {
+		t.Fatalf("ParseAssertion() returns error %q", err)
+	}
+	err = webauthn.VerifyAssertion(assertion, &webauthn.AssertionExpectedData{
+		Origin:            testOrigin,
+		RPID:              config.RPID,
+		Challenge:         base64.RawURLEncoding.EncodeToString(requestOptions.Challenge),
+		UserVerification:  config.UserVerification,
+		UserID:            user.ID,
+		UserCredentialIDs: user.CredentialIDs,
+		Credential:        attestation.AuthnData.Credential,
+	})
+	if err != nil {
+		t.Errorf("VerifyAssertion() returns error %q", err)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2019 Faye Amacker. All rights reserved.
+// Use of this source code is governed by Apache License 2.0 found in the LICENSE file.
+
+package virtualauthenticator
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// authenticatorFile is JSON encoded authenticator state saved by SaveFile.
+type authenticatorFile struct {
+	AttestationFormat string           `json:"attestationFormat"`
+	AAGUID            []byte           `json:"aaguid"`
+	AttestationKey    []byte           `json:"attestationKey,omitempty"`  // PKCS #8 private key in DER
+	AttestationCert   []byte           `json:"attestationCert,omitempty"` // X.509 certificate in DER
+	Credentials       []credentialFile `json:"credentials"`
+}
+
+type credentialFile struct {
+	ID           []byte `json:"id"`
+	RPID         string `json:"rpId"`
+	UserHandle   []byte `json:"userHandle"`
+	PrivateKey   []byte `json:"privateKey"` // PKCS #8 private key in DER
+	Counter      uint32 `json:"counter"`
+	Discoverable bool   `json:"discoverable"`
+}
+
+// LoadFile returns Authenticator for origin with credentials saved in file.  If file doesn't
+// exist, it returns a new Authenticator with attestation format.
+func LoadFile(path string, origin string, attestationFormat string) (*Authenticator, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return New(origin, attestationFormat)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f authenticatorFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, errors.New("virtualauthenticator: failed to decode authenticator file: " + err.Error())
+	}
+	a := &Authenticator{Origin: origin, AttestationFormat: f.AttestationFormat, AAGUID: f.AAGUID, attestnCert: f.AttestationCert}
+	if len(f.AttestationKey) > 0 {
+		if a.attestnKey, err = parseECPrivateKey(f.AttestationKey); err != nil {
+			return nil, err
+		}
+	}
+	for _, cf := range f.Credentials {
+		c := &Credential{ID: cf.ID, RPID: cf.RPID, UserHandle: cf.UserHandle, Counter: cf.Counter, Discoverable: cf.Discoverable}
+		if c.PrivateKey, err = parseECPrivateKey(cf.PrivateKey); err != nil {
+			return nil, err
+		}
+		a.credentials = append(a.credentials, c)
+	}
+	return a, nil
+}
+
+// SaveFile saves attestation key and credentials to file, which is readable only by owner.
+func (a *Authenticator) SaveFile(path string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f := authenticatorFile{AttestationFormat: a.AttestationFormat, AAGUID: a.AAGUID, AttestationCert: a.attestnCert}
+	if a.attestnKey != nil {
+		key, err := x509.MarshalPKCS8PrivateKey(a.attestnKey)
+		if err != nil {
+			return err
+		}
+		f.AttestationKey = key
+	}
+	for _, c := range a.credentials {
+		key, err := x509.MarshalPKCS8PrivateKey(c.PrivateKey)
+		if err != nil {
+			return err
+		}
+		f.Credentials = append(f.Credentials, credentialFile{
+			ID:           c.ID,
+			RPID:         c.RPID,
+			UserHandle:   c.UserHandle,
+			PrivateKey:   key,
+			Counter:      c.Counter,
+			Discoverable: c.Discoverable,
+		})
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func parseECPrivateKey(der []byte) (*ecdsa.PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, errors.New("virtualauthenticator: failed to parse private key: " + err.Error())
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("virtualauthenticator: private key isn't ECDSA key")
+	}
+	return ecKey, nil
+}